@@ -0,0 +1,145 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"mysql_public_data_ingestor/config"
+	"mysql_public_data_ingestor/syslogwrapper"
+)
+
+// Controller is the running pipeline as the API sees it
+type Controller interface {
+	State() State
+	SetFetchPaused(paused bool)
+	FetchNow()
+	SetFetchRate(multiplier float64)
+	SetTablePaused(table string, paused bool) error
+}
+
+// State is the pipeline state returned by GET /state
+type State struct {
+	Fetch  FetchState   `json:"fetch"`
+	Tables []TableState `json:"tables"`
+}
+
+type FetchState struct {
+	Paused    bool       `json:"paused"`
+	Rate      float64    `json:"rate"`
+	LastFetch *time.Time `json:"last_fetch,omitempty"`
+	LastError string     `json:"last_error,omitempty"`
+}
+
+type TableState struct {
+	Name          string     `json:"name"`
+	QueueDepth    int        `json:"queue_depth"`
+	Share         float64    `json:"share"` // fraction of each batch written
+	Paused        bool       `json:"paused"`
+	LastError     string     `json:"last_error,omitempty"`
+	LastErrorTime *time.Time `json:"last_error_time,omitempty"`
+}
+
+// Handler returns the API used to steer a running ingestor during long soak tests. Every request needs an
+// "Authorization: Bearer <token>" header.
+//
+//	GET  /state                          fetch state and every table with its queue depth and last error
+//	POST /fetch/pause, /fetch/resume     stop and restart fetching, queued batches are still written
+//	POST /fetch/now                      fetch at once, also while paused
+//	POST /fetch/rate?multiplier=2        scale the fetch rate on top of the workload profile
+//	POST /tables/pause?table=db.table    hold one table worker, its queue fills under the overflow policy
+//	POST /tables/resume?table=db.table
+func Handler(token string, controller Controller, sysLog syslogwrapper.SyslogWrapperInterface) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /state", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, controller.State())
+	})
+	mux.HandleFunc("POST /fetch/pause", func(w http.ResponseWriter, r *http.Request) {
+		controller.SetFetchPaused(true)
+		sysLog.Info("Admin API paused fetching")
+		writeJSON(w, http.StatusOK, controller.State().Fetch)
+	})
+	mux.HandleFunc("POST /fetch/resume", func(w http.ResponseWriter, r *http.Request) {
+		controller.SetFetchPaused(false)
+		sysLog.Info("Admin API resumed fetching")
+		writeJSON(w, http.StatusOK, controller.State().Fetch)
+	})
+	mux.HandleFunc("POST /fetch/now", func(w http.ResponseWriter, r *http.Request) {
+		controller.FetchNow()
+		writeJSON(w, http.StatusAccepted, controller.State().Fetch)
+	})
+	mux.HandleFunc("POST /fetch/rate", func(w http.ResponseWriter, r *http.Request) {
+		multiplier, err := strconv.ParseFloat(r.FormValue("multiplier"), 64)
+		if err != nil || multiplier <= 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("multiplier must be a positive number"))
+			return
+		}
+		controller.SetFetchRate(multiplier)
+		sysLog.Info(fmt.Sprintf("Admin API set the fetch rate to %gx", multiplier))
+		writeJSON(w, http.StatusOK, controller.State().Fetch)
+	})
+	mux.HandleFunc("POST /tables/pause", tableHandler(controller, sysLog, true))
+	mux.HandleFunc("POST /tables/resume", tableHandler(controller, sysLog, false))
+	return authorize(token, mux)
+}
+
+func tableHandler(controller Controller, sysLog syslogwrapper.SyslogWrapperInterface, paused bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		table := r.FormValue("table")
+		if table == "" {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("table is required"))
+			return
+		}
+		if err := controller.SetTablePaused(table, paused); err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		sysLog.Info(fmt.Sprintf("Admin API set %s paused=%t", table, paused))
+		for _, state := range controller.State().Tables {
+			if state.Name == table {
+				writeJSON(w, http.StatusOK, state)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNoContent) // Removed by a reload in the meantime
+	}
+}
+
+// authorize rejects requests without the bearer token
+func authorize(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			writeError(w, http.StatusUnauthorized, fmt.Errorf("missing or invalid token"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// Serve starts the API in the background. An empty listen address disables it.
+func Serve(cfg config.AdminConfig, controller Controller, sysLog syslogwrapper.SyslogWrapperInterface) {
+	if cfg.ListenAddr == "" {
+		return
+	}
+	handler := Handler(cfg.Token, controller, sysLog)
+	go func() {
+		if err := http.ListenAndServe(cfg.ListenAddr, handler); err != nil {
+			sysLog.Error(fmt.Sprintf("Admin listener on %s stopped: %v", cfg.ListenAddr, err))
+		}
+	}()
+}
@@ -0,0 +1,117 @@
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// MockSyslogWrapper is a mock implementation of syslogwrapper.SyslogWrapper
+type MockSyslogWrapper struct {
+	mock.Mock
+}
+
+func (m *MockSyslogWrapper) Close() {
+	m.Called()
+}
+
+func (m *MockSyslogWrapper) Warning(message string) {
+	m.Called(message)
+}
+
+func (m *MockSyslogWrapper) Error(message string) {
+	m.Called(message)
+}
+
+func (m *MockSyslogWrapper) Info(message string) {
+	m.Called(message)
+}
+
+func (m *MockSyslogWrapper) Debug(message string) {
+	m.Called(message)
+}
+
+// fakeController records what the API asked for
+type fakeController struct {
+	state   State
+	fetches int
+}
+
+func (c *fakeController) State() State {
+	return c.state
+}
+
+func (c *fakeController) SetFetchPaused(paused bool) {
+	c.state.Fetch.Paused = paused
+}
+
+func (c *fakeController) FetchNow() {
+	c.fetches++
+}
+
+func (c *fakeController) SetFetchRate(multiplier float64) {
+	c.state.Fetch.Rate = multiplier
+}
+
+func (c *fakeController) SetTablePaused(table string, paused bool) error {
+	for i := range c.state.Tables {
+		if c.state.Tables[i].Name == table {
+			c.state.Tables[i].Paused = paused
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown table %s", table)
+}
+
+func request(handler http.Handler, method, target, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+// TestHandlerToken tests requests without the right token are rejected
+func TestHandlerToken(t *testing.T) {
+	handler := Handler("secret", &fakeController{}, new(MockSyslogWrapper))
+	assert.Equal(t, http.StatusUnauthorized, request(handler, "GET", "/state", "").Code)
+	assert.Equal(t, http.StatusUnauthorized, request(handler, "GET", "/state", "wrong").Code)
+	assert.Equal(t, http.StatusOK, request(handler, "GET", "/state", "secret").Code)
+}
+
+// TestHandlerControls tests each endpoint reaches the controller
+func TestHandlerControls(t *testing.T) {
+	sysLog := new(MockSyslogWrapper)
+	sysLog.On("Info", mock.Anything).Return()
+	controller := &fakeController{state: State{Fetch: FetchState{Rate: 1}, Tables: []TableState{{Name: "p1.flights", QueueDepth: 3}}}}
+	handler := Handler("secret", controller, sysLog)
+
+	assert.Equal(t, http.StatusOK, request(handler, "POST", "/fetch/pause", "secret").Code)
+	assert.True(t, controller.state.Fetch.Paused)
+	assert.Equal(t, http.StatusOK, request(handler, "POST", "/fetch/resume", "secret").Code)
+	assert.False(t, controller.state.Fetch.Paused)
+
+	assert.Equal(t, http.StatusAccepted, request(handler, "POST", "/fetch/now", "secret").Code)
+	assert.Equal(t, 1, controller.fetches)
+
+	assert.Equal(t, http.StatusOK, request(handler, "POST", "/fetch/rate?multiplier=2.5", "secret").Code)
+	assert.Equal(t, 2.5, controller.state.Fetch.Rate)
+	assert.Equal(t, http.StatusBadRequest, request(handler, "POST", "/fetch/rate?multiplier=-1", "secret").Code)
+
+	rec := request(handler, "POST", "/tables/pause?table=p1.flights", "secret")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var table TableState
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &table))
+	assert.True(t, table.Paused)
+	assert.Equal(t, 3, table.QueueDepth)
+	assert.Equal(t, http.StatusNotFound, request(handler, "POST", "/tables/resume?table=p9.flights", "secret").Code)
+
+	assert.Equal(t, http.StatusMethodNotAllowed, request(handler, "GET", "/fetch/pause", "secret").Code)
+}
@@ -25,3 +25,15 @@ type APIPlugin interface {
 	GetValues(record interface{}) []interface{}
 	Name() string // Added method
 }
+
+// TimeColumnProvider is implemented by plugins whose records carry a unix timestamp column.
+// It lets checks that work on recent ranges of a table find those rows.
+type TimeColumnProvider interface {
+	TimeColumn() string
+}
+
+// Factory is implemented by plugins that can create a new, unconfigured instance of themselves. Config reloads
+// configure a new instance and swap it in rather than changing the one that is fetching.
+type Factory interface {
+	NewInstance() APIPlugin
+}
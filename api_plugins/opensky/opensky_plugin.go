@@ -4,6 +4,8 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"mysql_public_data_ingestor/api_plugins"
+	"mysql_public_data_ingestor/ident"
 	"mysql_public_data_ingestor/syslogwrapper"
 	"net/http"
 	"strings"
@@ -117,7 +119,7 @@ func (p *Plugin) FetchData() (interface{}, error) {
 func (p *Plugin) Schema() string {
 	var schemaParts []string
 	for field, fieldType := range schema {
-		schemaParts = append(schemaParts, fmt.Sprintf("%s %s", field, fieldType))
+		schemaParts = append(schemaParts, fmt.Sprintf("%s %s", ident.Quote(field), fieldType))
 	}
 	return fmt.Sprintf("(%s)", strings.Join(schemaParts, ", "))
 }
@@ -171,5 +173,15 @@ func (p *Plugin) Name() string {
 	return "opensky"
 }
 
+// TimeColumn implements api_plugins.TimeColumnProvider, time is the state vector timestamp in unix seconds
+func (p *Plugin) TimeColumn() string {
+	return "time"
+}
+
+// NewInstance implements api_plugins.Factory, the new instance logs to the same logger and has no config yet
+func (p *Plugin) NewInstance() api_plugins.APIPlugin {
+	return &Plugin{sysLog: p.sysLog}
+}
+
 // PluginInstance is the exported symbol that will be looked up when loading the plugin.
 var PluginInstance Plugin
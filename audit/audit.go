@@ -0,0 +1,70 @@
+package audit
+
+import (
+	"database/sql"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"mysql_public_data_ingestor/config"
+	"mysql_public_data_ingestor/metrics"
+)
+
+// Supported sink types
+const (
+	TableSinkType = "table"
+	FileSinkType  = "file"
+)
+
+var (
+	auditedBatches = metrics.Map("audited_batches")
+	lastBatchID    atomic.Uint64
+)
+
+// Entry records what one batch wrote to one table
+type Entry struct {
+	Database string    `json:"database"`
+	Table    string    `json:"table"`
+	BatchID  uint64    `json:"batch_id"`
+	Rows     int64     `json:"rows"`     // records the worker committed
+	Checksum uint64    `json:"checksum"` // XOR of the RowChecksum of every record, computed before writing them
+	Time     time.Time `json:"time"`
+}
+
+// NextBatchID returns a process wide, strictly increasing batch id based on the current time in nanoseconds,
+// so ids stay unique across restarts as long as the clock does not go backwards
+func NextBatchID() uint64 {
+	for {
+		last := lastBatchID.Load()
+		next := uint64(time.Now().UnixNano())
+		if next <= last {
+			next = last + 1
+		}
+		if lastBatchID.CompareAndSwap(last, next) {
+			return next
+		}
+	}
+}
+
+// Sink stores audit entries and hands them back for verification
+type Sink interface {
+	Record(entry Entry) error
+	// Entries calls fn for every stored entry, oldest first, stopping at the first error
+	Entries(fn func(entry Entry) error) error
+	Close() error
+}
+
+// New creates the sink described by cfg. It returns nil when auditing is disabled.
+// pool is called for every statement so the table sink follows the writable primary.
+func New(cfg config.AuditConfig, pool func() *sql.DB, databases func() []string) (Sink, error) {
+	switch cfg.Sink {
+	case "":
+		return nil, nil
+	case TableSinkType:
+		return NewTableSink(pool, databases), nil
+	case FileSinkType:
+		return NewFileSink(cfg.File)
+	default:
+		return nil, fmt.Errorf("unsupported audit sink: %s", cfg.Sink)
+	}
+}
@@ -0,0 +1,138 @@
+package audit
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-sql-driver/mysql"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"mysql_public_data_ingestor/config"
+)
+
+// MockSyslogWrapper is a mock implementation of syslogwrapper.SyslogWrapper
+type MockSyslogWrapper struct {
+	mock.Mock
+}
+
+func (m *MockSyslogWrapper) Close() {
+	m.Called()
+}
+
+func (m *MockSyslogWrapper) Warning(message string) {
+	m.Called(message)
+}
+
+func (m *MockSyslogWrapper) Error(message string) {
+	m.Called(message)
+}
+
+func (m *MockSyslogWrapper) Info(message string) {
+	m.Called(message)
+}
+
+func (m *MockSyslogWrapper) Debug(message string) {
+	m.Called(message)
+}
+
+func TestNextBatchID(t *testing.T) {
+	last := NextBatchID()
+	for i := 0; i < 1000; i++ {
+		next := NextBatchID()
+		assert.Greater(t, next, last, "Batch ids should be strictly increasing")
+		last = next
+	}
+}
+
+func TestNew(t *testing.T) {
+	sink, err := New(config.AuditConfig{}, nil, nil)
+	assert.NoError(t, err)
+	assert.Nil(t, sink, "An empty sink type disables auditing")
+
+	_, err = New(config.AuditConfig{Sink: "s3"}, nil, nil)
+	assert.Error(t, err)
+}
+
+// TestTableSinkEntriesReadOnly tests reading entries creates nothing and skips databases without an audit table
+func TestTableSinkEntriesReadOnly(t *testing.T) {
+	db, mockDB, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error creating mock DB: %v", err)
+	}
+	defer db.Close()
+
+	now := time.Now().UTC()
+	mockDB.ExpectQuery(regexp.QuoteMeta("FROM `auto_1`.`_ingest_audit`")).WillReturnError(&mysql.MySQLError{Number: 1146, Message: "Table doesn't exist"})
+	mockDB.ExpectQuery(regexp.QuoteMeta("FROM `auto_2`.`_ingest_audit`")).
+		WillReturnRows(sqlmock.NewRows([]string{"table_name", "batch_id", "row_count", "checksum", "created_at"}).AddRow("flights", 7, 2, 42, now))
+
+	sink := NewTableSink(func() *sql.DB { return db }, func() []string { return []string{"auto_1", "auto_2"} })
+	var entries []Entry
+	assert.NoError(t, sink.Entries(func(entry Entry) error {
+		entries = append(entries, entry)
+		return nil
+	}))
+	assert.Equal(t, []Entry{{Database: "auto_2", Table: "flights", BatchID: 7, Rows: 2, Checksum: 42, Time: now}}, entries)
+
+	if err := mockDB.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unmet expectations: %v", err)
+	}
+}
+
+// TestRowChecksum tests values hash the same once they have been through a MySQL column
+func TestRowChecksum(t *testing.T) {
+	written := []interface{}{float64(1700000000), 12.34, true, "EZY12", nil}
+	readBack := []interface{}{int64(1700000000), float64(float32(12.34)), int64(1), []byte("EZY12"), nil}
+	assert.Equal(t, RowChecksum(written), RowChecksum(readBack))
+	assert.NotEqual(t, RowChecksum(written), RowChecksum([]interface{}{float64(1700000001), 12.34, true, "EZY12", nil}))
+	assert.NotEqual(t, RowChecksum([]interface{}{nil}), RowChecksum([]interface{}{""}))
+	assert.Equal(t, []string{"a", "b"}, Columns([]string{"b", "a"}))
+}
+
+func TestVerify(t *testing.T) {
+	sink, err := NewFileSink(filepath.Join(t.TempDir(), "audit.ndjson"))
+	if err != nil {
+		t.Fatalf("Error creating audit sink: %v", err)
+	}
+	defer sink.Close()
+	now := time.Now()
+	checksum := RowChecksum([]interface{}{1.0, "a"}) ^ RowChecksum([]interface{}{2.0, "b"})
+	for batch := uint64(1); batch <= 3; batch++ {
+		assert.NoError(t, sink.Record(Entry{Database: "auto_1", Table: "flights", BatchID: batch, Rows: 2, Checksum: checksum, Time: now}))
+	}
+	// Purged by retention, never queried
+	assert.NoError(t, sink.Record(Entry{Database: "auto_1", Table: "flights", BatchID: 4, Rows: 2, Checksum: checksum, Time: now.Add(-2 * time.Hour)}))
+
+	db, mockDB, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error creating mock DB: %v", err)
+	}
+	defer db.Close()
+
+	rows := func() *sqlmock.Rows {
+		return mockDB.NewRowsWithColumnDefinition(mockDB.NewColumn("field1").OfType("INT", int64(0)), mockDB.NewColumn("field2").OfType("VARCHAR", ""))
+	}
+	query := regexp.QuoteMeta("SELECT `field1`, `field2` FROM `auto_1`.`flights` WHERE `_batch_id` = ?")
+	mockDB.ExpectQuery(query).WithArgs(1).WillReturnRows(rows().AddRow([]byte("2"), []byte("b")).AddRow([]byte("1"), []byte("a")))
+	mockDB.ExpectQuery(query).WithArgs(2).WillReturnRows(rows().AddRow([]byte("1"), []byte("a")))
+	mockDB.ExpectQuery(query).WithArgs(3).WillReturnRows(rows().AddRow([]byte("1"), []byte("a")).AddRow([]byte("2"), []byte("c")))
+
+	mockSyslog := new(MockSyslogWrapper)
+	mockSyslog.On("Error", mock.Anything).Return()
+	mockSyslog.On("Info", mock.Anything).Return()
+
+	result, err := Verify(sink, func() *sql.DB { return db }, []string{"field2", "field1"}, now.Add(-time.Hour), mockSyslog)
+	assert.NoError(t, err)
+	assert.Equal(t, Result{Batches: 3, Lost: 1, Mutated: 1, Expired: 1}, result)
+	assert.Equal(t, 2, result.Mismatched())
+	mockSyslog.AssertCalled(t, "Error", fmt.Sprintf("Batch 2 of auto_1.flights has lost rows: committed 2 rows (crc %d), found 1 rows (crc %d)", checksum, RowChecksum([]interface{}{1.0, "a"})))
+
+	if err := mockDB.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unmet expectations: %v", err)
+	}
+}
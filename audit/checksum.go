@@ -0,0 +1,102 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Batches are checksummed in Go, by the worker from the values it sends before writing them and by Verify from
+// the rows it reads back. Values are hashed in a text form that survives the trip through a MySQL column:
+// whole numbers as integers, other numbers at FLOAT precision, booleans as 1 and 0 and times in UTC.
+
+// Columns returns the order the columns of a row are hashed in
+func Columns(columns []string) []string {
+	columns = slices.Clone(columns)
+	slices.Sort(columns)
+	return columns
+}
+
+// RowChecksum returns the checksum of one row, its values in the order of Columns. The checksum of a batch is
+// the XOR of the checksums of its rows, so it does not depend on the order rows are written or read back.
+func RowChecksum(values []interface{}) uint64 {
+	var b strings.Builder
+	for i, value := range values {
+		if i > 0 {
+			b.WriteByte('#')
+		}
+		b.WriteString(canonical(value))
+	}
+	return uint64(crc32.ChecksumIEEE([]byte(b.String())))
+}
+
+func canonical(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return `\N`
+	case bool:
+		if v {
+			return "1"
+		}
+		return "0"
+	case int:
+		return strconv.FormatInt(int64(v), 10)
+	case int8:
+		return strconv.FormatInt(int64(v), 10)
+	case int16:
+		return strconv.FormatInt(int64(v), 10)
+	case int32:
+		return strconv.FormatInt(int64(v), 10)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case uint:
+		return strconv.FormatUint(uint64(v), 10)
+	case uint8:
+		return strconv.FormatUint(uint64(v), 10)
+	case uint16:
+		return strconv.FormatUint(uint64(v), 10)
+	case uint32:
+		return strconv.FormatUint(uint64(v), 10)
+	case uint64:
+		return strconv.FormatUint(v, 10)
+	case float32:
+		return number(float64(v))
+	case float64:
+		return number(v)
+	case json.Number:
+		if f, err := v.Float64(); err == nil {
+			return number(f)
+		}
+		return v.String()
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case time.Time:
+		return v.UTC().Format("2006-01-02 15:04:05.999999")
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// number writes f as an integer when it is whole, otherwise at the precision of a FLOAT column so a value
+// read back from one hashes the same as the value that was written
+func number(f float64) string {
+	if whole(f) {
+		return strconv.FormatInt(int64(f), 10)
+	}
+	f32 := float64(float32(f))
+	if whole(f32) {
+		return strconv.FormatInt(int64(f32), 10)
+	}
+	return strconv.FormatFloat(f32, 'g', -1, 32)
+}
+
+func whole(f float64) bool {
+	return f == math.Trunc(f) && math.Abs(f) < 1<<53
+}
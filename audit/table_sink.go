@@ -0,0 +1,105 @@
+package audit
+
+import (
+	"database/sql"
+	"fmt"
+	"sync"
+
+	"mysql_public_data_ingestor/ident"
+	"mysql_public_data_ingestor/retry"
+)
+
+// TableName is the audit table created in each generated database
+const TableName = "_ingest_audit"
+
+const tableSchema = `(
+	id BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	table_name VARCHAR(64) NOT NULL,
+	batch_id BIGINT UNSIGNED NOT NULL,
+	row_count BIGINT NOT NULL,
+	checksum BIGINT UNSIGNED NOT NULL,
+	created_at DATETIME(6) NOT NULL,
+	UNIQUE KEY (table_name, batch_id)
+)`
+
+// TableSink keeps audit entries in an _ingest_audit table next to the tables they describe
+type TableSink struct {
+	pool      func() *sql.DB
+	databases func() []string // read on each use, config reloads add databases
+
+	mu      sync.Mutex
+	created map[string]bool
+}
+
+func NewTableSink(pool func() *sql.DB, databases func() []string) *TableSink {
+	return &TableSink{pool: pool, databases: databases, created: make(map[string]bool)}
+}
+
+func (s *TableSink) ensureTable(dbName string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.created[dbName] {
+		return nil
+	}
+	_, err := s.pool().Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s %s", ident.Table(dbName, TableName), tableSchema))
+	if err != nil {
+		return fmt.Errorf("failed to create audit table in %s: %w", dbName, err)
+	}
+	s.created[dbName] = true
+	return nil
+}
+
+func (s *TableSink) Record(entry Entry) error {
+	if err := s.ensureTable(entry.Database); err != nil {
+		return err
+	}
+	_, err := s.pool().Exec(
+		fmt.Sprintf("INSERT INTO %s (table_name, batch_id, row_count, checksum, created_at) VALUES (?, ?, ?, ?, ?)", ident.Table(entry.Database, TableName)),
+		entry.Table, entry.BatchID, entry.Rows, entry.Checksum, entry.Time,
+	)
+	if err != nil {
+		return err
+	}
+	auditedBatches.Add(entry.Database+"."+entry.Table, 1)
+	return nil
+}
+
+func (s *TableSink) Entries(fn func(entry Entry) error) error {
+	for _, dbName := range s.databases() {
+		entries, err := s.load(dbName)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if err := fn(entry); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *TableSink) load(dbName string) ([]Entry, error) {
+	rows, err := s.pool().Query(fmt.Sprintf("SELECT table_name, batch_id, row_count, checksum, created_at FROM %s ORDER BY id", ident.Table(dbName, TableName)))
+	if retry.NoSuchTable(err) {
+		return nil, nil // Nothing was audited in dbName yet, reading does not create the table
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read audit entries from %s: %w", dbName, err)
+	}
+	defer rows.Close()
+
+	var entries []Entry
+	for rows.Next() {
+		entry := Entry{Database: dbName}
+		if err := rows.Scan(&entry.Table, &entry.BatchID, &entry.Rows, &entry.Checksum, &entry.Time); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+func (s *TableSink) Close() error {
+	return nil
+}
@@ -0,0 +1,115 @@
+package audit
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"mysql_public_data_ingestor/database"
+	"mysql_public_data_ingestor/ident"
+	"mysql_public_data_ingestor/syslogwrapper"
+)
+
+// Result counts the outcome of a verification run
+type Result struct {
+	Batches int // batches checked
+	Lost    int // batches with fewer rows than were committed
+	Extra   int // batches with more rows than were committed
+	Mutated int // batches with the committed row count but different content
+	Expired int // batches skipped because retention may have purged their rows
+}
+
+// Mismatched is the number of batches that no longer match what was written
+func (r Result) Mismatched() int {
+	return r.Lost + r.Extra + r.Mutated
+}
+
+// Verify reads back the rows of every audited batch, recomputes their count and checksum and reports the
+// batches that changed since they were committed. It only reads. Batches committed before expiredBefore are
+// skipped, a zero time checks them all.
+func Verify(sink Sink, pool func() *sql.DB, columns []string, expiredBefore time.Time, sysLog syslogwrapper.SyslogWrapperInterface) (Result, error) {
+	var result Result
+	columns = Columns(columns)
+	err := sink.Entries(func(entry Entry) error {
+		if entry.Time.Before(expiredBefore) {
+			result.Expired++
+			return nil
+		}
+		rows, checksum, err := batchChecksum(pool(), entry, columns)
+		if err != nil {
+			return fmt.Errorf("failed to checksum batch %d of %s.%s: %w", entry.BatchID, entry.Database, entry.Table, err)
+		}
+
+		result.Batches++
+		var problem string
+		switch {
+		case rows < entry.Rows:
+			result.Lost++
+			problem = "lost rows"
+		case rows > entry.Rows:
+			result.Extra++
+			problem = "unexpected rows"
+		case checksum != entry.Checksum:
+			result.Mutated++
+			problem = "mutated rows"
+		default:
+			return nil
+		}
+		sysLog.Error(fmt.Sprintf("Batch %d of %s.%s has %s: committed %d rows (crc %d), found %d rows (crc %d)",
+			entry.BatchID, entry.Database, entry.Table, problem, entry.Rows, entry.Checksum, rows, checksum))
+		return nil
+	})
+	sysLog.Info(fmt.Sprintf("Verified %d batches: %d lost rows, %d unexpected rows, %d mutated, %d skipped as expired", result.Batches, result.Lost, result.Extra, result.Mutated, result.Expired))
+	return result, err
+}
+
+// batchChecksum reads the rows entry wrote and returns their count and checksum, see RowChecksum
+func batchChecksum(db *sql.DB, entry Entry, columns []string) (int64, uint64, error) {
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE %s = ?", ident.List(columns), ident.Table(entry.Database, entry.Table), ident.Quote(database.BatchColumn))
+	rows, err := db.Query(query, entry.BatchID)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer rows.Close()
+	types, err := rows.ColumnTypes()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var count int64
+	var checksum uint64
+	values := make([]interface{}, len(columns))
+	dest := make([]interface{}, len(columns))
+	for i := range dest {
+		dest[i] = &values[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return 0, 0, err
+		}
+		for i, value := range values {
+			values[i] = scanned(value, types[i])
+		}
+		count++
+		checksum ^= RowChecksum(values)
+	}
+	return count, checksum, rows.Err()
+}
+
+// scanned turns the text MySQL sends for a numeric column back into a number, so it hashes like the value
+// that was written
+func scanned(value interface{}, columnType *sql.ColumnType) interface{} {
+	text, ok := value.([]byte)
+	if !ok {
+		return value
+	}
+	switch name := strings.TrimPrefix(columnType.DatabaseTypeName(), "UNSIGNED "); name {
+	case "TINYINT", "SMALLINT", "MEDIUMINT", "INT", "BIGINT", "FLOAT", "DOUBLE", "DECIMAL":
+		if f, err := strconv.ParseFloat(string(text), 64); err == nil {
+			return f
+		}
+	}
+	return text
+}
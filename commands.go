@@ -0,0 +1,304 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+
+	"mysql_public_data_ingestor/api_plugins"
+	"mysql_public_data_ingestor/config"
+	"mysql_public_data_ingestor/database"
+	"mysql_public_data_ingestor/syslogwrapper"
+)
+
+// Commands lists the subcommands in the order the usage shows them
+var Commands = []struct{ Name, Help string }{
+	{"run", "create the databases and tables, then ingest (the default)"},
+	{"init", "create the databases and tables, then exit"},
+	{"print-ddl", "print the statements init runs, without connecting"},
+	{"status", "show rows and size of every generated table [--exact to count rows]"},
+	{"drop", "drop the databases init created for this config [--yes to confirm, --orphans for others matching databases.prefix]"},
+	{"verify", "check audited batches still match what the tables hold"},
+	{"replay-dead-letters", "write dead-lettered records again"},
+}
+
+func usage(program string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Usage: %s [flags] [command] [command flags]\n\nCommands:\n", program)
+	w := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	for _, command := range Commands {
+		fmt.Fprintf(w, "  %s\t%s\n", command.Name, command.Help)
+	}
+	w.Flush()
+	fmt.Fprintf(&b, "\n%s", config.Usage())
+	return b.String()
+}
+
+// RunCommand runs a subcommand, writing its report to out
+func RunCommand(command string, args []string, cfg config.MainConfig, sysLog syslogwrapper.SyslogWrapperInterface, out io.Writer) error {
+	flags := flag.NewFlagSet(command, flag.ContinueOnError)
+	yes := flags.Bool("yes", false, "drop without asking for confirmation")
+	orphans := flags.Bool("orphans", false, "also drop databases that only match databases.prefix")
+	exact := flags.Bool("exact", false, "count rows with COUNT(*) instead of the information_schema estimate")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments %v", flags.Args())
+	}
+	if ((*yes || *orphans) && command != "drop") || (*exact && command != "status") {
+		return fmt.Errorf("flag not supported by %s", command)
+	}
+
+	switch command {
+	case "run":
+		return Run(cfg, sysLog)
+	case "init":
+		return Init(cfg, sysLog, out)
+	case "print-ddl":
+		apiPlugin, err := loadPlugin(cfg, sysLog)
+		if err != nil {
+			return err
+		}
+		return PrintDDL(cfg, apiPlugin, out)
+	case "status":
+		managers, err := connectTargets(cfg)
+		if err != nil {
+			return err
+		}
+		defer closeManagers(managers)
+		return Status(cfg, managers, *exact, out)
+	case "drop":
+		managers, err := connectTargets(cfg)
+		if err != nil {
+			return err
+		}
+		defer closeManagers(managers)
+		return Drop(cfg, managers, *yes, *orphans, out)
+	case "verify":
+		return Verify(cfg, sysLog)
+	case "replay-dead-letters":
+		return Replay(cfg, sysLog)
+	}
+	return fmt.Errorf("unknown command, run with --help for the list")
+}
+
+// Init creates the databases and tables on every target without ingesting
+func Init(cfg config.MainConfig, sysLog syslogwrapper.SyslogWrapperInterface, out io.Writer) error {
+	apiPlugin, err := SetupPlugins(cfg, sysLog)
+	if err != nil {
+		return err
+	}
+	managers, err := connectTargets(cfg)
+	if err != nil {
+		return err
+	}
+	defer closeManagers(managers)
+	return CreateLayout(cfg, managers, apiPlugin, sysLog, out)
+}
+
+// CreateLayout creates the databases and tables on each target and writes the outcome for every one of them.
+// It fails when any could not be created.
+func CreateLayout(cfg config.MainConfig, managers []*database.DBManager, apiPlugin api_plugins.APIPlugin, sysLog syslogwrapper.SyslogWrapperInterface, out io.Writer) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "TARGET\tOBJECT\tNAME\tRESULT\n")
+	failed, total := 0, 0
+	for _, dbManager := range managers {
+		report := dbManager.InitializeDatabases(cfg, sysLog, apiPlugin)
+		for _, result := range report {
+			status := "ok"
+			if result.Err != nil {
+				status = "failed: " + result.Err.Error()
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", dbManager.Name, result.Kind, result.Name, status)
+		}
+		failed += len(report.Failed())
+		total += len(report)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed to create %d of %d databases and tables", failed, total)
+	}
+	return nil
+}
+
+// PrintDDL writes the statements Init runs
+func PrintDDL(cfg config.MainConfig, apiPlugin api_plugins.APIPlugin, out io.Writer) error {
+	for _, statement := range database.DDL(cfg, apiPlugin) {
+		if _, err := fmt.Fprintf(out, "%s;\n", statement); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// connectTargets opens a connection to every target without creating anything
+func connectTargets(cfg config.MainConfig) ([]*database.DBManager, error) {
+	managers := make([]*database.DBManager, 0, len(cfg.Targets))
+	for _, targetCfg := range cfg.Targets {
+		dbManager, err := database.NewDBManager(targetCfg.MySQL)
+		if err != nil {
+			closeManagers(managers)
+			return nil, fmt.Errorf("target %s: %w", targetCfg.Name, err)
+		}
+		dbManager.Name = targetCfg.Name
+		managers = append(managers, dbManager)
+	}
+	return managers, nil
+}
+
+func closeManagers(managers []*database.DBManager) {
+	for _, dbManager := range managers {
+		dbManager.Close()
+	}
+}
+
+// Status writes the rows and size of every table in the generated databases of each target
+func Status(cfg config.MainConfig, managers []*database.DBManager, exact bool, out io.Writer) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', tabwriter.AlignRight)
+	rowsHeader := "ROWS (EST)"
+	if exact {
+		rowsHeader = "ROWS"
+	}
+	fmt.Fprintf(w, "TARGET\tDATABASE\tTABLE\t%s\tDATA\tINDEX\t\n", rowsHeader)
+	for _, dbManager := range managers {
+		dbs, err := dbManager.GeneratedDatabases(cfg.Databases.Prefix)
+		if err != nil {
+			return fmt.Errorf("target %s: %w", dbManager.Name, err)
+		}
+		stats, err := dbManager.TableStats(dbs, exact)
+		if err != nil {
+			return fmt.Errorf("target %s: %w", dbManager.Name, err)
+		}
+		for _, s := range stats {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\t\n", dbManager.Name, s.Database, s.Table, s.Rows, formatBytes(s.DataBytes), formatBytes(s.IndexBytes))
+		}
+	}
+	return w.Flush()
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// Drop drops the databases init created for cfg on each target: those named by the current config that hold
+// the marker table. Databases that only have a name the prefix could generate are orphans, left alone unless
+// orphans is set. Without yes it only lists what it would drop.
+func Drop(cfg config.MainConfig, managers []*database.DBManager, yes, orphans bool, out io.Writer) error {
+	configured := make(map[string]bool)
+	for _, dbName := range database.DatabaseNames(cfg) {
+		configured[dbName] = true
+	}
+	total, skipped := 0, 0
+	for _, dbManager := range managers {
+		dbs, err := dbManager.GeneratedDatabases(cfg.Databases.Prefix)
+		if err != nil {
+			return fmt.Errorf("target %s: %w", dbManager.Name, err)
+		}
+		marked, err := dbManager.MarkedDatabases()
+		if err != nil {
+			return fmt.Errorf("target %s: %w", dbManager.Name, err)
+		}
+		for _, dbName := range dbs {
+			reason := ""
+			switch {
+			case !configured[dbName]:
+				reason = "it is not in the current config"
+			case !marked[dbName]:
+				reason = "init did not create it"
+			}
+			if reason != "" && !orphans {
+				skipped++
+				fmt.Fprintf(out, "skipping %s on %s, %s\n", dbName, dbManager.Name, reason)
+				continue
+			}
+			total++
+			if !yes {
+				fmt.Fprintf(out, "would drop %s on %s\n", dbName, dbManager.Name)
+				continue
+			}
+			if err := dbManager.DropDatabase(dbName); err != nil {
+				return fmt.Errorf("target %s: failed to drop %s: %w", dbManager.Name, dbName, err)
+			}
+			fmt.Fprintf(out, "dropped %s on %s\n", dbName, dbManager.Name)
+		}
+	}
+	if !yes && total > 0 {
+		fmt.Fprintf(out, "%d databases left in place, run drop --yes to drop them\n", total)
+	}
+	if skipped > 0 {
+		fmt.Fprintf(out, "%d databases only match databases.prefix, add --orphans to drop them too\n", skipped)
+	}
+	return nil
+}
+
+// Verify checks the audited batches of every target and fails when any no longer match. It only reads, the
+// plugin is not handed its config and nothing is created.
+func Verify(cfg config.MainConfig, sysLog syslogwrapper.SyslogWrapperInterface) error {
+	apiPlugin, err := loadPlugin(cfg, sysLog)
+	if err != nil {
+		return err
+	}
+	targets, err := OpenTargets(cfg, apiPlugin)
+	if err != nil {
+		return err
+	}
+	defer closeTargets(targets)
+
+	mismatched := 0
+	for _, target := range targets {
+		result, err := VerifyAudit(cfg, target, sysLog, apiPlugin)
+		if err != nil {
+			return fmt.Errorf("failed to verify target %s: %w", target.Name, err)
+		}
+		mismatched += result.Mismatched()
+	}
+	if mismatched > 0 {
+		return fmt.Errorf("verification found %d batches that no longer match what was written", mismatched)
+	}
+	return nil
+}
+
+// Replay writes the dead letters of every target again. It creates nothing: a target whose tables are not all
+// there is reported before any dead letter is replayed.
+func Replay(cfg config.MainConfig, sysLog syslogwrapper.SyslogWrapperInterface) error {
+	apiPlugin, err := loadPlugin(cfg, sysLog)
+	if err != nil {
+		return err
+	}
+	targets, err := OpenTargets(cfg, apiPlugin)
+	if err != nil {
+		return err
+	}
+	defer closeTargets(targets)
+
+	for _, target := range targets {
+		missing, err := target.DBManager.MissingTables()
+		if err != nil {
+			return fmt.Errorf("target %s: failed to list tables: %w", target.Name, err)
+		}
+		if len(missing) > 0 {
+			return fmt.Errorf("target %s is missing %d tables (%s), run init first", target.Name, len(missing), strings.Join(missing, ", "))
+		}
+	}
+	for _, target := range targets {
+		err := ReplayDeadLetters(target.DeadLetter, target.DBManager, sysLog, apiPlugin)
+		if err != nil {
+			return fmt.Errorf("failed to replay dead letters for target %s: %w", target.Name, err)
+		}
+	}
+	return nil
+}
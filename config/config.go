@@ -1,14 +1,24 @@
 package config
 
 import (
-	"crypto/tls"
+	"bytes"
+	"errors"
 	"fmt"
-	"gopkg.in/yaml.v2"
+	"gopkg.in/yaml.v3"
+	"io"
 	"mysql_public_data_ingestor/api_plugins"
+	"mysql_public_data_ingestor/ident"
+	"mysql_public_data_ingestor/retry"
 	"mysql_public_data_ingestor/syslogwrapper"
+	"net"
 	"os"
 	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
+	"unicode/utf8"
 )
 
 type DBConfig struct {
@@ -17,30 +27,55 @@ type DBConfig struct {
 	Extra  map[string]struct {
 		Tables int `yaml:"tables"`
 	} `yaml:"extra"`
-	WriteWorkers int `yaml:"write_workers"`
+	Layout           []DatabaseLayout `yaml:"layout"`
+	Statement        string           `yaml:"statement"`          // how rows are written, see Statements; layout tables may override it
+	RowsPerStatement int              `yaml:"rows_per_statement"` // records written by one INSERT, 1 writes each record on its own
+	InitWorkers      int              `yaml:"init_workers"`       // databases created at once at startup and on reload
+	WriteWorkers     int              `yaml:"write_workers"`
 }
 
+// Write statements
+const (
+	StatementInsert       = "insert"        // INSERT, one record per transaction
+	StatementInsertIgnore = "insert_ignore" // INSERT IGNORE, duplicates and bad values become warnings
+	StatementReplace      = "replace"       // REPLACE, deleting any row with the same unique key first
+	StatementUpsert       = "upsert"        // INSERT ... ON DUPLICATE KEY UPDATE of every column, through a row alias on MySQL 8.0.19 and later
+	StatementLoadData     = "load_data"     // LOAD DATA LOCAL INFILE of the whole batch, needs local_infile on the server
+)
+
+// Statements are the accepted values of databases.statement
+var Statements = []string{StatementInsert, StatementInsertIgnore, StatementReplace, StatementUpsert, StatementLoadData}
+
+// defaultInitWorkers bounds the DDL run at once, well below the default connection pool
+const defaultInitWorkers = 4
+
+// MaxRowsPerStatement keeps multi-row statements well below the 65535 placeholders a prepared statement takes
+const MaxRowsPerStatement = 1000
+
 type MySQLConfig struct {
-	User           string         `yaml:"user"`
-	Password       string         `yaml:"password"`
-	Host           string         `yaml:"host"`
-	Port           int            `yaml:"port"`
-	DBName         string         `yaml:"dbname"`
-	TLSConfig      TLSConfig      `yaml:"tls_config"`
-	ConnectionPool ConnectionPool `yaml:"connection_pool"`
+	User                  string         `yaml:"user"`
+	Password              string         `yaml:"password"`
+	Host                  string         `yaml:"host"`
+	Port                  int            `yaml:"port"`
+	Hosts                 []string       `yaml:"hosts"`                   // host:port candidates for failover, overrides host/port
+	FailoverCheckInterval time.Duration  `yaml:"failover_check_interval"` // how often the writable primary is re-checked
+	DBName                string         `yaml:"dbname"`
+	InterpolateParams     bool           `yaml:"interpolate_params"` // the driver interpolates arguments client side instead of preparing statements
+	TLSConfig             TLSConfig      `yaml:"tls_config"`
+	ConnectionPool        ConnectionPool `yaml:"connection_pool"`
 }
 
 // TLSConfig holds the TLS configuration options
 type TLSConfig struct {
-	CAFile             string
-	CertFile           string
-	KeyFile            string
-	InsecureSkipVerify bool
-	ServerName         string
-	MinVersion         uint16
-	MaxVersion         uint16
-	CipherSuites       []uint16
-	ClientAuth         tls.ClientAuthType
+	Mode               string   `yaml:"mode"`      // disabled, preferred, required, verify-ca or verify-identity
+	CAFile             string   `yaml:"ca_file"`   // defaults to the system roots when verifying
+	CertFile           string   `yaml:"cert_file"` // client certificate, needs key_file
+	KeyFile            string   `yaml:"key_file"`
+	InsecureSkipVerify bool     `yaml:"insecure_skip_verify"` // same as mode: required when mode is unset
+	ServerName         string   `yaml:"server_name"`          // defaults to the host being connected to
+	MinVersion         string   `yaml:"min_version"`          // "1.0" to "1.3"
+	MaxVersion         string   `yaml:"max_version"`
+	CipherSuites       []string `yaml:"cipher_suites"` // crypto/tls names, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256
 }
 
 // ConnectionPool holds the connection pool configuration
@@ -59,50 +94,820 @@ func NewConnectionPool() ConnectionPool {
 	}
 }
 
+// WorkloadPhase describes one step of a workload profile
+type WorkloadPhase struct {
+	Name           string        `yaml:"name"`
+	Duration       time.Duration `yaml:"duration"`
+	RateMultiplier *float64      `yaml:"rate_multiplier"` // fetch rate relative to the plugin interval, 0 stops fetching
+	WriteMix       *float64      `yaml:"write_mix"`       // fraction [0-1] of each batch the writers insert
+	ActiveTables   int           `yaml:"active_tables"`   // 0 means every table
+}
+
+// Rate returns the rate multiplier of the phase, 1 when unset
+func (phase WorkloadPhase) Rate() float64 {
+	if phase.RateMultiplier == nil {
+		return 1
+	}
+	return *phase.RateMultiplier
+}
+
+// Mix returns the write mix of the phase, 1 when unset
+func (phase WorkloadPhase) Mix() float64 {
+	if phase.WriteMix == nil {
+		return 1
+	}
+	return *phase.WriteMix
+}
+
+// WorkloadProfile is a time based schedule of load intensity
+type WorkloadProfile struct {
+	Phases []WorkloadPhase `yaml:"phases"`
+	Loop   bool            `yaml:"loop"`
+}
+
+// QueueConfig bounds the per-table batch queues between the fetcher and the table workers
+type QueueConfig struct {
+	Capacity      int    `yaml:"capacity"`        // batches held in memory per table
+	Overflow      string `yaml:"overflow"`        // block, drop_oldest, drop_newest or spill
+	SpillDir      string `yaml:"spill_dir"`       // where the spill policy writes overflowing batches
+	SpillMaxBytes int64  `yaml:"spill_max_bytes"` // per table cap on spilled data
+}
+
+// SpoolConfig controls the on-disk write-ahead queue that holds batches while MySQL is unavailable
+type SpoolConfig struct {
+	Dir            string        `yaml:"dir"`             // empty disables spooling
+	MaxBytes       int64         `yaml:"max_bytes"`       // per table cap, batches beyond it are dropped
+	SegmentBytes   int64         `yaml:"segment_bytes"`   // size at which a new segment file is started
+	ReplayInterval time.Duration `yaml:"replay_interval"` // how often an idle worker retries spooled batches
+}
+
+// BackoffConfig controls the delay between retries of a failed write
+type BackoffConfig struct {
+	Initial     time.Duration `yaml:"initial"`
+	Max         time.Duration `yaml:"max"`
+	Multiplier  float64       `yaml:"multiplier"`
+	MaxAttempts int           `yaml:"max_attempts"`
+}
+
+// WriteErrorsConfig maps MySQL error classes to the policy the table workers apply
+type WriteErrorsConfig struct {
+	Backoff  BackoffConfig     `yaml:"backoff"`
+	Policies map[string]string `yaml:"policies"` // class -> retry, skip, dead_letter or halt
+}
+
+// DeadLetterConfig selects where records that cannot be written are kept for later replay
+type DeadLetterConfig struct {
+	Sink string `yaml:"sink"` // table (a _dead_letter table per database), file, or empty to only log them
+	File string `yaml:"file"` // NDJSON path for the file sink
+}
+
+// TargetConfig is one MySQL server, or failover group, that receives the generated databases
+type TargetConfig struct {
+	Name  string      `yaml:"name"`
+	MySQL MySQLConfig `yaml:"mysql"`
+}
+
+// RoutingConfig decides which targets receive a batch
+type RoutingConfig struct {
+	Policy  string `yaml:"policy"`   // replicate, shard_tables or hash_key
+	HashKey string `yaml:"hash_key"` // plugin field hashed to pick a target under hash_key
+}
+
+// Routing policies
+const (
+	RouteReplicate   = "replicate"    // every target receives every batch
+	RouteShardTables = "shard_tables" // each table is written on exactly one target
+	RouteHashKey     = "hash_key"     // each record goes to the target its key hashes to
+)
+
+// DistributionConfig decides which tables receive each record
+type DistributionConfig struct {
+	Mode   string  `yaml:"mode"`   // replicate, weighted or zipf
+	Fanout int     `yaml:"fanout"` // tables each record is written to under weighted and zipf
+	ZipfS  float64 `yaml:"zipf_s"` // zipf skew, above 1; higher values concentrate writes on fewer tables
+	ZipfV  float64 `yaml:"zipf_v"` // zipf offset, at least 1; higher values flatten the head
+}
+
+// Distribution modes
+const (
+	DistributeReplicate = "replicate" // every table receives every record, sampled down by its write weight
+	DistributeWeighted  = "weighted"  // each record goes to tables picked in proportion to their write weight
+	DistributeZipf      = "zipf"      // each record goes to tables picked by a Zipf distribution over their names
+)
+
+// ReadQuery is a read template. {table} is replaced with a generated table, and each arg is either a
+// literal or a generator: sample:<column> picks a value recently seen in the table, since:<duration>
+// is the unix time that long ago.
+type ReadQuery struct {
+	Name   string   `yaml:"name"`
+	SQL    string   `yaml:"sql"` // sent as written once {table} is replaced, quote columns that are keywords
+	Args   []string `yaml:"args"`
+	Weight int      `yaml:"weight"` // relative share of the reads, defaults to 1
+}
+
+// ReadWorkloadConfig runs readers against the generated tables alongside the writers
+type ReadWorkloadConfig struct {
+	Workers int           `yaml:"workers"` // per target, 0 disables reads
+	QPS     float64       `yaml:"qps"`     // per target, spread over the workers
+	Timeout time.Duration `yaml:"timeout"` // per query
+	Queries []ReadQuery   `yaml:"queries"` // defaults to the built-in flights templates
+}
+
+// ReplicaConfig is a replica endpoint checked against its primary
+type ReplicaConfig struct {
+	Name  string      `yaml:"name"`
+	MySQL MySQLConfig `yaml:"mysql"`
+}
+
+// ReplicationCheckConfig measures replica lag with heartbeats and compares recent table ranges by checksum
+type ReplicationCheckConfig struct {
+	Target            string          `yaml:"target"` // target acting as primary, defaults to the first one
+	Replicas          []ReplicaConfig `yaml:"replicas"`
+	HeartbeatInterval time.Duration   `yaml:"heartbeat_interval"`
+	ChecksumInterval  time.Duration   `yaml:"checksum_interval"`
+	ChecksumWindow    time.Duration   `yaml:"checksum_window"` // length of the time range checksummed per table
+	ChecksumDelay     time.Duration   `yaml:"checksum_delay"`  // how far behind now the range ends, must exceed the lag
+}
+
+// AuditConfig records the row count and checksum of every committed batch so writes can be verified later.
+// It needs every table written with the insert statement.
+type AuditConfig struct {
+	Sink string `yaml:"sink"` // table (an _ingest_audit table per database), file, or empty to disable
+	File string `yaml:"file"` // NDJSON path for the file sink
+}
+
+// MetricsConfig controls where runtime metrics are exposed
+type MetricsConfig struct {
+	ListenAddr string `yaml:"listen_addr"`
+}
+
+// AdminConfig controls the admin HTTP API. It only listens on loopback addresses and every request must
+// carry the token as a bearer token.
+type AdminConfig struct {
+	ListenAddr string `yaml:"listen_addr"` // empty disables the API
+	Token      string `yaml:"token"`
+}
+
+// RetentionConfig purges rows older than MaxAge from every generated table, by the plugin's time column. With
+// partitioning enabled whole partitions are dropped instead and the chunk settings are unused.
+type RetentionConfig struct {
+	MaxAge     time.Duration `yaml:"max_age"`     // 0 keeps everything
+	Interval   time.Duration `yaml:"interval"`    // time between purge passes
+	ChunkSize  int           `yaml:"chunk_size"`  // rows deleted per statement
+	ChunkPause time.Duration `yaml:"chunk_pause"` // pause between statements so purging does not crowd out writes
+	Orphans    bool          `yaml:"orphans"`     // also purge databases and tables init created that are no longer in the config
+}
+
+// PartitioningConfig creates the generated tables RANGE partitioned on the plugin's time column. A
+// maintainer keeps Ahead partitions ready past the current one and, with retention enabled, drops
+// partitions once all their rows are older than retention.max_age.
+type PartitioningConfig struct {
+	Interval      time.Duration `yaml:"interval"`       // time covered by one partition, 0 disables partitioning
+	Ahead         int           `yaml:"ahead"`          // future partitions kept ready
+	CheckInterval time.Duration `yaml:"check_interval"` // how often partitions are added and dropped
+}
+
+// ReloadConfig controls when the config is re-read while running. SIGHUP always triggers a reload.
+type ReloadConfig struct {
+	WatchInterval time.Duration `yaml:"watch_interval"` // how often the file is checked for changes, 0 disables
+}
+
 type MainConfig struct {
-	PluginSpec api_plugins.PluginSpec `yaml:"plugin_spec"`
-	Databases  DBConfig               `yaml:"databases"`
-	MySQL      MySQLConfig            `yaml:"mysql"`
+	PluginSpec       api_plugins.PluginSpec `yaml:"plugin_spec"`
+	Databases        DBConfig               `yaml:"databases"`
+	MySQL            MySQLConfig            `yaml:"mysql"`
+	Targets          []TargetConfig         `yaml:"targets"` // overrides mysql when set
+	Routing          RoutingConfig          `yaml:"routing"`
+	Distribution     DistributionConfig     `yaml:"distribution"`
+	ReadWorkload     ReadWorkloadConfig     `yaml:"read_workload"`
+	ReplicationCheck ReplicationCheckConfig `yaml:"replication_check"`
+	WorkloadProfile  WorkloadProfile        `yaml:"workload_profile"`
+	Queue            QueueConfig            `yaml:"queue"`
+	Spool            SpoolConfig            `yaml:"spool"`
+	WriteErrors      WriteErrorsConfig      `yaml:"write_errors"`
+	DeadLetter       DeadLetterConfig       `yaml:"dead_letter"`
+	Audit            AuditConfig            `yaml:"audit"`
+	Metrics          MetricsConfig          `yaml:"metrics"`
+	Admin            AdminConfig            `yaml:"admin"`
+	Retention        RetentionConfig        `yaml:"retention"`
+	Partitioning     PartitioningConfig     `yaml:"partitioning"`
+	Reload           ReloadConfig           `yaml:"reload"`
+
+	secrets []string // values resolved from secret references, see Redacted
 }
 
-// ValidateConnectionPool ensures the ConnectionPool has default values if they are not provided
-func ValidateConnectionPool(config *MainConfig) {
+// Validate checks the whole config and fills in defaults. It reports every problem it finds, not just
+// the first, as a *ValidationError.
+func Validate(config *MainConfig) error {
+	var p problems
+	p.merge(ValidatePluginSpec(config))
+	p.merge(ValidateDatabases(config))
+	p.merge(ValidateConnectionPool(config))
+	p.merge(ValidateServers(config)) // before ValidateTargets turns mysql into a target
+	p.merge(ValidateTargets(config))
+	p.merge(ValidateDistribution(config))
+	p.merge(ValidateWorkloadProfile(config))
+	p.merge(ValidateQueue(config))
+	p.merge(ValidateWriteErrors(config))
+	p.merge(ValidateSinks(config))
+	p.merge(ValidateReadWorkload(config))
+	p.merge(ValidateReplicationCheck(config))
+	p.merge(ValidateMetrics(config))
+	p.merge(ValidateAdmin(config))
+	p.merge(ValidateRetention(config))
+	p.merge(ValidatePartitioning(config)) // after ValidateRetention, the partition count depends on max_age
+	if config.Reload.WatchInterval < 0 {
+		p.add("reload.watch_interval", "must not be negative")
+	}
+	return p.err()
+}
+
+// ValidatePluginSpec checks that a plugin is selected
+func ValidatePluginSpec(config *MainConfig) error {
+	var p problems
+	if config.PluginSpec.Name == "" {
+		p.add("plugin_spec.name", "is required")
+	}
+	return p.err()
+}
+
+// identifier matches the names accepted for generated databases and tables: letters and digits of any
+// script, _, $ and -. They are always quoted in SQL; dots and slashes are left out because they separate
+// the parts of queue names and spool paths.
+var identifier = regexp.MustCompile(`^[\p{L}\p{M}\p{N}_$-]+$`)
+
+// optionName matches the engine, charset and collation names written unquoted into table options
+var optionName = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+// validName reports whether name is accepted for a generated database or table
+func validName(name string) bool {
+	return identifier.MatchString(name) && ident.Validate(name) == nil
+}
+
+// ValidateDatabases checks the generated database layout
+func ValidateDatabases(config *MainConfig) error {
+	var p problems
+	dbs := config.Databases
+	if !validName(dbs.Prefix) {
+		p.add("databases.prefix", "%q is not a valid identifier, use letters, digits, _, $ and -", dbs.Prefix)
+	} else if utf8.RuneCountInString(dbs.Prefix)+len(strconv.Itoa(dbs.Copies)) > ident.MaxLength {
+		p.add("databases.prefix", "is too long, generated database names must fit in %d characters", ident.MaxLength)
+	}
+	if dbs.Copies < 0 || (dbs.Copies == 0 && len(dbs.Layout) == 0) {
+		p.add("databases.copies", "must be positive, got %d", dbs.Copies)
+	}
+	for name, extra := range dbs.Extra {
+		path := fmt.Sprintf("databases.extra.%s", name)
+		if !validName(name) {
+			p.add(path, "%q is not a valid identifier", name)
+		} else if utf8.RuneCountInString(dbs.Prefix)+1+utf8.RuneCountInString(name) > ident.MaxLength {
+			p.add(path, "generated database name %s_%s is longer than %d characters", dbs.Prefix, name, ident.MaxLength)
+		}
+		if extra.Tables <= 0 {
+			p.add(path+".tables", "must be positive, got %d", extra.Tables)
+		}
+	}
+	if config.Databases.Statement == "" {
+		config.Databases.Statement = StatementInsert
+	} else if !slices.Contains(Statements, dbs.Statement) {
+		p.add("databases.statement", "unknown statement %s, use one of %s", dbs.Statement, strings.Join(Statements, ", "))
+	}
+	if dbs.RowsPerStatement == 0 {
+		config.Databases.RowsPerStatement = 1
+	} else if dbs.RowsPerStatement < 0 || dbs.RowsPerStatement > MaxRowsPerStatement {
+		p.add("databases.rows_per_statement", "must be between 1 and %d, got %d", MaxRowsPerStatement, dbs.RowsPerStatement)
+	}
+	validateLayout(&p, dbs)
+	if dbs.InitWorkers == 0 {
+		config.Databases.InitWorkers = defaultInitWorkers
+	} else if dbs.InitWorkers < 0 {
+		p.add("databases.init_workers", "must not be negative")
+	}
+	if dbs.WriteWorkers < 0 {
+		p.add("databases.write_workers", "must not be negative")
+	}
+	return p.err()
+}
+
+// ValidateConnectionPool ensures every connection pool has default values if they are not provided
+func ValidateConnectionPool(config *MainConfig) error {
 	// Create a struct with default values
 	connectionPoolDefaults := NewConnectionPool()
 
+	var p problems
+	setPoolDefaults(&p, "mysql.connection_pool", &config.MySQL.ConnectionPool, connectionPoolDefaults)
+	for i := range config.Targets {
+		setPoolDefaults(&p, fmt.Sprintf("targets[%d].mysql.connection_pool", i), &config.Targets[i].MySQL.ConnectionPool, connectionPoolDefaults)
+	}
+	return p.err()
+}
+
+func setPoolDefaults(p *problems, path string, pool *ConnectionPool, connectionPoolDefaults ConnectionPool) {
 	poolConfigDefaults := reflect.ValueOf(connectionPoolDefaults)
-	poolConfigValues := reflect.ValueOf(&config.MySQL.ConnectionPool).Elem()
+	poolConfigValues := reflect.ValueOf(pool).Elem()
 	configType := poolConfigValues.Type()
 
 	// Iterate through the fields of the ConnectionPool struct by name
 	for i := 0; i < poolConfigValues.NumField(); i++ {
 		configValue := poolConfigValues.Field(i)
-		configKey := configType.Field(i).Name
-		defaultValue := poolConfigDefaults.FieldByName(configKey)
+		if configValue.Kind() != reflect.Int {
+			continue
+		}
+		configField := configType.Field(i)
+		if configValue.Int() < 0 {
+			p.add(joinPath(path, fieldName(configField)), "must not be negative")
+			continue
+		}
+		// Zero means not set
+		if configValue.Int() == 0 {
+			configValue.Set(poolConfigDefaults.FieldByName(configField.Name))
+		}
+	}
+}
+
+// ValidateServers checks the connection settings of the mysql section, or of every target when targets
+// are set, and of every replica
+func ValidateServers(config *MainConfig) error {
+	var p problems
+	if len(config.Targets) == 0 {
+		validateMySQL(&p, "mysql", config.MySQL)
+	}
+	for i, target := range config.Targets {
+		validateMySQL(&p, fmt.Sprintf("targets[%d].mysql", i), target.MySQL)
+	}
+	for i, replica := range config.ReplicationCheck.Replicas {
+		validateMySQL(&p, fmt.Sprintf("replication_check.replicas[%d].mysql", i), replica.MySQL)
+	}
+	return p.err()
+}
+
+// validateMySQL checks the connection settings of a server section found at path
+func validateMySQL(p *problems, path string, mysql MySQLConfig) {
+	if mysql.User == "" {
+		p.add(path+".user", "is required")
+	}
+	if len(mysql.Hosts) == 0 {
+		if mysql.Host == "" {
+			p.add(path+".host", "is required unless hosts is set")
+		}
+		if mysql.Port < 1 || mysql.Port > 65535 {
+			p.add(path+".port", "must be between 1 and 65535, got %d", mysql.Port)
+		}
+	}
+	for i, host := range mysql.Hosts {
+		_, port, err := net.SplitHostPort(host)
+		if err != nil {
+			p.add(fmt.Sprintf("%s.hosts[%d]", path, i), "%q is not host:port", host)
+			continue
+		}
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			p.add(fmt.Sprintf("%s.hosts[%d]", path, i), "port %q is not between 1 and 65535", port)
+		}
+	}
+	if mysql.FailoverCheckInterval < 0 {
+		p.add(path+".failover_check_interval", "must not be negative")
+	}
 
-		// Check if the field is an integer and its value is zero
-		if configValue.Kind() != reflect.Int || configValue.Int() == 0 {
-			configValue.Set(defaultValue)
+	tlsPath := path + ".tls_config"
+	tlsConfig := mysql.TLSConfig
+	if tlsConfig.Mode != "" && !slices.Contains(TLSModes, tlsConfig.Mode) {
+		p.add(tlsPath+".mode", "unknown mode %q, use one of %s", tlsConfig.Mode, strings.Join(TLSModes, ", "))
+	}
+	for _, file := range []struct{ key, path string }{
+		{"ca_file", tlsConfig.CAFile},
+		{"cert_file", tlsConfig.CertFile},
+		{"key_file", tlsConfig.KeyFile},
+	} {
+		if file.path == "" {
+			continue
 		}
+		if _, err := os.Stat(file.path); err != nil {
+			p.add(tlsPath+"."+file.key, "cannot be read: %v", err)
+		}
+	}
+	if (tlsConfig.CertFile == "") != (tlsConfig.KeyFile == "") {
+		p.add(tlsPath, "cert_file and key_file must be set together")
+	}
+	minVersion, err := ParseTLSVersion(tlsConfig.MinVersion)
+	if err != nil {
+		p.add(tlsPath+".min_version", "%v", err)
+	}
+	maxVersion, err := ParseTLSVersion(tlsConfig.MaxVersion)
+	if err != nil {
+		p.add(tlsPath+".max_version", "%v", err)
+	}
+	if minVersion != 0 && maxVersion != 0 && minVersion > maxVersion {
+		p.add(tlsPath+".min_version", "is above max_version")
+	}
+	if _, err := ParseCipherSuites(tlsConfig.CipherSuites); err != nil {
+		p.add(tlsPath+".cipher_suites", "%v", err)
 	}
 }
 
-// LoadConfig loads the configuration from a file and overrides defaults
-func LoadConfig(filename string, sysLog syslogwrapper.SyslogWrapperInterface) (MainConfig, error) {
+// ValidateWorkloadProfile fills unset phase fields with values that leave the load unchanged
+func ValidateWorkloadProfile(config *MainConfig) error {
+	var p problems
+	for i := range config.WorkloadProfile.Phases {
+		phase := &config.WorkloadProfile.Phases[i]
+		path := fmt.Sprintf("workload_profile.phases[%d]", i)
+		if phase.Name == "" {
+			phase.Name = fmt.Sprintf("phase_%d", i+1)
+		}
+		if phase.Duration <= 0 {
+			p.add(path+".duration", "must be positive")
+		}
+		if phase.Rate() < 0 {
+			p.add(path+".rate_multiplier", "must not be negative")
+		}
+		if phase.Mix() < 0 || phase.Mix() > 1 {
+			p.add(path+".write_mix", "must be between 0 and 1, got %v", phase.Mix())
+		}
+		if phase.ActiveTables < 0 {
+			p.add(path+".active_tables", "must not be negative")
+		}
+	}
+	return p.err()
+}
+
+// QueueOverflowPolicies are the accepted values of queue.overflow
+var QueueOverflowPolicies = []string{"block", "drop_oldest", "drop_newest", "spill"}
+
+// ValidateQueue checks the in-memory queue and on-disk spool settings
+func ValidateQueue(config *MainConfig) error {
+	var p problems
+	if config.Queue.Capacity < 0 {
+		p.add("queue.capacity", "must not be negative")
+	}
+	if config.Queue.Overflow != "" && !slices.Contains(QueueOverflowPolicies, config.Queue.Overflow) {
+		p.add("queue.overflow", "unknown policy %q, use one of %s", config.Queue.Overflow, strings.Join(QueueOverflowPolicies, ", "))
+	}
+	if config.Queue.SpillMaxBytes < 0 {
+		p.add("queue.spill_max_bytes", "must not be negative")
+	}
+	if config.Spool.MaxBytes < 0 {
+		p.add("spool.max_bytes", "must not be negative")
+	}
+	if config.Spool.SegmentBytes < 0 {
+		p.add("spool.segment_bytes", "must not be negative")
+	}
+	if config.Spool.ReplayInterval < 0 {
+		p.add("spool.replay_interval", "must not be negative")
+	}
+	return p.err()
+}
+
+// ValidateWriteErrors checks the error policies and fills in backoff and policy defaults
+func ValidateWriteErrors(config *MainConfig) error {
+	var p problems
+	backoff := &config.WriteErrors.Backoff
+	if backoff.Initial <= 0 {
+		backoff.Initial = 100 * time.Millisecond
+	}
+	if backoff.Max <= 0 {
+		backoff.Max = 10 * time.Second
+	}
+	if backoff.Multiplier <= 0 {
+		backoff.Multiplier = 2
+	}
+	if backoff.MaxAttempts <= 0 {
+		backoff.MaxAttempts = 5
+	}
+
+	policies := make(map[string]string, len(retry.Classes))
+	for class, policy := range config.WriteErrors.Policies {
+		path := "write_errors.policies." + class
+		if !slices.Contains(retry.Classes, retry.Class(class)) {
+			p.add(path, "unknown error class %s", class)
+			continue
+		}
+		if !slices.Contains(retry.Policies, retry.Policy(policy)) {
+			p.add(path, "unknown policy %s", policy)
+			continue
+		}
+		policies[class] = policy
+	}
+	for class, policy := range retry.DefaultPolicies {
+		if _, ok := policies[string(class)]; !ok {
+			policies[string(class)] = string(policy)
+		}
+	}
+	config.WriteErrors.Policies = policies
+	return p.err()
+}
+
+// ValidateSinks checks the dead-letter and audit sinks
+func ValidateSinks(config *MainConfig) error {
+	var p problems
+	for section, sink := range map[string]struct{ Sink, File string }{
+		"dead_letter": {config.DeadLetter.Sink, config.DeadLetter.File},
+		"audit":       {config.Audit.Sink, config.Audit.File},
+	} {
+		switch sink.Sink {
+		case "", "table":
+		case "file":
+			if sink.File == "" {
+				p.add(section+".file", "is required for the file sink")
+			}
+		default:
+			p.add(section+".sink", "unknown sink %q, use table or file", sink.Sink)
+		}
+	}
+	if config.Audit.Sink != "" {
+		// The audit counts every record a statement sends as stored with its batch id, which only INSERT
+		// guarantees: the others skip duplicates, turn errors into warnings or move rows to a later batch
+		statements := map[string]string{"databases.statement": config.Databases.Statement}
+		for i, db := range config.Databases.Layout {
+			for j, table := range db.Tables {
+				statements[fmt.Sprintf("databases.layout[%d].tables[%d].statement", i, j)] = table.Statement
+			}
+		}
+		for path, statement := range statements {
+			if statement != "" && statement != StatementInsert {
+				p.add(path, "%s cannot be audited, use %s or disable audit.sink", statement, StatementInsert)
+			}
+		}
+	}
+	return p.err()
+}
+
+// ValidateTargets turns a plain mysql section into a single target, names the targets and checks the
+// routing policy
+func ValidateTargets(config *MainConfig) error {
+	var p problems
+	if len(config.Targets) == 0 {
+		config.Targets = []TargetConfig{{Name: "default", MySQL: config.MySQL}}
+	}
+	seen := make(map[string]bool, len(config.Targets))
+	for i := range config.Targets {
+		target := &config.Targets[i]
+		if target.Name == "" {
+			target.Name = fmt.Sprintf("target_%d", i+1)
+		}
+		if seen[target.Name] {
+			p.add(fmt.Sprintf("targets[%d].name", i), "duplicate target name %s", target.Name)
+		}
+		seen[target.Name] = true
+	}
+
+	switch config.Routing.Policy {
+	case "":
+		config.Routing.Policy = RouteReplicate
+	case RouteReplicate, RouteShardTables:
+	case RouteHashKey:
+		if config.Routing.HashKey == "" {
+			p.add("routing.hash_key", "is required by the hash_key policy")
+		}
+	default:
+		p.add("routing.policy", "unknown policy %s", config.Routing.Policy)
+	}
+	return p.err()
+}
+
+// ValidateReadWorkload checks the read templates and fills the per query defaults
+func ValidateReadWorkload(config *MainConfig) error {
+	var p problems
+	reads := &config.ReadWorkload
+	if reads.Workers < 0 {
+		p.add("read_workload.workers", "must not be negative")
+	}
+	if reads.QPS < 0 {
+		p.add("read_workload.qps", "must not be negative")
+	}
+	if reads.Workers > 0 && reads.QPS == 0 {
+		p.add("read_workload.qps", "is required when workers are set")
+	}
+	for i := range reads.Queries {
+		query := &reads.Queries[i]
+		path := fmt.Sprintf("read_workload.queries[%d]", i)
+		if query.Name == "" {
+			query.Name = fmt.Sprintf("query_%d", i+1)
+		}
+		if query.SQL == "" {
+			p.add(path+".sql", "is required")
+		}
+		if query.Weight < 0 {
+			p.add(path+".weight", "must not be negative")
+		}
+		if query.Weight == 0 {
+			query.Weight = 1
+		}
+	}
+	return p.err()
+}
+
+// ValidateReplicationCheck fills the check intervals and resolves the primary target
+func ValidateReplicationCheck(config *MainConfig) error {
+	var p problems
+	check := &config.ReplicationCheck
+	if len(check.Replicas) == 0 {
+		return nil
+	}
+	if check.Target == "" && len(config.Targets) > 0 {
+		check.Target = config.Targets[0].Name
+	}
+	if !slices.ContainsFunc(config.Targets, func(target TargetConfig) bool { return target.Name == check.Target }) {
+		p.add("replication_check.target", "unknown target %s", check.Target)
+	}
+	for i := range check.Replicas {
+		replica := &check.Replicas[i]
+		if replica.Name == "" {
+			replica.Name = fmt.Sprintf("replica_%d", i+1)
+		}
+		setPoolDefaults(&p, fmt.Sprintf("replication_check.replicas[%d].mysql.connection_pool", i), &replica.MySQL.ConnectionPool, NewConnectionPool())
+	}
+	if check.HeartbeatInterval <= 0 {
+		check.HeartbeatInterval = time.Second
+	}
+	if check.ChecksumInterval <= 0 {
+		check.ChecksumInterval = time.Minute
+	}
+	if check.ChecksumWindow <= 0 {
+		check.ChecksumWindow = 10 * time.Minute
+	}
+	if check.ChecksumDelay <= 0 {
+		check.ChecksumDelay = 30 * time.Second
+	}
+	return p.err()
+}
+
+// ValidateDistribution checks the distribution mode and fills in the fanout and Zipf parameters. The fanout
+// cannot exceed the tables of the layout.
+func ValidateDistribution(config *MainConfig) error {
+	var p problems
+	distribution := &config.Distribution
+	switch distribution.Mode {
+	case "":
+		distribution.Mode = DistributeReplicate
+	case DistributeReplicate, DistributeWeighted, DistributeZipf:
+	default:
+		p.add("distribution.mode", "unknown mode %s, use %s, %s or %s", distribution.Mode, DistributeReplicate, DistributeWeighted, DistributeZipf)
+	}
+	if distribution.Fanout < 0 {
+		p.add("distribution.fanout", "must not be negative")
+	} else if distribution.Fanout == 0 {
+		distribution.Fanout = 1
+	}
+	if tables := config.Databases.TableCount(); distribution.Mode != DistributeReplicate && tables > 0 && distribution.Fanout > tables {
+		p.add("distribution.fanout", "must be at most the %d tables of the layout, got %d", tables, distribution.Fanout)
+	}
+	if distribution.ZipfS == 0 {
+		distribution.ZipfS = 1.1
+	} else if distribution.ZipfS <= 1 {
+		p.add("distribution.zipf_s", "must be greater than 1, got %g", distribution.ZipfS)
+	}
+	if distribution.ZipfV == 0 {
+		distribution.ZipfV = 1
+	} else if distribution.ZipfV < 1 {
+		p.add("distribution.zipf_v", "must be at least 1, got %g", distribution.ZipfV)
+	}
+	return p.err()
+}
+
+// ValidateMetrics checks the metrics listener address
+func ValidateMetrics(config *MainConfig) error {
+	var p problems
+	if config.Metrics.ListenAddr != "" {
+		if _, _, err := net.SplitHostPort(config.Metrics.ListenAddr); err != nil {
+			p.add("metrics.listen_addr", "%q is not host:port", config.Metrics.ListenAddr)
+		}
+	}
+	return p.err()
+}
+
+// ValidateAdmin checks the admin API is bound to a loopback address and protected by a token
+func ValidateAdmin(config *MainConfig) error {
+	var p problems
+	admin := config.Admin
+	if admin.ListenAddr == "" {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(admin.ListenAddr)
+	if err != nil {
+		p.add("admin.listen_addr", "%q is not host:port", admin.ListenAddr)
+	} else if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		p.add("admin.listen_addr", "must be a loopback address such as 127.0.0.1, got %q", host)
+	}
+	if admin.Token == "" {
+		p.add("admin.token", "is required when the admin API is enabled")
+	}
+	return p.err()
+}
+
+// ValidateRetention fills in the purge defaults when retention is enabled
+func ValidateRetention(config *MainConfig) error {
+	var p problems
+	retention := &config.Retention
+	if retention.MaxAge < 0 {
+		p.add("retention.max_age", "must not be negative")
+	}
+	if retention.MaxAge <= 0 {
+		return p.err()
+	}
+	if retention.Interval <= 0 {
+		retention.Interval = time.Minute
+	}
+	if retention.ChunkSize < 0 {
+		p.add("retention.chunk_size", "must not be negative")
+	} else if retention.ChunkSize == 0 {
+		retention.ChunkSize = 1000
+	}
+	if retention.ChunkPause < 0 {
+		p.add("retention.chunk_pause", "must not be negative")
+	} else if retention.ChunkPause == 0 {
+		retention.ChunkPause = 100 * time.Millisecond
+	}
+	return p.err()
+}
+
+// maxPartitions is the MySQL limit on partitions per table
+const maxPartitions = 8192
+
+// ValidatePartitioning fills in the partition maintenance defaults and checks the partitions a table needs
+// stay within what MySQL allows
+func ValidatePartitioning(config *MainConfig) error {
+	var p problems
+	partitioning := &config.Partitioning
+	if partitioning.Interval == 0 {
+		return nil
+	}
+	if partitioning.Interval < time.Minute || partitioning.Interval%time.Second != 0 {
+		p.add("partitioning.interval", "must be a whole number of seconds and at least 1m, got %v", partitioning.Interval)
+		return p.err()
+	}
+	if partitioning.Ahead < 0 {
+		p.add("partitioning.ahead", "must not be negative")
+	} else if partitioning.Ahead == 0 {
+		partitioning.Ahead = 2
+	}
+	if partitioning.CheckInterval < 0 {
+		p.add("partitioning.check_interval", "must not be negative")
+	} else if partitioning.CheckInterval == 0 {
+		partitioning.CheckInterval = min(partitioning.Interval, 10*time.Minute)
+	}
+	if maxAge := config.Retention.MaxAge; maxAge > 0 {
+		if needed := int(maxAge/partitioning.Interval) + partitioning.Ahead + 2; needed > maxPartitions {
+			p.add("partitioning.interval", "keeping %v of data needs %d partitions, more than the %d MySQL allows", maxAge, needed, maxPartitions)
+		}
+	}
+	return p.err()
+}
+
+// LoadConfig loads the configuration from a file and overrides defaults. overrides are applied on top of
+// the file in order, so later ones win (environment then flags).
+func LoadConfig(filename string, sysLog syslogwrapper.SyslogWrapperInterface, overrides ...Overrides) (MainConfig, error) {
 	data, err := os.ReadFile(filename)
 	if err != nil {
 		sysLog.Error(fmt.Sprintf("Failed to read config file: %v", err))
 		return MainConfig{}, err
 	}
 
-	var config MainConfig
-	err = yaml.Unmarshal(data, &config)
+	// The node tree is only used to point problems at their line
+	var root yaml.Node
+	err = yaml.Unmarshal(data, &root)
 	if err != nil {
 		sysLog.Error(fmt.Sprintf("Failed to unmarshal config file: %v", err))
 		return MainConfig{}, err
 	}
 
-	ValidateConnectionPool(&config)
+	var config MainConfig
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true) // Typos in keys are errors rather than silently ignored
+	err = decoder.Decode(&config)
+	if err != nil && !errors.Is(err, io.EOF) {
+		var typeErr *yaml.TypeError
+		if errors.As(err, &typeErr) {
+			for _, problem := range typeErr.Errors {
+				sysLog.Error(fmt.Sprintf("Invalid config file %s: %s", filename, problem))
+			}
+		} else {
+			sysLog.Error(fmt.Sprintf("Failed to unmarshal config file: %v", err))
+		}
+		return MainConfig{}, err
+	}
+
+	for _, o := range overrides {
+		err = ApplyOverrides(&config, o)
+		if err != nil {
+			sysLog.Error(fmt.Sprintf("Invalid config override: %v", err))
+			return MainConfig{}, err
+		}
+	}
+
+	err = ResolveSecrets(&config)
+	if err != nil {
+		sysLog.Error(fmt.Sprintf("Failed to resolve config secrets: %v", err))
+		return MainConfig{}, err
+	}
+
+	err = Validate(&config)
+	var validationErr *ValidationError
+	if errors.As(err, &validationErr) {
+		validationErr.locate(&root)
+		for _, problem := range validationErr.Problems {
+			sysLog.Error(fmt.Sprintf("Invalid config file %s: %s", filename, problem))
+		}
+		return MainConfig{}, err
+	}
 
 	return config, nil
 }
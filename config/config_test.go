@@ -5,7 +5,10 @@ import (
 	"github.com/stretchr/testify/mock"
 	"mysql_public_data_ingestor/syslogwrapper"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 // MockSyslogWrapper is a mock implementation of syslogwrapper.SyslogWrapper
@@ -171,3 +174,267 @@ databases:
 		return msg != ""
 	}))
 }
+
+// TestValidateAuditStatements tests audit is only accepted with tables written by INSERT
+func TestValidateAuditStatements(t *testing.T) {
+	for _, statement := range Statements {
+		cfg := MainConfig{Databases: DBConfig{Statement: statement}, Audit: AuditConfig{Sink: "table"}}
+		layout := MainConfig{
+			Databases: DBConfig{Layout: []DatabaseLayout{{Name: "orders", Tables: []TableLayout{{Name: "t", Statement: statement}}}}},
+			Audit:     AuditConfig{Sink: "table"},
+		}
+		if statement == StatementInsert {
+			assert.NoError(t, ValidateSinks(&cfg), statement)
+			assert.NoError(t, ValidateSinks(&layout), statement)
+			continue
+		}
+		assert.ErrorContains(t, ValidateSinks(&cfg), "databases.statement", statement)
+		assert.ErrorContains(t, ValidateSinks(&layout), "databases.layout[0].tables[0].statement", statement)
+		cfg.Audit.Sink = ""
+		assert.NoError(t, ValidateSinks(&cfg), statement)
+	}
+}
+
+// TestValidateWorkloadProfile tests defaulting and rejection of workload phases
+func TestValidateWorkloadProfile(t *testing.T) {
+	cfg := MainConfig{WorkloadProfile: WorkloadProfile{Phases: []WorkloadPhase{{Duration: time.Minute}}}}
+	assert.NoError(t, ValidateWorkloadProfile(&cfg))
+	assert.Equal(t, "phase_1", cfg.WorkloadProfile.Phases[0].Name)
+	assert.Equal(t, 1.0, cfg.WorkloadProfile.Phases[0].Rate())
+	assert.Equal(t, 1.0, cfg.WorkloadProfile.Phases[0].Mix())
+
+	zero := 0.0
+	cfg = MainConfig{WorkloadProfile: WorkloadProfile{Phases: []WorkloadPhase{{Duration: time.Minute, RateMultiplier: &zero, WriteMix: &zero}}}}
+	assert.NoError(t, ValidateWorkloadProfile(&cfg))
+	assert.Equal(t, 0.0, cfg.WorkloadProfile.Phases[0].Rate(), "A rate of 0 should be kept")
+	assert.Equal(t, 0.0, cfg.WorkloadProfile.Phases[0].Mix(), "A write mix of 0 should be kept")
+
+	two := 2.0
+	cfg = MainConfig{WorkloadProfile: WorkloadProfile{Phases: []WorkloadPhase{{Name: "spike"}}}}
+	assert.Error(t, ValidateWorkloadProfile(&cfg), "Phases without duration should be rejected")
+
+	cfg = MainConfig{WorkloadProfile: WorkloadProfile{Phases: []WorkloadPhase{{Duration: time.Minute, WriteMix: &two}}}}
+	assert.Error(t, ValidateWorkloadProfile(&cfg), "Write mix above 1 should be rejected")
+}
+
+// TestValidateWriteErrors tests policy defaults and rejection of unknown classes and policies
+func TestValidateWriteErrors(t *testing.T) {
+	cfg := MainConfig{WriteErrors: WriteErrorsConfig{Policies: map[string]string{"deadlock": "halt"}}}
+	assert.NoError(t, ValidateWriteErrors(&cfg))
+	assert.Equal(t, "halt", cfg.WriteErrors.Policies["deadlock"], "Configured policy should be kept")
+	assert.Equal(t, "skip", cfg.WriteErrors.Policies["duplicate_key"], "Missing classes should use the default policy")
+	assert.Equal(t, 5, cfg.WriteErrors.Backoff.MaxAttempts)
+
+	cfg = MainConfig{WriteErrors: WriteErrorsConfig{Policies: map[string]string{"deadlocks": "retry"}}}
+	assert.Error(t, ValidateWriteErrors(&cfg), "Unknown error classes should be rejected")
+
+	cfg = MainConfig{WriteErrors: WriteErrorsConfig{Policies: map[string]string{"deadlock": "ignore"}}}
+	assert.Error(t, ValidateWriteErrors(&cfg), "Unknown policies should be rejected")
+}
+
+// TestValidateTargets tests the single target fallback, target naming and routing policy checks
+func TestValidateTargets(t *testing.T) {
+	cfg := MainConfig{MySQL: MySQLConfig{Host: "localhost", Port: 3306}}
+	assert.NoError(t, ValidateTargets(&cfg))
+	assert.Len(t, cfg.Targets, 1, "A plain mysql section should become the only target")
+	assert.Equal(t, "default", cfg.Targets[0].Name)
+	assert.Equal(t, "localhost", cfg.Targets[0].MySQL.Host)
+	assert.Equal(t, RouteReplicate, cfg.Routing.Policy)
+
+	cfg = MainConfig{Targets: []TargetConfig{{}, {}}, Routing: RoutingConfig{Policy: RouteShardTables}}
+	assert.NoError(t, ValidateTargets(&cfg))
+	assert.Equal(t, "target_2", cfg.Targets[1].Name)
+
+	cfg = MainConfig{Targets: []TargetConfig{{Name: "a"}, {Name: "a"}}}
+	assert.Error(t, ValidateTargets(&cfg), "Duplicate target names should be rejected")
+
+	cfg = MainConfig{Routing: RoutingConfig{Policy: RouteHashKey}}
+	assert.Error(t, ValidateTargets(&cfg), "hash_key routing needs a key field")
+
+	cfg = MainConfig{Routing: RoutingConfig{Policy: "round_robin"}}
+	assert.Error(t, ValidateTargets(&cfg), "Unknown routing policies should be rejected")
+}
+
+// TestValidateReadWorkload tests read query defaults and rejection of unusable settings
+func TestValidateReadWorkload(t *testing.T) {
+	cfg := MainConfig{ReadWorkload: ReadWorkloadConfig{Workers: 2, QPS: 50, Queries: []ReadQuery{{SQL: "SELECT 1"}}}}
+	assert.NoError(t, ValidateReadWorkload(&cfg))
+	assert.Equal(t, "query_1", cfg.ReadWorkload.Queries[0].Name)
+	assert.Equal(t, 1, cfg.ReadWorkload.Queries[0].Weight)
+
+	cfg = MainConfig{ReadWorkload: ReadWorkloadConfig{Workers: 2}}
+	assert.Error(t, ValidateReadWorkload(&cfg), "Workers without a rate should be rejected")
+
+	cfg = MainConfig{ReadWorkload: ReadWorkloadConfig{Workers: 1, QPS: 1, Queries: []ReadQuery{{Name: "empty"}}}}
+	assert.Error(t, ValidateReadWorkload(&cfg), "Queries without sql should be rejected")
+}
+
+// TestValidateReplicationCheck tests the check defaults and primary target resolution
+func TestValidateReplicationCheck(t *testing.T) {
+	cfg := MainConfig{Targets: []TargetConfig{{Name: "a"}}, ReplicationCheck: ReplicationCheckConfig{Replicas: []ReplicaConfig{{}}}}
+	assert.NoError(t, ValidateReplicationCheck(&cfg))
+	assert.Equal(t, "a", cfg.ReplicationCheck.Target, "The first target should be the default primary")
+	assert.Equal(t, "replica_1", cfg.ReplicationCheck.Replicas[0].Name)
+	assert.Equal(t, 30*time.Second, cfg.ReplicationCheck.ChecksumDelay)
+	assert.Equal(t, 25, cfg.ReplicationCheck.Replicas[0].MySQL.ConnectionPool.MaxOpenConns)
+
+	cfg = MainConfig{Targets: []TargetConfig{{Name: "a"}}, ReplicationCheck: ReplicationCheckConfig{Target: "b", Replicas: []ReplicaConfig{{}}}}
+	assert.Error(t, ValidateReplicationCheck(&cfg), "Unknown primary targets should be rejected")
+}
+
+// writeConfig writes data to a temporary config file and returns its path
+func writeConfig(t *testing.T, data string) string {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+	return path
+}
+
+// TestLoadConfig_UnknownKey tests that misspelled keys are rejected with their line
+func TestLoadConfig_UnknownKey(t *testing.T) {
+	path := writeConfig(t, `
+plugin_spec:
+  name: test_plugin
+mysql:
+  user: test_user
+  hostname: localhost
+`)
+	mockSyslog := new(MockSyslogWrapper)
+	mockSyslog.On("Error", mock.Anything).Return()
+
+	_, err := LoadConfig(path, mockSyslog)
+	assert.Error(t, err, "Unknown keys should be rejected")
+	mockSyslog.AssertCalled(t, "Error", mock.MatchedBy(func(msg string) bool {
+		return strings.Contains(msg, "line 6") && strings.Contains(msg, "hostname")
+	}))
+}
+
+// TestLoadConfig_ValidationProblems tests that every problem is reported at once with its path and line
+func TestLoadConfig_ValidationProblems(t *testing.T) {
+	path := writeConfig(t, `
+plugin_spec:
+  name: test_plugin
+databases:
+  prefix: "bad.prefix"
+  copies: 0
+mysql:
+  user: test_user
+  host: localhost
+  port: 70000
+  connection_pool:
+    max_idle_conns: -1
+queue:
+  overflow: drop_everything
+`)
+	mockSyslog := new(MockSyslogWrapper)
+	mockSyslog.On("Error", mock.Anything).Return()
+
+	_, err := LoadConfig(path, mockSyslog)
+	var validationErr *ValidationError
+	if !assert.ErrorAs(t, err, &validationErr) {
+		return
+	}
+	lines := make(map[string]int)
+	for _, problem := range validationErr.Problems {
+		lines[problem.Path] = problem.Line
+	}
+	assert.Equal(t, map[string]int{
+		"databases.prefix":                     5,
+		"databases.copies":                     6,
+		"mysql.port":                           10,
+		"mysql.connection_pool.max_idle_conns": 12,
+		"queue.overflow":                       14,
+	}, lines)
+	mockSyslog.AssertNumberOfCalls(t, "Error", len(validationErr.Problems))
+}
+
+// TestValidateConnectionPool tests that only unset pool values take the defaults
+func TestValidateConnectionPool(t *testing.T) {
+	cfg := MainConfig{MySQL: MySQLConfig{ConnectionPool: ConnectionPool{MaxIdleConns: 5}}}
+	assert.NoError(t, ValidateConnectionPool(&cfg))
+	assert.Equal(t, 5, cfg.MySQL.ConnectionPool.MaxIdleConns, "Configured values should be kept")
+	assert.Equal(t, NewConnectionPool().MaxOpenConns, cfg.MySQL.ConnectionPool.MaxOpenConns)
+
+	cfg = MainConfig{Targets: []TargetConfig{{MySQL: MySQLConfig{ConnectionPool: ConnectionPool{MaxOpenConns: -1}}}}}
+	assert.Error(t, ValidateConnectionPool(&cfg), "Negative pool sizes should be rejected")
+}
+
+// TestValidateServers tests the connection checks of the mysql section and the targets
+func TestValidateServers(t *testing.T) {
+	cfg := MainConfig{MySQL: MySQLConfig{User: "u", Host: "localhost", Port: 3306}}
+	assert.NoError(t, ValidateServers(&cfg))
+
+	cfg = MainConfig{MySQL: MySQLConfig{User: "u", Hosts: []string{"db1:3306", "db2"}}}
+	assert.Error(t, ValidateServers(&cfg), "Failover hosts need a port")
+
+	cfg = MainConfig{Targets: []TargetConfig{{MySQL: MySQLConfig{User: "u", Host: "db", Port: 3306, TLSConfig: TLSConfig{CertFile: "client.pem"}}}}}
+	err := ValidateServers(&cfg)
+	assert.ErrorContains(t, err, "targets[0].mysql.tls_config.cert_file")
+	assert.ErrorContains(t, err, "cert_file and key_file must be set together")
+
+	cfg = MainConfig{MySQL: MySQLConfig{User: "u", Host: "localhost", Port: 3306}, ReplicationCheck: ReplicationCheckConfig{Replicas: []ReplicaConfig{
+		{MySQL: MySQLConfig{ConnectionPool: ConnectionPool{MaxOpenConns: -1}}},
+	}}}
+	err = ValidateServers(&cfg)
+	assert.ErrorContains(t, err, "replication_check.replicas[0].mysql.user: is required")
+	assert.ErrorContains(t, err, "replication_check.replicas[0].mysql.host: is required unless hosts is set")
+	assert.ErrorContains(t, err, "replication_check.replicas[0].mysql.port: must be between 1 and 65535, got 0")
+	assert.NotContains(t, err.Error(), "connection_pool", "Replica pools are checked once, by ValidateReplicationCheck")
+}
+
+// TestValidateAdmin tests the admin API must stay on loopback and have a token
+func TestValidateAdmin(t *testing.T) {
+	cfg := MainConfig{Admin: AdminConfig{ListenAddr: "127.0.0.1:9101", Token: "t"}}
+	assert.NoError(t, ValidateAdmin(&cfg))
+	cfg = MainConfig{Admin: AdminConfig{ListenAddr: "localhost:9101", Token: "t"}}
+	assert.NoError(t, ValidateAdmin(&cfg))
+
+	cfg = MainConfig{Admin: AdminConfig{ListenAddr: "0.0.0.0:9101"}}
+	err := ValidateAdmin(&cfg)
+	assert.ErrorContains(t, err, "admin.listen_addr: must be a loopback address")
+	assert.ErrorContains(t, err, "admin.token: is required")
+}
+
+func TestValidateRetention(t *testing.T) {
+	cfg := MainConfig{}
+	assert.NoError(t, ValidateRetention(&cfg))
+	assert.Equal(t, RetentionConfig{}, cfg.Retention, "Disabled retention should not get defaults")
+
+	cfg = MainConfig{Retention: RetentionConfig{MaxAge: time.Hour}}
+	assert.NoError(t, ValidateRetention(&cfg))
+	assert.Equal(t, RetentionConfig{MaxAge: time.Hour, Interval: time.Minute, ChunkSize: 1000, ChunkPause: 100 * time.Millisecond}, cfg.Retention)
+
+	cfg = MainConfig{Retention: RetentionConfig{MaxAge: time.Hour, ChunkSize: -1}}
+	assert.ErrorContains(t, ValidateRetention(&cfg), "retention.chunk_size: must not be negative")
+}
+
+func TestValidatePartitioning(t *testing.T) {
+	cfg := MainConfig{Partitioning: PartitioningConfig{Interval: time.Hour}}
+	assert.NoError(t, ValidatePartitioning(&cfg))
+	assert.Equal(t, PartitioningConfig{Interval: time.Hour, Ahead: 2, CheckInterval: 10 * time.Minute}, cfg.Partitioning)
+
+	cfg = MainConfig{Partitioning: PartitioningConfig{Interval: time.Second}}
+	assert.ErrorContains(t, ValidatePartitioning(&cfg), "partitioning.interval: must be a whole number of seconds and at least 1m")
+
+	cfg = MainConfig{Partitioning: PartitioningConfig{Interval: time.Minute}, Retention: RetentionConfig{MaxAge: 30 * 24 * time.Hour}}
+	assert.ErrorContains(t, ValidatePartitioning(&cfg), "needs 43204 partitions, more than the 8192 MySQL allows")
+}
+
+func TestValidateDistribution(t *testing.T) {
+	cfg := MainConfig{}
+	assert.NoError(t, ValidateDistribution(&cfg))
+	assert.Equal(t, DistributionConfig{Mode: DistributeReplicate, Fanout: 1, ZipfS: 1.1, ZipfV: 1}, cfg.Distribution)
+
+	cfg = MainConfig{Distribution: DistributionConfig{Mode: "random", ZipfS: 0.5}}
+	err := ValidateDistribution(&cfg)
+	assert.ErrorContains(t, err, "distribution.mode: unknown mode random")
+	assert.ErrorContains(t, err, "distribution.zipf_s: must be greater than 1")
+
+	cfg = MainConfig{Distribution: DistributionConfig{Mode: DistributeZipf, Fanout: 5}, Databases: DBConfig{Copies: 2, Extra: map[string]struct {
+		Tables int `yaml:"tables"`
+	}{"foo": {Tables: 2}}}}
+	assert.ErrorContains(t, ValidateDistribution(&cfg), "distribution.fanout: must be at most the 4 tables of the layout, got 5")
+	cfg.Distribution.Fanout = 4
+	assert.NoError(t, ValidateDistribution(&cfg))
+}
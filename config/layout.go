@@ -0,0 +1,155 @@
+package config
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"mysql_public_data_ingestor/ident"
+)
+
+// Placeholders of the layout name templates
+const (
+	PrefixPlaceholder      = "{prefix}"       // databases.prefix
+	TablePrefixPlaceholder = "{table_prefix}" // the plugin's table prefix
+	NumberPlaceholder      = "{n}"            // instance number, from 1 to count
+)
+
+// DatabaseLayout declares generated databases beyond copies and extra. Name is a template; without
+// {prefix} it is prefixed with "{prefix}_" so drop and status still recognise the database as generated.
+type DatabaseLayout struct {
+	Name   string        `yaml:"name"`
+	Count  int           `yaml:"count"` // databases built from this entry, numbered by {n}, 0 means 1
+	Tables []TableLayout `yaml:"tables"`
+}
+
+// TableLayout declares tables of a layout database with their own options and write weight
+type TableLayout struct {
+	Name      string   `yaml:"name"`      // template, defaults to {table_prefix}
+	Count     int      `yaml:"count"`     // tables built from this entry, numbered by {n}, 0 means 1
+	Engine    string   `yaml:"engine"`    // server default when empty
+	Charset   string   `yaml:"charset"`   // server default when empty
+	Collation string   `yaml:"collation"` // charset default when empty
+	Weight    *float64 `yaml:"weight"`    // share of the writes relative to the other tables, defaults to 1
+	Statement string   `yaml:"statement"` // defaults to databases.statement
+}
+
+// Names expands the database name template for prefix
+func (l DatabaseLayout) Names(prefix string) []string {
+	name := l.Name
+	if !strings.Contains(name, PrefixPlaceholder) {
+		name = PrefixPlaceholder + "_" + name
+	}
+	return expand(name, l.Count, PrefixPlaceholder, prefix)
+}
+
+// WriteWeight returns the write weight of the table, 1 when unset
+func (l TableLayout) WriteWeight() float64 {
+	if l.Weight == nil {
+		return 1
+	}
+	return *l.Weight
+}
+
+// Names expands the table name template for the plugin's table prefix
+func (l TableLayout) Names(tablePrefix string) []string {
+	name := l.Name
+	if name == "" {
+		name = TablePrefixPlaceholder
+	}
+	return expand(name, l.Count, TablePrefixPlaceholder, tablePrefix)
+}
+
+// TableCount returns how many tables dbs generates: one per copy, the tables of the extra databases and those
+// of every layout database
+func (dbs DBConfig) TableCount() int {
+	n := max(dbs.Copies, 0)
+	for _, extra := range dbs.Extra {
+		n += max(extra.Tables, 0)
+	}
+	for _, db := range dbs.Layout {
+		tables := 0
+		for _, table := range db.Tables {
+			tables += max(table.Count, 1)
+		}
+		n += max(db.Count, 1) * tables
+	}
+	return n
+}
+
+// expand fills in placeholder and numbers count copies of template. Several copies without {n} are
+// numbered with an _n suffix, like the tables of extra databases.
+func expand(template string, count int, placeholder, value string) []string {
+	template = strings.ReplaceAll(template, placeholder, value)
+	if count <= 0 {
+		return []string{strings.ReplaceAll(template, NumberPlaceholder, "1")}
+	}
+	if count > 1 && !strings.Contains(template, NumberPlaceholder) {
+		template += "_" + NumberPlaceholder
+	}
+	names := make([]string, count)
+	for i := range names {
+		names[i] = strings.ReplaceAll(template, NumberPlaceholder, strconv.Itoa(i+1))
+	}
+	return names
+}
+
+// validateLayout checks the layout databases render to valid, unique names that do not collide with copies
+// and extra. Table names are checked with a stand-in for the plugin's table prefix, which is not known yet.
+func validateLayout(p *problems, dbs DBConfig) {
+	seen := make(map[string]bool)
+	for i := 1; i <= dbs.Copies; i++ {
+		seen[fmt.Sprintf("%s%d", dbs.Prefix, i)] = true
+	}
+	for name := range dbs.Extra {
+		seen[fmt.Sprintf("%s_%s", dbs.Prefix, name)] = true
+	}
+
+	for i, db := range dbs.Layout {
+		path := fmt.Sprintf("databases.layout[%d]", i)
+		if db.Count < 0 {
+			p.add(path+".count", "must not be negative")
+		}
+		for _, dbName := range db.Names(dbs.Prefix) {
+			if !strings.HasPrefix(dbName, dbs.Prefix+"_") {
+				p.add(path+".name", "database %s must start with %s_, put %s at the start of the name", dbName, dbs.Prefix, PrefixPlaceholder)
+			} else if !validName(dbName) {
+				p.add(path+".name", "database %s is not a valid identifier of at most %d characters", dbName, ident.MaxLength)
+			} else if seen[dbName] {
+				p.add(path+".name", "database %s is generated more than once", dbName)
+			}
+			seen[dbName] = true
+		}
+		if len(db.Tables) == 0 {
+			p.add(path+".tables", "must list at least one table")
+		}
+
+		tables := make(map[string]bool)
+		for j, table := range db.Tables {
+			tablePath := fmt.Sprintf("%s.tables[%d]", path, j)
+			if table.Count < 0 {
+				p.add(tablePath+".count", "must not be negative")
+			}
+			if table.Statement != "" && !slices.Contains(Statements, table.Statement) {
+				p.add(tablePath+".statement", "unknown statement %s, use one of %s", table.Statement, strings.Join(Statements, ", "))
+			}
+			if table.Weight != nil && *table.Weight <= 0 {
+				p.add(tablePath+".weight", "must be positive, leave it out for the default")
+			}
+			for _, option := range []struct{ key, value string }{{"engine", table.Engine}, {"charset", table.Charset}, {"collation", table.Collation}} {
+				if option.value != "" && !optionName.MatchString(option.value) {
+					p.add(tablePath+"."+option.key, "%q is not a valid name", option.value)
+				}
+			}
+			for _, tableName := range table.Names("t") {
+				if !validName(tableName) {
+					p.add(tablePath+".name", "table %s is not a valid identifier of at most %d characters", tableName, ident.MaxLength)
+				} else if tables[tableName] {
+					p.add(tablePath+".name", "table %s is listed more than once", tableName)
+				}
+				tables[tableName] = true
+			}
+		}
+	}
+}
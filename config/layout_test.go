@@ -0,0 +1,53 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLayoutNames(t *testing.T) {
+	assert.Equal(t, []string{"auto_orders"}, DatabaseLayout{Name: "orders"}.Names("auto"))
+	assert.Equal(t, []string{"auto_shard_1", "auto_shard_2"}, DatabaseLayout{Name: "{prefix}_shard_{n}", Count: 2}.Names("auto"))
+	assert.Equal(t, []string{"flights"}, TableLayout{}.Names("flights"))
+	assert.Equal(t, []string{"flights_archive_1", "flights_archive_2"}, TableLayout{Name: "{table_prefix}_archive", Count: 2}.Names("flights"))
+}
+
+func TestValidateDatabasesLayout(t *testing.T) {
+	heavy, zero, negative := 10.0, 0.0, -1.0
+	cfg := MainConfig{Databases: DBConfig{Prefix: "auto", Layout: []DatabaseLayout{{
+		Name:   "orders",
+		Tables: []TableLayout{{Name: "hot", Engine: "InnoDB", Charset: "utf8mb4", Weight: &heavy}, {Name: "cold_{n}", Count: 3}},
+	}}}}
+	assert.NoError(t, ValidateDatabases(&cfg), "A layout replaces copies")
+	assert.Equal(t, StatementInsert, cfg.Databases.Statement)
+	assert.Equal(t, 1, cfg.Databases.RowsPerStatement)
+	assert.Equal(t, 4, cfg.Databases.InitWorkers)
+
+	cfg = MainConfig{Databases: DBConfig{Prefix: "vols-aériens", Copies: 2, Layout: []DatabaseLayout{
+		{Name: "order", Tables: []TableLayout{{Name: "select"}, {Name: "航班-{n}", Count: 2}}},
+	}}}
+	assert.NoError(t, ValidateDatabases(&cfg), "Reserved words, hyphens and unicode are quoted")
+
+	cfg = MainConfig{Databases: DBConfig{Prefix: "auto", Copies: 1, Extra: map[string]struct {
+		Tables int `yaml:"tables"`
+	}{"foo": {Tables: 1}}, RowsPerStatement: MaxRowsPerStatement + 1, Layout: []DatabaseLayout{
+		{Name: "foo", Tables: []TableLayout{{}}},
+		{Name: "x{prefix}", Tables: []TableLayout{{}}},
+		{Name: "bar", Tables: []TableLayout{{Name: "t"}, {Name: "t", Engine: "In noDB", Weight: &negative, Statement: "upsert_all"}}},
+		{Name: "empty"},
+		{Name: "dot.ted", Tables: []TableLayout{{Name: "emoji_🛫", Weight: &zero}}},
+	}}}
+	err := ValidateDatabases(&cfg)
+	assert.ErrorContains(t, err, "databases.layout[0].name: database auto_foo is generated more than once")
+	assert.ErrorContains(t, err, "databases.layout[1].name: database xauto must start with auto_")
+	assert.ErrorContains(t, err, "databases.layout[2].tables[1].name: table t is listed more than once")
+	assert.ErrorContains(t, err, `databases.layout[2].tables[1].engine: "In noDB" is not a valid name`)
+	assert.ErrorContains(t, err, "databases.layout[2].tables[1].weight: must be positive, leave it out for the default")
+	assert.ErrorContains(t, err, "databases.layout[2].tables[1].statement: unknown statement upsert_all")
+	assert.ErrorContains(t, err, "databases.layout[3].tables: must list at least one table")
+	assert.ErrorContains(t, err, "databases.layout[4].name: database auto_dot.ted is not a valid identifier")
+	assert.ErrorContains(t, err, "databases.layout[4].tables[0].name: table emoji_🛫 is not a valid identifier")
+	assert.ErrorContains(t, err, "databases.layout[4].tables[0].weight: must be positive, leave it out for the default")
+	assert.ErrorContains(t, err, "databases.rows_per_statement: must be between 1 and 1000, got 1001")
+}
@@ -0,0 +1,278 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Every config key can be set outside the config file. A key is the dotted path of yaml names, e.g.
+// mysql.host or write_errors.backoff.max. Precedence is flags > environment > file > defaults.
+//
+//	environment  INGESTOR_MYSQL_HOST=db1
+//	flag         --mysql.host=db1 or --mysql.host db1, --mysql.interpolate_params alone for true
+//
+// Values are parsed as YAML, so lists and sections can be given in flow style
+// (--targets='[{name: a, mysql: {host: db1}}]'). Lists of strings also accept a comma separated value.
+// Keys inside the free form plugin_spec.config can only be reached with flags, e.g.
+// --plugin_spec.config.interval=30: an environment name cannot tell the _ inside a plugin key from a dot, so
+// the environment can only replace plugin_spec.config as a whole (INGESTOR_PLUGIN_SPEC_CONFIG='{interval: 30}').
+
+// EnvPrefix starts the name of every environment override
+const EnvPrefix = "INGESTOR_"
+
+// ConfigFileEnv and ConfigFileFlag select the config file itself rather than a key inside it
+const (
+	ConfigFileEnv  = EnvPrefix + "CONFIG"
+	ConfigFileFlag = "config"
+)
+
+// Overrides are config values given outside the config file, keyed by config key
+type Overrides map[string]string
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// Keys lists every config key that can be overridden, in declaration order
+func Keys() []string {
+	var keys []string
+	collectKeys(reflect.TypeOf(MainConfig{}), "", &keys)
+	return keys
+}
+
+func collectKeys(t reflect.Type, path string, keys *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		key := joinPath(path, fieldName(field))
+		if field.Type.Kind() == reflect.Struct && field.Type != durationType {
+			collectKeys(field.Type, key, keys)
+			continue
+		}
+		*keys = append(*keys, key)
+	}
+}
+
+// EnvName is the environment variable that overrides key
+func EnvName(key string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(key, ".", "_"))
+}
+
+// EnvOverrides picks the INGESTOR_ variables out of environ, as returned by os.Environ. Variables that name
+// no config key are returned in ignored rather than failing, other software sets INGESTOR_ variables too:
+// Kubernetes adds INGESTOR_SERVICE_HOST, INGESTOR_PORT and others for a Service named ingestor.
+func EnvOverrides(environ []string) (overrides Overrides, ignored []string) {
+	byEnv := make(map[string]string)
+	for _, key := range Keys() {
+		byEnv[EnvName(key)] = key
+	}
+
+	overrides = make(Overrides)
+	for _, entry := range environ {
+		name, value, _ := strings.Cut(entry, "=")
+		if !strings.HasPrefix(name, EnvPrefix) || name == ConfigFileEnv {
+			continue
+		}
+		key, ok := byEnv[name]
+		if !ok {
+			ignored = append(ignored, name)
+			continue
+		}
+		overrides[key] = value
+	}
+	return overrides, ignored
+}
+
+// ParseFlags reads --key=value and --key value flags from the start of args. A boolean key given alone, as
+// in --mysql.interpolate_params, is set to true. Other keys only take the next argument as their value when
+// it is not itself a flag, so values starting with - need --key=value. It stops at the first argument that is
+// not a flag, or after --, and returns the remaining arguments. The config file flag is returned under
+// ConfigFileFlag. -h and --help return flag.ErrHelp.
+func ParseFlags(args []string) (Overrides, []string, error) {
+	overrides := make(Overrides)
+	keys := Keys()
+	for len(args) > 0 {
+		arg := args[0]
+		if arg == "--" {
+			return overrides, args[1:], nil
+		}
+		if !strings.HasPrefix(arg, "-") {
+			break
+		}
+		key, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if key == "h" || key == "help" {
+			return nil, nil, flag.ErrHelp
+		}
+		if key != ConfigFileFlag && !slices.Contains(keys, key) && !isMapKey(keys, key) {
+			return nil, nil, fmt.Errorf("unknown config flag --%s", key)
+		}
+		args = args[1:]
+		if !hasValue {
+			switch {
+			case isBoolKey(key):
+				value = "true"
+			case len(args) == 0 || strings.HasPrefix(args[0], "-"):
+				return nil, nil, fmt.Errorf("flag --%s needs a value, give it as --%s=<value>", key, key)
+			default:
+				value, args = args[0], args[1:]
+			}
+		}
+		overrides[key] = value
+	}
+	return overrides, args, nil
+}
+
+// isBoolKey reports whether key is a boolean config key
+func isBoolKey(key string) bool {
+	t := reflect.TypeOf(MainConfig{})
+	for _, name := range strings.Split(key, ".") {
+		if t.Kind() != reflect.Struct {
+			return false
+		}
+		field, ok := fieldByName(t, name)
+		if !ok {
+			return false
+		}
+		t = field.Type
+	}
+	return t.Kind() == reflect.Bool
+}
+
+func fieldByName(t reflect.Type, name string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		if field := t.Field(i); field.IsExported() && fieldName(field) == name {
+			return field, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// Usage describes the override flags and environment variables
+func Usage() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Flags override environment variables, which override the config file.\n\n")
+	fmt.Fprintf(&b, "  --%-45s %s\n", ConfigFileFlag+"=<path>", ConfigFileEnv)
+	for _, key := range Keys() {
+		fmt.Fprintf(&b, "  --%-45s %s\n", key+"=<value>", EnvName(key))
+	}
+	return b.String()
+}
+
+// isMapKey reports whether key points inside a map valued config key such as plugin_spec.config
+func isMapKey(keys []string, key string) bool {
+	return slices.ContainsFunc(keys, func(k string) bool { return strings.HasPrefix(key, k+".") })
+}
+
+// ApplyOverrides sets every override on config. Keys of the config file itself are skipped.
+func ApplyOverrides(config *MainConfig, overrides Overrides) error {
+	keys := make([]string, 0, len(overrides))
+	for key := range overrides {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys) // Sections before the keys inside them
+	for _, key := range keys {
+		if key == ConfigFileFlag {
+			continue
+		}
+		if err := applyOverride(reflect.ValueOf(config).Elem(), strings.Split(key, "."), overrides[key]); err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+func applyOverride(v reflect.Value, path []string, value string) error {
+	if len(path) == 0 {
+		return setValue(v, value)
+	}
+	switch v.Kind() {
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			if field.IsExported() && fieldName(field) == path[0] {
+				return applyOverride(v.Field(i), path[1:], value)
+			}
+		}
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			break
+		}
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+		key := reflect.ValueOf(path[0]).Convert(v.Type().Key())
+		inner := reflect.New(v.Type().Elem()).Elem()
+		if existing := v.MapIndex(key); existing.IsValid() {
+			inner.Set(existing)
+		}
+		if inner.Kind() == reflect.Interface && len(path) > 1 {
+			// Nested plugin config sections decode as map[string]interface{}
+			nested, ok := inner.Interface().(map[string]interface{})
+			if !ok {
+				nested = make(map[string]interface{})
+			}
+			if err := setNested(nested, path[1:], value); err != nil {
+				return err
+			}
+			inner.Set(reflect.ValueOf(nested))
+		} else if err := applyOverride(inner, path[1:], value); err != nil {
+			return err
+		}
+		v.SetMapIndex(key, inner)
+		return nil
+	}
+	return fmt.Errorf("unknown config key")
+}
+
+func setNested(m map[string]interface{}, path []string, value string) error {
+	if len(path) == 1 {
+		var decoded interface{}
+		if err := yaml.Unmarshal([]byte(value), &decoded); err != nil {
+			return err
+		}
+		m[path[0]] = decoded
+		return nil
+	}
+	nested, ok := m[path[0]].(map[string]interface{})
+	if !ok {
+		nested = make(map[string]interface{})
+		m[path[0]] = nested
+	}
+	return setNested(nested, path[1:], value)
+}
+
+// setValue parses value into v. Strings are taken literally, lists of strings may be comma separated,
+// everything else is decoded as YAML.
+func setValue(v reflect.Value, value string) error {
+	switch {
+	case v.Kind() == reflect.String:
+		v.SetString(value)
+		return nil
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.String && !strings.HasPrefix(strings.TrimSpace(value), "["):
+		parts := strings.Split(value, ",")
+		list := reflect.MakeSlice(v.Type(), 0, len(parts))
+		for _, part := range parts {
+			if part = strings.TrimSpace(part); part != "" {
+				list = reflect.Append(list, reflect.ValueOf(part).Convert(v.Type().Elem()))
+			}
+		}
+		v.Set(list)
+		return nil
+	}
+	target := reflect.New(v.Type())
+	decoder := yaml.NewDecoder(strings.NewReader(value))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(target.Interface()); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("invalid value %q: %w", value, err)
+	}
+	v.Set(target.Elem())
+	return nil
+}
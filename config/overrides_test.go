@@ -0,0 +1,87 @@
+package config
+
+import (
+	"flag"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestKeys tests that nested sections are flattened into dotted keys
+func TestKeys(t *testing.T) {
+	keys := Keys()
+	assert.Contains(t, keys, "mysql.host")
+	assert.Contains(t, keys, "mysql.connection_pool.max_open_conns")
+	assert.Contains(t, keys, "write_errors.backoff.max")
+	assert.Contains(t, keys, "targets", "Lists are overridden as a whole")
+	assert.NotContains(t, keys, "mysql", "Sections are not keys themselves")
+	assert.Equal(t, "INGESTOR_WRITE_ERRORS_BACKOFF_MAX", EnvName("write_errors.backoff.max"))
+}
+
+// TestEnvOverrides tests the mapping of INGESTOR_ variables to config keys
+func TestEnvOverrides(t *testing.T) {
+	overrides, ignored := EnvOverrides([]string{"PATH=/bin", "INGESTOR_MYSQL_HOST=db1", "INGESTOR_CONFIG=/etc/ingestor.yaml"})
+	assert.Equal(t, Overrides{"mysql.host": "db1"}, overrides)
+	assert.Empty(t, ignored)
+
+	// Kubernetes sets these for a Service named ingestor, they must not stop the ingestor from starting
+	overrides, ignored = EnvOverrides([]string{"INGESTOR_SERVICE_HOST=10.0.0.1", "INGESTOR_PORT=tcp://10.0.0.1:8080",
+		"INGESTOR_PORT_8080_TCP_ADDR=10.0.0.1", "INGESTOR_MYSQL_HOTS=db1", "INGESTOR_MYSQL_PORT=3307"})
+	assert.Equal(t, Overrides{"mysql.port": "3307"}, overrides)
+	assert.Equal(t, []string{"INGESTOR_SERVICE_HOST", "INGESTOR_PORT", "INGESTOR_PORT_8080_TCP_ADDR", "INGESTOR_MYSQL_HOTS"}, ignored)
+}
+
+// TestParseFlags tests both flag forms and where flag parsing stops
+func TestParseFlags(t *testing.T) {
+	overrides, rest, err := ParseFlags([]string{"--mysql.host=db1", "--mysql.port", "3307", "--plugin_spec.config.interval=30", "verify", "--extra"})
+	assert.NoError(t, err)
+	assert.Equal(t, Overrides{"mysql.host": "db1", "mysql.port": "3307", "plugin_spec.config.interval": "30"}, overrides)
+	assert.Equal(t, []string{"verify", "--extra"}, rest)
+
+	overrides, rest, err = ParseFlags([]string{"--mysql.interpolate_params", "--mysql.tls_config.insecure_skip_verify=false", "run"})
+	assert.NoError(t, err)
+	assert.Equal(t, Overrides{"mysql.interpolate_params": "true", "mysql.tls_config.insecure_skip_verify": "false"}, overrides,
+		"A boolean flag given alone should not take the next argument")
+	assert.Equal(t, []string{"run"}, rest)
+
+	_, _, err = ParseFlags([]string{"--mysql.host", "--mysql.port=3307"})
+	assert.ErrorContains(t, err, "flag --mysql.host needs a value")
+
+	_, _, err = ParseFlags([]string{"--mysql.hots=db1"})
+	assert.Error(t, err, "Unknown flags should be rejected")
+
+	_, _, err = ParseFlags([]string{"--help"})
+	assert.ErrorIs(t, err, flag.ErrHelp)
+}
+
+// TestApplyOverrides tests precedence and parsing of the different value types
+func TestApplyOverrides(t *testing.T) {
+	cfg := MainConfig{MySQL: MySQLConfig{Host: "file-host", Port: 3306}}
+	cfg.PluginSpec.Config = map[string]interface{}{"auth": map[string]interface{}{"user": "sky"}}
+
+	env := Overrides{"mysql.host": "env-host", "mysql.port": "3307", "mysql.hosts": "db1:3306, db2:3306"}
+	flags := Overrides{
+		"mysql.host":                           "flag-host",
+		"spool.replay_interval":                "10s",
+		"plugin_spec.config.auth.pass":         "secret",
+		"targets":                              "[{name: a, mysql: {host: db-a}}]",
+		"write_errors.policies":                "{deadlock: halt}",
+		"mysql.connection_pool.max_idle_conns": "7",
+	}
+	assert.NoError(t, ApplyOverrides(&cfg, env))
+	assert.NoError(t, ApplyOverrides(&cfg, flags))
+
+	assert.Equal(t, "flag-host", cfg.MySQL.Host, "Flags should win over the environment")
+	assert.Equal(t, 3307, cfg.MySQL.Port)
+	assert.Equal(t, []string{"db1:3306", "db2:3306"}, cfg.MySQL.Hosts)
+	assert.Equal(t, 10*time.Second, cfg.Spool.ReplayInterval)
+	assert.Equal(t, 7, cfg.MySQL.ConnectionPool.MaxIdleConns)
+	assert.Equal(t, "db-a", cfg.Targets[0].MySQL.Host)
+	assert.Equal(t, "halt", cfg.WriteErrors.Policies["deadlock"])
+	auth := cfg.PluginSpec.Config["auth"].(map[string]interface{})
+	assert.Equal(t, "sky", auth["user"], "Plugin config keys that are not overridden should be kept")
+	assert.Equal(t, "secret", auth["pass"])
+
+	assert.Error(t, ApplyOverrides(&cfg, Overrides{"mysql.port": "not-a-port"}))
+}
@@ -0,0 +1,119 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Problem is one thing wrong with the config, located by its key path and, when it came from the file,
+// its line
+type Problem struct {
+	Path    string
+	Line    int
+	Message string
+}
+
+func (p Problem) String() string {
+	if p.Line > 0 {
+		return fmt.Sprintf("%s (line %d): %s", p.Path, p.Line, p.Message)
+	}
+	return fmt.Sprintf("%s: %s", p.Path, p.Message)
+}
+
+// ValidationError reports every problem found in a config at once
+type ValidationError struct {
+	Problems []Problem
+}
+
+func (e *ValidationError) Error() string {
+	lines := make([]string, len(e.Problems))
+	for i, p := range e.Problems {
+		lines[i] = p.String()
+	}
+	return fmt.Sprintf("%d config problem(s):\n  %s", len(e.Problems), strings.Join(lines, "\n  "))
+}
+
+// problems collects the findings of a validation pass
+type problems []Problem
+
+func (p *problems) add(path, format string, args ...interface{}) {
+	*p = append(*p, Problem{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+// merge adds the problems of a validator that returned an error
+func (p *problems) merge(err error) {
+	if err == nil {
+		return
+	}
+	if verr, ok := err.(*ValidationError); ok {
+		*p = append(*p, verr.Problems...)
+		return
+	}
+	*p = append(*p, Problem{Message: err.Error()})
+}
+
+func (p problems) err() error {
+	if len(p) == 0 {
+		return nil
+	}
+	return &ValidationError{Problems: p}
+}
+
+// locate fills in the line of each problem from the parsed file. Keys that are not in the file, because
+// they were left to their default or set by an override, report the line of their closest parent.
+func (e *ValidationError) locate(root *yaml.Node) {
+	for i := range e.Problems {
+		e.Problems[i].Line = lineOf(root, e.Problems[i].Path)
+	}
+}
+
+func lineOf(root *yaml.Node, path string) int {
+	node := root
+	if node == nil {
+		return 0
+	}
+	if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+	line := 0
+	for _, part := range splitPath(path) {
+		next := child(node, part)
+		if next == nil {
+			break
+		}
+		line = next.Line
+		node = next
+	}
+	return line
+}
+
+// splitPath turns a.b[2].c into a, b, 2, c
+func splitPath(path string) []string {
+	path = strings.NewReplacer("[", ".", "]", "").Replace(path)
+	if path == "" {
+		return nil
+	}
+	return strings.Split(path, ".")
+}
+
+func child(node *yaml.Node, key string) *yaml.Node {
+	switch node.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i].Value == key {
+				// Point at the key rather than the value, a nested section starts on the next line
+				value := *node.Content[i+1]
+				value.Line = node.Content[i].Line
+				return &value
+			}
+		}
+	case yaml.SequenceNode:
+		if i, err := strconv.Atoi(key); err == nil && i >= 0 && i < len(node.Content) {
+			return node.Content[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,203 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Secret references can appear in any string value of the config file:
+//
+//	${env:NAME}          the value of environment variable NAME
+//	${exec:helper args}  the trimmed stdout of a credential helper, run without a shell
+//	file:/path           the contents of a file, such as a Docker or Kubernetes secret (whole value only)
+//
+// env and exec references may be embedded in a longer string.
+var secretRef = regexp.MustCompile(`\$\{(env|exec):([^}]*)\}`)
+
+const (
+	filePrefix    = "file:"
+	execTimeout   = 10 * time.Second
+	redactedValue = "******"
+)
+
+// sensitiveKeys are redacted from config dumps even when they hold a literal value
+var sensitiveKeys = []string{"password", "pass", "secret", "token", "api_key"}
+
+// ResolveSecrets replaces the secret references in every string of config, including the free form plugin
+// config. Resolved values are remembered so Redacted can hide them.
+func ResolveSecrets(config *MainConfig) error {
+	return resolveValue(reflect.ValueOf(config).Elem(), "", &config.secrets)
+}
+
+func resolveValue(v reflect.Value, path string, secrets *[]string) error {
+	switch v.Kind() {
+	case reflect.String:
+		resolved, isSecret, err := resolveString(v.String())
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if isSecret {
+			v.SetString(resolved)
+			*secrets = append(*secrets, resolved)
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if !v.Type().Field(i).IsExported() {
+				continue
+			}
+			if err := resolveValue(v.Field(i), joinPath(path, fieldName(v.Type().Field(i))), secrets); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if err := resolveValue(v.Index(i), fmt.Sprintf("%s[%d]", path, i), secrets); err != nil {
+				return err
+			}
+		}
+	case reflect.Ptr:
+		if !v.IsNil() {
+			return resolveValue(v.Elem(), path, secrets)
+		}
+	case reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		// Values behind an interface are not addressable, resolve a copy and put it back
+		inner := reflect.New(v.Elem().Type()).Elem()
+		inner.Set(v.Elem())
+		if err := resolveValue(inner, path, secrets); err != nil {
+			return err
+		}
+		v.Set(inner)
+	case reflect.Map:
+		for _, key := range v.MapKeys() {
+			inner := reflect.New(v.Type().Elem()).Elem()
+			inner.Set(v.MapIndex(key))
+			if err := resolveValue(inner, joinPath(path, fmt.Sprint(key.Interface())), secrets); err != nil {
+				return err
+			}
+			v.SetMapIndex(key, inner)
+		}
+	}
+	return nil
+}
+
+// resolveString returns value with its references resolved, and whether it contained any
+func resolveString(value string) (string, bool, error) {
+	if strings.HasPrefix(value, filePrefix) {
+		path := strings.TrimPrefix(value, filePrefix)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", false, fmt.Errorf("failed to read secret file %s: %w", path, err)
+		}
+		return strings.TrimRight(string(data), "\r\n"), true, nil
+	}
+	if !secretRef.MatchString(value) {
+		return value, false, nil
+	}
+
+	var resolveErr error
+	resolved := secretRef.ReplaceAllStringFunc(value, func(ref string) string {
+		match := secretRef.FindStringSubmatch(ref)
+		var out string
+		var err error
+		switch match[1] {
+		case "env":
+			var ok bool
+			out, ok = os.LookupEnv(match[2])
+			if !ok {
+				err = fmt.Errorf("environment variable %s is not set", match[2])
+			}
+		case "exec":
+			out, err = runHelper(match[2])
+		}
+		if err != nil && resolveErr == nil {
+			resolveErr = err
+		}
+		return out
+	})
+	return resolved, true, resolveErr
+}
+
+// runHelper runs a credential helper and returns its output without the trailing newline
+func runHelper(command string) (string, error) {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return "", fmt.Errorf("empty exec reference")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), execTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("credential helper %s failed: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimRight(string(out), "\r\n"), nil
+}
+
+// Redacted returns the config as YAML with resolved secrets and sensitive keys masked, for logging
+func (config MainConfig) Redacted() string {
+	data, err := yaml.Marshal(config)
+	if err != nil {
+		return fmt.Sprintf("<failed to encode config: %v>", err)
+	}
+	var tree interface{}
+	if err := yaml.Unmarshal(data, &tree); err != nil {
+		return fmt.Sprintf("<failed to encode config: %v>", err)
+	}
+	data, err = yaml.Marshal(redact(tree, "", config.secrets))
+	if err != nil {
+		return fmt.Sprintf("<failed to encode config: %v>", err)
+	}
+	return string(data)
+}
+
+func redact(node interface{}, key string, secrets []string) interface{} {
+	switch n := node.(type) {
+	case map[string]interface{}:
+		for k, v := range n {
+			n[k] = redact(v, k, secrets)
+		}
+		return n
+	case []interface{}:
+		for i, v := range n {
+			n[i] = redact(v, key, secrets)
+		}
+		return n
+	case string:
+		if n != "" && (slices.Contains(sensitiveKeys, strings.ToLower(key)) || slices.Contains(secrets, n)) {
+			return redactedValue
+		}
+		return n
+	default:
+		return n
+	}
+}
+
+// fieldName is the yaml key of a struct field, used in error paths
+func fieldName(field reflect.StructField) string {
+	if name, _, _ := strings.Cut(field.Tag.Get("yaml"), ","); name != "" {
+		return name
+	}
+	return strings.ToLower(field.Name)
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
@@ -0,0 +1,65 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestResolveSecrets tests env, file and exec references, including inside the plugin config
+func TestResolveSecrets(t *testing.T) {
+	t.Setenv("TEST_MYSQL_PASSWORD", "from-env")
+	secretFile := filepath.Join(t.TempDir(), "mysql_user")
+	if err := os.WriteFile(secretFile, []byte("from-file\n"), 0o600); err != nil {
+		t.Fatalf("Failed to write secret file: %v", err)
+	}
+
+	cfg := MainConfig{
+		MySQL: MySQLConfig{
+			User:     "file:" + secretFile,
+			Password: "${env:TEST_MYSQL_PASSWORD}",
+			Host:     "db-${exec:echo 1}.internal",
+		},
+	}
+	cfg.PluginSpec.Config = map[string]interface{}{
+		"auth": map[string]interface{}{"user": "sky", "pass": "${env:TEST_MYSQL_PASSWORD}"},
+	}
+
+	assert.NoError(t, ResolveSecrets(&cfg))
+	assert.Equal(t, "from-file", cfg.MySQL.User)
+	assert.Equal(t, "from-env", cfg.MySQL.Password)
+	assert.Equal(t, "db-1.internal", cfg.MySQL.Host, "References can be embedded in a longer value")
+	assert.Equal(t, "from-env", cfg.PluginSpec.Config["auth"].(map[string]interface{})["pass"])
+	assert.Equal(t, "sky", cfg.PluginSpec.Config["auth"].(map[string]interface{})["user"])
+}
+
+// TestResolveSecretsErrors tests that missing references fail with the config path
+func TestResolveSecretsErrors(t *testing.T) {
+	cfg := MainConfig{MySQL: MySQLConfig{Password: "${env:TEST_SECRET_THAT_IS_NOT_SET}"}}
+	err := ResolveSecrets(&cfg)
+	assert.ErrorContains(t, err, "mysql.password")
+
+	cfg = MainConfig{MySQL: MySQLConfig{Password: "file:/nonexistent/secret"}}
+	assert.Error(t, ResolveSecrets(&cfg))
+
+	cfg = MainConfig{MySQL: MySQLConfig{Password: "${exec:false}"}}
+	assert.Error(t, ResolveSecrets(&cfg), "A failing credential helper should be reported")
+}
+
+// TestRedacted tests that resolved secrets and sensitive keys are masked in config dumps
+func TestRedacted(t *testing.T) {
+	t.Setenv("TEST_MYSQL_USER", "secret-user")
+	cfg := MainConfig{MySQL: MySQLConfig{User: "${env:TEST_MYSQL_USER}", Password: "literal-password", Host: "localhost"}}
+	cfg.PluginSpec.Config = map[string]interface{}{"auth": map[string]interface{}{"pass": "sky-pass"}}
+	assert.NoError(t, ResolveSecrets(&cfg))
+
+	dump := cfg.Redacted()
+	for _, secret := range []string{"secret-user", "literal-password", "sky-pass"} {
+		assert.False(t, strings.Contains(dump, secret), "%s should be redacted", secret)
+	}
+	assert.Contains(t, dump, "localhost")
+	assert.Equal(t, "literal-password", cfg.MySQL.Password, "Redacting should not change the config")
+}
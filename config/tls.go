@@ -0,0 +1,75 @@
+package config
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+)
+
+// TLS modes, named after the MySQL client --ssl-mode values
+const (
+	TLSDisabled       = "disabled"        // plain connections
+	TLSPreferred      = "preferred"       // encrypt when the server supports it, without verifying it
+	TLSRequired       = "required"        // always encrypt, without verifying the server
+	TLSVerifyCA       = "verify-ca"       // always encrypt and check the server certificate against the CA
+	TLSVerifyIdentity = "verify-identity" // verify-ca and check the certificate matches the host name
+)
+
+// TLSModes are the accepted values of tls_config.mode
+var TLSModes = []string{TLSDisabled, TLSPreferred, TLSRequired, TLSVerifyCA, TLSVerifyIdentity}
+
+// EffectiveMode is the mode the connection uses. Without an explicit mode, configs that only set files
+// keep the full verification they always had and configs without any TLS settings stay plain.
+func (t TLSConfig) EffectiveMode() string {
+	switch {
+	case t.Mode != "":
+		return t.Mode
+	case t.InsecureSkipVerify:
+		return TLSRequired
+	case t.CAFile != "" || t.CertFile != "" || t.KeyFile != "":
+		return TLSVerifyIdentity
+	default:
+		return TLSDisabled
+	}
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// ParseTLSVersion turns "1.2" (or "TLS1.2", "TLSv1.2") into its crypto/tls constant. Empty means the
+// crypto/tls default and returns 0.
+func ParseTLSVersion(version string) (uint16, error) {
+	if version == "" {
+		return 0, nil
+	}
+	trimmed := strings.TrimPrefix(strings.TrimPrefix(strings.ToUpper(version), "TLS"), "V")
+	if v, ok := tlsVersions[trimmed]; ok {
+		return v, nil
+	}
+	return 0, fmt.Errorf("unknown TLS version %q, use 1.0, 1.1, 1.2 or 1.3", version)
+}
+
+// ParseCipherSuites turns cipher suite names as listed by crypto/tls, e.g.
+// TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, into their ids. An empty list means the crypto/tls defaults.
+func ParseCipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	known := make(map[string]uint16)
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		known[suite.Name] = suite.ID
+	}
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, ok := known[strings.ToUpper(strings.TrimSpace(name))]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
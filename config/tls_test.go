@@ -0,0 +1,48 @@
+package config
+
+import (
+	"crypto/tls"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestParseTLSVersion tests the accepted spellings of TLS versions
+func TestParseTLSVersion(t *testing.T) {
+	for version, want := range map[string]uint16{"": 0, "1.2": tls.VersionTLS12, "TLS1.3": tls.VersionTLS13, "tlsv1.1": tls.VersionTLS11} {
+		got, err := ParseTLSVersion(version)
+		assert.NoError(t, err, version)
+		assert.Equal(t, want, got, version)
+	}
+	_, err := ParseTLSVersion("1.4")
+	assert.Error(t, err)
+}
+
+// TestParseCipherSuites tests cipher suite names are turned into ids
+func TestParseCipherSuites(t *testing.T) {
+	ids, err := ParseCipherSuites([]string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", "tls_rsa_with_aes_128_cbc_sha"})
+	assert.NoError(t, err)
+	assert.Equal(t, []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, tls.TLS_RSA_WITH_AES_128_CBC_SHA}, ids)
+
+	_, err = ParseCipherSuites([]string{"TLS_MADE_UP"})
+	assert.Error(t, err)
+}
+
+// TestEffectiveMode tests the mode used when none is configured
+func TestEffectiveMode(t *testing.T) {
+	assert.Equal(t, TLSDisabled, TLSConfig{}.EffectiveMode())
+	assert.Equal(t, TLSVerifyIdentity, TLSConfig{CAFile: "ca.pem"}.EffectiveMode())
+	assert.Equal(t, TLSRequired, TLSConfig{CAFile: "ca.pem", InsecureSkipVerify: true}.EffectiveMode())
+	assert.Equal(t, TLSVerifyCA, TLSConfig{Mode: TLSVerifyCA}.EffectiveMode())
+}
+
+// TestValidateServersTLS tests TLS settings are checked with the server they belong to
+func TestValidateServersTLS(t *testing.T) {
+	cfg := MainConfig{MySQL: MySQLConfig{User: "u", Host: "db", Port: 3306, TLSConfig: TLSConfig{
+		Mode: "verify-full", MinVersion: "1.3", MaxVersion: "1.2", CipherSuites: []string{"RC4"},
+	}}}
+	err := ValidateServers(&cfg)
+	assert.ErrorContains(t, err, "mysql.tls_config.mode")
+	assert.ErrorContains(t, err, "mysql.tls_config.min_version: is above max_version")
+	assert.ErrorContains(t, err, "mysql.tls_config.cipher_suites")
+}
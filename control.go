@@ -0,0 +1,233 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"mysql_public_data_ingestor/admin"
+)
+
+// Pause holds a running loop without stopping it. The zero value is running.
+type Pause struct {
+	mu      sync.Mutex
+	resumed chan struct{} // closed on resume, nil while running
+}
+
+func (p *Pause) Set(paused bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch {
+	case paused && p.resumed == nil:
+		p.resumed = make(chan struct{})
+	case !paused && p.resumed != nil:
+		close(p.resumed)
+		p.resumed = nil
+	}
+}
+
+func (p *Pause) Paused() bool {
+	return p.Resumed() != nil
+}
+
+// Resumed returns a channel closed once the pause ends, or nil when not paused
+func (p *Pause) Resumed() <-chan struct{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.resumed
+}
+
+// TableControl lets the admin API pause a table worker and see its last write error. It also holds the
+// table's write share, which a config reload can change while the worker runs.
+type TableControl struct {
+	Pause
+
+	share atomic.Uint64 // float64 bits of the fraction of each batch written, 0 means 1
+
+	mu        sync.Mutex
+	lastError error
+	errorTime time.Time
+}
+
+// resumed is Resumed for a worker that may have no control
+func (c *TableControl) resumed() <-chan struct{} {
+	if c == nil {
+		return nil
+	}
+	return c.Resumed()
+}
+
+// SetShare sets the fraction of each batch the table writes, see database.WriteShares
+func (c *TableControl) SetShare(share float64) {
+	c.share.Store(math.Float64bits(share))
+}
+
+// Share is the fraction of each batch the table writes, 1 for a worker without control
+func (c *TableControl) Share() float64 {
+	if c == nil {
+		return 1
+	}
+	if share := math.Float64frombits(c.share.Load()); share > 0 {
+		return share
+	}
+	return 1
+}
+
+func (c *TableControl) setError(err error) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lastError = err
+	c.errorTime = time.Now().UTC()
+}
+
+// LastError returns the most recent write error of the table and when it happened
+func (c *TableControl) LastError() (error, time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lastError, c.errorTime
+}
+
+// FetchControl lets the admin API steer the fetch loop: pause it, trigger a fetch and scale its rate
+type FetchControl struct {
+	Pause
+
+	now  chan struct{}
+	rate atomic.Uint64 // float64 bits of the rate multiplier, 0 means 1
+
+	mu        sync.Mutex
+	lastFetch time.Time
+	lastError error
+}
+
+func NewFetchControl() *FetchControl {
+	return &FetchControl{now: make(chan struct{}, 1)}
+}
+
+// FetchNow makes the fetch loop fetch at once, even while paused
+func (c *FetchControl) FetchNow() {
+	select {
+	case c.now <- struct{}{}:
+	default: // A fetch is already pending
+	}
+}
+
+// SetRate scales the fetch rate on top of the workload profile, 2 fetches twice as often
+func (c *FetchControl) SetRate(multiplier float64) {
+	c.rate.Store(math.Float64bits(multiplier))
+}
+
+func (c *FetchControl) Rate() float64 {
+	if c == nil {
+		return 1
+	}
+	if rate := math.Float64frombits(c.rate.Load()); rate > 0 {
+		return rate
+	}
+	return 1
+}
+
+// wait sleeps for interval scaled by the rate and for as long as the loop is paused. It returns early when
+// a fetch is triggered and false when stop is closed.
+func (c *FetchControl) wait(interval time.Duration, stop <-chan struct{}) bool {
+	if c == nil {
+		select {
+		case <-time.After(interval):
+			return true
+		case <-stop:
+			return false
+		}
+	}
+
+	timer := time.NewTimer(time.Duration(float64(interval) / c.Rate()))
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			resumed := c.Resumed()
+			if resumed == nil {
+				return true
+			}
+			select {
+			case <-resumed:
+				return true
+			case <-c.now:
+				return true
+			case <-stop:
+				return false
+			}
+		case <-c.now:
+			return true
+		case <-stop:
+			return false
+		}
+	}
+}
+
+func (c *FetchControl) fetched(err error) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lastFetch = time.Now().UTC()
+	c.lastError = err
+}
+
+// LastFetch returns when the last fetch finished and its error
+func (c *FetchControl) LastFetch() (time.Time, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lastFetch, c.lastError
+}
+
+// pipelineControl exposes the fetch loop and the table workers to the admin API
+type pipelineControl struct {
+	fetch  *FetchControl
+	tables *TableQueues
+}
+
+func (c pipelineControl) State() admin.State {
+	state := admin.State{Fetch: admin.FetchState{Paused: c.fetch.Paused(), Rate: c.fetch.Rate()}}
+	if lastFetch, err := c.fetch.LastFetch(); !lastFetch.IsZero() {
+		state.Fetch.LastFetch = &lastFetch
+		if err != nil {
+			state.Fetch.LastError = err.Error()
+		}
+	}
+
+	queues := c.tables.Snapshot()
+	for _, name := range c.tables.Names() {
+		q, ok := queues[name]
+		control, found := c.tables.Control(name)
+		if !ok || !found {
+			continue // Removed by a reload in the meantime
+		}
+		table := admin.TableState{Name: name, QueueDepth: q.Len(), Share: control.Share(), Paused: control.Paused()}
+		if err, at := control.LastError(); err != nil {
+			table.LastError = err.Error()
+			table.LastErrorTime = &at
+		}
+		state.Tables = append(state.Tables, table)
+	}
+	return state
+}
+
+func (c pipelineControl) SetFetchPaused(paused bool) {
+	c.fetch.Set(paused)
+}
+
+func (c pipelineControl) FetchNow() {
+	c.fetch.FetchNow()
+}
+
+func (c pipelineControl) SetFetchRate(multiplier float64) {
+	c.fetch.SetRate(multiplier)
+}
+
+func (c pipelineControl) SetTablePaused(table string, paused bool) error {
+	return c.tables.SetPaused(table, paused)
+}
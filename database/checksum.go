@@ -0,0 +1,34 @@
+package database
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"mysql_public_data_ingestor/ident"
+)
+
+// BatchColumn tags every row with the id of the batch that wrote it when auditing is enabled
+const BatchColumn = "_batch_id"
+
+// ChecksumQuery selects the row count and an order independent checksum of the rows of dbName.tableName
+// matching where. Rows are folded with BIT_XOR(CRC32(...)) the way pt-table-checksum does, so only two
+// numbers cross the network. Columns are sorted first so every caller hashes them in the same order.
+func ChecksumQuery(dbName, tableName string, columns []string, where string) string {
+	columns = slices.Clone(columns)
+	slices.Sort(columns)
+	nulls := make([]string, len(columns))
+	for i, column := range columns {
+		nulls[i] = fmt.Sprintf("ISNULL(%s)", ident.Quote(column))
+	}
+	return fmt.Sprintf(
+		"SELECT COUNT(*), COALESCE(BIT_XOR(CRC32(CONCAT_WS('#', %s, CONCAT(%s)))), 0) FROM %s WHERE %s",
+		ident.List(columns), strings.Join(nulls, ", "), ident.Table(dbName, tableName), where,
+	)
+}
+
+// WithBatchColumn adds the batch id column and its index to a plugin schema
+func WithBatchColumn(schema string) string {
+	schema = strings.TrimSpace(schema)
+	return fmt.Sprintf("%s, %s BIGINT UNSIGNED NULL, KEY (%s))", strings.TrimSuffix(schema, ")"), ident.Quote(BatchColumn), ident.Quote(BatchColumn))
+}
@@ -0,0 +1,16 @@
+package database
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChecksumQuery(t *testing.T) {
+	query := ChecksumQuery("auto_1", "flights", []string{"time", "icao24"}, "`time` >= ?")
+	assert.Equal(t, "SELECT COUNT(*), COALESCE(BIT_XOR(CRC32(CONCAT_WS('#', `icao24`, `time`, CONCAT(ISNULL(`icao24`), ISNULL(`time`))))), 0) FROM `auto_1`.`flights` WHERE `time` >= ?", query)
+}
+
+func TestWithBatchColumn(t *testing.T) {
+	assert.Equal(t, "(time INT, icao24 VARCHAR(10), `_batch_id` BIGINT UNSIGNED NULL, KEY (`_batch_id`))", WithBatchColumn("(time INT, icao24 VARCHAR(10))"))
+}
@@ -5,13 +5,16 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"database/sql"
+	"errors"
 	"fmt"
-	"log"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-sql-driver/mysql"
-	"mysql_public_data_ingestor/api_plugins"
 	"mysql_public_data_ingestor/config"
 	"mysql_public_data_ingestor/syslogwrapper"
 
@@ -20,153 +23,339 @@ import (
 
 type DBManagerInterface interface {
 	Conn(ctx context.Context) (*sql.Conn, error)
+	CheckPrimary() // Ask for the writable primary to be re-resolved after a connection or read-only error
 }
 
 type DBManager struct {
-	DSN    string
-	DBs    []string
-	Tables map[string][]string
-	DbPool *sql.DB
+	Name string // target name, used in logs and metrics
+	DSN  string
+
+	mu       sync.RWMutex
+	dbs      []string            // databases of the layout created last, replaced as a whole on reload
+	tables   map[string][]string // tables of each database in dbs
+	hosts    []string            // candidate servers as host:port, in order of preference
+	dsns     map[string]string   // per host DSN
+	pools    map[string]*sql.DB  // per host connection pool, opened lazily
+	primary  string              // host currently receiving writes
+	poolCfg  config.ConnectionPool
+	failover chan struct{}
+
+	rowAlias bool // the primary found at startup takes a row alias in INSERT
+
+	stop      chan struct{} // closed by Close to end the maintenance loops
+	closeOnce sync.Once
+	loops     sync.WaitGroup
 }
 
+// connectTimeout bounds the ping NewDBManager checks the primary with
+const connectTimeout = 10 * time.Second
+
 func (dbm *DBManager) Conn(ctx context.Context) (*sql.Conn, error) {
-	return dbm.DbPool.Conn(ctx)
+	return dbm.Pool().Conn(ctx)
+}
+
+// DatabaseNames returns the databases of the layout created last
+func (dbm *DBManager) DatabaseNames() []string {
+	dbm.mu.RLock()
+	defer dbm.mu.RUnlock()
+	return dbm.dbs
+}
+
+// TableNames returns the tables of dbName in the layout created last
+func (dbm *DBManager) TableNames(dbName string) []string {
+	dbm.mu.RLock()
+	defer dbm.mu.RUnlock()
+	return dbm.tables[dbName]
+}
+
+// Pool returns the connection pool of the current writable primary
+func (dbm *DBManager) Pool() *sql.DB {
+	dbm.mu.RLock()
+	defer dbm.mu.RUnlock()
+	return dbm.pools[dbm.primary]
 }
 
 // NewDBManager initializes DBManager with the provided MySQL configuration and creates a new connection pool.
-func NewDBManager(mysqlConfig config.MySQLConfig) *DBManager {
-	dsn := fmt.Sprintf("%s:%s@tcp(%s:%d)/%s?tls=%s",
-		mysqlConfig.User, mysqlConfig.Password,
-		mysqlConfig.Host, mysqlConfig.Port,
-		mysqlConfig.DBName, setupTLSConfig(mysqlConfig.TLSConfig),
-	)
-
-	conn, err := sql.Open("mysql", dsn)
+// When several hosts are configured the first writable one becomes the primary.
+func NewDBManager(mysqlConfig config.MySQLConfig) (*DBManager, error) {
+	hosts := mysqlConfig.Hosts
+	if len(hosts) == 0 {
+		hosts = []string{fmt.Sprintf("%s:%d", mysqlConfig.Host, mysqlConfig.Port)}
+	}
+	tlsParams, err := setupTLSConfig(mysqlConfig.TLSConfig)
 	if err != nil {
-		log.Fatalf("Failed to connect to MySQL: %v", err)
+		return nil, err
 	}
 
-	// Apply connection pool settings directly
-	conn.SetMaxOpenConns(mysqlConfig.ConnectionPool.MaxOpenConns)
-	conn.SetMaxIdleConns(mysqlConfig.ConnectionPool.MaxIdleConns)
-	conn.SetConnMaxLifetime(time.Duration(mysqlConfig.ConnectionPool.ConnMaxLifetime) * time.Second)
-
-	return &DBManager{
-		DSN:    dsn,
-		DbPool: conn,
+	dbm := &DBManager{
+		Name:     "default",
+		hosts:    hosts,
+		dsns:     make(map[string]string, len(hosts)),
+		pools:    make(map[string]*sql.DB, len(hosts)),
+		poolCfg:  mysqlConfig.ConnectionPool,
+		failover: make(chan struct{}, 1),
+		stop:     make(chan struct{}),
 	}
-}
-
-func setupTLSConfig(tlsConfig config.TLSConfig) string {
-	if tlsConfig.CAFile == "" && tlsConfig.CertFile == "" && tlsConfig.KeyFile == "" {
-		return "false"
+	params := tlsParams + "&parseTime=true"
+	if mysqlConfig.InterpolateParams {
+		params += "&interpolateParams=true"
+	}
+	for _, host := range hosts {
+		dbm.dsns[host] = fmt.Sprintf("%s:%s@tcp(%s)/%s?%s",
+			mysqlConfig.User, mysqlConfig.Password,
+			host,
+			mysqlConfig.DBName, params,
+		)
 	}
 
-	rootCertPool := x509.NewCertPool()
-	if tlsConfig.CAFile != "" {
-		pem, err := os.ReadFile(tlsConfig.CAFile)
-		if err != nil {
-			log.Fatalf("Failed to read CA file: %v", err)
-		}
-		if ok := rootCertPool.AppendCertsFromPEM(pem); !ok {
-			log.Fatalf("Failed to append CA certificates")
+	primary := hosts[0]
+	if len(hosts) > 1 {
+		if writable, err := dbm.findPrimary(context.Background()); err == nil {
+			primary = writable
 		}
 	}
+	db, err := dbm.pool(primary)
+	if err == nil {
+		// sql.Open only checks the DSN, the ping is what reaches the server
+		ctx, cancel := context.WithTimeout(context.Background(), connectTimeout)
+		err = db.PingContext(ctx)
+		cancel()
+	}
+	if err != nil {
+		dbm.Close()
+		return nil, fmt.Errorf("failed to connect to MySQL: %w", err)
+	}
+	dbm.primary = primary
+	dbm.DSN = dbm.dsns[primary]
+	var version string
+	if err := db.QueryRow("SELECT VERSION()").Scan(&version); err == nil {
+		dbm.rowAlias = SupportsRowAlias(version)
+	}
+
+	return dbm, nil
+}
+
+// RowAlias reports whether the server takes a row alias in INSERT, see SupportsRowAlias
+func (dbm *DBManager) RowAlias() bool {
+	return dbm.rowAlias
+}
 
-	clientCert := make([]tls.Certificate, 0, 1)
-	if tlsConfig.CertFile != "" && tlsConfig.KeyFile != "" {
-		certs, err := tls.LoadX509KeyPair(tlsConfig.CertFile, tlsConfig.KeyFile)
+// SupportsRowAlias reports whether a server of version, as SELECT VERSION() returns it, takes a row alias in
+// INSERT ... ON DUPLICATE KEY UPDATE. MySQL added it in 8.0.19 and deprecated VALUES() in 8.0.20; MariaDB has
+// no row alias.
+func SupportsRowAlias(version string) bool {
+	if strings.Contains(version, "MariaDB") {
+		return false
+	}
+	number, _, _ := strings.Cut(version, "-")
+	var parts [3]int
+	for i, part := range strings.SplitN(number, ".", 3) {
+		n, err := strconv.Atoi(part)
 		if err != nil {
-			log.Fatalf("Failed to load client certificate and key: %v", err)
+			return false
 		}
-		clientCert = append(clientCert, certs)
+		parts[i] = n
 	}
+	return parts[0] > 8 || parts[0] == 8 && (parts[1] > 0 || parts[2] >= 19)
+}
 
-	tlsConfigStruct := &tls.Config{
-		RootCAs:            rootCertPool,
-		Certificates:       clientCert,
-		InsecureSkipVerify: tlsConfig.InsecureSkipVerify,
-		ServerName:         tlsConfig.ServerName,
+// NewDBManagerFromPool wraps an already opened pool, for callers that manage the connection themselves
+func NewDBManagerFromPool(db *sql.DB) *DBManager {
+	return &DBManager{
+		Name:     "default",
+		hosts:    []string{"default"},
+		pools:    map[string]*sql.DB{"default": db},
+		primary:  "default",
+		failover: make(chan struct{}, 1),
+		stop:     make(chan struct{}),
 	}
+}
 
-	if tlsConfig.MinVersion != 0 {
-		tlsConfigStruct.MinVersion = tlsConfig.MinVersion
+// pool returns the connection pool for host, opening it on first use
+func (dbm *DBManager) pool(host string) (*sql.DB, error) {
+	dbm.mu.Lock()
+	defer dbm.mu.Unlock()
+	if db, ok := dbm.pools[host]; ok {
+		return db, nil
 	}
-	if tlsConfig.MaxVersion != 0 {
-		tlsConfigStruct.MaxVersion = tlsConfig.MaxVersion
+
+	conn, err := sql.Open("mysql", dbm.dsns[host])
+	if err != nil {
+		return nil, err
 	}
-	if tlsConfig.CipherSuites != nil && len(tlsConfig.CipherSuites) > 0 {
-		tlsConfigStruct.CipherSuites = tlsConfig.CipherSuites
-	} else {
-		tlsConfigStruct.CipherSuites = nil // Use default cipher suites
+
+	// Apply connection pool settings directly
+	conn.SetMaxOpenConns(dbm.poolCfg.MaxOpenConns)
+	conn.SetMaxIdleConns(dbm.poolCfg.MaxIdleConns)
+	conn.SetConnMaxLifetime(time.Duration(dbm.poolCfg.ConnMaxLifetime) * time.Second)
+
+	dbm.pools[host] = conn
+	return conn, nil
+}
+
+// StartMaintenance runs PingIdleConnections and WatchPrimary in the background until Close
+func (dbm *DBManager) StartMaintenance(sysLog syslogwrapper.SyslogWrapperInterface, failoverInterval time.Duration) {
+	dbm.loops.Add(2)
+	go func() {
+		defer dbm.loops.Done()
+		dbm.PingIdleConnections(sysLog)
+	}()
+	go func() {
+		defer dbm.loops.Done()
+		dbm.WatchPrimary(sysLog, failoverInterval)
+	}()
+}
+
+// Close stops the maintenance loops, waits for them to return and closes every pool. Later calls do nothing.
+func (dbm *DBManager) Close() error {
+	var errs []error
+	dbm.closeOnce.Do(func() {
+		close(dbm.stop)
+		dbm.loops.Wait()
+
+		dbm.mu.Lock()
+		defer dbm.mu.Unlock()
+		for host, db := range dbm.pools {
+			if err := db.Close(); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", host, err))
+			}
+		}
+	})
+	return errors.Join(errs...)
+}
+
+// SetPoolConfig changes the limits of every open pool and of those opened later
+func (dbm *DBManager) SetPoolConfig(poolCfg config.ConnectionPool) {
+	dbm.mu.Lock()
+	defer dbm.mu.Unlock()
+	dbm.poolCfg = poolCfg
+	for _, conn := range dbm.pools {
+		conn.SetMaxOpenConns(poolCfg.MaxOpenConns)
+		conn.SetMaxIdleConns(poolCfg.MaxIdleConns)
+		conn.SetConnMaxLifetime(time.Duration(poolCfg.ConnMaxLifetime) * time.Second)
 	}
-	if tlsConfig.ClientAuth != 0 {
-		tlsConfigStruct.ClientAuth = tls.ClientAuthType(tlsConfig.ClientAuth)
+}
+
+// tlsConfigs numbers the TLS configurations registered with the driver
+var tlsConfigs atomic.Int64
+
+// setupTLSConfig registers the TLS settings with the driver and returns the DSN parameters that select them.
+// Each call registers its own name so servers with different settings do not overwrite each other.
+func setupTLSConfig(tlsConfig config.TLSConfig) (string, error) {
+	mode := tlsConfig.EffectiveMode()
+	if mode == config.TLSDisabled {
+		return "tls=false", nil
 	}
 
-	err := mysql.RegisterTLSConfig("custom", tlsConfigStruct)
+	tlsConfigStruct, err := buildTLSConfig(tlsConfig, mode)
 	if err != nil {
-		log.Fatalf("Failed to register custom TLS configuration: %v", err)
+		return "", err
+	}
+	name := fmt.Sprintf("ingestor_%d", tlsConfigs.Add(1))
+	err = mysql.RegisterTLSConfig(name, tlsConfigStruct)
+	if err != nil {
+		return "", fmt.Errorf("failed to register TLS configuration: %w", err)
 	}
 
-	return "custom"
+	params := "tls=" + name
+	if mode == config.TLSPreferred {
+		params += "&allowFallbackToPlaintext=true"
+	}
+	return params, nil
 }
 
-func (dbm *DBManager) InitializeDatabases(cfg config.MainConfig, sysLog syslogwrapper.SyslogWrapperInterface, apiPlugin api_plugins.APIPlugin) {
-	db := dbm.DbPool
-
-	dbm.Tables = make(map[string][]string)
+// buildTLSConfig turns the TLS settings into a crypto/tls config following the MySQL client --ssl-mode semantics
+func buildTLSConfig(tlsConfig config.TLSConfig, mode string) (*tls.Config, error) {
+	tlsConfigStruct := &tls.Config{
+		ServerName: tlsConfig.ServerName, // the driver fills in the host when empty
+	}
 
-	for i := 1; i <= cfg.Databases.Copies; i++ {
-		dbName := fmt.Sprintf("%s%d", cfg.Databases.Prefix, i)
-		dbm.DBs = append(dbm.DBs, dbName)
-		dbm.createDatabase(db, dbName, sysLog)
-		tableName := apiPlugin.TablePrefix()
-		dbm.createTable(db, dbName, tableName, sysLog, apiPlugin.Schema())
-		dbm.Tables[dbName] = append(dbm.Tables[dbName], tableName)
+	if tlsConfig.CAFile != "" {
+		pem, err := os.ReadFile(tlsConfig.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %w", err)
+		}
+		rootCertPool := x509.NewCertPool()
+		if ok := rootCertPool.AppendCertsFromPEM(pem); !ok {
+			return nil, fmt.Errorf("no certificates found in CA file %s", tlsConfig.CAFile)
+		}
+		tlsConfigStruct.RootCAs = rootCertPool
 	}
 
-	for extraDB, dbConfig := range cfg.Databases.Extra {
-		dbName := fmt.Sprintf("%s_%s", cfg.Databases.Prefix, extraDB)
-		dbm.DBs = append(dbm.DBs, dbName)
-		dbm.createDatabase(db, dbName, sysLog)
-		for j := 1; j <= dbConfig.Tables; j++ {
-			tableName := fmt.Sprintf("%s_%d", apiPlugin.TablePrefix(), j)
-			dbm.createTable(db, dbName, tableName, sysLog, apiPlugin.Schema())
-			dbm.Tables[dbName] = append(dbm.Tables[dbName], tableName)
+	if tlsConfig.CertFile != "" || tlsConfig.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(tlsConfig.CertFile, tlsConfig.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate and key: %w", err)
 		}
+		tlsConfigStruct.Certificates = []tls.Certificate{cert}
 	}
-}
 
-func (dbm *DBManager) createDatabase(db *sql.DB, dbName string, sysLog syslogwrapper.SyslogWrapperInterface) {
-	query := fmt.Sprintf("CREATE DATABASE IF NOT EXISTS `%s`", dbName)
-	_, err := db.Exec(query)
+	var err error
+	tlsConfigStruct.MinVersion, err = config.ParseTLSVersion(tlsConfig.MinVersion)
 	if err != nil {
-		sysLog.Warning(fmt.Sprintf("Failed to create database %s: %v", dbName, err))
+		return nil, err
 	}
-}
-
-func (dbm *DBManager) createTable(db *sql.DB, dbName, tableName string, sysLog syslogwrapper.SyslogWrapperInterface, schema string) {
-	_, err := db.Exec(fmt.Sprintf("USE %s", dbName))
+	tlsConfigStruct.MaxVersion, err = config.ParseTLSVersion(tlsConfig.MaxVersion)
 	if err != nil {
-		sysLog.Warning(fmt.Sprintf("Failed to use database %s: %v", dbName, err))
-		return
+		return nil, err
 	}
-
-	createTableQuery := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s %s", tableName, schema)
-	_, err = db.Exec(createTableQuery)
+	tlsConfigStruct.CipherSuites, err = config.ParseCipherSuites(tlsConfig.CipherSuites)
 	if err != nil {
-		sysLog.Warning(fmt.Sprintf("Failed to create table %s in database %s: %v", tableName, dbName, err))
+		return nil, err
+	}
+
+	switch mode {
+	case config.TLSPreferred, config.TLSRequired:
+		tlsConfigStruct.InsecureSkipVerify = true
+	case config.TLSVerifyCA:
+		// crypto/tls can only check the chain and the host name together, so the chain is checked here instead
+		tlsConfigStruct.InsecureSkipVerify = true
+		tlsConfigStruct.VerifyPeerCertificate = verifyChain(tlsConfigStruct.RootCAs)
+	case config.TLSVerifyIdentity:
+	default:
+		return nil, fmt.Errorf("unknown TLS mode %q", mode)
+	}
+	return tlsConfigStruct, nil
+}
+
+// verifyChain checks the server certificate was issued by roots, or the system roots when nil, without
+// looking at the host name
+func verifyChain(roots *x509.CertPool) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return fmt.Errorf("server sent no certificate")
+		}
+		certs := make([]*x509.Certificate, len(rawCerts))
+		for i, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return fmt.Errorf("failed to parse server certificate: %w", err)
+			}
+			certs[i] = cert
+		}
+		intermediates := x509.NewCertPool()
+		for _, cert := range certs[1:] {
+			intermediates.AddCert(cert)
+		}
+		_, err := certs[0].Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates})
+		return err
 	}
 }
 
-// PingIdleConnections pings all idle connections in the pool to keep them healthy
+// PingIdleConnections pings all idle connections in the pool to keep them healthy, until Close
 func (dbm *DBManager) PingIdleConnections(sysLog syslogwrapper.SyslogWrapperInterface) {
+	ticker := time.NewTicker(1 * time.Minute)
+	defer ticker.Stop()
 	for {
-		time.Sleep(1 * time.Minute)
-		idleConns := dbm.DbPool.Stats().Idle
+		select {
+		case <-ticker.C:
+		case <-dbm.stop:
+			return
+		}
+		pool := dbm.Pool()
+		idleConns := pool.Stats().Idle
 		for i := 0; i < idleConns; i++ {
-			conn, err := dbm.DbPool.Conn(context.Background())
+			conn, err := pool.Conn(context.Background())
 			if err != nil {
 				sysLog.Warning(fmt.Sprintf("Failed to get connection from pool: %v", err))
 				continue
@@ -1,10 +1,25 @@
 package database
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	_ "database/sql"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
 	"github.com/DATA-DOG/go-sqlmock"
+	"math/big"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
@@ -87,45 +102,35 @@ func (m *MockAPIPlugin) Name() string {
 	return args.String(0)
 }
 
+// TestInitializeDatabases tests every statement names its database, so databases can be created concurrently
+// on any pooled connection, and that the report lists each object in layout order
 func TestInitializeDatabases(t *testing.T) {
-	// Setup mock database connection
 	db, mockDB, err := sqlmock.New()
 	if err != nil {
 		t.Fatalf("Error creating mock DB: %v", err)
 	}
-	// TODO: mockDB closing too soon
-	//defer func() {
-	//	if err := db.Close(); err != nil {
-	//		t.Fatalf("Error closing mock DB: %v", err)
-	//	}
-	//}()
-
-	// Setup expectations
-	// TODO: ExpectExec now working for Database and table commands
-	//mockDB.ExpectExec("CREATE DATABASE IF NOT EXISTS test_prefix1").WillReturnResult(sqlmock.NewResult(1, 1))
-	//mockDB.ExpectExec("CREATE TABLE IF NOT EXISTS test_table_prefix (id INT PRIMARY KEY)").WillReturnResult(sqlmock.NewResult(1, 1))
-	//mockDB.ExpectExec("CREATE DATABASE IF NOT EXISTS test_prefix2").WillReturnResult(sqlmock.NewResult(1, 1))
-	//mockDB.ExpectExec("CREATE DATABASE IF NOT EXISTS test_prefix_extra1").WillReturnResult(sqlmock.NewResult(1, 1))
-	//mockDB.ExpectExec("CREATE TABLE IF NOT EXISTS test_table_prefix_1 (id INT PRIMARY KEY)").WillReturnResult(sqlmock.NewResult(1, 1))
-	//mockDB.ExpectExec("CREATE TABLE IF NOT EXISTS test_table_prefix_2 (id INT PRIMARY KEY)").WillReturnResult(sqlmock.NewResult(1, 1))
-	//mockDB.ExpectExec("CREATE TABLE IF NOT EXISTS test_table_prefix_3 (id INT PRIMARY KEY)").WillReturnResult(sqlmock.NewResult(1, 1))
+	defer db.Close()
+	mockDB.MatchExpectationsInOrder(false)
+
+	mockDB.ExpectExec(regexp.QuoteMeta("CREATE DATABASE IF NOT EXISTS `test_prefix1`")).WillReturnResult(sqlmock.NewResult(0, 1))
+	mockDB.ExpectExec(regexp.QuoteMeta("CREATE TABLE IF NOT EXISTS `test_prefix1`.`_ingestor`")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mockDB.ExpectExec(regexp.QuoteMeta("CREATE TABLE IF NOT EXISTS `test_prefix1`.`test_table_prefix` (id INT PRIMARY KEY)")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mockDB.ExpectExec(regexp.QuoteMeta("CREATE DATABASE IF NOT EXISTS `test_prefix2`")).WillReturnError(errors.New("access denied"))
+	mockDB.ExpectExec(regexp.QuoteMeta("CREATE DATABASE IF NOT EXISTS `test_prefix_extra1`")).WillReturnResult(sqlmock.NewResult(0, 1))
+	mockDB.ExpectExec(regexp.QuoteMeta("CREATE TABLE IF NOT EXISTS `test_prefix_extra1`.`_ingestor`")).WillReturnResult(sqlmock.NewResult(0, 0))
+	for i := 1; i <= 3; i++ {
+		mockDB.ExpectExec(regexp.QuoteMeta(fmt.Sprintf("CREATE TABLE IF NOT EXISTS `test_prefix_extra1`.`test_table_prefix_%d` (id INT PRIMARY KEY)", i))).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+	}
 
 	// Mock syslog
 	mockSyslog := new(MockSyslogWrapper)
 	mockSyslog.On("Error", mock.Anything).Return()
-	mockSyslog.On("Warning", mock.Anything).Return()
 
 	// Mock APIPlugin
 	mockAPIPlugin := new(MockAPIPlugin)
 	mockAPIPlugin.On("TablePrefix").Return("test_table_prefix")
 	mockAPIPlugin.On("Schema").Return("(id INT PRIMARY KEY)")
-	mockAPIPlugin.On("FetchData").Return(nil, nil)
-	mockAPIPlugin.On("ValidateConfig", mock.Anything).Return(nil)
-	mockAPIPlugin.On("Interval").Return(10, nil)
-	mockAPIPlugin.On("SetLogger", mock.Anything).Return()
-	mockAPIPlugin.On("GetFieldNames").Return([]string{"field1", "field2"})
-	mockAPIPlugin.On("GetValues", mock.Anything).Return([]interface{}{1, "value"})
-	mockAPIPlugin.On("Name").Return("test_plugin")
 
 	// Test config
 	cfg := config.MainConfig{
@@ -137,33 +142,182 @@ func TestInitializeDatabases(t *testing.T) {
 			}{
 				"extra1": {Tables: 3},
 			},
-			WriteWorkers: 5,
+			InitWorkers: 3,
 		},
 	}
 
-	// Create DBManager with mock configuration
-	dbManager := NewDBManager(config.MySQLConfig{
-		User:     "test_user",
-		Password: "test_password",
-		Host:     "localhost",
-		Port:     3306,
-		DBName:   "test_db",
-		TLS:      "true",
-	}, db)
-
-	// Call InitializeDatabases
-	dbManager.InitializeDatabases(cfg, mockSyslog, mockAPIPlugin)
+	// Create DBManager on top of the mock connection
+	dbManager := NewDBManagerFromPool(db)
+	report := dbManager.InitializeDatabases(cfg, mockSyslog, mockAPIPlugin)
 
 	// Validate results
-	assert.ElementsMatch(t, []string{"test_prefix1", "test_prefix2", "test_prefix_extra1"}, dbManager.DBs)
-	assert.Contains(t, dbManager.Tables, "test_prefix1")
-	assert.Contains(t, dbManager.Tables, "test_prefix_extra1")
-	assert.Equal(t, []string{"test_table_prefix"}, dbManager.Tables["test_prefix1"])
-	assert.Equal(t, []string{"test_table_prefix_1", "test_table_prefix_2", "test_table_prefix_3"}, dbManager.Tables["test_prefix_extra1"])
+	assert.ElementsMatch(t, []string{"test_prefix1", "test_prefix2", "test_prefix_extra1"}, dbManager.DatabaseNames())
+	assert.Equal(t, []string{"test_table_prefix"}, dbManager.TableNames("test_prefix1"))
+	assert.Equal(t, []string{"test_table_prefix_1", "test_table_prefix_2", "test_table_prefix_3"}, dbManager.TableNames("test_prefix_extra1"))
+
+	names := make([]string, len(report))
+	for i, result := range report {
+		names[i] = result.Kind + " " + result.Name
+	}
+	assert.Equal(t, []string{
+		"database test_prefix1", "table test_prefix1.test_table_prefix",
+		"database test_prefix2", "table test_prefix2.test_table_prefix",
+		"database test_prefix_extra1", "table test_prefix_extra1.test_table_prefix_1",
+		"table test_prefix_extra1.test_table_prefix_2", "table test_prefix_extra1.test_table_prefix_3",
+	}, names)
+	assert.Equal(t, InitReport{
+		{Kind: ObjectDatabase, Name: "test_prefix2", Err: errors.New("access denied")},
+		{Kind: ObjectTable, Name: "test_prefix2.test_table_prefix", Err: errDatabaseMissing},
+	}, report.Failed())
+	assert.EqualError(t, report.Err(), "database test_prefix2: access denied\n"+
+		"table test_prefix2.test_table_prefix: skipped, the database could not be created")
+	mockSyslog.AssertNumberOfCalls(t, "Error", 2)
 
 	// Ensure all expectations were met
 	if err := mockDB.ExpectationsWereMet(); err != nil {
 		t.Errorf("There were unmet expectations: %v", err)
 	}
+}
+
+// TestInitializeDatabasesAudited tests the batch column is added to tables created before auditing was enabled
+func TestInitializeDatabasesAudited(t *testing.T) {
+	db, mockDB, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error creating mock DB: %v", err)
+	}
+	defer db.Close()
+
+	mockDB.ExpectExec(regexp.QuoteMeta("CREATE DATABASE IF NOT EXISTS `p1`")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mockDB.ExpectExec(regexp.QuoteMeta("CREATE TABLE IF NOT EXISTS `p1`.`_ingestor`")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mockDB.ExpectExec(regexp.QuoteMeta("CREATE TABLE IF NOT EXISTS `p1`.`flights`")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mockDB.ExpectQuery("information_schema.COLUMNS").WithArgs("p1", "flights", BatchColumn).
+		WillReturnRows(sqlmock.NewRows([]string{"COUNT(*)"}).AddRow(0))
+	mockDB.ExpectExec(regexp.QuoteMeta("ALTER TABLE `p1`.`flights` ADD COLUMN `_batch_id` BIGINT UNSIGNED NULL, ADD KEY (`_batch_id`)")).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	mockAPIPlugin := new(MockAPIPlugin)
+	mockAPIPlugin.On("TablePrefix").Return("flights")
+	mockAPIPlugin.On("Schema").Return("(id INT PRIMARY KEY)")
+	cfg := config.MainConfig{Databases: config.DBConfig{Prefix: "p", Copies: 1}, Audit: config.AuditConfig{Sink: "table"}}
+
+	report := NewDBManagerFromPool(db).InitializeDatabases(cfg, new(MockSyslogWrapper), mockAPIPlugin)
+	assert.NoError(t, report.Err())
+	assert.Len(t, report, 2)
+	assert.NoError(t, mockDB.ExpectationsWereMet())
+}
+
+// writeCert creates a key and a certificate for host signed by parent, or self-signed when parent is nil,
+// and writes them as PEM files
+func writeCert(t *testing.T, dir, name, host string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IsCA:         parent == nil,
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
 
+		BasicConstraintsValid: true,
+	}
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent, parentKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatalf("Failed to write certificate: %v", err)
+	}
+	return cert, key, path
+}
+
+// TestBuildTLSConfig tests each mode verifies as much of the server as the MySQL client would
+func TestBuildTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey, caFile := writeCert(t, dir, "ca.pem", "test-ca", nil, nil)
+	server, _, _ := writeCert(t, dir, "server.pem", "db.internal", ca, caKey)
+	_, _, otherCAFile := writeCert(t, dir, "other-ca.pem", "other-ca", nil, nil)
+
+	required, err := buildTLSConfig(config.TLSConfig{MinVersion: "1.2"}, config.TLSRequired)
+	assert.NoError(t, err)
+	assert.True(t, required.InsecureSkipVerify)
+	assert.Equal(t, uint16(tls.VersionTLS12), required.MinVersion)
+
+	identity, err := buildTLSConfig(config.TLSConfig{CAFile: caFile}, config.TLSVerifyIdentity)
+	assert.NoError(t, err)
+	assert.False(t, identity.InsecureSkipVerify, "verify-identity should leave verification to crypto/tls")
+	assert.NotNil(t, identity.RootCAs)
+
+	verifyCA, err := buildTLSConfig(config.TLSConfig{CAFile: caFile}, config.TLSVerifyCA)
+	assert.NoError(t, err)
+	assert.NoError(t, verifyCA.VerifyPeerCertificate([][]byte{server.Raw}, nil), "verify-ca should accept a certificate for another host name")
+
+	otherCA, err := buildTLSConfig(config.TLSConfig{CAFile: otherCAFile}, config.TLSVerifyCA)
+	assert.NoError(t, err)
+	assert.Error(t, otherCA.VerifyPeerCertificate([][]byte{server.Raw}, nil), "verify-ca should reject certificates from another CA")
+
+	_, err = buildTLSConfig(config.TLSConfig{CAFile: filepath.Join(dir, "missing.pem")}, config.TLSVerifyCA)
+	assert.Error(t, err, "Unreadable CA files should be returned as errors")
+}
+
+// TestSetupTLSConfig tests the DSN parameters and that every config is registered under its own name
+func TestSetupTLSConfig(t *testing.T) {
+	params, err := setupTLSConfig(config.TLSConfig{})
+	assert.NoError(t, err)
+	assert.Equal(t, "tls=false", params)
+
+	first, err := setupTLSConfig(config.TLSConfig{Mode: config.TLSPreferred})
+	assert.NoError(t, err)
+	assert.Contains(t, first, "&allowFallbackToPlaintext=true")
+	second, err := setupTLSConfig(config.TLSConfig{Mode: config.TLSRequired})
+	assert.NoError(t, err)
+	assert.NotEqual(t, strings.Split(first, "&")[0], second)
+}
+
+// TestNewDBManagerUnreachable tests a server that cannot be reached fails at startup, not on the first write
+func TestNewDBManagerUnreachable(t *testing.T) {
+	_, err := NewDBManager(config.MySQLConfig{User: "ingestor", Host: "127.0.0.1", Port: 1})
+	assert.ErrorContains(t, err, "failed to connect to MySQL")
+}
+
+// TestCloseStopsMaintenance tests Close ends the maintenance loops and closes the pool
+func TestCloseStopsMaintenance(t *testing.T) {
+	db, mockDB, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error creating mock DB: %v", err)
+	}
+	mockDB.ExpectClose()
+
+	dbm := NewDBManagerFromPool(db)
+	dbm.StartMaintenance(new(MockSyslogWrapper), time.Second)
+	assert.NoError(t, dbm.Close())
+	assert.NoError(t, dbm.Close())
+	assert.NoError(t, mockDB.ExpectationsWereMet())
+}
+
+// TestSupportsRowAlias tests the row alias is only used on MySQL 8.0.19 and later
+func TestSupportsRowAlias(t *testing.T) {
+	for version, want := range map[string]bool{
+		"8.0.18":                       false,
+		"8.0.19":                       true,
+		"8.0.36-log":                   true,
+		"8.4.0":                        true,
+		"9.1.0-commercial":             true,
+		"5.7.44-log":                   false,
+		"10.11.6-MariaDB-0+deb12u1":    false,
+		"5.5.5-10.6.16-MariaDB-1:10.6": false,
+		"":                             false,
+	} {
+		assert.Equal(t, want, SupportsRowAlias(version), version)
+	}
 }
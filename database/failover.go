@@ -0,0 +1,122 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"mysql_public_data_ingestor/metrics"
+	"mysql_public_data_ingestor/syslogwrapper"
+)
+
+const erUnknownSystemVariable = 1193
+
+var (
+	failovers   = metrics.Map("mysql_failovers") // keyed by target name
+	primaryHost = metrics.Map("mysql_primary")
+)
+
+func (dbm *DBManager) setPrimaryMetric(host string) {
+	label := new(expvar.String)
+	label.Set(host)
+	primaryHost.Set(dbm.Name, label)
+}
+
+// CheckPrimary asks WatchPrimary to verify the primary right away instead of waiting for the next tick
+func (dbm *DBManager) CheckPrimary() {
+	select {
+	case dbm.failover <- struct{}{}:
+	default:
+	}
+}
+
+// WatchPrimary keeps the DBManager pointed at a writable server. It re-checks the primary every interval
+// and whenever CheckPrimary is called, switching to the first writable host when the current one is
+// unreachable or has become read-only. It returns on Close, or immediately when only one host is configured.
+func (dbm *DBManager) WatchPrimary(sysLog syslogwrapper.SyslogWrapperInterface, interval time.Duration) {
+	if len(dbm.hosts) < 2 {
+		return
+	}
+	dbm.setPrimaryMetric(dbm.currentPrimary())
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-dbm.failover:
+		case <-dbm.stop:
+			return
+		}
+
+		current := dbm.currentPrimary()
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		writable, err := dbm.isWritable(ctx, current)
+		if err == nil && writable {
+			cancel()
+			continue
+		}
+
+		next, err := dbm.findPrimary(ctx)
+		cancel()
+		if err != nil {
+			sysLog.Error(fmt.Sprintf("No writable MySQL primary found for target %s: %v", dbm.Name, err))
+			continue
+		}
+		if next != current {
+			dbm.mu.Lock()
+			dbm.primary = next
+			dbm.DSN = dbm.dsns[next]
+			dbm.mu.Unlock()
+			failovers.Add(dbm.Name, 1)
+			dbm.setPrimaryMetric(next)
+			sysLog.Warning(fmt.Sprintf("MySQL primary of target %s changed from %s to %s", dbm.Name, current, next))
+		}
+	}
+}
+
+func (dbm *DBManager) currentPrimary() string {
+	dbm.mu.RLock()
+	defer dbm.mu.RUnlock()
+	return dbm.primary
+}
+
+// findPrimary returns the first configured host that accepts writes
+func (dbm *DBManager) findPrimary(ctx context.Context) (string, error) {
+	var errs []error
+	for _, host := range dbm.hosts {
+		writable, err := dbm.isWritable(ctx, host)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", host, err))
+			continue
+		}
+		if writable {
+			return host, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: read only", host))
+	}
+	return "", errors.Join(errs...)
+}
+
+// isWritable reports whether host has both read_only and super_read_only disabled
+func (dbm *DBManager) isWritable(ctx context.Context, host string) (bool, error) {
+	db, err := dbm.pool(host)
+	if err != nil {
+		return false, err
+	}
+
+	var readOnly, superReadOnly bool
+	err = db.QueryRowContext(ctx, "SELECT @@global.read_only, @@global.super_read_only").Scan(&readOnly, &superReadOnly)
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) && mysqlErr.Number == erUnknownSystemVariable {
+		// Servers without super_read_only (MariaDB, MySQL < 5.7.8)
+		err = db.QueryRowContext(ctx, "SELECT @@global.read_only").Scan(&readOnly)
+	}
+	if err != nil {
+		return false, err
+	}
+	return !readOnly && !superReadOnly, nil
+}
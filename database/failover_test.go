@@ -0,0 +1,84 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-sql-driver/mysql"
+	"github.com/stretchr/testify/assert"
+)
+
+func newFailoverManager(t *testing.T, hosts ...string) (*DBManager, map[string]sqlmock.Sqlmock) {
+	dbm := &DBManager{
+		hosts:    hosts,
+		pools:    make(map[string]*sql.DB),
+		primary:  hosts[0],
+		failover: make(chan struct{}, 1),
+	}
+	mocks := make(map[string]sqlmock.Sqlmock)
+	for _, host := range hosts {
+		db, mockDB, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("Error creating mock DB: %v", err)
+		}
+		t.Cleanup(func() { db.Close() })
+		dbm.pools[host] = db
+		mocks[host] = mockDB
+	}
+	return dbm, mocks
+}
+
+func TestFindPrimary(t *testing.T) {
+	dbm, mocks := newFailoverManager(t, "db1:3306", "db2:3306", "db3:3306")
+
+	mocks["db1:3306"].ExpectQuery("SELECT @@global.read_only").WillReturnError(mysql.ErrInvalidConn)
+	mocks["db2:3306"].ExpectQuery("SELECT @@global.read_only").
+		WillReturnRows(sqlmock.NewRows([]string{"read_only", "super_read_only"}).AddRow(1, 1))
+	mocks["db3:3306"].ExpectQuery("SELECT @@global.read_only").
+		WillReturnRows(sqlmock.NewRows([]string{"read_only", "super_read_only"}).AddRow(0, 0))
+
+	primary, err := dbm.findPrimary(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "db3:3306", primary, "The first writable host should become the primary")
+
+	for host, mockDB := range mocks {
+		if err := mockDB.ExpectationsWereMet(); err != nil {
+			t.Errorf("There were unmet expectations on %s: %v", host, err)
+		}
+	}
+}
+
+func TestFindPrimaryNoneWritable(t *testing.T) {
+	dbm, mocks := newFailoverManager(t, "db1:3306", "db2:3306")
+
+	for _, mockDB := range mocks {
+		mockDB.ExpectQuery("SELECT @@global.read_only").
+			WillReturnRows(sqlmock.NewRows([]string{"read_only", "super_read_only"}).AddRow(1, 0))
+	}
+
+	_, err := dbm.findPrimary(context.Background())
+	assert.ErrorContains(t, err, "db1:3306: read only")
+	assert.ErrorContains(t, err, "db2:3306: read only")
+}
+
+func TestIsWritableWithoutSuperReadOnly(t *testing.T) {
+	dbm, mocks := newFailoverManager(t, "db1:3306")
+
+	mocks["db1:3306"].ExpectQuery("SELECT @@global.read_only, @@global.super_read_only").
+		WillReturnError(&mysql.MySQLError{Number: 1193, Message: "Unknown system variable 'super_read_only'"})
+	mocks["db1:3306"].ExpectQuery("SELECT @@global.read_only").
+		WillReturnRows(sqlmock.NewRows([]string{"read_only"}).AddRow(0))
+
+	writable, err := dbm.isWritable(context.Background(), "db1:3306")
+	assert.NoError(t, err)
+	assert.True(t, writable)
+}
+
+func TestCheckPrimaryDoesNotBlock(t *testing.T) {
+	dbm, _ := newFailoverManager(t, "db1:3306", "db2:3306")
+	dbm.CheckPrimary()
+	dbm.CheckPrimary() // A pending check is already queued, this one is dropped
+	assert.Len(t, dbm.failover, 1)
+}
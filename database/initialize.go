@@ -0,0 +1,154 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+
+	"mysql_public_data_ingestor/api_plugins"
+	"mysql_public_data_ingestor/config"
+	"mysql_public_data_ingestor/ident"
+	"mysql_public_data_ingestor/syslogwrapper"
+)
+
+// Kinds of object in an InitReport
+const (
+	ObjectDatabase = "database"
+	ObjectTable    = "table"
+)
+
+// errDatabaseMissing marks the tables of a database that could not be created
+var errDatabaseMissing = errors.New("skipped, the database could not be created")
+
+// ObjectResult is the outcome of creating one database or table
+type ObjectResult struct {
+	Kind string // ObjectDatabase or ObjectTable
+	Name string // the database, or database.table
+	Err  error  // nil when the object exists
+}
+
+// InitReport lists every database and table InitializeDatabases created, in layout order
+type InitReport []ObjectResult
+
+// Failed returns the objects that could not be created
+func (r InitReport) Failed() InitReport {
+	var failed InitReport
+	for _, result := range r {
+		if result.Err != nil {
+			failed = append(failed, result)
+		}
+	}
+	return failed
+}
+
+// Err joins the failures, nil when every object was created
+func (r InitReport) Err() error {
+	var errs []error
+	for _, result := range r.Failed() {
+		errs = append(errs, fmt.Errorf("%s %s: %w", result.Kind, result.Name, result.Err))
+	}
+	return errors.Join(errs...)
+}
+
+// SetLayout records the databases and tables of cfg as the ones dbm works with, without creating them
+func (dbm *DBManager) SetLayout(cfg config.MainConfig, tablePrefix string) {
+	dbs, tables := Layout(cfg, tablePrefix)
+	dbm.mu.Lock()
+	defer dbm.mu.Unlock()
+	dbm.dbs, dbm.tables = dbs, tables
+}
+
+// InitializeDatabases creates the databases and tables of cfg. Every statement names its database, so it
+// does not matter which pooled connection runs it. Up to databases.init_workers databases are created at
+// once, each followed by its tables. Failures are logged and listed in the report with everything else.
+func (dbm *DBManager) InitializeDatabases(cfg config.MainConfig, sysLog syslogwrapper.SyslogWrapperInterface, apiPlugin api_plugins.APIPlugin) InitReport {
+	db := dbm.Pool()
+
+	// Rebuilt from scratch so a reloaded config can also remove databases and tables
+	tables := Tables(cfg, apiPlugin.TablePrefix())
+	dbm.SetLayout(cfg, apiPlugin.TablePrefix())
+
+	var dbNames []string
+	byDatabase := make(map[string][]Table)
+	for _, table := range tables {
+		if _, ok := byDatabase[table.Database]; !ok {
+			dbNames = append(dbNames, table.Database)
+		}
+		byDatabase[table.Database] = append(byDatabase[table.Database], table)
+	}
+
+	// Each database reports into its own slot so the report keeps the layout order
+	reports := make([]InitReport, len(dbNames))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < min(max(cfg.Databases.InitWorkers, 1), len(dbNames)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				reports[j] = initializeDatabase(db, cfg, apiPlugin, dbNames[j], byDatabase[dbNames[j]])
+			}
+		}()
+	}
+	for i := range dbNames {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	var report InitReport
+	for _, r := range reports {
+		report = append(report, r...)
+	}
+	for _, result := range report.Failed() {
+		sysLog.Error(fmt.Sprintf("Failed to create %s %s on target %s: %v", result.Kind, result.Name, dbm.Name, result.Err))
+	}
+	return report
+}
+
+// initializeDatabase creates dbName with its marker table and then its tables, which are skipped when the database failed
+func initializeDatabase(db *sql.DB, cfg config.MainConfig, apiPlugin api_plugins.APIPlugin, dbName string, tables []Table) InitReport {
+	_, err := db.Exec("CREATE DATABASE IF NOT EXISTS " + ident.Quote(dbName))
+	if err == nil {
+		_, err = db.Exec(MarkerDDL(dbName))
+	}
+	report := InitReport{{Kind: ObjectDatabase, Name: dbName, Err: err}}
+	for _, table := range tables {
+		result := ObjectResult{Kind: ObjectTable, Name: table.Database + "." + table.Name, Err: errDatabaseMissing}
+		if err == nil {
+			result.Err = createTable(db, cfg, apiPlugin, table)
+		}
+		report = append(report, result)
+	}
+	return report
+}
+
+func createTable(db *sql.DB, cfg config.MainConfig, apiPlugin api_plugins.APIPlugin, table Table) error {
+	_, err := db.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s %s", ident.Table(table.Database, table.Name), TableSchema(cfg, apiPlugin, table)))
+	if err != nil || cfg.Audit.Sink == "" {
+		return err
+	}
+	return ensureBatchColumn(db, table.Database, table.Name)
+}
+
+// ensureBatchColumn adds the batch id column to tables created before auditing was enabled
+func ensureBatchColumn(db *sql.DB, dbName, tableName string) error {
+	var count int
+	err := db.QueryRow(
+		"SELECT COUNT(*) FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = ? AND TABLE_NAME = ? AND COLUMN_NAME = ?",
+		dbName, tableName, BatchColumn,
+	).Scan(&count)
+	if err != nil {
+		return fmt.Errorf("failed to check for %s: %w", BatchColumn, err)
+	}
+	if count > 0 {
+		return nil
+	}
+	batchColumn := ident.Quote(BatchColumn)
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s BIGINT UNSIGNED NULL, ADD KEY (%s)", ident.Table(dbName, tableName), batchColumn, batchColumn))
+	if err != nil {
+		return fmt.Errorf("failed to add %s: %w", BatchColumn, err)
+	}
+	return nil
+}
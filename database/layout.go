@@ -0,0 +1,171 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"mysql_public_data_ingestor/api_plugins"
+	"mysql_public_data_ingestor/config"
+	"mysql_public_data_ingestor/ident"
+)
+
+// Table is a generated table with its creation options and write weight
+type Table struct {
+	Database  string
+	Name      string
+	Engine    string
+	Charset   string
+	Collation string
+	Weight    float64 // relative share of the writes
+	Statement string  // how rows are written, one of config.Statements
+}
+
+// Tables returns every table cfg generates, in creation order. Copies are named prefix1..prefixN with one
+// table, extras prefix_name with tables numbered from 1, followed by the databases of databases.layout.
+func Tables(cfg config.MainConfig, tablePrefix string) []Table {
+	var tables []Table
+	for i := 1; i <= cfg.Databases.Copies; i++ {
+		tables = append(tables, Table{Database: fmt.Sprintf("%s%d", cfg.Databases.Prefix, i), Name: tablePrefix, Weight: 1, Statement: cfg.Databases.Statement})
+	}
+
+	extras := make([]string, 0, len(cfg.Databases.Extra))
+	for extraDB := range cfg.Databases.Extra {
+		extras = append(extras, extraDB)
+	}
+	sort.Strings(extras)
+	for _, extraDB := range extras {
+		dbName := fmt.Sprintf("%s_%s", cfg.Databases.Prefix, extraDB)
+		for j := 1; j <= cfg.Databases.Extra[extraDB].Tables; j++ {
+			tables = append(tables, Table{Database: dbName, Name: fmt.Sprintf("%s_%d", tablePrefix, j), Weight: 1, Statement: cfg.Databases.Statement})
+		}
+	}
+
+	for _, db := range cfg.Databases.Layout {
+		for _, dbName := range db.Names(cfg.Databases.Prefix) {
+			for _, tableLayout := range db.Tables {
+				statement := tableLayout.Statement
+				if statement == "" {
+					statement = cfg.Databases.Statement
+				}
+				for _, tableName := range tableLayout.Names(tablePrefix) {
+					tables = append(tables, Table{
+						Database:  dbName,
+						Name:      tableName,
+						Engine:    tableLayout.Engine,
+						Charset:   tableLayout.Charset,
+						Collation: tableLayout.Collation,
+						Weight:    tableLayout.WriteWeight(),
+						Statement: statement,
+					})
+				}
+			}
+		}
+	}
+	return tables
+}
+
+// Layout returns the databases cfg generates, in creation order, and the table names of each
+func Layout(cfg config.MainConfig, tablePrefix string) ([]string, map[string][]string) {
+	var dbs []string
+	tables := make(map[string][]string)
+	for _, table := range Tables(cfg, tablePrefix) {
+		if _, ok := tables[table.Database]; !ok {
+			dbs = append(dbs, table.Database)
+		}
+		tables[table.Database] = append(tables[table.Database], table.Name)
+	}
+	return dbs, tables
+}
+
+// DatabaseNames returns the databases cfg generates, whose names do not depend on the plugin's table prefix
+func DatabaseNames(cfg config.MainConfig) []string {
+	dbs, _ := Layout(cfg, "")
+	return dbs
+}
+
+// WriteShares returns the fraction of each batch every db.table writes. The heaviest tables write whole
+// batches, the others a sample in proportion to their weight.
+func WriteShares(cfg config.MainConfig, tablePrefix string) map[string]float64 {
+	tables := Tables(cfg, tablePrefix)
+	heaviest := 0.0
+	for _, table := range tables {
+		heaviest = max(heaviest, table.Weight)
+	}
+	shares := make(map[string]float64, len(tables))
+	for _, table := range tables {
+		shares[fmt.Sprintf("%s.%s", table.Database, table.Name)] = table.Weight / heaviest
+	}
+	return shares
+}
+
+// ValidateIdentifiers checks the table prefix, field names and time column a plugin supplies are names MySQL
+// accepts once quoted. Field names must also be unique, MySQL compares column names without case, and must
+// not take the batch column.
+func ValidateIdentifiers(apiPlugin api_plugins.APIPlugin) error {
+	var errs []error
+	if err := ident.Validate(apiPlugin.TablePrefix()); err != nil {
+		errs = append(errs, fmt.Errorf("table prefix: %w", err))
+	}
+	seen := make(map[string]bool)
+	for _, field := range apiPlugin.GetFieldNames() {
+		key := strings.ToLower(field)
+		if err := ident.Validate(field); err != nil {
+			errs = append(errs, fmt.Errorf("field: %w", err))
+		} else if seen[key] {
+			errs = append(errs, fmt.Errorf("field %s is listed more than once", field))
+		} else if key == BatchColumn {
+			errs = append(errs, fmt.Errorf("field %s is reserved for auditing", field))
+		}
+		seen[key] = true
+	}
+	if provider, ok := apiPlugin.(api_plugins.TimeColumnProvider); ok {
+		if err := ident.Validate(provider.TimeColumn()); err != nil {
+			errs = append(errs, fmt.Errorf("time column: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// TableSchema is the definition of table: the plugin columns, with the batch column when auditing is
+// enabled, then the table options, then the RANGE partitions on the plugin's time column when partitioning
+// is enabled. Plugins without a time column get unpartitioned tables.
+func TableSchema(cfg config.MainConfig, apiPlugin api_plugins.APIPlugin, table Table) string {
+	schema := apiPlugin.Schema()
+	if cfg.Audit.Sink != "" {
+		schema = WithBatchColumn(schema)
+	}
+	var options []string
+	if table.Engine != "" {
+		options = append(options, "ENGINE="+table.Engine)
+	}
+	if table.Charset != "" {
+		options = append(options, "DEFAULT CHARSET="+table.Charset)
+	}
+	if table.Collation != "" {
+		options = append(options, "COLLATE="+table.Collation)
+	}
+	if len(options) > 0 {
+		schema = fmt.Sprintf("%s %s", schema, strings.Join(options, " "))
+	}
+	if provider, ok := apiPlugin.(api_plugins.TimeColumnProvider); ok && cfg.Partitioning.Interval > 0 {
+		schema = fmt.Sprintf("%s %s", schema, PartitionClause(provider.TimeColumn(), cfg.Partitioning.Interval, time.Now(), cfg.Partitioning.Ahead))
+	}
+	return schema
+}
+
+// DDL returns the statements that create the layout of cfg, as InitializeDatabases would run them
+func DDL(cfg config.MainConfig, apiPlugin api_plugins.APIPlugin) []string {
+	var statements []string
+	created := make(map[string]bool)
+	for _, table := range Tables(cfg, apiPlugin.TablePrefix()) {
+		if !created[table.Database] {
+			created[table.Database] = true
+			statements = append(statements, "CREATE DATABASE IF NOT EXISTS "+ident.Quote(table.Database), MarkerDDL(table.Database))
+		}
+		statements = append(statements, fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s %s", ident.Table(table.Database, table.Name), TableSchema(cfg, apiPlugin, table)))
+	}
+	return statements
+}
@@ -0,0 +1,99 @@
+package database
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"mysql_public_data_ingestor/config"
+)
+
+// TestDDL tests the statements match the layout InitializeDatabases creates, extras in name order
+func TestDDL(t *testing.T) {
+	mockAPIPlugin := new(MockAPIPlugin)
+	mockAPIPlugin.On("TablePrefix").Return("flights")
+	mockAPIPlugin.On("Schema").Return("(id INT PRIMARY KEY)")
+
+	cfg := config.MainConfig{
+		Databases: config.DBConfig{
+			Prefix: "p",
+			Copies: 1,
+			Extra: map[string]struct {
+				Tables int `yaml:"tables"`
+			}{"zed": {Tables: 1}, "abc": {Tables: 2}},
+		},
+	}
+
+	assert.Equal(t, []string{
+		"CREATE DATABASE IF NOT EXISTS `p1`",
+		"CREATE TABLE IF NOT EXISTS `p1`.`_ingestor` (created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP)",
+		"CREATE TABLE IF NOT EXISTS `p1`.`flights` (id INT PRIMARY KEY)",
+		"CREATE DATABASE IF NOT EXISTS `p_abc`",
+		"CREATE TABLE IF NOT EXISTS `p_abc`.`_ingestor` (created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP)",
+		"CREATE TABLE IF NOT EXISTS `p_abc`.`flights_1` (id INT PRIMARY KEY)",
+		"CREATE TABLE IF NOT EXISTS `p_abc`.`flights_2` (id INT PRIMARY KEY)",
+		"CREATE DATABASE IF NOT EXISTS `p_zed`",
+		"CREATE TABLE IF NOT EXISTS `p_zed`.`_ingestor` (created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP)",
+		"CREATE TABLE IF NOT EXISTS `p_zed`.`flights_1` (id INT PRIMARY KEY)",
+	}, DDL(cfg, mockAPIPlugin))
+}
+
+// TestLayoutTables tests the declarative layout follows copies and extra, with its own table options and
+// write shares relative to the heaviest table
+func TestLayoutTables(t *testing.T) {
+	mockAPIPlugin := new(MockAPIPlugin)
+	mockAPIPlugin.On("TablePrefix").Return("flights")
+	mockAPIPlugin.On("Schema").Return("(id INT)")
+
+	weight := 4.0
+	cfg := config.MainConfig{Databases: config.DBConfig{
+		Prefix: "p",
+		Copies: 1,
+		Layout: []config.DatabaseLayout{{
+			Name: "orders",
+			Tables: []config.TableLayout{
+				{Name: "hot", Engine: "InnoDB", Charset: "utf8mb4", Collation: "utf8mb4_bin", Weight: &weight},
+				{Name: "{table_prefix}_cold", Count: 2},
+			},
+		}},
+	}}
+
+	dbs, tables := Layout(cfg, "flights")
+	assert.Equal(t, []string{"p1", "p_orders"}, dbs)
+	assert.Equal(t, []string{"hot", "flights_cold_1", "flights_cold_2"}, tables["p_orders"])
+
+	assert.Equal(t, map[string]float64{
+		"p1.flights":              0.25,
+		"p_orders.hot":            1,
+		"p_orders.flights_cold_1": 0.25,
+		"p_orders.flights_cold_2": 0.25,
+	}, WriteShares(cfg, "flights"))
+
+	assert.Equal(t, []string{
+		"CREATE DATABASE IF NOT EXISTS `p1`",
+		"CREATE TABLE IF NOT EXISTS `p1`.`_ingestor` (created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP)",
+		"CREATE TABLE IF NOT EXISTS `p1`.`flights` (id INT)",
+		"CREATE DATABASE IF NOT EXISTS `p_orders`",
+		"CREATE TABLE IF NOT EXISTS `p_orders`.`_ingestor` (created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP)",
+		"CREATE TABLE IF NOT EXISTS `p_orders`.`hot` (id INT) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin",
+		"CREATE TABLE IF NOT EXISTS `p_orders`.`flights_cold_1` (id INT)",
+		"CREATE TABLE IF NOT EXISTS `p_orders`.`flights_cold_2` (id INT)",
+	}, DDL(cfg, mockAPIPlugin))
+}
+
+// TestValidateIdentifiers tests reserved words, hyphens and unicode are accepted and names MySQL cannot take are not
+func TestValidateIdentifiers(t *testing.T) {
+	valid := new(MockAPIPlugin)
+	valid.On("TablePrefix").Return("vols-aériens")
+	valid.On("GetFieldNames").Return([]string{"time", "order", "key", "données", "航班"})
+	assert.NoError(t, ValidateIdentifiers(valid))
+
+	invalid := new(MockAPIPlugin)
+	invalid.On("TablePrefix").Return("")
+	invalid.On("GetFieldNames").Return([]string{"time", "Time", "_batch_id", "trailing ", "emoji_🛫"})
+	err := ValidateIdentifiers(invalid)
+	assert.ErrorContains(t, err, "table prefix: identifier is empty")
+	assert.ErrorContains(t, err, "field Time is listed more than once")
+	assert.ErrorContains(t, err, "field _batch_id is reserved for auditing")
+	assert.ErrorContains(t, err, `field: identifier "trailing " ends with a space`)
+	assert.ErrorContains(t, err, "U+1F6EB")
+}
@@ -0,0 +1,235 @@
+package database
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"mysql_public_data_ingestor/ident"
+)
+
+// MarkerTable is created in every database init creates, so drop can tell them from databases that only
+// have a name the prefix could generate
+const MarkerTable = "_ingestor"
+
+// MarkerDDL returns the statement that creates the marker table in dbName
+func MarkerDDL(dbName string) string {
+	return fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP)", ident.Table(dbName, MarkerTable))
+}
+
+// IsGenerated reports whether dbName has a name the layout with prefix could create: prefix followed by a
+// copy number, or by _ and an extra name. It does not mean init created it, see MarkedDatabases.
+func IsGenerated(prefix, dbName string) bool {
+	rest, ok := strings.CutPrefix(dbName, prefix)
+	if !ok || rest == "" {
+		return false
+	}
+	if extra, ok := strings.CutPrefix(rest, "_"); ok {
+		return extra != ""
+	}
+	return strings.Trim(rest, "0123456789") == ""
+}
+
+// GeneratedDatabases lists the databases on the server generated with prefix, including extras that have
+// since been removed from the config
+func (dbm *DBManager) GeneratedDatabases(prefix string) ([]string, error) {
+	rows, err := dbm.Pool().Query("SELECT SCHEMA_NAME FROM information_schema.SCHEMATA ORDER BY SCHEMA_NAME")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var dbs []string
+	for rows.Next() {
+		var dbName string
+		if err := rows.Scan(&dbName); err != nil {
+			return nil, err
+		}
+		if IsGenerated(prefix, dbName) {
+			dbs = append(dbs, dbName)
+		}
+	}
+	return dbs, rows.Err()
+}
+
+// MarkedDatabases returns the databases on the server that hold the marker table
+func (dbm *DBManager) MarkedDatabases() (map[string]bool, error) {
+	rows, err := dbm.Pool().Query("SELECT TABLE_SCHEMA FROM information_schema.TABLES WHERE TABLE_NAME = ?", MarkerTable)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	marked := make(map[string]bool)
+	for rows.Next() {
+		var dbName string
+		if err := rows.Scan(&dbName); err != nil {
+			return nil, err
+		}
+		marked[dbName] = true
+	}
+	return marked, rows.Err()
+}
+
+// TablesWithColumn lists the db.table names in the databases generated with prefix that have column. With
+// the plugin's time column that leaves out the audit, dead letter and heartbeat tables.
+func (dbm *DBManager) TablesWithColumn(prefix, column string) ([]string, error) {
+	dbs, err := dbm.GeneratedDatabases(prefix)
+	if err != nil || len(dbs) == 0 {
+		return nil, err
+	}
+	args := []interface{}{column}
+	for _, dbName := range dbs {
+		args = append(args, dbName)
+	}
+	rows, err := dbm.Pool().Query(fmt.Sprintf(
+		"SELECT TABLE_SCHEMA, TABLE_NAME FROM information_schema.COLUMNS WHERE COLUMN_NAME = ? AND TABLE_SCHEMA IN (%s) ORDER BY TABLE_SCHEMA, TABLE_NAME",
+		strings.TrimSuffix(strings.Repeat("?, ", len(dbs)), ", "),
+	), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tables []string
+	for rows.Next() {
+		var dbName, tableName string
+		if err := rows.Scan(&dbName, &tableName); err != nil {
+			return nil, err
+		}
+		tables = append(tables, fmt.Sprintf("%s.%s", dbName, tableName))
+	}
+	return tables, rows.Err()
+}
+
+// LayoutTablesWithColumn is TablesWithColumn limited to the tables of the layout dbm works with, in databases
+// that hold the marker table. Tables that only share the prefix are left out.
+func (dbm *DBManager) LayoutTablesWithColumn(prefix, column string) ([]string, error) {
+	return dbm.markedTablesWithColumn(prefix, column, true)
+}
+
+// MarkedTablesWithColumn is TablesWithColumn limited to databases that hold the marker table, including
+// databases and tables since removed from the config
+func (dbm *DBManager) MarkedTablesWithColumn(prefix, column string) ([]string, error) {
+	return dbm.markedTablesWithColumn(prefix, column, false)
+}
+
+func (dbm *DBManager) markedTablesWithColumn(prefix, column string, layoutOnly bool) ([]string, error) {
+	tables, err := dbm.TablesWithColumn(prefix, column)
+	if err != nil || len(tables) == 0 {
+		return nil, err
+	}
+	marked, err := dbm.MarkedDatabases()
+	if err != nil {
+		return nil, err
+	}
+	var owned []string
+	for _, table := range tables {
+		dbName, tableName, _ := strings.Cut(table, ".")
+		if marked[dbName] && (!layoutOnly || slices.Contains(dbm.TableNames(dbName), tableName)) {
+			owned = append(owned, table)
+		}
+	}
+	return owned, nil
+}
+
+// MissingTables lists the db.table names of the layout dbm works with that do not exist on the server
+func (dbm *DBManager) MissingTables() ([]string, error) {
+	dbs := dbm.DatabaseNames()
+	if len(dbs) == 0 {
+		return nil, nil
+	}
+	args := make([]interface{}, len(dbs))
+	for i, dbName := range dbs {
+		args[i] = dbName
+	}
+	rows, err := dbm.Pool().Query(fmt.Sprintf(
+		"SELECT TABLE_SCHEMA, TABLE_NAME FROM information_schema.TABLES WHERE TABLE_SCHEMA IN (%s)",
+		strings.TrimSuffix(strings.Repeat("?, ", len(dbs)), ", "),
+	), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	existing := make(map[string]bool)
+	for rows.Next() {
+		var dbName, tableName string
+		if err := rows.Scan(&dbName, &tableName); err != nil {
+			return nil, err
+		}
+		existing[dbName+"."+tableName] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var missing []string
+	for _, dbName := range dbs {
+		for _, tableName := range dbm.TableNames(dbName) {
+			if name := dbName + "." + tableName; !existing[name] {
+				missing = append(missing, name)
+			}
+		}
+	}
+	return missing, nil
+}
+
+// DropDatabase drops a database and everything in it
+func (dbm *DBManager) DropDatabase(dbName string) error {
+	_, err := dbm.Pool().Exec("DROP DATABASE IF EXISTS " + ident.Quote(dbName))
+	return err
+}
+
+// TableStats is the size of one table as information_schema reports it
+type TableStats struct {
+	Database   string
+	Table      string
+	Rows       int64 // an estimate for InnoDB unless counted exactly
+	DataBytes  int64
+	IndexBytes int64
+}
+
+// TableStats returns the size of every table in dbs but the marker. With exact set rows are counted with
+// COUNT(*), which scans each table.
+func (dbm *DBManager) TableStats(dbs []string, exact bool) ([]TableStats, error) {
+	if len(dbs) == 0 {
+		return nil, nil
+	}
+	args := []interface{}{MarkerTable}
+	for _, dbName := range dbs {
+		args = append(args, dbName)
+	}
+	db := dbm.Pool()
+	rows, err := db.Query(fmt.Sprintf(
+		"SELECT TABLE_SCHEMA, TABLE_NAME, COALESCE(TABLE_ROWS, 0), COALESCE(DATA_LENGTH, 0), COALESCE(INDEX_LENGTH, 0) "+
+			"FROM information_schema.TABLES WHERE TABLE_NAME <> ? AND TABLE_SCHEMA IN (%s) ORDER BY TABLE_SCHEMA, TABLE_NAME",
+		strings.TrimSuffix(strings.Repeat("?, ", len(dbs)), ", "),
+	), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var stats []TableStats
+	for rows.Next() {
+		var s TableStats
+		if err := rows.Scan(&s.Database, &s.Table, &s.Rows, &s.DataBytes, &s.IndexBytes); err != nil {
+			return nil, err
+		}
+		stats = append(stats, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if exact {
+		for i := range stats {
+			err := db.QueryRow("SELECT COUNT(*) FROM " + ident.Table(stats[i].Database, stats[i].Table)).Scan(&stats[i].Rows)
+			if err != nil {
+				return nil, fmt.Errorf("failed to count %s.%s: %w", stats[i].Database, stats[i].Table, err)
+			}
+		}
+	}
+	return stats, nil
+}
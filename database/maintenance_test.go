@@ -0,0 +1,76 @@
+package database
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"mysql_public_data_ingestor/config"
+)
+
+func TestIsGenerated(t *testing.T) {
+	for dbName, want := range map[string]bool{
+		"p1":      true,
+		"p12":     true,
+		"p_extra": true,
+		"p":       false,
+		"p_":      false,
+		"px":      false,
+		"p1x":     false,
+		"other1":  false,
+		"mysql":   false,
+	} {
+		assert.Equal(t, want, IsGenerated("p", dbName), dbName)
+	}
+}
+
+// TestTableStats tests the information_schema sizes and the exact row counts
+func TestTableStats(t *testing.T) {
+	db, sqlMock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error creating mock DB: %v", err)
+	}
+	defer db.Close()
+	dbManager := NewDBManagerFromPool(db)
+
+	sqlMock.ExpectQuery(regexp.QuoteMeta("FROM information_schema.TABLES WHERE TABLE_NAME <> ? AND TABLE_SCHEMA IN (?, ?)")).
+		WithArgs(MarkerTable, "p1", "p_extra").
+		WillReturnRows(sqlmock.NewRows([]string{"TABLE_SCHEMA", "TABLE_NAME", "TABLE_ROWS", "DATA_LENGTH", "INDEX_LENGTH"}).
+			AddRow("p1", "flights", 10, 16384, 0).
+			AddRow("p_extra", "flights_1", 3, 16384, 8192))
+	sqlMock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(*) FROM `p1`.`flights`")).
+		WillReturnRows(sqlmock.NewRows([]string{"COUNT(*)"}).AddRow(12))
+	sqlMock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(*) FROM `p_extra`.`flights_1`")).
+		WillReturnRows(sqlmock.NewRows([]string{"COUNT(*)"}).AddRow(3))
+
+	stats, err := dbManager.TableStats([]string{"p1", "p_extra"}, true)
+	assert.NoError(t, err)
+	assert.Equal(t, []TableStats{
+		{Database: "p1", Table: "flights", Rows: 12, DataBytes: 16384},
+		{Database: "p_extra", Table: "flights_1", Rows: 3, DataBytes: 16384, IndexBytes: 8192},
+	}, stats)
+	assert.NoError(t, sqlMock.ExpectationsWereMet())
+}
+
+// TestMissingTables tests the layout tables the server does not have are listed
+func TestMissingTables(t *testing.T) {
+	db, sqlMock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error creating mock DB: %v", err)
+	}
+	defer db.Close()
+	dbManager := NewDBManagerFromPool(db)
+	dbManager.SetLayout(config.MainConfig{Databases: config.DBConfig{Prefix: "p", Copies: 1, Extra: map[string]struct {
+		Tables int `yaml:"tables"`
+	}{"extra": {Tables: 2}}}}, "flights")
+
+	sqlMock.ExpectQuery(regexp.QuoteMeta("SELECT TABLE_SCHEMA, TABLE_NAME FROM information_schema.TABLES WHERE TABLE_SCHEMA IN (?, ?)")).
+		WithArgs("p1", "p_extra").
+		WillReturnRows(sqlmock.NewRows([]string{"TABLE_SCHEMA", "TABLE_NAME"}).AddRow("p1", "flights").AddRow("p_extra", "flights_2"))
+
+	missing, err := dbManager.MissingTables()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"p_extra.flights_1"}, missing)
+	assert.NoError(t, sqlMock.ExpectationsWereMet())
+}
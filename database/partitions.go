@@ -0,0 +1,123 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"mysql_public_data_ingestor/ident"
+)
+
+// MaxPartition catches rows past the last time range, so inserts never fail when maintenance falls behind
+const MaxPartition = "pmax"
+
+// ErrForeignPartitions is returned for a table whose partitions are not the time ranges init creates
+var ErrForeignPartitions = errors.New("not partitioned into time ranges by init")
+
+// Partition is one RANGE partition, holding the rows with a time column value below LessThan
+type Partition struct {
+	Name     string
+	LessThan int64 // unix seconds, unused for MaxPartition
+}
+
+// PartitionName names the partition whose range starts at from
+func PartitionName(from time.Time) string {
+	return "p" + from.UTC().Format("20060102_1504")
+}
+
+// PartitionsUntil returns the partitions of interval width that follow the bound after, up to and including
+// the one ending at until
+func PartitionsUntil(after, until time.Time, interval time.Duration) []Partition {
+	var partitions []Partition
+	for from := after; from.Before(until); from = from.Add(interval) {
+		partitions = append(partitions, Partition{Name: PartitionName(from), LessThan: from.Add(interval).Unix()})
+	}
+	return partitions
+}
+
+// PartitionClause partitions a table by column into ranges of interval, from the one holding now to ahead
+// ranges past it, plus MaxPartition. The first range also takes every older row.
+func PartitionClause(column string, interval time.Duration, now time.Time, ahead int) string {
+	start := now.Truncate(interval)
+	partitions := PartitionsUntil(start, start.Add(time.Duration(ahead+1)*interval), interval)
+	return fmt.Sprintf("PARTITION BY RANGE (%s) (%s)", ident.Quote(column), partitionDefinitions(partitions))
+}
+
+func partitionDefinitions(partitions []Partition) string {
+	definitions := make([]string, 0, len(partitions)+1)
+	for _, partition := range partitions {
+		definitions = append(definitions, fmt.Sprintf("PARTITION %s VALUES LESS THAN (%d)", ident.Quote(partition.Name), partition.LessThan))
+	}
+	definitions = append(definitions, fmt.Sprintf("PARTITION %s VALUES LESS THAN MAXVALUE", ident.Quote(MaxPartition)))
+	return strings.Join(definitions, ", ")
+}
+
+// Partitions returns the time range partitions of a table in order, without MaxPartition. partitioned is
+// false for a table that is not partitioned at all. A table partitioned other than by RANGE of column into
+// PartitionName ranges followed by MaxPartition returns ErrForeignPartitions.
+func (dbm *DBManager) Partitions(dbName, tableName, column string) (partitions []Partition, partitioned bool, err error) {
+	rows, err := dbm.Pool().Query(
+		"SELECT PARTITION_NAME, PARTITION_DESCRIPTION, PARTITION_METHOD, PARTITION_EXPRESSION FROM information_schema.PARTITIONS "+
+			"WHERE TABLE_SCHEMA = ? AND TABLE_NAME = ? AND PARTITION_NAME IS NOT NULL ORDER BY PARTITION_ORDINAL_POSITION",
+		dbName, tableName,
+	)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	hasMax := false
+	for rows.Next() {
+		var name, description, method, expression string
+		if err := rows.Scan(&name, &description, &method, &expression); err != nil {
+			return nil, false, err
+		}
+		partitioned = true
+		if method != "RANGE" || expression != ident.Quote(column) {
+			return nil, true, fmt.Errorf("%s.%s: %w, it is partitioned by %s (%s)", dbName, tableName, ErrForeignPartitions, method, expression)
+		}
+		if hasMax {
+			return nil, true, fmt.Errorf("%s.%s: %w, %s follows %s", dbName, tableName, ErrForeignPartitions, name, MaxPartition)
+		}
+		if name == MaxPartition {
+			hasMax = true
+			continue
+		}
+		if !isPartitionName(name) {
+			return nil, true, fmt.Errorf("%s.%s: %w, partition %s is not a time range", dbName, tableName, ErrForeignPartitions, name)
+		}
+		lessThan, err := strconv.ParseInt(description, 10, 64)
+		if err != nil {
+			return nil, true, fmt.Errorf("%s.%s: %w, partition %s ends at %q", dbName, tableName, ErrForeignPartitions, name, description)
+		}
+		partitions = append(partitions, Partition{Name: name, LessThan: lessThan})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, false, err
+	}
+	if partitioned && !hasMax {
+		return nil, true, fmt.Errorf("%s.%s: %w, it has no %s partition", dbName, tableName, ErrForeignPartitions, MaxPartition)
+	}
+	return partitions, partitioned, nil
+}
+
+// isPartitionName reports whether name is one PartitionName gives
+func isPartitionName(name string) bool {
+	from, err := time.Parse("p20060102_1504", name)
+	return err == nil && PartitionName(from) == name
+}
+
+// AddPartitions splits the new time ranges off MaxPartition, which is empty unless maintenance fell behind
+func (dbm *DBManager) AddPartitions(dbName, tableName string, partitions []Partition) error {
+	_, err := dbm.Pool().Exec(fmt.Sprintf("ALTER TABLE %s REORGANIZE PARTITION %s INTO (%s)",
+		ident.Table(dbName, tableName), ident.Quote(MaxPartition), partitionDefinitions(partitions)))
+	return err
+}
+
+// DropPartitions drops partitions and the rows in them
+func (dbm *DBManager) DropPartitions(dbName, tableName string, names []string) error {
+	_, err := dbm.Pool().Exec(fmt.Sprintf("ALTER TABLE %s DROP PARTITION %s", ident.Table(dbName, tableName), ident.List(names)))
+	return err
+}
@@ -0,0 +1,17 @@
+package database
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPartitionClause(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 34, 0, 0, time.UTC)
+	assert.Equal(t, "PARTITION BY RANGE (`time`) ("+
+		"PARTITION `p20240501_1200` VALUES LESS THAN (1714568400), "+
+		"PARTITION `p20240501_1300` VALUES LESS THAN (1714572000), "+
+		"PARTITION `p20240501_1400` VALUES LESS THAN (1714575600), "+
+		"PARTITION `pmax` VALUES LESS THAN MAXVALUE)", PartitionClause("time", time.Hour, now, 2))
+}
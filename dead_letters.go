@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"mysql_public_data_ingestor/api_plugins"
+	"mysql_public_data_ingestor/database"
+	"mysql_public_data_ingestor/deadletter"
+	"mysql_public_data_ingestor/syslogwrapper"
+)
+
+// ReplayDeadLetters re-attempts every dead-lettered record once. Records that insert cleanly are removed
+// from the sink, the rest stay for the next replay.
+func ReplayDeadLetters(sink deadletter.Sink, dbManager database.DBManagerInterface, sysLog syslogwrapper.SyslogWrapperInterface, apiPlugin api_plugins.APIPlugin) error {
+	if sink == nil {
+		return errors.New("no dead-letter sink configured")
+	}
+
+	writers := make(map[string]*tableWriter)
+	defer func() {
+		for _, w := range writers {
+			w.release()
+		}
+	}()
+
+	ok, failed, err := sink.Replay(func(entry deadletter.Entry) error {
+		name := fmt.Sprintf("%s.%s", entry.Database, entry.Table)
+		w, exists := writers[name]
+		if !exists {
+			w = newTableWriter(entry.Database, entry.Table, sysLog, dbManager, apiPlugin, WorkerOptions{})
+			writers[name] = w
+		}
+
+		var record interface{}
+		if err := json.Unmarshal(entry.Record, &record); err != nil {
+			return err
+		}
+		values, err := w.values(record)
+		if err != nil {
+			return err
+		}
+		if err := w.insert(1, values); err != nil {
+			sysLog.Warning(fmt.Sprintf("Dead letter for %s still fails: %v", name, err))
+			return err
+		}
+		return nil
+	})
+	sysLog.Info(fmt.Sprintf("Replayed %d dead letters, %d still failing", ok, failed))
+	return err
+}
@@ -0,0 +1,71 @@
+package deadletter
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"mysql_public_data_ingestor/config"
+	"mysql_public_data_ingestor/metrics"
+)
+
+// Supported sink types
+const (
+	TableSinkType = "table"
+	FileSinkType  = "file"
+)
+
+var (
+	deadLettered = metrics.Map("dead_lettered_records")
+	replayed     = metrics.Counter("dead_letters_replayed")
+)
+
+// Entry is a record that could not be written, together with why
+type Entry struct {
+	Database     string          `json:"database"`
+	Table        string          `json:"table"`
+	Record       json.RawMessage `json:"record"` // the record as fetched from the plugin
+	ErrorCode    uint16          `json:"error_code"`
+	ErrorMessage string          `json:"error_message"`
+	Time         time.Time       `json:"time"`
+}
+
+// NewEntry builds an Entry for record, encoding it as JSON
+func NewEntry(dbName, tableName string, record interface{}, code uint16, cause error) (Entry, error) {
+	raw, err := json.Marshal(record)
+	if err != nil {
+		return Entry{}, fmt.Errorf("failed to encode dead-letter record: %w", err)
+	}
+	return Entry{
+		Database:     dbName,
+		Table:        tableName,
+		Record:       raw,
+		ErrorCode:    code,
+		ErrorMessage: cause.Error(),
+		Time:         time.Now().UTC(),
+	}, nil
+}
+
+// Sink stores dead-lettered records and hands them back for replay
+type Sink interface {
+	Write(entry Entry) error
+	// Replay calls fn for every stored entry, oldest first, and removes the ones fn accepts
+	Replay(fn func(entry Entry) error) (ok int, failed int, err error)
+	Close() error
+}
+
+// New creates the sink described by cfg. It returns nil when dead-lettering is disabled.
+// pool is called for every statement so the table sink follows the writable primary.
+func New(cfg config.DeadLetterConfig, pool func() *sql.DB, databases func() []string) (Sink, error) {
+	switch cfg.Sink {
+	case "":
+		return nil, nil
+	case TableSinkType:
+		return NewTableSink(pool, databases), nil
+	case FileSinkType:
+		return NewFileSink(cfg.File)
+	default:
+		return nil, fmt.Errorf("unsupported dead-letter sink: %s", cfg.Sink)
+	}
+}
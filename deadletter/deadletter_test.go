@@ -0,0 +1,84 @@
+package deadletter
+
+import (
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"mysql_public_data_ingestor/config"
+)
+
+func TestFileSinkReplay(t *testing.T) {
+	sink, err := NewFileSink(filepath.Join(t.TempDir(), "dead_letters.ndjson"))
+	if err != nil {
+		t.Fatalf("Error creating file sink: %v", err)
+	}
+	defer sink.Close()
+
+	for _, record := range []interface{}{"good", "bad"} {
+		entry, err := NewEntry("auto_1", "flights", []interface{}{record}, 1406, errors.New("Data too long"))
+		assert.NoError(t, err)
+		assert.NoError(t, sink.Write(entry))
+	}
+
+	ok, failed, err := sink.Replay(func(entry Entry) error {
+		if string(entry.Record) == `["bad"]` {
+			return errors.New("still failing")
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, ok)
+	assert.Equal(t, 1, failed)
+
+	// Only the failing entry is left for the next replay
+	var seen []string
+	_, _, err = sink.Replay(func(entry Entry) error {
+		seen = append(seen, string(entry.Record))
+		assert.Equal(t, uint16(1406), entry.ErrorCode)
+		assert.Equal(t, "flights", entry.Table)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{`["bad"]`}, seen)
+}
+
+func TestTableSinkWrite(t *testing.T) {
+	db, mockDB, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error creating mock DB: %v", err)
+	}
+	defer db.Close()
+
+	mockDB.ExpectExec(regexp.QuoteMeta("CREATE TABLE IF NOT EXISTS `auto_1`.`_dead_letter`")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mockDB.ExpectExec(regexp.QuoteMeta("INSERT INTO `auto_1`.`_dead_letter`")).
+		WithArgs("flights", `["x"]`, uint16(1062), "Duplicate entry", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mockDB.ExpectExec(regexp.QuoteMeta("INSERT INTO `auto_1`.`_dead_letter`")).WillReturnResult(sqlmock.NewResult(2, 1))
+
+	sink := NewTableSink(func() *sql.DB { return db }, func() []string { return []string{"auto_1"} })
+	entry, err := NewEntry("auto_1", "flights", []interface{}{"x"}, 1062, errors.New("Duplicate entry"))
+	assert.NoError(t, err)
+	assert.NoError(t, sink.Write(entry))
+	assert.NoError(t, sink.Write(entry), "The dead-letter table should only be created once")
+
+	if err := mockDB.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unmet expectations: %v", err)
+	}
+}
+
+func TestNew(t *testing.T) {
+	sink, err := New(config.DeadLetterConfig{}, nil, nil)
+	assert.NoError(t, err)
+	assert.Nil(t, sink, "An empty sink type disables dead-lettering")
+
+	_, err = New(config.DeadLetterConfig{Sink: "s3"}, nil, nil)
+	assert.Error(t, err)
+
+	_, err = New(config.DeadLetterConfig{Sink: FileSinkType}, nil, nil)
+	assert.Error(t, err, "The file sink needs a path")
+}
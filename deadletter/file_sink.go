@@ -0,0 +1,101 @@
+package deadletter
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// FileSink appends dead letters to an NDJSON file, one Entry per line
+type FileSink struct {
+	path string
+
+	mu   sync.Mutex
+	file *os.File
+}
+
+func NewFileSink(path string) (*FileSink, error) {
+	if path == "" {
+		return nil, errors.New("dead_letter.file is required for the file sink")
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open dead-letter file %s: %w", path, err)
+	}
+	return &FileSink{path: path, file: file}, nil
+}
+
+func (s *FileSink) Write(entry Entry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	deadLettered.Add(entry.Database+"."+entry.Table, 1)
+	return nil
+}
+
+// Replay re-attempts every entry and rewrites the file with the ones that still fail
+func (s *FileSink) Replay(fn func(entry Entry) error) (int, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var remaining []byte
+	ok, failed := 0, 0
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		var entry Entry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return ok, failed, fmt.Errorf("failed to decode dead letter: %w", err)
+		}
+		if err := fn(entry); err != nil {
+			failed++
+			remaining = append(remaining, line...)
+			remaining = append(remaining, '\n')
+			continue
+		}
+		ok++
+		replayed.Add(1)
+	}
+	if err := scanner.Err(); err != nil {
+		return ok, failed, err
+	}
+
+	// Swap the file atomically so a crash mid-replay keeps the original entries
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, remaining, 0o644); err != nil {
+		return ok, failed, err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return ok, failed, err
+	}
+	if err := s.file.Close(); err != nil {
+		return ok, failed, err
+	}
+	s.file, err = os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	return ok, failed, err
+}
+
+func (s *FileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Close()
+}
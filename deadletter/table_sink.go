@@ -0,0 +1,117 @@
+package deadletter
+
+import (
+	"database/sql"
+	"fmt"
+	"sync"
+
+	"mysql_public_data_ingestor/ident"
+	"mysql_public_data_ingestor/retry"
+)
+
+// TableName is the dead-letter table created in each generated database
+const TableName = "_dead_letter"
+
+const tableSchema = `(
+	id BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	target_table VARCHAR(64) NOT NULL,
+	record JSON NOT NULL,
+	error_code SMALLINT UNSIGNED NOT NULL,
+	error_message TEXT NOT NULL,
+	created_at DATETIME(6) NOT NULL
+)`
+
+// TableSink keeps dead letters in a _dead_letter table next to the table they were meant for
+type TableSink struct {
+	pool      func() *sql.DB
+	databases func() []string // read on each use, config reloads add databases
+
+	mu      sync.Mutex
+	created map[string]bool
+}
+
+func NewTableSink(pool func() *sql.DB, databases func() []string) *TableSink {
+	return &TableSink{pool: pool, databases: databases, created: make(map[string]bool)}
+}
+
+func (s *TableSink) ensureTable(dbName string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.created[dbName] {
+		return nil
+	}
+	_, err := s.pool().Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s %s", ident.Table(dbName, TableName), tableSchema))
+	if err != nil {
+		return fmt.Errorf("failed to create dead-letter table in %s: %w", dbName, err)
+	}
+	s.created[dbName] = true
+	return nil
+}
+
+func (s *TableSink) Write(entry Entry) error {
+	if err := s.ensureTable(entry.Database); err != nil {
+		return err
+	}
+	_, err := s.pool().Exec(
+		fmt.Sprintf("INSERT INTO %s (target_table, record, error_code, error_message, created_at) VALUES (?, ?, ?, ?, ?)", ident.Table(entry.Database, TableName)),
+		entry.Table, string(entry.Record), entry.ErrorCode, entry.ErrorMessage, entry.Time,
+	)
+	if err != nil {
+		return err
+	}
+	deadLettered.Add(entry.Database+"."+entry.Table, 1)
+	return nil
+}
+
+func (s *TableSink) Replay(fn func(entry Entry) error) (int, int, error) {
+	ok, failed := 0, 0
+	for _, dbName := range s.databases() {
+		entries, ids, err := s.load(dbName)
+		if err != nil {
+			return ok, failed, err
+		}
+		for i, entry := range entries {
+			if err := fn(entry); err != nil {
+				failed++
+				continue
+			}
+			_, err := s.pool().Exec(fmt.Sprintf("DELETE FROM %s WHERE id = ?", ident.Table(dbName, TableName)), ids[i])
+			if err != nil {
+				return ok, failed, fmt.Errorf("failed to remove replayed dead letter %d from %s: %w", ids[i], dbName, err)
+			}
+			ok++
+			replayed.Add(1)
+		}
+	}
+	return ok, failed, nil
+}
+
+func (s *TableSink) load(dbName string) ([]Entry, []uint64, error) {
+	rows, err := s.pool().Query(fmt.Sprintf("SELECT id, target_table, record, error_code, error_message, created_at FROM %s ORDER BY id", ident.Table(dbName, TableName)))
+	if retry.NoSuchTable(err) {
+		return nil, nil, nil // Nothing was dead-lettered in dbName yet, replaying does not create the table
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read dead letters from %s: %w", dbName, err)
+	}
+	defer rows.Close()
+
+	var entries []Entry
+	var ids []uint64
+	for rows.Next() {
+		var id uint64
+		var record []byte
+		entry := Entry{Database: dbName}
+		if err := rows.Scan(&id, &entry.Table, &record, &entry.ErrorCode, &entry.ErrorMessage, &entry.Time); err != nil {
+			return nil, nil, err
+		}
+		entry.Record = record
+		entries = append(entries, entry)
+		ids = append(ids, id)
+	}
+	return entries, ids, rows.Err()
+}
+
+func (s *TableSink) Close() error {
+	return nil
+}
@@ -0,0 +1,107 @@
+package distribution
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"mysql_public_data_ingestor/config"
+)
+
+// Distributor sends each record of a batch to a few tables instead of all of them, so some tables run hot
+// and most stay cold. A nil *Distributor leaves batches whole, every table receives every record.
+type Distributor struct {
+	cfg config.DistributionConfig
+
+	mu  sync.Mutex
+	rng *rand.Rand
+}
+
+// New returns a Distributor for the configured mode, or nil for replicate
+func New(cfg config.DistributionConfig) *Distributor {
+	if cfg.Mode == "" || cfg.Mode == config.DistributeReplicate {
+		return nil
+	}
+	return &Distributor{cfg: cfg, rng: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+// Split picks fanout distinct tables for every record of batch and returns the records of each table.
+// Under weighted a table is picked in proportion to weight(table); under zipf the tables are ranked by name
+// and the first ones take most records. Tables that receive nothing are missing from the result.
+func (d *Distributor) Split(batch []interface{}, tables []string, weight func(table string) float64) map[string][]interface{} {
+	if d == nil || len(tables) == 0 {
+		return nil
+	}
+	tables = append([]string(nil), tables...)
+	sort.Strings(tables)
+
+	base, pickable := d.weights(tables, weight)
+	fanout := min(max(d.cfg.Fanout, 1), pickable)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	split := make(map[string][]interface{})
+	weights := make([]float64, len(base))
+	for _, record := range batch {
+		// Tables are drawn without replacement, a chosen table leaves the draw and the others share its weight
+		copy(weights, base)
+		total := 0.0
+		for _, w := range weights {
+			total += w
+		}
+		for n := 0; n < fanout; n++ {
+			i := d.draw(weights, total)
+			split[tables[i]] = append(split[tables[i]], record)
+			total -= weights[i]
+			weights[i] = 0
+		}
+	}
+	return split
+}
+
+// weights returns the draw weight of each table and how many tables can be drawn. Under zipf the table of
+// rank k weighs (zipf_v + k)^-zipf_s, as rand.Zipf would draw it.
+func (d *Distributor) weights(tables []string, weight func(table string) float64) ([]float64, int) {
+	weights := make([]float64, len(tables))
+	if d.cfg.Mode == config.DistributeZipf {
+		for k := range weights {
+			weights[k] = math.Pow(d.cfg.ZipfV+float64(k), -d.cfg.ZipfS)
+		}
+		return weights, len(tables)
+	}
+
+	weighted := 0
+	for i, table := range tables {
+		if w := weight(table); w > 0 {
+			weights[i] = w
+			weighted++
+		}
+	}
+	if weighted == 0 {
+		for i := range weights {
+			weights[i] = 1
+		}
+		return weights, len(tables)
+	}
+	return weights, weighted
+}
+
+// draw picks the index of a table in proportion to its weight, total being the sum of weights. Tables
+// without weight are never drawn. d.mu must be held.
+func (d *Distributor) draw(weights []float64, total float64) int {
+	x := d.rng.Float64() * total
+	last := -1
+	for i, w := range weights {
+		if w <= 0 {
+			continue
+		}
+		if x < w {
+			return i
+		}
+		x -= w
+		last = i
+	}
+	return last // x ran past the end through rounding
+}
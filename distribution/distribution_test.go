@@ -0,0 +1,76 @@
+package distribution
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"mysql_public_data_ingestor/config"
+)
+
+func batchOf(n int) []interface{} {
+	batch := make([]interface{}, n)
+	for i := range batch {
+		batch[i] = i
+	}
+	return batch
+}
+
+func TestReplicate(t *testing.T) {
+	d := New(config.DistributionConfig{Mode: config.DistributeReplicate})
+	assert.Nil(t, d)
+	assert.Nil(t, d.Split(batchOf(3), []string{"a", "b"}, nil), "A nil Distributor leaves batches whole")
+}
+
+// TestWeighted tests records follow the weights, each goes to fanout distinct tables and tables without
+// weight get nothing
+func TestWeighted(t *testing.T) {
+	d := New(config.DistributionConfig{Mode: config.DistributeWeighted, Fanout: 2})
+	weights := map[string]float64{"hot": 8, "warm": 2, "cold": 1, "off": 0}
+	split := d.Split(batchOf(10000), []string{"off", "cold", "warm", "hot"}, func(table string) float64 { return weights[table] })
+
+	assert.NotContains(t, split, "off")
+	total := 0
+	for _, records := range split {
+		total += len(records)
+	}
+	assert.Equal(t, 20000, total, "Every record should be written to two tables")
+	assert.Greater(t, len(split["hot"]), len(split["warm"]))
+	assert.Greater(t, len(split["warm"]), len(split["cold"]))
+
+	// The fanout is capped at the tables that can be picked
+	split = d.Split(batchOf(10), []string{"hot", "off"}, func(table string) float64 { return weights[table] })
+	assert.Equal(t, map[string][]interface{}{"hot": batchOf(10)}, split)
+}
+
+// TestZipf tests the first tables by name take most of the records
+func TestZipf(t *testing.T) {
+	d := New(config.DistributionConfig{Mode: config.DistributeZipf, Fanout: 1, ZipfS: 1.5, ZipfV: 1})
+	tables := []string{"t05", "t04", "t03", "t02", "t01"}
+	split := d.Split(batchOf(10000), tables, nil)
+
+	total := 0
+	for _, records := range split {
+		total += len(records)
+	}
+	assert.Equal(t, 10000, total)
+	assert.Greater(t, len(split["t01"]), len(split["t02"]))
+	assert.Greater(t, len(split["t02"]), len(split["t05"]))
+	assert.Greater(t, len(split["t01"]), 5000)
+}
+
+// TestZipfFullFanout tests a fanout covering every table under a steep Zipf draws each table once per record
+// instead of drawing the head over and over
+func TestZipfFullFanout(t *testing.T) {
+	d := New(config.DistributionConfig{Mode: config.DistributeZipf, Fanout: 50, ZipfS: 8, ZipfV: 1})
+	tables := make([]string, 50)
+	for i := range tables {
+		tables[i] = fmt.Sprintf("t%02d", i)
+	}
+	split := d.Split(batchOf(100), tables, nil)
+
+	assert.Len(t, split, 50)
+	for _, table := range tables {
+		assert.Equal(t, batchOf(100), split[table], table)
+	}
+}
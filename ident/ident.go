@@ -0,0 +1,54 @@
+package ident
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// MaxLength is the longest database, table or column name MySQL accepts, in characters
+const MaxLength = 64
+
+// Quote quotes name as a MySQL identifier. Backticks in name are doubled, so any name is safe to build SQL
+// with, reserved words, hyphens and unicode included.
+func Quote(name string) string {
+	return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+}
+
+// Table quotes the fully qualified name of a table
+func Table(dbName, tableName string) string {
+	return Quote(dbName) + "." + Quote(tableName)
+}
+
+// List quotes names and joins them for a column list
+func List(names []string) string {
+	quoted := make([]string, len(names))
+	for i, name := range names {
+		quoted[i] = Quote(name)
+	}
+	return strings.Join(quoted, ", ")
+}
+
+// Validate checks name is one MySQL accepts once quoted: 1 to MaxLength characters of the Basic
+// Multilingual Plane other than NUL, not ending in a space.
+func Validate(name string) error {
+	if name == "" {
+		return errors.New("identifier is empty")
+	}
+	if !utf8.ValidString(name) {
+		return fmt.Errorf("identifier %q is not valid UTF-8", name)
+	}
+	if n := utf8.RuneCountInString(name); n > MaxLength {
+		return fmt.Errorf("identifier %q is %d characters long, at most %d are allowed", name, n, MaxLength)
+	}
+	for _, r := range name {
+		if r == 0 || r > 0xFFFF {
+			return fmt.Errorf("identifier %q contains %U, which MySQL does not allow in identifiers", name, r)
+		}
+	}
+	if strings.HasSuffix(name, " ") {
+		return fmt.Errorf("identifier %q ends with a space", name)
+	}
+	return nil
+}
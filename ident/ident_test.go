@@ -0,0 +1,48 @@
+package ident
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQuote(t *testing.T) {
+	tests := map[string]string{
+		"flights":       "`flights`",
+		"time":          "`time`",
+		"order":         "`order`",
+		"select":        "`select`",
+		"my-prefix_1":   "`my-prefix_1`",
+		"123":           "`123`",
+		"with space":    "`with space`",
+		"back`tick":     "`back``tick`",
+		"``":            "``````",
+		"vols_aériens":  "`vols_aériens`",
+		"航班":            "`航班`",
+		"a.b":           "`a.b`",
+		"'; DROP x; --": "`'; DROP x; --`",
+	}
+	for name, quoted := range tests {
+		assert.Equal(t, quoted, Quote(name), name)
+	}
+}
+
+func TestTableAndList(t *testing.T) {
+	assert.Equal(t, "`auto-1`.`order`", Table("auto-1", "order"))
+	assert.Equal(t, "`time`, `key`, `données`", List([]string{"time", "key", "données"}))
+	assert.Equal(t, "", List(nil))
+}
+
+func TestValidate(t *testing.T) {
+	for _, name := range []string{"time", "order", "my-prefix", "123", "vols_aériens", "航班", "back`tick", "with space", strings.Repeat("é", MaxLength)} {
+		assert.NoError(t, Validate(name), name)
+	}
+
+	assert.ErrorContains(t, Validate(""), "empty")
+	assert.ErrorContains(t, Validate(strings.Repeat("a", MaxLength+1)), "65 characters long")
+	assert.ErrorContains(t, Validate("trailing "), "ends with a space")
+	assert.ErrorContains(t, Validate("nul\x00"), "U+0000")
+	assert.ErrorContains(t, Validate("emoji_🛫"), "U+1F6EB")
+	assert.ErrorContains(t, Validate("bad\xffutf8"), "not valid UTF-8")
+}
@@ -2,19 +2,26 @@ package main
 
 import (
 	"context"
-	"database/sql"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"os"
-	"strings"
-	"sync"
+	"os/signal"
+	"syscall"
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
+	"mysql_public_data_ingestor/admin"
 	"mysql_public_data_ingestor/api_plugins"
 	"mysql_public_data_ingestor/config"
 	"mysql_public_data_ingestor/database"
+	"mysql_public_data_ingestor/distribution"
+	"mysql_public_data_ingestor/metrics"
+	"mysql_public_data_ingestor/queue"
+	"mysql_public_data_ingestor/routing"
 	"mysql_public_data_ingestor/syslogwrapper"
+	"mysql_public_data_ingestor/workload"
 )
 
 func main() {
@@ -24,47 +31,164 @@ func main() {
 	}
 	defer sysLog.Close()
 
-	cfg, err := LoadConfig(sysLog)
+	cfg, args, err := LoadConfig(sysLog, os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		fmt.Fprint(os.Stderr, usage(os.Args[0]))
+		return
+	}
 	if err != nil {
 		log.Fatalf("Failed to load config file: %v", err)
 	}
+	sysLog.Debug(fmt.Sprintf("Loaded config:\n%s", cfg.Redacted()))
 
+	command := "run"
+	if len(args) > 0 {
+		command, args = args[0], args[1:]
+	}
+	err = RunCommand(command, args, cfg, sysLog, os.Stdout)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatalf("%s: %v", command, err)
+	}
+}
+
+// Run creates the database layout on every target and ingests until SIGINT or SIGTERM, or until a halt policy
+// stops it. Either way the queues and spools are drained before it returns.
+func Run(cfg config.MainConfig, sysLog syslogwrapper.SyslogWrapperInterface) error {
 	apiPlugin, err := SetupPlugins(cfg, sysLog)
 	if err != nil {
-		log.Fatalf("Failed to setup plugins: %v", err)
+		return fmt.Errorf("failed to setup plugins: %w", err)
+	}
+
+	targets, err := InitializeTargets(cfg, sysLog, apiPlugin)
+	if err != nil {
+		return fmt.Errorf("failed to initialize databases: %w", err)
 	}
+	defer closeTargets(targets)
 
-	dbManager, err := InitializeDatabases(cfg, sysLog, apiPlugin)
+	router, err := routing.New(cfg.Routing, targetNames(targets), apiPlugin.GetFieldNames(), apiPlugin.GetValues)
 	if err != nil {
-		log.Fatalf("Failed to initialize databases: %v", err)
+		return fmt.Errorf("failed to setup routing: %w", err)
 	}
 
-	go dbManager.PingIdleConnections(sysLog) // Keep the connection pool healthy
+	StartTargetMaintenance(cfg, targets, sysLog)
+
+	metrics.Serve(cfg.Metrics.ListenAddr, sysLog)
+	profile := workload.NewProfile(cfg.WorkloadProfile, sysLog)
+
+	halted := make(chan error, 1)
+	halt := func(err error) {
+		select {
+		case halted <- err:
+		default:
+		}
+	}
 
-	tableChannels, wg := CreateTableWorkers(dbManager, sysLog, apiPlugin)
+	workerOpts := NewWorkerOptions(cfg)
+	workerOpts.Profile = profile
+	workerOpts.Halt = halt
+
+	tableQueues, err := CreateTableWorkers(cfg, targets, router, sysLog, apiPlugin, workerOpts)
+	if err != nil {
+		return fmt.Errorf("failed to create table workers: %w", err)
+	}
 
 	stop := make(chan struct{})
-	go StartDataFetching(apiPlugin, tableChannels, sysLog, stop)
+	fetchControl := NewFetchControl()
+	livePlugin := NewLivePlugin(apiPlugin)
+	go StartDataFetching(livePlugin, router, distribution.New(cfg.Distribution), tableQueues, sysLog, stop, profile, fetchControl)
+	admin.Serve(cfg.Admin, pipelineControl{fetch: fetchControl, tables: tableQueues}, sysLog)
 
-	time.Sleep(1 * time.Minute) // Example: run for 1 minute
+	flags, _, _ := config.ParseFlags(os.Args[1:]) // already validated by LoadConfig
+	reload := func() (config.MainConfig, error) {
+		cfg, _, err := LoadConfig(sysLog, os.Args[1:])
+		return cfg, err
+	}
+	go NewReloader(configPath(flags), reload, cfg, targets, router, tableQueues, livePlugin, workerOpts, sysLog).Run(stop)
+
+	readers, err := StartReaders(cfg, targets, router, sysLog, stop)
+	if err != nil {
+		return fmt.Errorf("failed to start readers: %w", err)
+	}
+	err = StartReplicationCheck(cfg, targets, apiPlugin, sysLog, stop, readers)
+	if err != nil {
+		return fmt.Errorf("failed to start replication check: %w", err)
+	}
+	err = StartRetention(cfg, targets, apiPlugin, sysLog, stop, readers)
+	if err != nil {
+		return fmt.Errorf("failed to start retention: %w", err)
+	}
+
+	signals, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	select {
+	case <-signals.Done():
+		sysLog.Info("Stopping ingestor on signal, draining the queues")
+	case err := <-halted:
+		sysLog.Error(fmt.Sprintf("Stopping ingestor: %v", err))
+	}
 	close(stop)
+	// The fetcher closes the queues too, but it may be waiting on a full one
+	tableQueues.Close()
 
-	wg.Wait()
+	tableQueues.Wait()
+	readers.Wait()
+	return nil
 }
 
 func SetupSyslog(tag string) (*syslogwrapper.SyslogWrapper, error) {
 	return syslogwrapper.NewSyslogWrapper(tag)
 }
 
-func LoadConfig(sysLog syslogwrapper.SyslogWrapperInterface) (config.MainConfig, error) {
-	configPath := os.Getenv("TEST_CONFIG_FILE")
-	if configPath == "" {
-		configPath = "config.yaml" // Default config file path
+// LoadConfig reads the config file and applies environment and flag overrides, flags taking precedence.
+// It returns the arguments left after the flags.
+func LoadConfig(sysLog syslogwrapper.SyslogWrapperInterface, args []string) (config.MainConfig, []string, error) {
+	flags, rest, err := config.ParseFlags(args)
+	if err != nil {
+		sysLog.Error(fmt.Sprintf("Invalid command line: %v", err))
+		return config.MainConfig{}, nil, err
 	}
-	return config.LoadConfig(configPath, sysLog)
+	env, ignored := config.EnvOverrides(os.Environ())
+	for _, name := range ignored {
+		sysLog.Warning(fmt.Sprintf("Ignoring environment variable %s, it names no config key", name))
+	}
+
+	cfg, err := config.LoadConfig(configPath(flags), sysLog, env, flags)
+	return cfg, rest, err
+}
+
+// configPath picks the config file from the --config flag, then the environment
+func configPath(flags config.Overrides) string {
+	path := flags[config.ConfigFileFlag]
+	if path == "" {
+		path = os.Getenv(config.ConfigFileEnv)
+	}
+	if path == "" {
+		path = os.Getenv("TEST_CONFIG_FILE")
+	}
+	if path == "" {
+		path = "config.yaml" // Default config file path
+	}
+	return path
 }
 
 func SetupPlugins(cfg config.MainConfig, sysLog syslogwrapper.SyslogWrapperInterface) (api_plugins.APIPlugin, error) {
+	apiPlugin, err := loadPlugin(cfg, sysLog)
+	if err != nil {
+		return nil, err
+	}
+	err = ConfigurePlugin(apiPlugin, cfg.PluginSpec)
+	if err != nil {
+		sysLog.Error(fmt.Sprintf("Invalid config for plugin %s: %v", cfg.PluginSpec.Name, err))
+		return nil, err
+	}
+	return apiPlugin, nil
+}
+
+// loadPlugin loads the configured plugin without handing it its config, for commands that only need its schema
+func loadPlugin(cfg config.MainConfig, sysLog syslogwrapper.SyslogWrapperInterface) (api_plugins.APIPlugin, error) {
 	err := api_plugins.LoadPlugins("api_plugins")
 	if err != nil {
 		sysLog.Error(fmt.Sprintf("Failed to load plugins: %v", err))
@@ -73,42 +197,82 @@ func SetupPlugins(cfg config.MainConfig, sysLog syslogwrapper.SyslogWrapperInter
 
 	api_plugins.SetLoggerForAllPlugins(sysLog)
 
-	return api_plugins.InitPlugin(cfg.PluginSpec.Name)
+	apiPlugin, err := api_plugins.InitPlugin(cfg.PluginSpec.Name)
+	if err != nil {
+		return nil, err
+	}
+	if err := database.ValidateIdentifiers(apiPlugin); err != nil {
+		sysLog.Error(fmt.Sprintf("Plugin %s supplies invalid identifiers: %v", cfg.PluginSpec.Name, err))
+		return nil, err
+	}
+	return apiPlugin, nil
 }
 
-func InitializeDatabases(cfg config.MainConfig, sysLog syslogwrapper.SyslogWrapperInterface, apiPlugin api_plugins.APIPlugin) (*database.DBManager, error) {
-	dbManager := database.NewDBManager(cfg.MySQL)
-	dbManager.InitializeDatabases(cfg, sysLog, apiPlugin)
+func InitializeDatabases(cfg config.MainConfig, mysqlConfig config.MySQLConfig, sysLog syslogwrapper.SyslogWrapperInterface, apiPlugin api_plugins.APIPlugin) (*database.DBManager, error) {
+	dbManager, err := database.NewDBManager(mysqlConfig)
+	if err != nil {
+		sysLog.Error(fmt.Sprintf("Failed to set up MySQL connection: %v", err))
+		return nil, err
+	}
+	report := dbManager.InitializeDatabases(cfg, sysLog, apiPlugin)
+	if err := report.Err(); err != nil {
+		dbManager.Close()
+		return nil, fmt.Errorf("failed to create %d of %d databases and tables: %w", len(report.Failed()), len(report), err)
+	}
 	return dbManager, nil
 }
 
-func CreateTableWorkers(dbManager *database.DBManager, sysLog syslogwrapper.SyslogWrapperInterface, apiPlugin api_plugins.APIPlugin) (map[string]chan []interface{}, *sync.WaitGroup) {
-	tableChannels := make(map[string]chan []interface{})
-	var wg sync.WaitGroup
+// CreateTableWorkers starts one worker per table on every target that the router lets write it
+func CreateTableWorkers(cfg config.MainConfig, targets []Target, router *routing.Router, sysLog syslogwrapper.SyslogWrapperInterface, apiPlugin api_plugins.APIPlugin, workerOpts WorkerOptions) (*TableQueues, error) {
+	tableQueues := NewTableQueues()
+	shares := database.WriteShares(cfg, apiPlugin.TablePrefix())
 
-	for _, dbName := range dbManager.DBs {
-		for _, tableName := range dbManager.Tables[dbName] {
-			ch := make(chan []interface{})
-			tableChannels[fmt.Sprintf("%s.%s", dbName, tableName)] = ch
-			wg.Add(1)
-			go TableWorker(dbName, tableName, ch, &wg, sysLog, dbManager, apiPlugin)
+	for _, target := range targets {
+		for _, table := range database.Tables(cfg, apiPlugin.TablePrefix()) {
+			if !router.Owns(target.Name, table.Database, table.Name) {
+				continue
+			}
+			name := router.QueueName(target.Name, table.Database, table.Name)
+			err := tableQueues.Start(cfg, target, name, table, shares[table.Database+"."+table.Name], sysLog, apiPlugin, workerOpts)
+			if err != nil {
+				return nil, err
+			}
 		}
 	}
 
-	return tableChannels, &wg
+	return tableQueues, nil
 }
 
-func StartDataFetching(apiPlugin api_plugins.APIPlugin, tableChannels map[string]chan []interface{}, sysLog syslogwrapper.SyslogWrapperInterface, stop chan struct{}) {
+// idlePhaseCheck is how often the fetch loop looks for the end of a workload phase with a rate of 0
+const idlePhaseCheck = time.Second
+
+// StartDataFetching fetches from the live plugin instance on its interval, shaped by the workload profile and the admin
+// fetch control, and hands every batch to the table queues
+func StartDataFetching(plugin *LivePlugin, router *routing.Router, distributor *distribution.Distributor, tableQueues *TableQueues, sysLog syslogwrapper.SyslogWrapperInterface, stop chan struct{}, profile *workload.Profile, control *FetchControl) {
+	weight := func(queueName string) float64 {
+		control, _ := tableQueues.Control(queueName)
+		return control.Share()
+	}
 	go func() {
+		profile.Start()
 		for {
 			select {
 			case <-stop:
-				for _, ch := range tableChannels {
-					close(ch)
-				}
+				tableQueues.Close()
 				return
 			default:
-				err := FetchAndDistributeData(apiPlugin, tableChannels, sysLog)
+				phase := profile.Phase()
+				if workload.Idle(phase) {
+					// Nothing is fetched during the phase, look again for the next one
+					if !control.wait(idlePhaseCheck, stop) {
+						tableQueues.Close()
+						return
+					}
+					continue
+				}
+				apiPlugin := plugin.Get()
+				err := FetchAndDistributeData(apiPlugin, router, distributor, workload.ActiveTables(phase, tableQueues.Snapshot()), weight, sysLog)
+				control.fetched(err)
 				if err != nil {
 					sysLog.Warning(fmt.Sprintf("Error fetching data: %v", err))
 					time.Sleep(5 * time.Second) // Wait before retrying
@@ -120,13 +284,18 @@ func StartDataFetching(apiPlugin api_plugins.APIPlugin, tableChannels map[string
 					time.Sleep(5 * time.Second) // Wait before retrying
 					continue
 				}
-				time.Sleep(time.Duration(interval) * time.Second)
+				if !control.wait(workload.Interval(phase, time.Duration(interval)*time.Second), stop) {
+					tableQueues.Close()
+					return
+				}
 			}
 		}
 	}()
 }
 
-func FetchAndDistributeData(apiPlugin api_plugins.APIPlugin, tableChannels map[string]chan []interface{}, sysLog syslogwrapper.SyslogWrapperInterface) error {
+// FetchAndDistributeData fetches one batch and hands it to the table queues. weight returns the write weight
+// of a queue's table, used by the weighted distribution.
+func FetchAndDistributeData(apiPlugin api_plugins.APIPlugin, router *routing.Router, distributor *distribution.Distributor, tableQueues map[string]*queue.Queue, weight func(queueName string) float64, sysLog syslogwrapper.SyslogWrapperInterface) error {
 	// Fetch data from the API plugin
 	data, err := apiPlugin.FetchData()
 	if err != nil {
@@ -145,68 +314,44 @@ func FetchAndDistributeData(apiPlugin api_plugins.APIPlugin, tableChannels map[s
 		return fmt.Errorf("unsupported data type")
 	}
 
-	// Send the batch data to each channel
-	for _, ch := range tableChannels {
-		// Send the batch data to the channel
-		// Here we use a goroutine to avoid blocking if the channel might be full
-		go func(ch chan []interface{}) {
-			ch <- batchData
-		}(ch)
+	// Send the batch data to each table queue, the queue overflow policy decides what happens when a table falls behind.
+	// Under hash_key routing each target only receives the records that hash to it. A distributor then picks the
+	// tables of each record, the same table on every target when the whole batch goes to all of them.
+	parts := router.Split(batchData)
+	tables := make(map[string]string) // db.table to one of its queue names
+	for name := range tableQueues {
+		tables[routing.TableOf(name)] = name
 	}
-
-	return nil
-}
-
-func TableWorker(dbName, tableName string, batchChan <-chan []interface{}, wg *sync.WaitGroup, sysLog syslogwrapper.SyslogWrapperInterface, dbManager database.DBManagerInterface, apiPlugin api_plugins.APIPlugin) {
-	defer wg.Done()
-
-	fieldNames := apiPlugin.GetFieldNames()
-	fieldNamesStr := strings.Join(fieldNames, ", ")
-	placeholderStr := strings.Repeat("?, ", len(fieldNames)-1) + "?"
-
-	// Get a connection from the pool
-	db, err := dbManager.Conn(context.Background())
-	if err != nil {
-		sysLog.Warning(fmt.Sprintf("Failed to get connection from pool: %v", err))
-		return
+	tableNames := make([]string, 0, len(tables))
+	for table := range tables {
+		tableNames = append(tableNames, table)
 	}
-	defer func(db *sql.Conn) {
-		err := db.Close()
-		if err != nil {
-			sysLog.Warning(fmt.Sprintf("Failed to release DBPool connection: %v", err))
-		}
-	}(db)
-
-	for batch := range batchChan {
-		tx, err := db.BeginTx(context.Background(), &sql.TxOptions{})
-		if err != nil {
-			sysLog.Warning(fmt.Sprintf("Failed to begin transaction: %v", err))
-			continue
+	tableWeight := func(table string) float64 { return weight(tables[table]) }
+	distributed := make(map[string]map[string][]interface{}) // per target under hash_key, shared otherwise
+	for name, q := range tableQueues {
+		batch := batchData
+		if parts != nil {
+			batch = parts[routing.TargetOf(name)]
 		}
-
-		for _, record := range batch {
-			values := apiPlugin.GetValues(record)
-			query := fmt.Sprintf("%s %s.%s (%s) VALUES (%s)",
-				"INSERT INTO",
-				dbName,
-				tableName,
-				fieldNamesStr,
-				placeholderStr,
-			)
-			_, err := tx.Exec(query, values...)
-			if err != nil {
-				sysLog.Warning(fmt.Sprintf("Failed to insert record into %s.%s: %v", dbName, tableName, err))
-				err := tx.Rollback()
-				if err != nil {
-					sysLog.Warning(fmt.Sprintf("Failed to rollback transaction: %v", err))
-				} // Rollback the current transaction on error
-				continue
+		if distributor != nil {
+			key := ""
+			if parts != nil {
+				key = routing.TargetOf(name)
 			}
-			// Commit each record change
-			err = tx.Commit()
-			if err != nil {
-				sysLog.Warning(fmt.Sprintf("Failed to commit transaction: %v", err))
+			split, ok := distributed[key]
+			if !ok {
+				split = distributor.Split(batch, tableNames, tableWeight)
+				distributed[key] = split
 			}
+			batch = split[routing.TableOf(name)]
+		}
+		if (parts != nil || distributor != nil) && len(batch) == 0 {
+			continue
+		}
+		if !q.Push(batch) {
+			sysLog.Warning(fmt.Sprintf("FetchAndDistributeData: Dropped batch for %s, queue is full", name))
 		}
 	}
+
+	return nil
 }
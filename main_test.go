@@ -1,18 +1,34 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"database/sql"
 	"encoding/json"
+	"expvar"
 	"fmt"
 	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-sql-driver/mysql"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"io"
 	"mysql_public_data_ingestor/api_plugins"
+	"mysql_public_data_ingestor/audit"
+	"mysql_public_data_ingestor/config"
+	"mysql_public_data_ingestor/database"
+	"mysql_public_data_ingestor/deadletter"
+	"mysql_public_data_ingestor/distribution"
+	"mysql_public_data_ingestor/queue"
+	"mysql_public_data_ingestor/retry"
+	"mysql_public_data_ingestor/routing"
+	"mysql_public_data_ingestor/spool"
 	"mysql_public_data_ingestor/syslogwrapper"
 	"os"
+	"path/filepath"
+	"regexp"
 	"sync"
 	"testing"
+	"time"
 )
 
 // Mock implementations for testing
@@ -109,6 +125,8 @@ func (m *MockDBManager) Conn(ctx context.Context) (*sql.Conn, error) {
 	return m.DbPool.Conn(ctx)
 }
 
+func (m *MockDBManager) CheckPrimary() {}
+
 // Test for FetchAndDistributeData function
 func TestFetchAndDistributeData(t *testing.T) {
 	// Mock Syslog
@@ -120,23 +138,59 @@ func TestFetchAndDistributeData(t *testing.T) {
 	mockAPIPlugin.On("GetFieldNames").Return([]string{"field1", "field2"})
 	mockAPIPlugin.On("GetValues", mock.Anything).Return([]interface{}{1, "value"})
 	t.Logf("Setup Mock and catch methods...")
-	tableChannels := make(map[string]chan []interface{})
-	tableChannels["db.table"] = make(chan []interface{})
-	t.Logf("Setup tableChannels...")
+	tableQueue, err := queue.New("db.table", config.QueueConfig{Capacity: 1})
+	if err != nil {
+		t.Fatalf("Error creating table queue: %v", err)
+	}
+	tableQueues := map[string]*queue.Queue{"db.table": tableQueue}
+	t.Logf("Setup tableQueues...")
 
-	err := FetchAndDistributeData(mockAPIPlugin, tableChannels, mockSyslog)
+	err = FetchAndDistributeData(mockAPIPlugin, nil, nil, tableQueues, nil, mockSyslog)
 	assert.NoError(t, err)
 	t.Logf("Ran FetchAndDistributeData...")
 
-	// Check channel data
-	batchData := <-tableChannels["db.table"]
+	// Check queued data
+	batchData := <-tableQueue.C()
 	assert.Equal(t, 2, len(batchData))
 }
 
+// TestFetchAndDistributeDataDistributed tests a distributor picks tables per record and that a table gets the
+// same records on every target
+func TestFetchAndDistributeDataDistributed(t *testing.T) {
+	mockSyslog := new(MockSyslogWrapper)
+	mockAPIPlugin := new(MockAPIPlugin)
+	records := make([]interface{}, 100)
+	for i := range records {
+		records[i] = i
+	}
+	mockAPIPlugin.On("FetchData").Return(api_plugins.Response{Records: records}, nil)
+
+	router, err := routing.New(config.RoutingConfig{Policy: config.RouteReplicate}, []string{"a", "b"}, nil, nil)
+	assert.NoError(t, err)
+	tableQueues := make(map[string]*queue.Queue)
+	for _, name := range []string{"a/p1.hot", "a/p1.cold", "b/p1.hot", "b/p1.cold"} {
+		q, err := queue.New(name, config.QueueConfig{Capacity: 1})
+		assert.NoError(t, err)
+		tableQueues[name] = q
+	}
+	weights := map[string]float64{"a/p1.hot": 1, "b/p1.hot": 1}
+	distributor := distribution.New(config.DistributionConfig{Mode: config.DistributeWeighted, Fanout: 1})
+
+	err = FetchAndDistributeData(mockAPIPlugin, router, distributor, tableQueues, func(name string) float64 { return weights[name] }, mockSyslog)
+	assert.NoError(t, err)
+
+	hot := <-tableQueues["a/p1.hot"].C()
+	assert.Equal(t, records, hot, "Only the weighted table should be picked")
+	assert.Equal(t, hot, <-tableQueues["b/p1.hot"].C())
+	assert.Equal(t, 0, tableQueues["a/p1.cold"].Len())
+	assert.Equal(t, 0, tableQueues["b/p1.cold"].Len())
+}
+
 // Test for TableWorker function
 func TestTableWorker(t *testing.T) {
 	// Mock Syslog
 	mockSyslog := new(MockSyslogWrapper)
+	mockSyslog.On("Warning", mock.Anything).Return()
 
 	// Setup mock database manager
 	mockDBManager, err := NewMockDBManager()
@@ -154,25 +208,27 @@ func TestTableWorker(t *testing.T) {
 	mockAPIPlugin.On("GetFieldNames").Return([]string{"field1", "field2"})
 	mockAPIPlugin.On("GetValues", mock.Anything).Return([]interface{}{1, "value"})
 
-	// Mock the SQL expectations
-	mockDBManager.Mock.ExpectBegin()
+	// Mock the SQL expectations, each record is committed on its own
 	query := fmt.Sprintf(
-		"%s %s.%s (%s) VALUES (%s)",
+		"%s `%s`.`%s` (%s) VALUES (%s)",
 		"INSERT INTO",
 		"test_db",
 		"test_table",
-		"field1, field2",
+		"`field1`, `field2`",
 		"?, ?",
 	)
-	mockDBManager.Mock.ExpectExec(query).WithArgs(1, "value").WillReturnResult(sqlmock.NewResult(1, 1))
-	mockDBManager.Mock.ExpectCommit()
+	for i := 0; i < 2; i++ {
+		mockDBManager.Mock.ExpectBegin()
+		mockDBManager.Mock.ExpectExec(regexp.QuoteMeta(query)).WithArgs(1, "value").WillReturnResult(sqlmock.NewResult(1, 1))
+		mockDBManager.Mock.ExpectCommit()
+	}
 
 	// Setup table worker
 	var wg sync.WaitGroup
 	batchChan := make(chan []interface{})
 	wg.Add(1)
 
-	go TableWorker("test_db", "test_table", batchChan, &wg, mockSyslog, mockDBManager, mockAPIPlugin)
+	go TableWorker("test_db", "test_table", batchChan, &wg, mockSyslog, mockDBManager, mockAPIPlugin, WorkerOptions{})
 
 	// Send test data
 	batchChan <- []interface{}{"record1", "record2"}
@@ -186,6 +242,328 @@ func TestTableWorker(t *testing.T) {
 	}
 }
 
+func TestWriteQuery(t *testing.T) {
+	columns := []string{"a", "b"}
+	assert.Equal(t, "INSERT INTO `db`.`t` (`a`, `b`) VALUES (?, ?)", writeQuery("", "db", "t", columns, 1, false))
+	assert.Equal(t, "INSERT IGNORE INTO `db`.`t` (`a`, `b`) VALUES (?, ?)", writeQuery(config.StatementInsertIgnore, "db", "t", columns, 1, false))
+	assert.Equal(t, "REPLACE INTO `db`.`t` (`a`, `b`) VALUES (?, ?)", writeQuery(config.StatementReplace, "db", "t", columns, 1, false))
+	assert.Equal(t, "INSERT INTO `db`.`t` (`a`, `b`) VALUES (?, ?) ON DUPLICATE KEY UPDATE `a` = VALUES(`a`), `b` = VALUES(`b`)", writeQuery(config.StatementUpsert, "db", "t", columns, 1, false))
+	assert.Equal(t, "INSERT INTO `db`.`t` (`a`, `b`) VALUES (?, ?) AS `new` ON DUPLICATE KEY UPDATE `a` = `new`.`a`, `b` = `new`.`b`", writeQuery(config.StatementUpsert, "db", "t", columns, 1, true))
+	assert.Equal(t, "INSERT INTO `db`.`t` (`a`, `b`) VALUES (?, ?), (?, ?), (?, ?)", writeQuery("", "db", "t", columns, 3, false))
+	assert.Equal(t, "INSERT INTO `auto-1`.`order` (`time`, `key`) VALUES (?, ?)", writeQuery("", "auto-1", "order", []string{"time", "key"}, 1, false))
+
+	assert.Equal(t, []int{1}, statementSizes(1))
+	assert.Equal(t, []int{8, 4, 2, 1}, statementSizes(8))
+	assert.Equal(t, []int{100, 64, 32, 16, 8, 4, 2, 1}, statementSizes(100))
+}
+
+func TestEncodeRow(t *testing.T) {
+	var buf bytes.Buffer
+	err := encodeRow(&buf, []interface{}{nil, "back\\slash\ttab\nline", true, 1.5, int64(7), []interface{}{"x", 1}})
+	assert.NoError(t, err)
+	assert.Equal(t, `\N`+"\t"+`back\\slash\ttab\nline`+"\t1\t1.5\t7\t"+`["x",1]`+"\n", buf.String())
+}
+
+// TestTableWorkerLoadData tests a load_data worker writes the whole batch with one LOAD DATA statement
+func TestTableWorkerLoadData(t *testing.T) {
+	mockSyslog := new(MockSyslogWrapper)
+	mockDBManager, err := NewMockDBManager()
+	if err != nil {
+		t.Fatalf("Error creating mock DBManager: %v", err)
+	}
+	defer mockDBManager.DbPool.Close()
+
+	mockAPIPlugin := new(MockAPIPlugin)
+	mockAPIPlugin.On("GetFieldNames").Return([]string{"field1", "field2"})
+	mockAPIPlugin.On("GetValues", mock.Anything).Return([]interface{}{1, "value"})
+
+	mockDBManager.Mock.ExpectExec("LOAD DATA LOCAL INFILE 'Reader::ingestor_load_\\d+' INTO TABLE `test_db`\\.`test_table` .* \\(`field1`, `field2`\\)").
+		WillReturnResult(sqlmock.NewResult(0, 3))
+
+	var wg sync.WaitGroup
+	batchChan := make(chan []interface{})
+	wg.Add(1)
+	go TableWorker("test_db", "test_table", batchChan, &wg, mockSyslog, mockDBManager, mockAPIPlugin, WorkerOptions{Statement: config.StatementLoadData})
+	batchChan <- []interface{}{"record1", "record2", "record3"}
+	close(batchChan)
+	wg.Wait()
+
+	if err := mockDBManager.Mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unmet expectations: %v", err)
+	}
+}
+
+// TestTableWorkerPrepared tests a worker prepares each statement size once and prepares again after a table change
+func TestTableWorkerPrepared(t *testing.T) {
+	mockSyslog := new(MockSyslogWrapper)
+	mockDBManager, err := NewMockDBManager()
+	if err != nil {
+		t.Fatalf("Error creating mock DBManager: %v", err)
+	}
+	defer mockDBManager.DbPool.Close()
+
+	mockAPIPlugin := new(MockAPIPlugin)
+	mockAPIPlugin.On("GetFieldNames").Return([]string{"field1", "field2"})
+	mockAPIPlugin.On("GetValues", mock.Anything).Return([]interface{}{1, "value"})
+
+	two := "^" + regexp.QuoteMeta("INSERT INTO `test_db`.`test_table` (`field1`, `field2`) VALUES (?, ?), (?, ?)") + "$"
+	one := "^" + regexp.QuoteMeta("INSERT INTO `test_db`.`test_table` (`field1`, `field2`) VALUES (?, ?)") + "$"
+	mockDBManager.Mock.ExpectPrepare(two).WillBeClosed()
+	mockDBManager.Mock.ExpectExec(two).WithArgs(1, "value", 1, "value").WillReturnResult(sqlmock.NewResult(0, 2))
+	mockDBManager.Mock.ExpectPrepare(one).WillBeClosed()
+	mockDBManager.Mock.ExpectExec(one).WithArgs(1, "value").WillReturnResult(sqlmock.NewResult(0, 1))
+	// The second batch reuses both statements
+	mockDBManager.Mock.ExpectExec(two).WillReturnResult(sqlmock.NewResult(0, 2))
+	mockDBManager.Mock.ExpectExec(one).WillReturnResult(sqlmock.NewResult(0, 1))
+	// The third one finds the table changed
+	mockDBManager.Mock.ExpectExec(one).WillReturnError(&mysql.MySQLError{Number: erNeedReprepare, Message: "Prepared statement needs to be re-prepared"})
+	mockDBManager.Mock.ExpectPrepare(one).WillBeClosed()
+	mockDBManager.Mock.ExpectExec(one).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	var wg sync.WaitGroup
+	batchChan := make(chan []interface{})
+	wg.Add(1)
+	go TableWorker("test_db", "test_table", batchChan, &wg, mockSyslog, mockDBManager, mockAPIPlugin, WorkerOptions{Prepare: true, RowsPerStatement: 2})
+	batchChan <- []interface{}{"record1", "record2", "record3"}
+	batchChan <- []interface{}{"record4", "record5", "record6"}
+	batchChan <- []interface{}{"record7"}
+	close(batchChan)
+	wg.Wait()
+
+	if err := mockDBManager.Mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unmet expectations: %v", err)
+	}
+}
+
+// TestTableWorkerSplitsMultiRow tests a multi-row statement failing on a record is written again one record at a time
+func TestTableWorkerSplitsMultiRow(t *testing.T) {
+	mockSyslog := new(MockSyslogWrapper)
+	mockSyslog.On("Warning", mock.Anything).Return()
+	mockDBManager, err := NewMockDBManager()
+	if err != nil {
+		t.Fatalf("Error creating mock DBManager: %v", err)
+	}
+	defer mockDBManager.DbPool.Close()
+
+	mockAPIPlugin := new(MockAPIPlugin)
+	mockAPIPlugin.On("GetFieldNames").Return([]string{"field1", "field2"})
+	mockAPIPlugin.On("GetValues", mock.Anything).Return([]interface{}{1, "value"})
+
+	two := "^" + regexp.QuoteMeta("INSERT INTO `test_db`.`test_table` (`field1`, `field2`) VALUES (?, ?), (?, ?)") + "$"
+	one := "^" + regexp.QuoteMeta("INSERT INTO `test_db`.`test_table` (`field1`, `field2`) VALUES (?, ?)") + "$"
+	duplicate := &mysql.MySQLError{Number: 1062, Message: "Duplicate entry"}
+	mockDBManager.Mock.ExpectBegin()
+	mockDBManager.Mock.ExpectExec(two).WillReturnError(duplicate)
+	mockDBManager.Mock.ExpectRollback()
+	mockDBManager.Mock.ExpectBegin()
+	mockDBManager.Mock.ExpectExec(one).WillReturnResult(sqlmock.NewResult(1, 1))
+	mockDBManager.Mock.ExpectCommit()
+	mockDBManager.Mock.ExpectBegin()
+	mockDBManager.Mock.ExpectExec(one).WillReturnError(duplicate)
+	mockDBManager.Mock.ExpectRollback()
+	mockDBManager.Mock.ExpectBegin()
+	mockDBManager.Mock.ExpectExec(one).WillReturnResult(sqlmock.NewResult(1, 1))
+	mockDBManager.Mock.ExpectCommit()
+
+	var wg sync.WaitGroup
+	batchChan := make(chan []interface{})
+	wg.Add(1)
+	go TableWorker("test_db", "test_table", batchChan, &wg, mockSyslog, mockDBManager, mockAPIPlugin, WorkerOptions{RowsPerStatement: 2})
+	batchChan <- []interface{}{"record1", "record2", "record3"}
+	close(batchChan)
+	wg.Wait()
+
+	if err := mockDBManager.Mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unmet expectations: %v", err)
+	}
+	mockSyslog.AssertNumberOfCalls(t, "Warning", 1)
+}
+
+// Test that TableWorker spools a batch it cannot write and replays it once MySQL is back
+func TestTableWorkerSpoolsDuringOutage(t *testing.T) {
+	mockSyslog := new(MockSyslogWrapper)
+	mockSyslog.On("Warning", mock.Anything).Return()
+
+	mockDBManager, err := NewMockDBManager()
+	if err != nil {
+		t.Fatalf("Error creating mock DBManager: %v", err)
+	}
+
+	mockAPIPlugin := new(MockAPIPlugin)
+	mockAPIPlugin.On("GetFieldNames").Return([]string{"field1", "field2"})
+	mockAPIPlugin.On("GetValues", mock.Anything).Return([]interface{}{1, "value"})
+
+	outageSpool, err := spool.Open("test_db.test_table", t.TempDir(), config.SpoolConfig{})
+	if err != nil {
+		t.Fatalf("Error opening spool: %v", err)
+	}
+	defer outageSpool.Close()
+
+	// The first attempt fails, the replay on shutdown succeeds
+	mockDBManager.Mock.ExpectBegin().WillReturnError(mysql.ErrInvalidConn)
+	mockDBManager.Mock.ExpectBegin()
+	mockDBManager.Mock.ExpectExec(regexp.QuoteMeta("INSERT INTO `test_db`.`test_table`")).WithArgs(1, "value").WillReturnResult(sqlmock.NewResult(1, 1))
+	mockDBManager.Mock.ExpectCommit()
+
+	var wg sync.WaitGroup
+	batchChan := make(chan []interface{})
+	wg.Add(1)
+	go TableWorker("test_db", "test_table", batchChan, &wg, mockSyslog, mockDBManager, mockAPIPlugin, WorkerOptions{Spool: outageSpool, ReplayInterval: time.Hour})
+
+	batchChan <- []interface{}{"record1"}
+	close(batchChan)
+	wg.Wait()
+
+	assert.Equal(t, 0, outageSpool.Len(), "Spooled batch should be replayed")
+	if err := mockDBManager.Mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unmet expectations: %v", err)
+	}
+}
+
+// Test that TableWorker retries a deadlocked insert and halts on a policy that says so
+func TestTableWorkerErrorPolicies(t *testing.T) {
+	mockSyslog := new(MockSyslogWrapper)
+	mockSyslog.On("Warning", mock.Anything).Return()
+	mockSyslog.On("Error", mock.Anything).Return()
+
+	mockDBManager, err := NewMockDBManager()
+	if err != nil {
+		t.Fatalf("Error creating mock DBManager: %v", err)
+	}
+
+	mockAPIPlugin := new(MockAPIPlugin)
+	mockAPIPlugin.On("GetFieldNames").Return([]string{"field1", "field2"})
+	mockAPIPlugin.On("GetValues", mock.Anything).Return([]interface{}{1, "value"})
+
+	query := regexp.QuoteMeta("INSERT INTO `test_db`.`test_table`")
+	mockDBManager.Mock.ExpectBegin()
+	mockDBManager.Mock.ExpectExec(query).WillReturnError(&mysql.MySQLError{Number: 1213, Message: "Deadlock found"})
+	mockDBManager.Mock.ExpectRollback()
+	mockDBManager.Mock.ExpectBegin()
+	mockDBManager.Mock.ExpectExec(query).WillReturnResult(sqlmock.NewResult(1, 1))
+	mockDBManager.Mock.ExpectCommit()
+	mockDBManager.Mock.ExpectBegin()
+	mockDBManager.Mock.ExpectExec(query).WillReturnError(&mysql.MySQLError{Number: 1406, Message: "Data too long"})
+	mockDBManager.Mock.ExpectRollback()
+
+	var haltErr error
+	opts := WorkerOptions{
+		Backoff:  retry.Backoff{Initial: time.Millisecond, Max: time.Millisecond, MaxAttempts: 3},
+		Policies: map[retry.Class]retry.Policy{retry.Deadlock: retry.Retry, retry.DataTooLong: retry.Halt},
+		Halt:     func(err error) { haltErr = err },
+	}
+
+	var wg sync.WaitGroup
+	batchChan := make(chan []interface{}, 2)
+	wg.Add(1)
+	go TableWorker("test_db", "test_table", batchChan, &wg, mockSyslog, mockDBManager, mockAPIPlugin, opts)
+
+	batchChan <- []interface{}{"record1", "record2"}
+	batchChan <- []interface{}{"record3"} // Drained without writing once halted
+	close(batchChan)
+	wg.Wait()
+
+	assert.Error(t, haltErr, "Halt policy should stop the worker")
+	if err := mockDBManager.Mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unmet expectations: %v", err)
+	}
+}
+
+// Test that an audited TableWorker tags rows with the batch id and records the batch checksum
+func TestTableWorkerAudit(t *testing.T) {
+	mockSyslog := new(MockSyslogWrapper)
+	mockSyslog.On("Warning", mock.Anything).Return()
+
+	mockDBManager, err := NewMockDBManager()
+	if err != nil {
+		t.Fatalf("Error creating mock DBManager: %v", err)
+	}
+	defer mockDBManager.DbPool.Close()
+
+	mockAPIPlugin := new(MockAPIPlugin)
+	mockAPIPlugin.On("GetFieldNames").Return([]string{"field1", "field2"})
+	mockAPIPlugin.On("GetValues", "record1").Return([]interface{}{1, "a"})
+	mockAPIPlugin.On("GetValues", "record2").Return([]interface{}{2, "b"})
+
+	sink, err := audit.NewFileSink(filepath.Join(t.TempDir(), "audit.ndjson"))
+	if err != nil {
+		t.Fatalf("Error creating audit sink: %v", err)
+	}
+	defer sink.Close()
+
+	query := regexp.QuoteMeta("INSERT INTO `test_db`.`test_table` (`field1`, `field2`, `_batch_id`) VALUES (?, ?, ?)")
+	for i, value := range []string{"a", "b"} {
+		mockDBManager.Mock.ExpectBegin()
+		mockDBManager.Mock.ExpectExec(query).WithArgs(i+1, value, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+		mockDBManager.Mock.ExpectCommit()
+	}
+
+	var wg sync.WaitGroup
+	batchChan := make(chan []interface{})
+	wg.Add(1)
+	go TableWorker("test_db", "test_table", batchChan, &wg, mockSyslog, mockDBManager, mockAPIPlugin, WorkerOptions{Audit: sink})
+	batchChan <- []interface{}{"record1", "record2"}
+	close(batchChan)
+	wg.Wait()
+
+	var entries []audit.Entry
+	assert.NoError(t, sink.Entries(func(entry audit.Entry) error {
+		entries = append(entries, entry)
+		return nil
+	}))
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, int64(2), entries[0].Rows)
+		assert.Equal(t, audit.RowChecksum([]interface{}{1, "a"})^audit.RowChecksum([]interface{}{2, "b"}), entries[0].Checksum, "The checksum should come from the values written, nothing is read back")
+		assert.NotZero(t, entries[0].BatchID)
+	}
+	if err := mockDBManager.Mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unmet expectations: %v", err)
+	}
+}
+
+// Test that ReplayDeadLetters re-inserts dead letters and keeps the ones that still fail
+func TestReplayDeadLetters(t *testing.T) {
+	mockSyslog := new(MockSyslogWrapper)
+	mockSyslog.On("Warning", mock.Anything).Return()
+	mockSyslog.On("Info", mock.Anything).Return()
+
+	mockDBManager, err := NewMockDBManager()
+	if err != nil {
+		t.Fatalf("Error creating mock DBManager: %v", err)
+	}
+
+	mockAPIPlugin := new(MockAPIPlugin)
+	mockAPIPlugin.On("GetFieldNames").Return([]string{"field1", "field2"})
+	mockAPIPlugin.On("GetValues", mock.Anything).Return([]interface{}{1, "value"})
+
+	sink, err := deadletter.NewFileSink(filepath.Join(t.TempDir(), "dead_letters.ndjson"))
+	if err != nil {
+		t.Fatalf("Error creating dead-letter sink: %v", err)
+	}
+	defer sink.Close()
+	for i := 0; i < 2; i++ {
+		entry, err := deadletter.NewEntry("test_db", "test_table", []interface{}{i}, 1406, fmt.Errorf("Data too long"))
+		if err != nil {
+			t.Fatalf("Error creating dead letter: %v", err)
+		}
+		assert.NoError(t, sink.Write(entry))
+	}
+
+	query := regexp.QuoteMeta("INSERT INTO `test_db`.`test_table`")
+	mockDBManager.Mock.ExpectBegin()
+	mockDBManager.Mock.ExpectExec(query).WillReturnResult(sqlmock.NewResult(1, 1))
+	mockDBManager.Mock.ExpectCommit()
+	mockDBManager.Mock.ExpectBegin()
+	mockDBManager.Mock.ExpectExec(query).WillReturnError(&mysql.MySQLError{Number: 1406, Message: "Data too long"})
+	mockDBManager.Mock.ExpectRollback()
+
+	assert.NoError(t, ReplayDeadLetters(sink, mockDBManager, mockSyslog, mockAPIPlugin))
+	mockSyslog.AssertCalled(t, "Info", "Replayed 1 dead letters, 1 still failing")
+	if err := mockDBManager.Mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unmet expectations: %v", err)
+	}
+}
+
 // Test for SetupSyslog function
 func TestSetupSyslog(t *testing.T) {
 	mockSyslog, err := SetupSyslog("test_tag")
@@ -216,10 +594,12 @@ func TestLoadConfig(t *testing.T) {
 		}
 	}()
 
-	cfg, err := LoadConfig(mockSyslog)
+	cfg, args, err := LoadConfig(mockSyslog, []string{"--databases.copies=7", "verify"})
 	if err != nil {
 		t.Fatalf("Error loading config: %v", err)
 	}
+	assert.Equal(t, 7, cfg.Databases.Copies, "Flags should override the config file")
+	assert.Equal(t, []string{"verify"}, args, "Arguments after the flags should be returned")
 
 	if cfg.PluginSpec.Name == "" {
 		t.Fatal("Expected non-empty plugin name in config")
@@ -251,3 +631,424 @@ func TestLoadConfig(t *testing.T) {
 //		t.Fatal("Expected non-nil plugin")
 //	}
 //}
+
+// newReloadTarget returns a target backed by sqlmock that accepts any statement
+func newReloadTarget(t *testing.T) Target {
+	db, sqlMock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create sqlmock: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	sqlMock.MatchExpectationsInOrder(false)
+	for i := 0; i < 50; i++ {
+		sqlMock.ExpectExec(".").WillReturnResult(sqlmock.NewResult(0, 0))
+	}
+	return Target{Name: "default", DBManager: database.NewDBManagerFromPool(db)}
+}
+
+func newReloadPlugin() *MockAPIPlugin {
+	mockAPIPlugin := new(MockAPIPlugin)
+	mockAPIPlugin.On("Schema").Return("(id INT)")
+	mockAPIPlugin.On("TablePrefix").Return("flights")
+	mockAPIPlugin.On("GetFieldNames").Return([]string{"id"})
+	mockAPIPlugin.On("Name").Return("mock")
+	return mockAPIPlugin
+}
+
+func reloadCount(result string) int64 {
+	if v, ok := configReloads.Get(result).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+// TestReloaderAppliesLayout tests that a reload starts workers for new tables and stops removed ones
+func TestReloaderAppliesLayout(t *testing.T) {
+	mockSyslog := new(MockSyslogWrapper)
+	mockSyslog.On("Info", mock.Anything).Return()
+	mockSyslog.On("Warning", mock.Anything).Return()
+	mockAPIPlugin := newReloadPlugin()
+	target := newReloadTarget(t)
+
+	cfg := config.MainConfig{
+		Databases: config.DBConfig{Prefix: "p", Copies: 1, Extra: map[string]struct {
+			Tables int `yaml:"tables"`
+		}{"foo": {Tables: 1}}},
+		Targets: []config.TargetConfig{{Name: "default"}},
+	}
+	target.DBManager.InitializeDatabases(cfg, mockSyslog, mockAPIPlugin)
+	router, err := routing.New(config.RoutingConfig{Policy: config.RouteReplicate}, []string{"default"}, []string{"id"}, nil)
+	assert.NoError(t, err)
+	tableQueues, err := CreateTableWorkers(cfg, []Target{target}, router, mockSyslog, mockAPIPlugin, WorkerOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"p1.flights", "p_foo.flights_1"}, tableQueues.Names())
+
+	next := cfg
+	next.Databases.Extra = map[string]struct {
+		Tables int `yaml:"tables"`
+	}{"bar": {Tables: 2}}
+	next.WorkloadProfile.Loop = true
+	applied := reloadCount("applied")
+	reloader := NewReloader("config.yaml", func() (config.MainConfig, error) { return next, nil }, cfg, []Target{target}, router, tableQueues, NewLivePlugin(mockAPIPlugin), WorkerOptions{}, mockSyslog)
+	assert.NoError(t, reloader.Reload())
+	assert.Equal(t, applied+1, reloadCount("applied"))
+
+	assert.Equal(t, []string{"p1.flights", "p_bar.flights_1", "p_bar.flights_2"}, tableQueues.Names())
+	assert.Equal(t, next.Databases, reloader.cfg.Databases)
+	assert.False(t, reloader.cfg.WorkloadProfile.Loop, "Sections that need a restart should keep their running value")
+	mockSyslog.AssertCalled(t, "Warning", "Config change to workload_profile needs a restart to take effect")
+
+	tableQueues.Close()
+	tableQueues.Wait()
+}
+
+// reloadablePlugin builds a new instance for each config reload. Its interval is a plain field, so the race
+// detector catches an instance being reconfigured while the fetcher uses it.
+type reloadablePlugin struct {
+	*MockAPIPlugin
+	interval int
+}
+
+func (p *reloadablePlugin) NewInstance() api_plugins.APIPlugin {
+	return &reloadablePlugin{MockAPIPlugin: p.MockAPIPlugin}
+}
+
+func (p *reloadablePlugin) ValidateConfig(raw json.RawMessage) error {
+	var cfg struct {
+		Interval int `json:"interval"`
+	}
+	if err := json.Unmarshal(raw, &cfg); err != nil {
+		return err
+	}
+	if cfg.Interval <= 0 {
+		return fmt.Errorf("interval must be positive")
+	}
+	p.interval = cfg.Interval
+	return nil
+}
+
+func (p *reloadablePlugin) Interval() (int, error) {
+	return p.interval, nil
+}
+
+func (p *reloadablePlugin) FetchData() (interface{}, error) {
+	return api_plugins.Response{Records: []interface{}{p.interval}}, nil
+}
+
+func (p *reloadablePlugin) SetLogger(sysLog syslogwrapper.SyslogWrapperInterface) {}
+
+// TestReloaderRejectsPluginConfig tests that a plugin config the plugin rejects leaves the running config and
+// plugin instance in place
+func TestReloaderRejectsPluginConfig(t *testing.T) {
+	mockSyslog := new(MockSyslogWrapper)
+	mockSyslog.On("Error", mock.Anything).Return()
+	running := &reloadablePlugin{MockAPIPlugin: newReloadPlugin(), interval: 60}
+	plugin := NewLivePlugin(running)
+
+	cfg := config.MainConfig{PluginSpec: api_plugins.PluginSpec{Name: "mock", Config: map[string]interface{}{"interval": 60}}}
+	next := cfg
+	next.PluginSpec.Config = map[string]interface{}{"interval": 0}
+	next.Databases.Copies = 3
+
+	rejected := reloadCount("rejected")
+	reloader := NewReloader("config.yaml", func() (config.MainConfig, error) { return next, nil }, cfg, nil, nil, NewTableQueues(), plugin, WorkerOptions{}, mockSyslog)
+	assert.Error(t, reloader.Reload())
+	assert.Equal(t, rejected+1, reloadCount("rejected"))
+	assert.Equal(t, cfg, reloader.cfg, "The running config should be kept")
+	assert.Same(t, running, plugin.Get(), "The running plugin should be kept")
+	assert.Equal(t, 60, running.interval)
+
+	// A config that fails to load is rejected the same way
+	reloader.load = func() (config.MainConfig, error) { return config.MainConfig{}, fmt.Errorf("invalid config") }
+	assert.Error(t, reloader.Reload())
+	assert.Equal(t, cfg, reloader.cfg)
+}
+
+// TestReloaderKeepsPluginWithoutFactory tests plugins without api_plugins.Factory keep their config until restarted
+func TestReloaderKeepsPluginWithoutFactory(t *testing.T) {
+	mockSyslog := new(MockSyslogWrapper)
+	mockSyslog.On("Info", mock.Anything).Return()
+	mockSyslog.On("Warning", mock.Anything).Return()
+	mockAPIPlugin := newReloadPlugin()
+
+	cfg := config.MainConfig{PluginSpec: api_plugins.PluginSpec{Name: "mock", Config: map[string]interface{}{"interval": 60}}}
+	next := cfg
+	next.PluginSpec.Config = map[string]interface{}{"interval": 30}
+	reloader := NewReloader("config.yaml", func() (config.MainConfig, error) { return next, nil }, cfg, nil, nil, NewTableQueues(), NewLivePlugin(mockAPIPlugin), WorkerOptions{}, mockSyslog)
+	assert.NoError(t, reloader.Reload())
+	assert.Equal(t, cfg.PluginSpec, reloader.cfg.PluginSpec)
+	mockAPIPlugin.AssertNotCalled(t, "ValidateConfig", mock.Anything)
+	mockSyslog.AssertCalled(t, "Warning", "Config change to plugin_spec needs a restart to take effect")
+}
+
+// TestReloadWhileFetching reloads the plugin and layout config while the fetcher and workers run, run it with
+// -race to check nothing the fetcher or workers use is changed in place
+func TestReloadWhileFetching(t *testing.T) {
+	mockSyslog := new(MockSyslogWrapper)
+	mockSyslog.On("Info", mock.Anything).Return()
+	mockSyslog.On("Warning", mock.Anything).Return()
+	mockSyslog.On("Error", mock.Anything).Return()
+	mockAPIPlugin := newReloadPlugin()
+	mockAPIPlugin.On("GetValues", mock.Anything).Return([]interface{}{1})
+	running := &reloadablePlugin{MockAPIPlugin: mockAPIPlugin, interval: 1}
+	plugin := NewLivePlugin(running)
+	target := newReloadTarget(t)
+
+	cfg := config.MainConfig{
+		PluginSpec: api_plugins.PluginSpec{Name: "mock", Config: map[string]interface{}{"interval": 1}},
+		Databases:  config.DBConfig{Prefix: "p", Copies: 1},
+		Queue:      config.QueueConfig{Overflow: queue.DropNewest},
+		Targets:    []config.TargetConfig{{Name: "default"}},
+	}
+	target.DBManager.InitializeDatabases(cfg, mockSyslog, running)
+	router, err := routing.New(config.RoutingConfig{Policy: config.RouteReplicate}, []string{"default"}, []string{"id"}, nil)
+	assert.NoError(t, err)
+	tableQueues, err := CreateTableWorkers(cfg, []Target{target}, router, mockSyslog, running, WorkerOptions{})
+	assert.NoError(t, err)
+
+	stop := make(chan struct{})
+	control := NewFetchControl()
+	control.SetRate(1000)
+	StartDataFetching(plugin, router, nil, tableQueues, mockSyslog, stop, nil, control)
+
+	next := cfg
+	reloader := NewReloader("config.yaml", func() (config.MainConfig, error) { return next, nil }, cfg, []Target{target}, router, tableQueues, plugin, WorkerOptions{}, mockSyslog)
+	for i := 2; i < 12; i++ {
+		next.PluginSpec.Config = map[string]interface{}{"interval": i}
+		next.Databases.Copies = 1 + i%2
+		assert.NoError(t, reloader.Reload())
+		assert.Equal(t, i, plugin.Get().(*reloadablePlugin).interval)
+		time.Sleep(5 * time.Millisecond)
+	}
+	assert.Equal(t, 1, running.interval, "The first instance should never be reconfigured")
+
+	close(stop)
+	tableQueues.Close()
+	tableQueues.Wait()
+}
+
+// TestTableWorkerPause tests a paused worker leaves batches queued until resumed and reports its last error
+func TestTableWorkerPause(t *testing.T) {
+	mockSyslog := new(MockSyslogWrapper)
+	mockSyslog.On("Warning", mock.Anything).Return()
+
+	mockDBManager, err := NewMockDBManager()
+	if err != nil {
+		t.Fatalf("Error creating mock DBManager: %v", err)
+	}
+	defer mockDBManager.DbPool.Close()
+
+	mockAPIPlugin := new(MockAPIPlugin)
+	mockAPIPlugin.On("GetFieldNames").Return([]string{"field1"})
+	mockAPIPlugin.On("GetValues", mock.Anything).Return([]interface{}{1})
+
+	mockDBManager.Mock.ExpectBegin()
+	mockDBManager.Mock.ExpectExec("INSERT INTO `test_db`.`test_table`").WillReturnError(&mysql.MySQLError{Number: 1062, Message: "Duplicate entry"})
+	mockDBManager.Mock.ExpectRollback()
+
+	control := &TableControl{}
+	control.Set(true)
+	var wg sync.WaitGroup
+	batchChan := make(chan []interface{}, 1)
+	wg.Add(1)
+	go TableWorker("test_db", "test_table", batchChan, &wg, mockSyslog, mockDBManager, mockAPIPlugin, WorkerOptions{Control: control})
+
+	batchChan <- []interface{}{"record1"}
+	time.Sleep(50 * time.Millisecond)
+	assert.Len(t, batchChan, 1, "A paused worker should not take batches")
+
+	control.Set(false)
+	close(batchChan)
+	wg.Wait()
+
+	assert.NoError(t, mockDBManager.Mock.ExpectationsWereMet())
+	lastErr, at := control.LastError()
+	assert.ErrorContains(t, lastErr, "Duplicate entry")
+	assert.False(t, at.IsZero())
+}
+
+// TestTableWorkerPausedShutdown tests a paused table under the block policy still shuts down once its queue is
+// full: the blocked fetcher is released and the worker drains the queue and exits
+func TestTableWorkerPausedShutdown(t *testing.T) {
+	mockSyslog := new(MockSyslogWrapper)
+	mockSyslog.On("Warning", mock.Anything).Return()
+
+	mockDBManager, err := NewMockDBManager()
+	if err != nil {
+		t.Fatalf("Error creating mock DBManager: %v", err)
+	}
+	defer mockDBManager.DbPool.Close()
+
+	mockAPIPlugin := new(MockAPIPlugin)
+	mockAPIPlugin.On("GetFieldNames").Return([]string{"field1"})
+	mockAPIPlugin.On("GetValues", mock.Anything).Return([]interface{}{1})
+
+	mockDBManager.Mock.ExpectBegin()
+	mockDBManager.Mock.ExpectExec("INSERT INTO `test_db`.`test_table`").WithArgs(1).WillReturnResult(sqlmock.NewResult(1, 1))
+	mockDBManager.Mock.ExpectCommit()
+
+	q, err := queue.New("test.paused_shutdown", config.QueueConfig{Capacity: 1, Overflow: queue.Block})
+	if err != nil {
+		t.Fatalf("Error creating queue: %v", err)
+	}
+	control := &TableControl{}
+	control.Set(true)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go TableWorker("test_db", "test_table", q.C(), &wg, mockSyslog, mockDBManager, mockAPIPlugin, WorkerOptions{Control: control, Closed: q.Done()})
+
+	assert.True(t, q.Push([]interface{}{"record1"}))
+	pushed := make(chan bool)
+	go func() { pushed <- q.Push([]interface{}{"record2"}) }()
+	select {
+	case <-pushed:
+		t.Fatal("Push should block while the queue is full")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	done := make(chan struct{})
+	go func() {
+		q.Close()
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case ok := <-pushed:
+		assert.False(t, ok, "Closing the queue should release the blocked Push")
+	case <-time.After(time.Second):
+		t.Fatal("Push still blocked after Close")
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Paused worker did not exit after its queue closed")
+	}
+	assert.True(t, control.Paused())
+	assert.NoError(t, mockDBManager.Mock.ExpectationsWereMet())
+}
+
+// TestFetchControlWait tests the fetch loop wait honours the rate, immediate fetches and pauses
+func TestFetchControlWait(t *testing.T) {
+	stop := make(chan struct{})
+	control := NewFetchControl()
+
+	control.SetRate(100)
+	start := time.Now()
+	assert.True(t, control.wait(time.Second, stop))
+	assert.Less(t, time.Since(start), 500*time.Millisecond, "A higher rate should shorten the interval")
+
+	control.FetchNow()
+	start = time.Now()
+	assert.True(t, control.wait(time.Hour, stop), "FetchNow should end the wait")
+	assert.Less(t, time.Since(start), time.Second)
+
+	control.Set(true)
+	done := make(chan bool)
+	go func() { done <- control.wait(time.Millisecond, stop) }()
+	select {
+	case <-done:
+		t.Fatal("A paused loop should keep waiting")
+	case <-time.After(50 * time.Millisecond):
+	}
+	control.Set(false)
+	assert.True(t, <-done)
+
+	close(stop)
+	assert.False(t, control.wait(time.Hour, stop), "Closing stop should end the wait")
+}
+
+// TestPrintDDL tests print-ddl writes every statement terminated so it can be piped to the mysql client
+func TestPrintDDL(t *testing.T) {
+	mockAPIPlugin := newReloadPlugin()
+	cfg := config.MainConfig{Databases: config.DBConfig{Prefix: "p", Copies: 2}}
+
+	var out bytes.Buffer
+	assert.NoError(t, PrintDDL(cfg, mockAPIPlugin, &out))
+	assert.Equal(t, "CREATE DATABASE IF NOT EXISTS `p1`;\n"+
+		"CREATE TABLE IF NOT EXISTS `p1`.`_ingestor` (created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP);\n"+
+		"CREATE TABLE IF NOT EXISTS `p1`.`flights` (id INT);\n"+
+		"CREATE DATABASE IF NOT EXISTS `p2`;\n"+
+		"CREATE TABLE IF NOT EXISTS `p2`.`_ingestor` (created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP);\n"+
+		"CREATE TABLE IF NOT EXISTS `p2`.`flights` (id INT);\n", out.String())
+}
+
+// TestDrop tests drop only lists what it would drop until confirmed with --yes, and leaves databases init
+// did not create for the current config alone unless asked with --orphans
+func TestDrop(t *testing.T) {
+	db, sqlMock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+	dbManager := database.NewDBManagerFromPool(db)
+	cfg := config.MainConfig{Databases: config.DBConfig{Prefix: "p", Copies: 2}}
+	expectDatabases := func() {
+		sqlMock.ExpectQuery("information_schema.SCHEMATA").WillReturnRows(
+			sqlmock.NewRows([]string{"SCHEMA_NAME"}).AddRow("mysql").AddRow("p1").AddRow("p2").AddRow("p_extra").AddRow("prod"))
+		sqlMock.ExpectQuery("information_schema.TABLES").WithArgs(database.MarkerTable).WillReturnRows(
+			sqlmock.NewRows([]string{"TABLE_SCHEMA"}).AddRow("p1").AddRow("p_extra"))
+	}
+
+	expectDatabases()
+	var out bytes.Buffer
+	assert.NoError(t, Drop(cfg, []*database.DBManager{dbManager}, false, false, &out))
+	assert.Equal(t, "would drop p1 on default\n"+
+		"skipping p2 on default, init did not create it\n"+
+		"skipping p_extra on default, it is not in the current config\n"+
+		"1 databases left in place, run drop --yes to drop them\n"+
+		"2 databases only match databases.prefix, add --orphans to drop them too\n", out.String())
+
+	expectDatabases()
+	sqlMock.ExpectExec("DROP DATABASE IF EXISTS `p1`").WillReturnResult(sqlmock.NewResult(0, 0))
+	out.Reset()
+	assert.NoError(t, Drop(cfg, []*database.DBManager{dbManager}, true, false, &out))
+	assert.Equal(t, "dropped p1 on default\n"+
+		"skipping p2 on default, init did not create it\n"+
+		"skipping p_extra on default, it is not in the current config\n"+
+		"2 databases only match databases.prefix, add --orphans to drop them too\n", out.String())
+
+	expectDatabases()
+	sqlMock.ExpectExec("DROP DATABASE IF EXISTS `p1`").WillReturnResult(sqlmock.NewResult(0, 0))
+	sqlMock.ExpectExec("DROP DATABASE IF EXISTS `p2`").WillReturnResult(sqlmock.NewResult(0, 0))
+	sqlMock.ExpectExec("DROP DATABASE IF EXISTS `p_extra`").WillReturnResult(sqlmock.NewResult(0, 0))
+	out.Reset()
+	assert.NoError(t, Drop(cfg, []*database.DBManager{dbManager}, true, true, &out))
+	assert.Equal(t, "dropped p1 on default\ndropped p2 on default\ndropped p_extra on default\n", out.String())
+	assert.NoError(t, sqlMock.ExpectationsWereMet())
+}
+
+// TestCreateLayout tests init lists every database and table with its outcome and fails when any failed
+func TestCreateLayout(t *testing.T) {
+	db, sqlMock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+	dbManager := database.NewDBManagerFromPool(db)
+	mockSyslog := new(MockSyslogWrapper)
+	mockSyslog.On("Error", mock.Anything).Return()
+	cfg := config.MainConfig{Databases: config.DBConfig{Prefix: "p", Copies: 2}}
+
+	sqlMock.ExpectExec("CREATE DATABASE IF NOT EXISTS `p1`").WillReturnResult(sqlmock.NewResult(0, 1))
+	sqlMock.ExpectExec("CREATE TABLE IF NOT EXISTS `p1`.`_ingestor`").WillReturnResult(sqlmock.NewResult(0, 0))
+	sqlMock.ExpectExec("CREATE TABLE IF NOT EXISTS `p1`.`flights`").WillReturnResult(sqlmock.NewResult(0, 0))
+	sqlMock.ExpectExec("CREATE DATABASE IF NOT EXISTS `p2`").WillReturnError(&mysql.MySQLError{Number: 1044, Message: "Access denied"})
+
+	var out bytes.Buffer
+	err = CreateLayout(cfg, []*database.DBManager{dbManager}, newReloadPlugin(), mockSyslog, &out)
+	assert.EqualError(t, err, "failed to create 2 of 4 databases and tables")
+	assert.Equal(t, "TARGET   OBJECT    NAME        RESULT\n"+
+		"default  database  p1          ok\n"+
+		"default  table     p1.flights  ok\n"+
+		"default  database  p2          failed: Error 1044: Access denied\n"+
+		"default  table     p2.flights  failed: skipped, the database could not be created\n", out.String())
+	mockSyslog.AssertNumberOfCalls(t, "Error", 2)
+	assert.NoError(t, sqlMock.ExpectationsWereMet())
+}
+
+func TestRunCommandFlags(t *testing.T) {
+	mockSyslog := new(MockSyslogWrapper)
+	assert.ErrorContains(t, RunCommand("status", []string{"--yes"}, config.MainConfig{}, mockSyslog, io.Discard), "not supported by status")
+	assert.ErrorContains(t, RunCommand("status", []string{"--orphans"}, config.MainConfig{}, mockSyslog, io.Discard), "not supported by status")
+	assert.ErrorContains(t, RunCommand("bogus", nil, config.MainConfig{}, mockSyslog, io.Discard), "unknown command")
+}
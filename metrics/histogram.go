@@ -0,0 +1,113 @@
+package metrics
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// latencyBuckets are the upper bounds of the histogram buckets, roughly doubling from 250µs to 10s
+var latencyBuckets = []time.Duration{
+	250 * time.Microsecond, 500 * time.Microsecond,
+	time.Millisecond, 2 * time.Millisecond, 5 * time.Millisecond,
+	10 * time.Millisecond, 25 * time.Millisecond, 50 * time.Millisecond,
+	100 * time.Millisecond, 250 * time.Millisecond, 500 * time.Millisecond,
+	time.Second, 2500 * time.Millisecond, 5 * time.Second, 10 * time.Second,
+}
+
+// LatencyHistogram counts durations into fixed buckets. It publishes the bucket counts together with
+// p50/p95/p99 estimates, each estimate being the upper bound of the bucket holding that quantile.
+type LatencyHistogram struct {
+	mu     sync.Mutex
+	counts []int64 // one per bucket plus the overflow bucket
+	count  int64
+	sum    time.Duration
+}
+
+// Histogram returns the latency histogram registered under name, creating it if needed.
+func Histogram(name string) *LatencyHistogram {
+	mu.Lock()
+	defer mu.Unlock()
+	if v := expvar.Get(name); v != nil {
+		return v.(*LatencyHistogram)
+	}
+	h := newLatencyHistogram()
+	expvar.Publish(name, h)
+	return h
+}
+
+func newLatencyHistogram() *LatencyHistogram {
+	return &LatencyHistogram{counts: make([]int64, len(latencyBuckets)+1)}
+}
+
+// Observe records one duration
+func (h *LatencyHistogram) Observe(d time.Duration) {
+	i := 0
+	for i < len(latencyBuckets) && d > latencyBuckets[i] {
+		i++
+	}
+	h.mu.Lock()
+	h.counts[i]++
+	h.count++
+	h.sum += d
+	h.mu.Unlock()
+}
+
+// Quantile returns the upper bound of the bucket holding quantile q, or 0 when nothing was observed.
+// Durations beyond the last bucket report as the last bound.
+func (h *LatencyHistogram) Quantile(q float64) time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.quantile(q)
+}
+
+func (h *LatencyHistogram) quantile(q float64) time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+	rank := int64(q * float64(h.count))
+	if rank >= h.count {
+		rank = h.count - 1
+	}
+	var seen int64
+	for i, n := range h.counts {
+		seen += n
+		if seen > rank {
+			if i == len(latencyBuckets) {
+				break
+			}
+			return latencyBuckets[i]
+		}
+	}
+	return latencyBuckets[len(latencyBuckets)-1]
+}
+
+// String implements expvar.Var
+func (h *LatencyHistogram) String() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	buckets := make(map[string]int64, len(h.counts))
+	for i, n := range h.counts {
+		if i == len(latencyBuckets) {
+			buckets["inf"] = n
+			continue
+		}
+		buckets[fmt.Sprintf("le_%s", latencyBuckets[i])] = n
+	}
+	var meanMs float64
+	if h.count > 0 {
+		meanMs = float64(h.sum.Microseconds()) / float64(h.count) / 1000
+	}
+	out, _ := json.Marshal(map[string]interface{}{
+		"count":   h.count,
+		"mean_ms": meanMs,
+		"p50_ms":  float64(h.quantile(0.50).Microseconds()) / 1000,
+		"p95_ms":  float64(h.quantile(0.95).Microseconds()) / 1000,
+		"p99_ms":  float64(h.quantile(0.99).Microseconds()) / 1000,
+		"buckets": buckets,
+	})
+	return string(out)
+}
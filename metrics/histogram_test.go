@@ -0,0 +1,29 @@
+package metrics
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHistogram(t *testing.T) {
+	assert.Same(t, Histogram("test_latency"), Histogram("test_latency"), "Lookups should return the registered histogram")
+
+	h := newLatencyHistogram()
+	assert.Equal(t, time.Duration(0), h.Quantile(0.5))
+
+	for i := 0; i < 90; i++ {
+		h.Observe(800 * time.Microsecond)
+	}
+	for i := 0; i < 10; i++ {
+		h.Observe(40 * time.Millisecond)
+	}
+	assert.Equal(t, time.Millisecond, h.Quantile(0.5))
+	assert.Equal(t, 50*time.Millisecond, h.Quantile(0.95))
+
+	var out map[string]interface{}
+	assert.NoError(t, json.Unmarshal([]byte(h.String()), &out), "The histogram should publish valid JSON")
+	assert.Equal(t, 100.0, out["count"])
+}
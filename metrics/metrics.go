@@ -0,0 +1,73 @@
+package metrics
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"mysql_public_data_ingestor/syslogwrapper"
+)
+
+// Metrics are published through expvar so they show up under /debug/vars without
+// pulling in an external client library. Lookups are get-or-create so packages can
+// declare the metrics they use at init time and tests can re-run freely.
+
+var mu sync.Mutex
+
+// Counter returns the integer metric registered under name, creating it if needed.
+// It is used for both monotonically increasing counters and integer gauges.
+func Counter(name string) *expvar.Int {
+	mu.Lock()
+	defer mu.Unlock()
+	if v := expvar.Get(name); v != nil {
+		return v.(*expvar.Int)
+	}
+	return expvar.NewInt(name)
+}
+
+// Gauge returns the floating point metric registered under name, creating it if needed.
+func Gauge(name string) *expvar.Float {
+	mu.Lock()
+	defer mu.Unlock()
+	if v := expvar.Get(name); v != nil {
+		return v.(*expvar.Float)
+	}
+	return expvar.NewFloat(name)
+}
+
+// Label returns the string metric registered under name, creating it if needed.
+func Label(name string) *expvar.String {
+	mu.Lock()
+	defer mu.Unlock()
+	if v := expvar.Get(name); v != nil {
+		return v.(*expvar.String)
+	}
+	return expvar.NewString(name)
+}
+
+// Map returns the keyed metric registered under name, creating it if needed.
+// Keys are typically table names ("db.table").
+func Map(name string) *expvar.Map {
+	mu.Lock()
+	defer mu.Unlock()
+	if v := expvar.Get(name); v != nil {
+		return v.(*expvar.Map)
+	}
+	return expvar.NewMap(name)
+}
+
+// Serve exposes all registered metrics as JSON on addr under /debug/vars.
+// An empty addr disables the listener.
+func Serve(addr string, sysLog syslogwrapper.SyslogWrapperInterface) {
+	if addr == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			sysLog.Error(fmt.Sprintf("Metrics listener on %s stopped: %v", addr, err))
+		}
+	}()
+}
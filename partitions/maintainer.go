@@ -0,0 +1,159 @@
+package partitions
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"mysql_public_data_ingestor/api_plugins"
+	"mysql_public_data_ingestor/config"
+	"mysql_public_data_ingestor/database"
+	"mysql_public_data_ingestor/metrics"
+	"mysql_public_data_ingestor/syslogwrapper"
+)
+
+var (
+	partitionsAdded   = metrics.Map("partitions_added")
+	partitionsDropped = metrics.Map("partitions_dropped")
+	partitionErrors   = metrics.Map("partition_errors")
+)
+
+// Maintainer keeps the partitioned tables of one target rotating: it adds the partitions the coming
+// intervals need and drops those whose rows are all past retention
+type Maintainer struct {
+	cfg        config.PartitioningConfig
+	maxAge     time.Duration // 0 keeps every partition
+	target     string
+	prefix     string
+	dbManager  *database.DBManager
+	timeColumn string
+	sysLog     syslogwrapper.SyslogWrapperInterface
+	now        func() time.Time
+
+	skipped map[string]bool // tables already warned about
+}
+
+// New returns a Maintainer for the tables of dbManager generated with prefix. It returns nil when
+// partitioning is disabled. Partitions are ranges of the plugin's time column, so the plugin has to
+// implement api_plugins.TimeColumnProvider.
+func New(cfg config.MainConfig, dbManager *database.DBManager, apiPlugin api_plugins.APIPlugin, sysLog syslogwrapper.SyslogWrapperInterface) (*Maintainer, error) {
+	if cfg.Partitioning.Interval <= 0 {
+		return nil, nil
+	}
+	provider, ok := apiPlugin.(api_plugins.TimeColumnProvider)
+	if !ok {
+		return nil, fmt.Errorf("partitioning: plugin %s has no time column to partition by", apiPlugin.Name())
+	}
+	return &Maintainer{
+		cfg:        cfg.Partitioning,
+		maxAge:     cfg.Retention.MaxAge,
+		target:     dbManager.Name,
+		prefix:     cfg.Databases.Prefix,
+		dbManager:  dbManager,
+		timeColumn: provider.TimeColumn(),
+		sysLog:     sysLog,
+		now:        time.Now,
+		skipped:    make(map[string]bool),
+	}, nil
+}
+
+// Run maintains the partitions right away, catching up after downtime, and then every check_interval until
+// stop is closed. A nil Maintainer does nothing.
+func (m *Maintainer) Run(stop <-chan struct{}, wg *sync.WaitGroup) {
+	if m == nil {
+		return
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(m.cfg.CheckInterval)
+		defer ticker.Stop()
+		for {
+			if err := m.Maintain(); err != nil {
+				partitionErrors.Add(m.target, 1)
+				m.sysLog.Error(fmt.Sprintf("Partition maintenance on target %s failed: %v", m.target, err))
+			}
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Maintain runs one pass over the tables of the current layout in databases init created. A table that fails
+// is logged and the others are still maintained; the error reports how many failed.
+func (m *Maintainer) Maintain() error {
+	tables, err := m.dbManager.LayoutTablesWithColumn(m.prefix, m.timeColumn)
+	if err != nil {
+		return err
+	}
+	failed := 0
+	for _, table := range tables {
+		dbName, tableName, _ := strings.Cut(table, ".")
+		if err := m.maintainTable(dbName, tableName); err != nil {
+			failed++
+			m.sysLog.Warning(fmt.Sprintf("Failed to maintain partitions of %s on target %s: %v", table, m.target, err))
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d tables failed", failed, len(tables))
+	}
+	return nil
+}
+
+func (m *Maintainer) maintainTable(dbName, tableName string) error {
+	table := fmt.Sprintf("%s.%s", dbName, tableName)
+	existing, partitioned, err := m.dbManager.Partitions(dbName, tableName, m.timeColumn)
+	if errors.Is(err, database.ErrForeignPartitions) {
+		if !m.skipped[table] {
+			m.skipped[table] = true
+			m.sysLog.Warning(fmt.Sprintf("Leaving the partitions of %s on target %s alone: %v", table, m.target, err))
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !partitioned || len(existing) == 0 {
+		if !m.skipped[table] {
+			m.skipped[table] = true
+			m.sysLog.Warning(fmt.Sprintf("Table %s on target %s was created without partitions, drop and init it to partition it", table, m.target))
+		}
+		return nil
+	}
+
+	now := m.now()
+	last := time.Unix(existing[len(existing)-1].LessThan, 0)
+	until := now.Truncate(m.cfg.Interval).Add(time.Duration(m.cfg.Ahead+1) * m.cfg.Interval)
+	if added := database.PartitionsUntil(last, until, m.cfg.Interval); len(added) > 0 {
+		if err := m.dbManager.AddPartitions(dbName, tableName, added); err != nil {
+			return fmt.Errorf("failed to add partitions: %w", err)
+		}
+		partitionsAdded.Add(m.target, int64(len(added)))
+		m.sysLog.Info(fmt.Sprintf("Added %d partitions to %s on target %s, now covered until %s", len(added), table, m.target, until.UTC().Format(time.RFC3339)))
+	}
+
+	if m.maxAge <= 0 {
+		return nil
+	}
+	cutoff := now.Add(-m.maxAge).Unix()
+	var expired []string
+	for _, partition := range existing {
+		if partition.LessThan <= cutoff {
+			expired = append(expired, partition.Name)
+		}
+	}
+	if len(expired) == 0 {
+		return nil
+	}
+	if err := m.dbManager.DropPartitions(dbName, tableName, expired); err != nil {
+		return fmt.Errorf("failed to drop expired partitions: %w", err)
+	}
+	partitionsDropped.Add(m.target, int64(len(expired)))
+	m.sysLog.Info(fmt.Sprintf("Dropped %d partitions older than %v from %s on target %s", len(expired), m.maxAge, table, m.target))
+	return nil
+}
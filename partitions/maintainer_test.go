@@ -0,0 +1,132 @@
+package partitions
+
+import (
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"mysql_public_data_ingestor/config"
+	"mysql_public_data_ingestor/database"
+)
+
+// MockSyslogWrapper is a mock implementation of syslogwrapper.SyslogWrapper
+type MockSyslogWrapper struct {
+	mock.Mock
+}
+
+func (m *MockSyslogWrapper) Close() {
+	m.Called()
+}
+
+func (m *MockSyslogWrapper) Warning(message string) {
+	m.Called(message)
+}
+
+func (m *MockSyslogWrapper) Error(message string) {
+	m.Called(message)
+}
+
+func (m *MockSyslogWrapper) Info(message string) {
+	m.Called(message)
+}
+
+func (m *MockSyslogWrapper) Debug(message string) {
+	m.Called(message)
+}
+
+// TestMaintain tests missing future partitions are split off pmax and expired ones dropped, tables without
+// partitions or with partitions init did not create are only warned about once, and tables outside the layout
+// or in databases init did not create are never touched
+func TestMaintain(t *testing.T) {
+	db, sqlMock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error creating mock DB: %v", err)
+	}
+	defer db.Close()
+	mockSyslog := new(MockSyslogWrapper)
+	mockSyslog.On("Info", mock.Anything).Return()
+	mockSyslog.On("Warning", mock.Anything).Return()
+
+	now := time.Date(2024, 5, 1, 12, 34, 0, 0, time.UTC)
+	dbManager := database.NewDBManagerFromPool(db)
+	dbManager.SetLayout(config.MainConfig{Databases: config.DBConfig{Prefix: "p", Copies: 3}}, "flights")
+	m := &Maintainer{
+		cfg:        config.PartitioningConfig{Interval: time.Hour, Ahead: 1},
+		maxAge:     2 * time.Hour,
+		target:     "default",
+		prefix:     "p",
+		dbManager:  dbManager,
+		timeColumn: "time",
+		sysLog:     mockSyslog,
+		now:        func() time.Time { return now },
+		skipped:    make(map[string]bool),
+	}
+	columns := []string{"PARTITION_NAME", "PARTITION_DESCRIPTION", "PARTITION_METHOD", "PARTITION_EXPRESSION"}
+	partitionRows := func() *sqlmock.Rows {
+		return sqlmock.NewRows(columns).
+			AddRow("p20240501_0900", "1714557600", "RANGE", "`time`"). // ends 10:00, all rows past max_age
+			AddRow("p20240501_1000", "1714561200", "RANGE", "`time`"). // ends 11:00, still holds rows after the 10:34 cutoff
+			AddRow("p20240501_1100", "1714564800", "RANGE", "`time`").
+			AddRow("pmax", "MAXVALUE", "RANGE", "`time`")
+	}
+
+	for pass := 0; pass < 2; pass++ {
+		sqlMock.ExpectQuery("information_schema.SCHEMATA").
+			WillReturnRows(sqlmock.NewRows([]string{"SCHEMA_NAME"}).AddRow("p1").AddRow("p2").AddRow("p3").AddRow("p_archive"))
+		sqlMock.ExpectQuery("information_schema.COLUMNS").
+			WillReturnRows(sqlmock.NewRows([]string{"TABLE_SCHEMA", "TABLE_NAME"}).
+				AddRow("p1", "flights").AddRow("p1", "flights_old").AddRow("p2", "flights").AddRow("p3", "flights").AddRow("p_archive", "auto_archive"))
+		sqlMock.ExpectQuery("information_schema.TABLES").WithArgs(database.MarkerTable).
+			WillReturnRows(sqlmock.NewRows([]string{"TABLE_SCHEMA"}).AddRow("p1").AddRow("p2").AddRow("p3"))
+		sqlMock.ExpectQuery("information_schema.PARTITIONS").WithArgs("p1", "flights").WillReturnRows(partitionRows())
+		sqlMock.ExpectExec(regexp.QuoteMeta("ALTER TABLE `p1`.`flights` REORGANIZE PARTITION `pmax` INTO (" +
+			"PARTITION `p20240501_1200` VALUES LESS THAN (1714568400), " +
+			"PARTITION `p20240501_1300` VALUES LESS THAN (1714572000), " +
+			"PARTITION `pmax` VALUES LESS THAN MAXVALUE)")).WillReturnResult(sqlmock.NewResult(0, 0))
+		sqlMock.ExpectExec(regexp.QuoteMeta("ALTER TABLE `p1`.`flights` DROP PARTITION `p20240501_0900`")).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		sqlMock.ExpectQuery("information_schema.PARTITIONS").WithArgs("p2", "flights").
+			WillReturnRows(sqlmock.NewRows(columns))
+		sqlMock.ExpectQuery("information_schema.PARTITIONS").WithArgs("p3", "flights").
+			WillReturnRows(sqlmock.NewRows(columns).AddRow("p0", "1000000", "RANGE", "`id`").AddRow("p1", "2000000", "RANGE", "`id`"))
+		assert.NoError(t, m.Maintain())
+	}
+
+	mockSyslog.AssertNumberOfCalls(t, "Warning", 2)
+	mockSyslog.AssertCalled(t, "Info", "Added 2 partitions to p1.flights on target default, now covered until 2024-05-01T14:00:00Z")
+	assert.NoError(t, sqlMock.ExpectationsWereMet())
+}
+
+func TestNewDisabled(t *testing.T) {
+	m, err := New(config.MainConfig{}, nil, nil, nil)
+	assert.NoError(t, err)
+	assert.Nil(t, m)
+	m.Run(nil, nil) // A nil Maintainer does nothing
+}
+
+// TestForeignPartitions tests only RANGE partitions of the time column named as init names them are maintained
+func TestForeignPartitions(t *testing.T) {
+	db, sqlMock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error creating mock DB: %v", err)
+	}
+	defer db.Close()
+	dbManager := database.NewDBManagerFromPool(db)
+	columns := []string{"PARTITION_NAME", "PARTITION_DESCRIPTION", "PARTITION_METHOD", "PARTITION_EXPRESSION"}
+
+	for name, rows := range map[string]*sqlmock.Rows{
+		"other column":  sqlmock.NewRows(columns).AddRow("p20240501_0900", "1714557600", "RANGE", "`id`"),
+		"other names":   sqlmock.NewRows(columns).AddRow("p2023", "1704067200", "RANGE", "`time`").AddRow("pmax", "MAXVALUE", "RANGE", "`time`"),
+		"no pmax":       sqlmock.NewRows(columns).AddRow("p20240501_0900", "1714557600", "RANGE", "`time`"),
+		"other method":  sqlmock.NewRows(columns).AddRow("p0", "", "HASH", "`time`"),
+		"after maximum": sqlmock.NewRows(columns).AddRow("pmax", "MAXVALUE", "RANGE", "`time`").AddRow("p20240501_0900", "1714557600", "RANGE", "`time`"),
+	} {
+		sqlMock.ExpectQuery("information_schema.PARTITIONS").WillReturnRows(rows)
+		_, _, err := dbManager.Partitions("p1", "flights", "time")
+		assert.ErrorIs(t, err, database.ErrForeignPartitions, name)
+	}
+	assert.NoError(t, sqlMock.ExpectationsWereMet())
+}
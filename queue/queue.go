@@ -0,0 +1,218 @@
+package queue
+
+import (
+	"expvar"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"mysql_public_data_ingestor/config"
+	"mysql_public_data_ingestor/metrics"
+	"mysql_public_data_ingestor/spool"
+)
+
+// Overflow policies applied when a table queue is full
+const (
+	Block      = "block"       // the fetcher waits until the writer catches up, holding up the other tables
+	DropOldest = "drop_oldest" // the oldest queued batch is discarded to make room
+	DropNewest = "drop_newest" // the incoming batch is discarded
+	Spill      = "spill"       // the incoming batch is written to disk and replayed later
+)
+
+const defaultCapacity = 10
+
+var (
+	queueDepth     = metrics.Map("queue_depth")
+	droppedBatches = metrics.Map("queue_dropped_batches")
+	spilledBatches = metrics.Map("queue_spilled_batches")
+)
+
+// Queue is a bounded, ordered queue of batches feeding one table worker
+type Queue struct {
+	name   string
+	policy string
+	ch     chan []interface{}
+	spill  *spool.Spool
+
+	mu      sync.Mutex
+	closed  bool
+	stop    chan struct{}  // closed by Close, releases senders blocked on a full queue
+	senders sync.WaitGroup // blocked senders, the channel is closed once they are gone
+	wake    chan struct{}
+	done    chan struct{}
+}
+
+// New creates the queue for a table. Table names are used as metric keys.
+func New(name string, cfg config.QueueConfig) (*Queue, error) {
+	capacity := cfg.Capacity
+	if capacity <= 0 {
+		capacity = defaultCapacity
+	}
+	policy := cfg.Overflow
+	if policy == "" {
+		policy = Block
+	}
+
+	q := &Queue{
+		name:   name,
+		policy: policy,
+		ch:     make(chan []interface{}, capacity),
+		stop:   make(chan struct{}),
+	}
+
+	switch policy {
+	case Block, DropOldest, DropNewest:
+	case Spill:
+		dir := cfg.SpillDir
+		if dir == "" {
+			dir = os.TempDir()
+		}
+		spill, err := spool.Open(name+".overflow", filepath.Join(dir, name, "overflow"), config.SpoolConfig{MaxBytes: cfg.SpillMaxBytes})
+		if err != nil {
+			return nil, err
+		}
+		q.spill = spill
+		q.wake = make(chan struct{}, 1)
+		q.done = make(chan struct{})
+		if spill.Len() > 0 {
+			q.wake <- struct{}{} // Batches left over from a previous run go first
+		}
+		go q.replaySpill()
+	default:
+		return nil, fmt.Errorf("unsupported queue overflow policy: %s", policy)
+	}
+
+	queueDepth.Set(name, expvar.Func(func() any { return q.Len() }))
+	return q, nil
+}
+
+// C returns the channel the table worker reads batches from
+func (q *Queue) C() <-chan []interface{} {
+	return q.ch
+}
+
+// Len returns the number of batches waiting in memory and on disk
+func (q *Queue) Len() int {
+	n := len(q.ch)
+	if q.spill != nil {
+		n += q.spill.Len()
+	}
+	return n
+}
+
+// Done returns a channel closed once Close is called
+func (q *Queue) Done() <-chan struct{} {
+	return q.stop
+}
+
+// Push enqueues a batch according to the overflow policy. It returns false when the batch was dropped.
+// Under the block policy Push waits for room, or until the queue is closed.
+func (q *Queue) Push(batch []interface{}) bool {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return false
+	}
+	if q.policy == Block {
+		// Wait without the lock so Close is not stuck behind a full queue
+		q.senders.Add(1)
+		q.mu.Unlock()
+		defer q.senders.Done()
+		select {
+		case q.ch <- batch:
+			return true
+		case <-q.stop:
+			droppedBatches.Add(q.name, 1)
+			return false
+		}
+	}
+	defer q.mu.Unlock()
+
+	switch q.policy {
+	case DropNewest:
+		select {
+		case q.ch <- batch:
+			return true
+		default:
+			droppedBatches.Add(q.name, 1)
+			return false
+		}
+	case DropOldest:
+		for {
+			select {
+			case q.ch <- batch:
+				return true
+			default:
+			}
+			select {
+			case <-q.ch:
+				droppedBatches.Add(q.name, 1)
+			default:
+			}
+		}
+	case Spill:
+		// Once anything is on disk, new batches follow it there to keep order
+		if q.spill.Len() == 0 {
+			select {
+			case q.ch <- batch:
+				return true
+			default:
+			}
+		}
+		if err := q.spill.Append(batch); err != nil {
+			droppedBatches.Add(q.name, 1)
+			return false
+		}
+		spilledBatches.Add(q.name, 1)
+		select {
+		case q.wake <- struct{}{}:
+		default:
+		}
+		return true
+	default:
+		return false
+	}
+}
+
+// Close stops accepting batches and closes the worker channel once pending in-memory batches are handed over.
+// Batches still spilled to disk are left in the spill file.
+func (q *Queue) Close() {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return
+	}
+	q.closed = true
+	close(q.stop)
+	q.mu.Unlock()
+
+	if q.spill != nil {
+		close(q.wake)
+		<-q.done
+		_ = q.spill.Close()
+	}
+	q.senders.Wait()
+	close(q.ch)
+}
+
+// replaySpill moves spilled batches back into memory, oldest first, as the writer frees up room
+func (q *Queue) replaySpill() {
+	defer close(q.done)
+	for range q.wake {
+		for {
+			batch, ok, err := q.spill.Peek()
+			if err != nil || !ok {
+				break
+			}
+			select {
+			case q.ch <- batch:
+			case <-q.stop:
+				return // The batch stays on disk for the next run
+			}
+			if err := q.spill.Ack(); err != nil {
+				break
+			}
+		}
+	}
+}
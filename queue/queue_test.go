@@ -0,0 +1,85 @@
+package queue
+
+import (
+	"encoding/json"
+	"expvar"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"mysql_public_data_ingestor/config"
+)
+
+func dropped(name string) int64 {
+	if v, ok := droppedBatches.Get(name).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func drain(q *Queue) [][]interface{} {
+	var batches [][]interface{}
+	for batch := range q.C() {
+		batches = append(batches, batch)
+	}
+	return batches
+}
+
+func TestDropNewest(t *testing.T) {
+	before := dropped("test.drop_newest")
+	q, err := New("test.drop_newest", config.QueueConfig{Capacity: 2, Overflow: DropNewest})
+	if err != nil {
+		t.Fatalf("Error creating queue: %v", err)
+	}
+
+	assert.True(t, q.Push([]interface{}{1}))
+	assert.True(t, q.Push([]interface{}{2}))
+	assert.False(t, q.Push([]interface{}{3}), "Push should drop when the queue is full")
+	assert.Equal(t, 2, q.Len())
+
+	q.Close()
+	assert.Equal(t, [][]interface{}{{1}, {2}}, drain(q))
+	assert.Equal(t, before+1, dropped("test.drop_newest"))
+}
+
+func TestDropOldest(t *testing.T) {
+	before := dropped("test.drop_oldest")
+	q, err := New("test.drop_oldest", config.QueueConfig{Capacity: 2, Overflow: DropOldest})
+	if err != nil {
+		t.Fatalf("Error creating queue: %v", err)
+	}
+
+	assert.True(t, q.Push([]interface{}{1}))
+	assert.True(t, q.Push([]interface{}{2}))
+	assert.True(t, q.Push([]interface{}{3}))
+
+	q.Close()
+	assert.Equal(t, [][]interface{}{{2}, {3}}, drain(q))
+	assert.Equal(t, before+1, dropped("test.drop_oldest"))
+}
+
+func TestSpillKeepsOrder(t *testing.T) {
+	q, err := New("test.spill", config.QueueConfig{Capacity: 1, Overflow: Spill, SpillDir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("Error creating queue: %v", err)
+	}
+
+	for i := 1; i <= 5; i++ {
+		assert.True(t, q.Push([]interface{}{i}))
+	}
+
+	var got []interface{}
+	for len(got) < 5 {
+		batch := <-q.C()
+		got = append(got, batch[0])
+	}
+	q.Close()
+
+	// The first batch fits in memory, the others come back from disk with their numbers as json.Number
+	assert.Equal(t, []interface{}{1, json.Number("2"), json.Number("3"), json.Number("4"), json.Number("5")}, got)
+	assert.Equal(t, 0, q.Len())
+}
+
+func TestUnknownPolicy(t *testing.T) {
+	_, err := New("test.unknown", config.QueueConfig{Overflow: "discard"})
+	assert.Error(t, err)
+}
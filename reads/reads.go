@@ -0,0 +1,221 @@
+package reads
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"mysql_public_data_ingestor/config"
+	"mysql_public_data_ingestor/ident"
+	"mysql_public_data_ingestor/metrics"
+	"mysql_public_data_ingestor/syslogwrapper"
+)
+
+// DefaultQueries are the read templates used when none are configured. They target the opensky flights tables
+// and quote every column, time being a keyword. Configured queries are sent as written, only {table} is replaced,
+// so their columns must be quoted by whoever writes them.
+var DefaultQueries = []config.ReadQuery{
+	{Name: "point_lookup", SQL: "SELECT * FROM {table} WHERE `icao24` = ?", Args: []string{"sample:icao24"}, Weight: 5},
+	{Name: "range_scan", SQL: "SELECT `icao24`, `callsign`, `longitude`, `latitude` FROM {table} WHERE `time` >= ? ORDER BY `time` LIMIT 100", Args: []string{"since:5m"}, Weight: 3},
+	{Name: "aggregate", SQL: "SELECT `origin_country`, COUNT(*), AVG(`velocity`) FROM {table} WHERE `time` >= ? GROUP BY `origin_country`", Args: []string{"since:1h"}, Weight: 1},
+	{Name: "json_extract", SQL: "SELECT `icao24`, JSON_LENGTH(`sensors`), JSON_EXTRACT(`sensors`, '$[0]') FROM {table} WHERE `sensors` IS NOT NULL AND `time` >= ? LIMIT 100", Args: []string{"since:15m"}, Weight: 1},
+}
+
+const sampleSize = 100
+
+var (
+	readQueries = metrics.Map("read_queries")
+	readErrors  = metrics.Map("read_errors")
+	readSkipped = metrics.Map("read_skipped") // queries that had no sampled values to bind yet
+)
+
+// Generator issues read queries against the generated tables of one target at a fixed rate
+type Generator struct {
+	target   string
+	pool     func() *sql.DB
+	tables   []string // quoted `db`.`table` names
+	queries  []query
+	weights  int
+	workers  int
+	interval time.Duration // between reads of a single worker
+	timeout  time.Duration
+	sysLog   syslogwrapper.SyslogWrapperInterface
+	samples  *sampler
+}
+
+type query struct {
+	name    string
+	sql     string
+	args    []arg
+	weight  int
+	latency *metrics.LatencyHistogram
+}
+
+type argKind int
+
+const (
+	literalArg argKind = iota
+	sampleArg
+	sinceArg
+)
+
+type arg struct {
+	kind  argKind
+	value string // literal value or sampled column
+	since time.Duration
+}
+
+// New prepares a Generator for target. tables are the db.table names the readers pick from. It returns
+// nil when the read workload is disabled.
+func New(cfg config.ReadWorkloadConfig, target string, pool func() *sql.DB, tables []string, sysLog syslogwrapper.SyslogWrapperInterface) (*Generator, error) {
+	if cfg.Workers <= 0 || cfg.QPS <= 0 || len(tables) == 0 {
+		return nil, nil
+	}
+	g := &Generator{
+		target:   target,
+		pool:     pool,
+		workers:  cfg.Workers,
+		interval: time.Duration(float64(time.Second) * float64(cfg.Workers) / cfg.QPS),
+		timeout:  cfg.Timeout,
+		sysLog:   sysLog,
+		samples:  &sampler{pool: pool, values: make(map[string]*sample)},
+	}
+	if g.timeout <= 0 {
+		g.timeout = 5 * time.Second
+	}
+	for _, table := range tables {
+		dbName, tableName, _ := strings.Cut(table, ".")
+		g.tables = append(g.tables, ident.Table(dbName, tableName))
+	}
+
+	templates := cfg.Queries
+	if len(templates) == 0 {
+		templates = DefaultQueries
+	}
+	for _, tmpl := range templates {
+		q := query{
+			name:    tmpl.Name,
+			sql:     tmpl.SQL,
+			weight:  tmpl.Weight,
+			latency: metrics.Histogram(fmt.Sprintf("read_latency.%s.%s", target, tmpl.Name)),
+		}
+		if q.weight <= 0 {
+			q.weight = 1
+		}
+		for _, raw := range tmpl.Args {
+			a, err := parseArg(raw)
+			if err != nil {
+				return nil, fmt.Errorf("read query %s: %w", tmpl.Name, err)
+			}
+			q.args = append(q.args, a)
+		}
+		g.queries = append(g.queries, q)
+		g.weights += q.weight
+	}
+	return g, nil
+}
+
+func parseArg(raw string) (arg, error) {
+	kind, value, found := strings.Cut(raw, ":")
+	if !found {
+		return arg{kind: literalArg, value: raw}, nil
+	}
+	switch kind {
+	case "sample":
+		return arg{kind: sampleArg, value: value}, nil
+	case "since":
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return arg{}, fmt.Errorf("invalid since argument %s: %w", raw, err)
+		}
+		return arg{kind: sinceArg, since: d}, nil
+	default:
+		return arg{kind: literalArg, value: raw}, nil
+	}
+}
+
+// Run starts the reader goroutines. They stop when stop is closed. A nil Generator does nothing.
+func (g *Generator) Run(stop <-chan struct{}, wg *sync.WaitGroup) {
+	if g == nil {
+		return
+	}
+	g.sysLog.Info(fmt.Sprintf("Starting %d readers on target %s, one read every %v each", g.workers, g.target, g.interval))
+	for i := 0; i < g.workers; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(seed))
+			ticker := time.NewTicker(g.interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-stop:
+					return
+				case <-ticker.C:
+					g.readOnce(rng)
+				}
+			}
+		}(time.Now().UnixNano() + int64(i))
+	}
+}
+
+// readOnce runs one randomly chosen query against one randomly chosen table
+func (g *Generator) readOnce(rng *rand.Rand) {
+	q := g.pick(rng)
+	table := g.tables[rng.Intn(len(g.tables))]
+
+	args := make([]interface{}, 0, len(q.args))
+	for _, a := range q.args {
+		switch a.kind {
+		case sampleArg:
+			value, ok := g.samples.pick(table, a.value, rng)
+			if !ok {
+				readSkipped.Add(q.name, 1)
+				return
+			}
+			args = append(args, value)
+		case sinceArg:
+			args = append(args, time.Now().Add(-a.since).Unix())
+		default:
+			args = append(args, a.value)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), g.timeout)
+	defer cancel()
+	start := time.Now()
+	err := g.query(ctx, strings.ReplaceAll(q.sql, "{table}", table), args)
+	q.latency.Observe(time.Since(start))
+	readQueries.Add(q.name, 1)
+	if err != nil {
+		readErrors.Add(q.name, 1)
+		g.sysLog.Debug(fmt.Sprintf("Read %s on %s failed: %v", q.name, table, err))
+	}
+}
+
+// query runs a statement and reads every row so the latency covers the full result transfer
+func (g *Generator) query(ctx context.Context, statement string, args []interface{}) error {
+	rows, err := g.pool().QueryContext(ctx, statement, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+	}
+	return rows.Err()
+}
+
+func (g *Generator) pick(rng *rand.Rand) query {
+	n := rng.Intn(g.weights)
+	for _, q := range g.queries {
+		if n < q.weight {
+			return q
+		}
+		n -= q.weight
+	}
+	return g.queries[len(g.queries)-1]
+}
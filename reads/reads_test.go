@@ -0,0 +1,128 @@
+package reads
+
+import (
+	"database/sql"
+	"errors"
+	"expvar"
+	"math/rand"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"mysql_public_data_ingestor/config"
+)
+
+// MockSyslogWrapper is a mock implementation of syslogwrapper.SyslogWrapper
+type MockSyslogWrapper struct {
+	mock.Mock
+}
+
+func (m *MockSyslogWrapper) Close() {
+	m.Called()
+}
+
+func (m *MockSyslogWrapper) Warning(message string) {
+	m.Called(message)
+}
+
+func (m *MockSyslogWrapper) Error(message string) {
+	m.Called(message)
+}
+
+func (m *MockSyslogWrapper) Info(message string) {
+	m.Called(message)
+}
+
+func (m *MockSyslogWrapper) Debug(message string) {
+	m.Called(message)
+}
+
+func TestNewDisabled(t *testing.T) {
+	g, err := New(config.ReadWorkloadConfig{}, "default", nil, []string{"auto_1.flights"}, new(MockSyslogWrapper))
+	assert.NoError(t, err)
+	assert.Nil(t, g, "No workers should disable the read workload")
+	g.Run(nil, nil) // A nil Generator is safe to run
+
+	_, err = New(config.ReadWorkloadConfig{
+		Workers: 1,
+		QPS:     10,
+		Queries: []config.ReadQuery{{Name: "bad", SQL: "SELECT 1", Args: []string{"since:soon"}}},
+	}, "default", nil, []string{"auto_1.flights"}, new(MockSyslogWrapper))
+	assert.Error(t, err, "Invalid since durations should be rejected")
+}
+
+func TestReadOnce(t *testing.T) {
+	db, mockDB, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error creating mock DB: %v", err)
+	}
+	defer db.Close()
+
+	g, err := New(config.ReadWorkloadConfig{
+		Workers: 2,
+		QPS:     20,
+		Queries: []config.ReadQuery{{Name: "lookup", SQL: "SELECT * FROM {table} WHERE icao24 = ? AND time >= ?", Args: []string{"sample:icao24", "since:1h"}}},
+	}, "test", func() *sql.DB { return db }, []string{"auto_1.flights"}, new(MockSyslogWrapper))
+	assert.NoError(t, err)
+	assert.Equal(t, 100*time.Millisecond, g.interval, "20 QPS over 2 workers is one read per worker every 100ms")
+
+	mockDB.ExpectQuery(regexp.QuoteMeta("SELECT `icao24` FROM `auto_1`.`flights` WHERE `icao24` IS NOT NULL LIMIT 100")).
+		WillReturnRows(sqlmock.NewRows([]string{"icao24"}).AddRow("abc123"))
+	mockDB.ExpectQuery(regexp.QuoteMeta("SELECT * FROM `auto_1`.`flights` WHERE icao24 = ? AND time >= ?")).
+		WithArgs("abc123", sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"icao24"}).AddRow("abc123"))
+
+	rng := rand.New(rand.NewSource(1))
+	g.readOnce(rng)
+	assert.Greater(t, g.queries[0].latency.Quantile(1), time.Duration(0), "The read latency should be recorded")
+
+	if err := mockDB.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unmet expectations: %v", err)
+	}
+}
+
+func TestReadOnceSkipsEmptyTables(t *testing.T) {
+	db, mockDB, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error creating mock DB: %v", err)
+	}
+	defer db.Close()
+
+	mockSyslog := new(MockSyslogWrapper)
+	mockSyslog.On("Debug", mock.Anything).Return()
+
+	g, err := New(config.ReadWorkloadConfig{
+		Workers: 1,
+		QPS:     1,
+		Queries: []config.ReadQuery{
+			{Name: "empty_lookup", SQL: "SELECT * FROM {table} WHERE icao24 = ?", Args: []string{"sample:icao24"}},
+		},
+	}, "test", func() *sql.DB { return db }, []string{"auto_1.flights"}, mockSyslog)
+	assert.NoError(t, err)
+
+	mockDB.ExpectQuery("SELECT `icao24`").WillReturnError(errors.New("table is missing"))
+	skipped := func() int64 {
+		if v, ok := readSkipped.Get("empty_lookup").(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	before := skipped()
+	g.readOnce(rand.New(rand.NewSource(1)))
+	assert.Equal(t, before+1, skipped(), "Lookups without sampled keys should be skipped")
+
+	if err := mockDB.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unmet expectations: %v", err)
+	}
+}
+
+// TestDefaultQueriesQuoteColumns tests the built-in templates never use a column unquoted, time being a keyword
+func TestDefaultQueriesQuoteColumns(t *testing.T) {
+	bare := regexp.MustCompile("(^|[^`$])\\b(time|icao24|callsign|longitude|latitude|origin_country|velocity|sensors)\\b")
+	for _, q := range DefaultQueries {
+		assert.False(t, bare.MatchString(q.SQL), "%s: %s", q.Name, q.SQL)
+	}
+}
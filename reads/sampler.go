@@ -0,0 +1,75 @@
+package reads
+
+import (
+	"database/sql"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"mysql_public_data_ingestor/ident"
+)
+
+// sampleTTL is how long sampled column values are reused before they are fetched again
+const sampleTTL = 30 * time.Second
+
+// sampler keeps a small set of existing values per table column so lookups hit rows that exist
+type sampler struct {
+	pool func() *sql.DB
+
+	mu     sync.Mutex
+	values map[string]*sample
+}
+
+type sample struct {
+	mu      sync.Mutex
+	values  []interface{}
+	fetched time.Time
+}
+
+// pick returns a random sampled value of column in table. It returns false while the table has no rows.
+func (s *sampler) pick(table, column string, rng *rand.Rand) (interface{}, bool) {
+	key := table + "." + column
+	s.mu.Lock()
+	entry, ok := s.values[key]
+	if !ok {
+		entry = &sample{}
+		s.values[key] = entry
+	}
+	s.mu.Unlock()
+
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+	ttl := sampleTTL
+	if len(entry.values) == 0 {
+		ttl = time.Second // the table may only just have received its first batch
+	}
+	if time.Since(entry.fetched) > ttl {
+		if values, err := s.fetch(table, column); err == nil {
+			entry.values = values
+		}
+		entry.fetched = time.Now()
+	}
+	if len(entry.values) == 0 {
+		return nil, false
+	}
+	return entry.values[rng.Intn(len(entry.values))], true
+}
+
+func (s *sampler) fetch(table, column string) ([]interface{}, error) {
+	rows, err := s.pool().Query(fmt.Sprintf("SELECT %s FROM %s WHERE %s IS NOT NULL LIMIT %d", ident.Quote(column), table, ident.Quote(column), sampleSize))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var values []interface{}
+	for rows.Next() {
+		var value interface{}
+		if err := rows.Scan(&value); err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, rows.Err()
+}
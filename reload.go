@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"mysql_public_data_ingestor/api_plugins"
+	"mysql_public_data_ingestor/config"
+	"mysql_public_data_ingestor/database"
+	"mysql_public_data_ingestor/metrics"
+	"mysql_public_data_ingestor/routing"
+	"mysql_public_data_ingestor/syslogwrapper"
+)
+
+var configReloads = metrics.Map("config_reloads")
+
+// LivePlugin holds the plugin instance the fetcher uses. A config reload configures a new instance and swaps it
+// in, the instance in use is never reconfigured.
+type LivePlugin struct {
+	current atomic.Value // pluginRef
+}
+
+// pluginRef gives atomic.Value the same concrete type whatever the plugin
+type pluginRef struct {
+	apiPlugin api_plugins.APIPlugin
+}
+
+func NewLivePlugin(apiPlugin api_plugins.APIPlugin) *LivePlugin {
+	p := &LivePlugin{}
+	p.Set(apiPlugin)
+	return p
+}
+
+// Get returns the plugin instance configured last
+func (p *LivePlugin) Get() api_plugins.APIPlugin {
+	return p.current.Load().(pluginRef).apiPlugin
+}
+
+// Set swaps in apiPlugin, fetches already running finish on the previous instance
+func (p *LivePlugin) Set(apiPlugin api_plugins.APIPlugin) {
+	p.current.Store(pluginRef{apiPlugin: apiPlugin})
+}
+
+// Reloader re-reads the config on SIGHUP or when the config file changes and applies what can change while
+// running: the database layout, connection pool limits and the config of plugins implementing
+// api_plugins.Factory. A config that fails to load or that the plugin rejects is dropped and the running one is
+// kept. Other changes are logged and wait for a restart.
+type Reloader struct {
+	path    string
+	load    func() (config.MainConfig, error)
+	cfg     config.MainConfig // the config currently applied
+	targets []Target
+	router  *routing.Router
+	tables  *TableQueues
+	plugin  *LivePlugin
+	opts    WorkerOptions
+	sysLog  syslogwrapper.SyslogWrapperInterface
+	modTime time.Time
+}
+
+func NewReloader(path string, load func() (config.MainConfig, error), cfg config.MainConfig, targets []Target, router *routing.Router, tables *TableQueues, plugin *LivePlugin, opts WorkerOptions, sysLog syslogwrapper.SyslogWrapperInterface) *Reloader {
+	r := &Reloader{
+		path:    path,
+		load:    load,
+		cfg:     cfg,
+		targets: targets,
+		router:  router,
+		tables:  tables,
+		plugin:  plugin,
+		opts:    opts,
+		sysLog:  sysLog,
+	}
+	r.modTime = r.fileModTime()
+	return r
+}
+
+// Run reloads on SIGHUP and, when reload.watch_interval is set, whenever the config file's modification
+// time changes. It returns once stop is closed.
+func (r *Reloader) Run(stop <-chan struct{}) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var watch <-chan time.Time
+	if r.cfg.Reload.WatchInterval > 0 {
+		ticker := time.NewTicker(r.cfg.Reload.WatchInterval)
+		defer ticker.Stop()
+		watch = ticker.C
+	}
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-hup:
+			r.modTime = r.fileModTime()
+			r.Reload()
+		case <-watch:
+			modTime := r.fileModTime()
+			if modTime.Equal(r.modTime) {
+				continue
+			}
+			r.modTime = modTime
+			r.Reload()
+		}
+	}
+}
+
+func (r *Reloader) fileModTime() time.Time {
+	info, err := os.Stat(r.path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// Reload loads the config again and applies the difference to the running ingestor
+func (r *Reloader) Reload() error {
+	cfg, err := r.load()
+	if err == nil {
+		err = r.apply(cfg)
+	}
+	if err != nil {
+		configReloads.Add("rejected", 1)
+		r.sysLog.Error(fmt.Sprintf("Config reload rejected, keeping the running config: %v", err))
+		return err
+	}
+	configReloads.Add("applied", 1)
+	r.sysLog.Info(fmt.Sprintf("Config reloaded from %s", r.path))
+	return nil
+}
+
+func (r *Reloader) apply(cfg config.MainConfig) error {
+	// The plugin goes first, it is the only part that can still reject the config and nothing has changed yet
+	applied := r.cfg
+	apiPlugin := r.plugin.Get()
+	if factory, ok := apiPlugin.(api_plugins.Factory); ok && !reflect.DeepEqual(cfg.PluginSpec.Config, r.cfg.PluginSpec.Config) {
+		next := factory.NewInstance()
+		next.SetLogger(r.sysLog)
+		if err := ConfigurePlugin(next, cfg.PluginSpec); err != nil {
+			return fmt.Errorf("plugin config: %w", err)
+		}
+		r.plugin.Set(next)
+		apiPlugin = next
+		applied.PluginSpec.Config = cfg.PluginSpec.Config
+		r.sysLog.Info(fmt.Sprintf("Applied new config to plugin %s", apiPlugin.Name()))
+	}
+
+	applied.MySQL.ConnectionPool = cfg.MySQL.ConnectionPool
+	applied.Targets = append([]config.TargetConfig(nil), r.cfg.Targets...)
+	for i, target := range r.targets {
+		for _, targetCfg := range cfg.Targets {
+			pool := targetCfg.MySQL.ConnectionPool
+			if targetCfg.Name != target.Name || pool == applied.Targets[i].MySQL.ConnectionPool {
+				continue
+			}
+			target.DBManager.SetPoolConfig(pool)
+			applied.Targets[i].MySQL.ConnectionPool = pool
+			r.sysLog.Info(fmt.Sprintf("Target %s connection pool is now %d open, %d idle, %ds lifetime", target.Name, pool.MaxOpenConns, pool.MaxIdleConns, pool.ConnMaxLifetime))
+		}
+	}
+
+	if !reflect.DeepEqual(cfg.Databases, r.cfg.Databases) {
+		applied.Databases = cfg.Databases
+		r.applyLayout(applied, apiPlugin)
+	}
+
+	for _, section := range changedSections(applied, cfg) {
+		r.sysLog.Warning(fmt.Sprintf("Config change to %s needs a restart to take effect", section))
+	}
+	r.cfg = applied
+	return nil
+}
+
+// applyLayout creates the databases and tables cfg adds on every target and starts their workers. Tables that
+// could not be created get no worker. Workers of tables cfg no longer has are stopped once they have written
+// what was queued; the tables themselves are kept. Running tables take their new write share but keep their
+// statement and rows per statement until restarted.
+func (r *Reloader) applyLayout(cfg config.MainConfig, apiPlugin api_plugins.APIPlugin) {
+	shares := database.WriteShares(cfg, apiPlugin.TablePrefix())
+	running := make(map[string]bool)
+	for _, name := range r.tables.Names() {
+		running[name] = true
+	}
+
+	wanted := make(map[string]bool)
+	for _, target := range r.targets {
+		failed := make(map[string]bool)
+		for _, result := range target.DBManager.InitializeDatabases(cfg, r.sysLog, apiPlugin).Failed() {
+			failed[result.Name] = true
+		}
+		for _, table := range database.Tables(cfg, apiPlugin.TablePrefix()) {
+			if !r.router.Owns(target.Name, table.Database, table.Name) {
+				continue
+			}
+			name := r.router.QueueName(target.Name, table.Database, table.Name)
+			wanted[name] = true
+			share := shares[table.Database+"."+table.Name]
+			if running[name] {
+				if control, ok := r.tables.Control(name); ok {
+					control.SetShare(share)
+				}
+				continue
+			}
+			if failed[table.Database+"."+table.Name] {
+				continue // InitializeDatabases logged why
+			}
+			err := r.tables.Start(cfg, target, name, table, share, r.sysLog, apiPlugin, r.opts)
+			if err != nil {
+				r.sysLog.Error(fmt.Sprintf("Failed to start worker for %s: %v", name, err))
+				continue
+			}
+			r.sysLog.Info(fmt.Sprintf("Started worker for %s", name))
+		}
+	}
+
+	for name := range running {
+		if !wanted[name] {
+			r.tables.Stop(name)
+			r.sysLog.Info(fmt.Sprintf("Stopping worker for %s, the table is kept", name))
+		}
+	}
+}
+
+// changedSections lists the top level config sections that differ between applied and cfg
+func changedSections(applied, cfg config.MainConfig) []string {
+	var sections []string
+	a, b := reflect.ValueOf(applied), reflect.ValueOf(cfg)
+	for i := 0; i < a.NumField(); i++ {
+		field := a.Type().Field(i)
+		if !field.IsExported() || reflect.DeepEqual(a.Field(i).Interface(), b.Field(i).Interface()) {
+			continue
+		}
+		name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		sections = append(sections, name)
+	}
+	return sections
+}
+
+// ConfigurePlugin hands the plugin_spec.config section to the plugin, which validates and applies it
+func ConfigurePlugin(apiPlugin api_plugins.APIPlugin, spec api_plugins.PluginSpec) error {
+	raw, err := json.Marshal(spec.Config)
+	if err != nil {
+		return fmt.Errorf("failed to encode plugin config: %w", err)
+	}
+	return apiPlugin.ValidateConfig(raw)
+}
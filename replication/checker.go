@@ -0,0 +1,249 @@
+package replication
+
+import (
+	"database/sql"
+	"expvar"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"mysql_public_data_ingestor/api_plugins"
+	"mysql_public_data_ingestor/config"
+	"mysql_public_data_ingestor/database"
+	"mysql_public_data_ingestor/ident"
+	"mysql_public_data_ingestor/metrics"
+	"mysql_public_data_ingestor/syslogwrapper"
+)
+
+// HeartbeatTable is created in the first generated database of the primary target
+const HeartbeatTable = "_heartbeat"
+
+const heartbeatSchema = `(
+	id TINYINT UNSIGNED NOT NULL PRIMARY KEY,
+	ts DATETIME(6) NOT NULL
+)`
+
+var (
+	replicaLag        = metrics.Map("replica_lag_seconds")
+	checksumsRun      = metrics.Map("replica_checksums")
+	checksumMismatch  = metrics.Map("replica_checksum_mismatches")
+	replicaCheckFails = metrics.Map("replica_check_errors")
+)
+
+// Checker writes pt-heartbeat style heartbeats on a primary target, measures how far each replica is
+// behind, and periodically compares checksums of recent ranges of every generated table.
+type Checker struct {
+	cfg         config.ReplicationCheckConfig
+	primary     func() *sql.DB
+	heartbeatDB string
+	tables      []string // db.table names on the primary
+	columns     []string // plugin fields hashed by the checksums
+	timeColumn  string   // empty disables checksums
+	replicas    []replica
+	sysLog      syslogwrapper.SyslogWrapperInterface
+	now         func() time.Time
+
+	mu   sync.Mutex
+	lags map[string]time.Duration // last measured lag per replica
+}
+
+type replica struct {
+	name      string
+	dbManager *database.DBManager // owned by the Checker, closed with it
+}
+
+// New connects to the configured replicas of primary. It returns nil when no replicas are configured.
+// Checksums need the plugin to implement api_plugins.TimeColumnProvider, otherwise only lag is measured.
+func New(cfg config.ReplicationCheckConfig, primary *database.DBManager, apiPlugin api_plugins.APIPlugin, sysLog syslogwrapper.SyslogWrapperInterface) (*Checker, error) {
+	if len(cfg.Replicas) == 0 {
+		return nil, nil
+	}
+	dbs := primary.DatabaseNames()
+	if len(dbs) == 0 {
+		return nil, fmt.Errorf("replication check: target %s has no databases", primary.Name)
+	}
+
+	var timeColumn string
+	if provider, ok := apiPlugin.(api_plugins.TimeColumnProvider); ok {
+		timeColumn = provider.TimeColumn()
+	} else {
+		sysLog.Warning(fmt.Sprintf("Plugin %s has no time column, replica checksums are disabled", apiPlugin.Name()))
+	}
+
+	replicas := make([]replica, 0, len(cfg.Replicas))
+	for _, replicaCfg := range cfg.Replicas {
+		dbManager, err := database.NewDBManager(replicaCfg.MySQL)
+		if err != nil {
+			closeReplicas(replicas)
+			return nil, fmt.Errorf("replication check: replica %s: %w", replicaCfg.Name, err)
+		}
+		dbManager.Name = replicaCfg.Name
+		replicas = append(replicas, replica{name: replicaCfg.Name, dbManager: dbManager})
+	}
+
+	var tables []string
+	for _, dbName := range dbs {
+		for _, tableName := range primary.TableNames(dbName) {
+			tables = append(tables, fmt.Sprintf("%s.%s", dbName, tableName))
+		}
+	}
+	return newChecker(cfg, primary.Pool, dbs[0], tables, apiPlugin.GetFieldNames(), timeColumn, replicas, sysLog), nil
+}
+
+func newChecker(cfg config.ReplicationCheckConfig, primary func() *sql.DB, heartbeatDB string, tables, columns []string, timeColumn string, replicas []replica, sysLog syslogwrapper.SyslogWrapperInterface) *Checker {
+	return &Checker{
+		cfg:         cfg,
+		primary:     primary,
+		heartbeatDB: heartbeatDB,
+		tables:      tables,
+		columns:     columns,
+		timeColumn:  timeColumn,
+		replicas:    replicas,
+		sysLog:      sysLog,
+		now:         time.Now,
+		lags:        make(map[string]time.Duration),
+	}
+}
+
+// Run creates the heartbeat table and starts the heartbeat and checksum loops. They stop when stop is
+// closed, and the replica connections are closed once they have. A nil Checker does nothing.
+func (c *Checker) Run(stop <-chan struct{}, wg *sync.WaitGroup) error {
+	if c == nil {
+		return nil
+	}
+	_, err := c.primary().Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s %s", ident.Table(c.heartbeatDB, HeartbeatTable), heartbeatSchema))
+	if err != nil {
+		closeReplicas(c.replicas)
+		return fmt.Errorf("failed to create heartbeat table: %w", err)
+	}
+
+	var loops sync.WaitGroup
+	loops.Add(1)
+	go c.every(c.cfg.HeartbeatInterval, stop, &loops, c.heartbeat)
+	if c.timeColumn != "" {
+		loops.Add(1)
+		go c.every(c.cfg.ChecksumInterval, stop, &loops, c.checksumTables)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		loops.Wait()
+		closeReplicas(c.replicas)
+	}()
+	return nil
+}
+
+func closeReplicas(replicas []replica) {
+	for _, r := range replicas {
+		r.dbManager.Close()
+	}
+}
+
+func (c *Checker) every(interval time.Duration, stop <-chan struct{}, wg *sync.WaitGroup, fn func()) {
+	defer wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			fn()
+		}
+	}
+}
+
+// heartbeat writes the current time on the primary and reads it back from every replica. The lag is
+// measured against this process' clock on both sides, so it does not depend on server clocks agreeing.
+// Like pt-heartbeat it includes up to one heartbeat interval of write delay.
+func (c *Checker) heartbeat() {
+	_, err := c.primary().Exec(
+		fmt.Sprintf("REPLACE INTO %s (id, ts) VALUES (1, ?)", ident.Table(c.heartbeatDB, HeartbeatTable)),
+		c.now().UTC(),
+	)
+	if err != nil {
+		c.sysLog.Warning(fmt.Sprintf("Failed to write heartbeat: %v", err))
+		return
+	}
+
+	for _, r := range c.replicas {
+		lag, err := c.lag(r)
+		if err != nil {
+			replicaCheckFails.Add(r.name, 1)
+			c.sysLog.Warning(fmt.Sprintf("Failed to read heartbeat from replica %s: %v", r.name, err))
+			continue
+		}
+		c.mu.Lock()
+		c.lags[r.name] = lag
+		c.mu.Unlock()
+		gauge := new(expvar.Float)
+		gauge.Set(lag.Seconds())
+		replicaLag.Set(r.name, gauge)
+	}
+}
+
+func (c *Checker) lag(r replica) (time.Duration, error) {
+	var ts time.Time
+	err := r.dbManager.Pool().QueryRow(fmt.Sprintf("SELECT ts FROM %s WHERE id = 1", ident.Table(c.heartbeatDB, HeartbeatTable))).Scan(&ts)
+	if err != nil {
+		return 0, err
+	}
+	lag := c.now().Sub(ts)
+	if lag < 0 {
+		lag = 0
+	}
+	return lag, nil
+}
+
+// checksumTables compares the range [now-delay-window, now-delay) of every table on the primary and on
+// each replica that is less than delay behind
+func (c *Checker) checksumTables() {
+	to := c.now().Add(-c.cfg.ChecksumDelay)
+	from := to.Add(-c.cfg.ChecksumWindow)
+
+	for _, r := range c.replicas {
+		c.mu.Lock()
+		lag, measured := c.lags[r.name]
+		c.mu.Unlock()
+		if !measured || lag >= c.cfg.ChecksumDelay {
+			c.sysLog.Info(fmt.Sprintf("Skipping checksums on replica %s, lag %v is not below the checksum delay %v", r.name, lag, c.cfg.ChecksumDelay))
+			continue
+		}
+
+		for _, table := range c.tables {
+			primarySum, err := c.checksum(c.primary(), table, from, to)
+			if err != nil {
+				c.sysLog.Warning(fmt.Sprintf("Failed to checksum %s on the primary: %v", table, err))
+				continue
+			}
+			replicaSum, err := c.checksum(r.dbManager.Pool(), table, from, to)
+			if err != nil {
+				replicaCheckFails.Add(r.name, 1)
+				c.sysLog.Warning(fmt.Sprintf("Failed to checksum %s on replica %s: %v", table, r.name, err))
+				continue
+			}
+			checksumsRun.Add(r.name, 1)
+			if primarySum != replicaSum {
+				checksumMismatch.Add(r.name, 1)
+				c.sysLog.Error(fmt.Sprintf("Replica %s diverges on %s between %s and %s: primary has %d rows (crc %d), replica has %d rows (crc %d)",
+					r.name, table, from.UTC().Format(time.RFC3339), to.UTC().Format(time.RFC3339), primarySum.rows, primarySum.crc, replicaSum.rows, replicaSum.crc))
+			}
+		}
+	}
+}
+
+type tableChecksum struct {
+	rows int64
+	crc  uint64
+}
+
+// checksum compares two numbers per table instead of the rows themselves, see database.ChecksumQuery
+func (c *Checker) checksum(db *sql.DB, table string, from, to time.Time) (tableChecksum, error) {
+	dbName, tableName, _ := strings.Cut(table, ".")
+	where := fmt.Sprintf("%s >= ? AND %s < ?", ident.Quote(c.timeColumn), ident.Quote(c.timeColumn))
+
+	var sum tableChecksum
+	err := db.QueryRow(database.ChecksumQuery(dbName, tableName, c.columns, where), from.Unix(), to.Unix()).Scan(&sum.rows, &sum.crc)
+	return sum, err
+}
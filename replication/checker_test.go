@@ -0,0 +1,146 @@
+package replication
+
+import (
+	"database/sql"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"mysql_public_data_ingestor/config"
+	"mysql_public_data_ingestor/database"
+)
+
+// MockSyslogWrapper is a mock implementation of syslogwrapper.SyslogWrapper
+type MockSyslogWrapper struct {
+	mock.Mock
+}
+
+func (m *MockSyslogWrapper) Close() {
+	m.Called()
+}
+
+func (m *MockSyslogWrapper) Warning(message string) {
+	m.Called(message)
+}
+
+func (m *MockSyslogWrapper) Error(message string) {
+	m.Called(message)
+}
+
+func (m *MockSyslogWrapper) Info(message string) {
+	m.Called(message)
+}
+
+func (m *MockSyslogWrapper) Debug(message string) {
+	m.Called(message)
+}
+
+func newTestChecker(t *testing.T, sysLog *MockSyslogWrapper) (*Checker, sqlmock.Sqlmock, sqlmock.Sqlmock) {
+	primaryDB, primaryMock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error creating mock DB: %v", err)
+	}
+	t.Cleanup(func() { primaryDB.Close() })
+	replicaDB, replicaMock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error creating mock DB: %v", err)
+	}
+	t.Cleanup(func() { replicaDB.Close() })
+
+	cfg := config.ReplicationCheckConfig{
+		HeartbeatInterval: time.Second,
+		ChecksumInterval:  time.Minute,
+		ChecksumWindow:    10 * time.Minute,
+		ChecksumDelay:     30 * time.Second,
+	}
+	c := newChecker(cfg, func() *sql.DB { return primaryDB }, "auto_1", []string{"auto_1.flights"},
+		[]string{"time", "icao24"}, "time", []replica{{name: "replica_1", dbManager: database.NewDBManagerFromPool(replicaDB)}}, sysLog)
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	c.now = func() time.Time { return now }
+	return c, primaryMock, replicaMock
+}
+
+func TestHeartbeatMeasuresLag(t *testing.T) {
+	c, primaryMock, replicaMock := newTestChecker(t, new(MockSyslogWrapper))
+
+	primaryMock.ExpectExec(regexp.QuoteMeta("REPLACE INTO `auto_1`.`_heartbeat` (id, ts) VALUES (1, ?)")).
+		WithArgs(c.now().UTC()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	replicaMock.ExpectQuery(regexp.QuoteMeta("SELECT ts FROM `auto_1`.`_heartbeat` WHERE id = 1")).
+		WillReturnRows(sqlmock.NewRows([]string{"ts"}).AddRow(c.now().Add(-3 * time.Second)))
+
+	c.heartbeat()
+	assert.Equal(t, 3*time.Second, c.lags["replica_1"])
+	assert.Equal(t, "3", replicaLag.Get("replica_1").String())
+
+	for _, m := range []sqlmock.Sqlmock{primaryMock, replicaMock} {
+		if err := m.ExpectationsWereMet(); err != nil {
+			t.Errorf("There were unmet expectations: %v", err)
+		}
+	}
+}
+
+func TestChecksumReportsDivergence(t *testing.T) {
+	mockSyslog := new(MockSyslogWrapper)
+	mockSyslog.On("Error", mock.Anything).Return()
+	c, primaryMock, replicaMock := newTestChecker(t, mockSyslog)
+	c.lags["replica_1"] = time.Second
+
+	query := regexp.QuoteMeta("SELECT COUNT(*), COALESCE(BIT_XOR(CRC32(CONCAT_WS('#', `icao24`, `time`, CONCAT(ISNULL(`icao24`), ISNULL(`time`))))), 0) FROM `auto_1`.`flights` WHERE `time` >= ? AND `time` < ?")
+	to := c.now().Add(-30 * time.Second).Unix()
+	primaryMock.ExpectQuery(query).WithArgs(to-600, to).
+		WillReturnRows(sqlmock.NewRows([]string{"count", "crc"}).AddRow(10, 1234))
+	replicaMock.ExpectQuery(query).WithArgs(to-600, to).
+		WillReturnRows(sqlmock.NewRows([]string{"count", "crc"}).AddRow(9, 999))
+
+	c.checksumTables()
+	mockSyslog.AssertCalled(t, "Error", "Replica replica_1 diverges on auto_1.flights between 2024-05-01T11:49:30Z and 2024-05-01T11:59:30Z: primary has 10 rows (crc 1234), replica has 9 rows (crc 999)")
+
+	for _, m := range []sqlmock.Sqlmock{primaryMock, replicaMock} {
+		if err := m.ExpectationsWereMet(); err != nil {
+			t.Errorf("There were unmet expectations: %v", err)
+		}
+	}
+}
+
+func TestChecksumSkipsLaggingReplica(t *testing.T) {
+	mockSyslog := new(MockSyslogWrapper)
+	mockSyslog.On("Info", mock.Anything).Return()
+	c, primaryMock, replicaMock := newTestChecker(t, mockSyslog)
+	c.lags["replica_1"] = time.Minute
+
+	c.checksumTables()
+	mockSyslog.AssertNumberOfCalls(t, "Info", 1)
+
+	for _, m := range []sqlmock.Sqlmock{primaryMock, replicaMock} {
+		if err := m.ExpectationsWereMet(); err != nil {
+			t.Errorf("There were unmet expectations: %v", err)
+		}
+	}
+}
+
+// TestRunClosesReplicas tests the replica connections are closed once the loops stop
+func TestRunClosesReplicas(t *testing.T) {
+	sysLog := new(MockSyslogWrapper)
+	c, primaryMock, replicaMock := newTestChecker(t, sysLog)
+	primaryMock.ExpectExec("CREATE TABLE IF NOT EXISTS `auto_1`.`_heartbeat`").WillReturnResult(sqlmock.NewResult(0, 0))
+	replicaMock.ExpectClose()
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	assert.NoError(t, c.Run(stop, &wg))
+	close(stop)
+	wg.Wait()
+	assert.NoError(t, primaryMock.ExpectationsWereMet())
+	assert.NoError(t, replicaMock.ExpectationsWereMet())
+}
+
+func TestNilCheckerRun(t *testing.T) {
+	var c *Checker
+	var wg sync.WaitGroup
+	assert.NoError(t, c.Run(nil, &wg))
+}
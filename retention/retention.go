@@ -0,0 +1,137 @@
+package retention
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"mysql_public_data_ingestor/api_plugins"
+	"mysql_public_data_ingestor/config"
+	"mysql_public_data_ingestor/database"
+	"mysql_public_data_ingestor/ident"
+	"mysql_public_data_ingestor/metrics"
+	"mysql_public_data_ingestor/syslogwrapper"
+)
+
+var (
+	rowsPurged   = metrics.Map("retention_rows_purged")
+	purgeErrors  = metrics.Map("retention_errors")
+	purgeLatency = metrics.Histogram("retention_pass_latency")
+)
+
+// Purger deletes rows older than the configured age from the generated tables of one target, a chunk at a
+// time so the purge never holds long locks or builds a large undo log
+type Purger struct {
+	cfg        config.RetentionConfig
+	target     string
+	prefix     string
+	dbManager  *database.DBManager
+	timeColumn string
+	sysLog     syslogwrapper.SyslogWrapperInterface
+	now        func() time.Time
+}
+
+// New returns a Purger for the tables of dbManager generated with prefix. It returns nil when retention is
+// disabled. Rows are aged by the time column of the plugin, which has to implement
+// api_plugins.TimeColumnProvider.
+func New(cfg config.RetentionConfig, prefix string, dbManager *database.DBManager, apiPlugin api_plugins.APIPlugin, sysLog syslogwrapper.SyslogWrapperInterface) (*Purger, error) {
+	if cfg.MaxAge <= 0 {
+		return nil, nil
+	}
+	provider, ok := apiPlugin.(api_plugins.TimeColumnProvider)
+	if !ok {
+		return nil, fmt.Errorf("retention: plugin %s has no time column to age rows by", apiPlugin.Name())
+	}
+	return &Purger{
+		cfg:        cfg,
+		target:     dbManager.Name,
+		prefix:     prefix,
+		dbManager:  dbManager,
+		timeColumn: provider.TimeColumn(),
+		sysLog:     sysLog,
+		now:        time.Now,
+	}, nil
+}
+
+// Run purges every interval until stop is closed. A nil Purger does nothing.
+func (p *Purger) Run(stop <-chan struct{}, wg *sync.WaitGroup) {
+	if p == nil {
+		return
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(p.cfg.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				start := time.Now()
+				if _, err := p.Purge(stop); err != nil {
+					purgeErrors.Add(p.target, 1)
+					p.sysLog.Error(fmt.Sprintf("Retention on target %s failed: %v", p.target, err))
+				}
+				purgeLatency.Observe(time.Since(start))
+			}
+		}
+	}()
+}
+
+// Purge runs one pass over the tables of the current layout in databases init created and returns the number
+// of rows deleted. Tables init created that have since been removed from the config are only purged with
+// retention.orphans set, databases that merely match the prefix never are.
+func (p *Purger) Purge(stop <-chan struct{}) (int64, error) {
+	listTables := p.dbManager.LayoutTablesWithColumn
+	if p.cfg.Orphans {
+		listTables = p.dbManager.MarkedTablesWithColumn
+	}
+	tables, err := listTables(p.prefix, p.timeColumn)
+	if err != nil {
+		return 0, err
+	}
+	cutoff := p.now().Add(-p.cfg.MaxAge).Unix()
+
+	var total int64
+	for _, table := range tables {
+		purged, err := p.purgeTable(table, cutoff, stop)
+		total += purged
+		if err != nil {
+			return total, fmt.Errorf("failed to purge %s: %w", table, err)
+		}
+		if purged > 0 {
+			p.sysLog.Info(fmt.Sprintf("Retention purged %d rows older than %v from %s on target %s", purged, p.cfg.MaxAge, table, p.target))
+		}
+	}
+	return total, nil
+}
+
+// purgeTable deletes chunk_size rows at a time, pausing chunk_pause in between, until a chunk comes back short
+func (p *Purger) purgeTable(table string, cutoff int64, stop <-chan struct{}) (int64, error) {
+	dbName, tableName, _ := strings.Cut(table, ".")
+	query := fmt.Sprintf("DELETE FROM %s WHERE %s < ? LIMIT %d", ident.Table(dbName, tableName), ident.Quote(p.timeColumn), p.cfg.ChunkSize)
+
+	var total int64
+	for {
+		result, err := p.dbManager.Pool().Exec(query, cutoff)
+		if err != nil {
+			return total, err
+		}
+		affected, err := result.RowsAffected()
+		if err != nil {
+			return total, err
+		}
+		total += affected
+		rowsPurged.Add(p.target, affected)
+		if affected < int64(p.cfg.ChunkSize) {
+			return total, nil
+		}
+		select {
+		case <-stop:
+			return total, nil
+		case <-time.After(p.cfg.ChunkPause):
+		}
+	}
+}
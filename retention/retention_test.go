@@ -0,0 +1,113 @@
+package retention
+
+import (
+	"expvar"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"mysql_public_data_ingestor/config"
+	"mysql_public_data_ingestor/database"
+)
+
+// MockSyslogWrapper is a mock implementation of syslogwrapper.SyslogWrapper
+type MockSyslogWrapper struct {
+	mock.Mock
+}
+
+func (m *MockSyslogWrapper) Close() {
+	m.Called()
+}
+
+func (m *MockSyslogWrapper) Warning(message string) {
+	m.Called(message)
+}
+
+func (m *MockSyslogWrapper) Error(message string) {
+	m.Called(message)
+}
+
+func (m *MockSyslogWrapper) Info(message string) {
+	m.Called(message)
+}
+
+func (m *MockSyslogWrapper) Debug(message string) {
+	m.Called(message)
+}
+
+func purgedCount(target string) int64 {
+	if v, ok := rowsPurged.Get(target).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+// TestPurge tests rows are deleted in chunks until a chunk comes back short, only from the layout tables
+// with the time column in databases init created, and from those removed from the config only with orphans
+func TestPurge(t *testing.T) {
+	db, sqlMock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error creating mock DB: %v", err)
+	}
+	defer db.Close()
+	dbManager := database.NewDBManagerFromPool(db)
+	dbManager.SetLayout(config.MainConfig{Databases: config.DBConfig{Prefix: "p", Copies: 1}}, "flights")
+	mockSyslog := new(MockSyslogWrapper)
+	mockSyslog.On("Info", mock.Anything).Return()
+
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	cutoff := now.Add(-time.Hour).Unix()
+	p := &Purger{
+		cfg:        config.RetentionConfig{MaxAge: time.Hour, ChunkSize: 2, ChunkPause: time.Millisecond},
+		target:     "default",
+		prefix:     "p",
+		dbManager:  dbManager,
+		timeColumn: "time",
+		sysLog:     mockSyslog,
+		now:        func() time.Time { return now },
+	}
+	expectTables := func() {
+		sqlMock.ExpectQuery("information_schema.SCHEMATA").
+			WillReturnRows(sqlmock.NewRows([]string{"SCHEMA_NAME"}).AddRow("mysql").AddRow("p1").AddRow("p_extra").AddRow("p_foreign"))
+		sqlMock.ExpectQuery(regexp.QuoteMeta("FROM information_schema.COLUMNS WHERE COLUMN_NAME = ? AND TABLE_SCHEMA IN (?, ?, ?)")).
+			WithArgs("time", "p1", "p_extra", "p_foreign").
+			WillReturnRows(sqlmock.NewRows([]string{"TABLE_SCHEMA", "TABLE_NAME"}).
+				AddRow("p1", "flights").AddRow("p_extra", "flights_1").AddRow("p_foreign", "events"))
+		sqlMock.ExpectQuery("information_schema.TABLES").WithArgs(database.MarkerTable).
+			WillReturnRows(sqlmock.NewRows([]string{"TABLE_SCHEMA"}).AddRow("p1").AddRow("p_extra"))
+	}
+
+	expectTables()
+	deleteP1 := regexp.QuoteMeta("DELETE FROM `p1`.`flights` WHERE `time` < ? LIMIT 2")
+	sqlMock.ExpectExec(deleteP1).WithArgs(cutoff).WillReturnResult(sqlmock.NewResult(0, 2))
+	sqlMock.ExpectExec(deleteP1).WithArgs(cutoff).WillReturnResult(sqlmock.NewResult(0, 2))
+	sqlMock.ExpectExec(deleteP1).WithArgs(cutoff).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	before := purgedCount("default")
+	purged, err := p.Purge(make(chan struct{}))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(5), purged)
+	assert.Equal(t, before+5, purgedCount("default"))
+	mockSyslog.AssertCalled(t, "Info", "Retention purged 5 rows older than 1h0m0s from p1.flights on target default")
+	assert.NoError(t, sqlMock.ExpectationsWereMet())
+
+	p.cfg.Orphans = true
+	expectTables()
+	sqlMock.ExpectExec(deleteP1).WithArgs(cutoff).WillReturnResult(sqlmock.NewResult(0, 0))
+	sqlMock.ExpectExec(regexp.QuoteMeta("DELETE FROM `p_extra`.`flights_1` WHERE `time` < ? LIMIT 2")).
+		WithArgs(cutoff).WillReturnResult(sqlmock.NewResult(0, 1))
+	purged, err = p.Purge(make(chan struct{}))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), purged)
+	assert.NoError(t, sqlMock.ExpectationsWereMet())
+}
+
+func TestNewDisabled(t *testing.T) {
+	p, err := New(config.RetentionConfig{}, "p", nil, nil, nil)
+	assert.NoError(t, err)
+	assert.Nil(t, p)
+	p.Run(nil, nil) // A nil Purger does nothing
+}
@@ -0,0 +1,35 @@
+package retry
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Backoff computes jittered exponential delays between attempts
+type Backoff struct {
+	Initial     time.Duration
+	Max         time.Duration
+	Multiplier  float64
+	MaxAttempts int
+}
+
+// Delay returns how long to wait before the given retry (1 for the first retry).
+// Half of the delay is fixed and half is random so concurrent writers spread out.
+func (b Backoff) Delay(attempt int) time.Duration {
+	multiplier := b.Multiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+	delay := float64(b.Initial) * math.Pow(multiplier, float64(attempt-1))
+	if b.Max > 0 && delay > float64(b.Max) {
+		delay = float64(b.Max)
+	}
+	half := delay / 2
+	return time.Duration(half + rand.Float64()*half)
+}
+
+// Exhausted reports whether attempt has used up the retry budget
+func (b Backoff) Exhausted(attempt int) bool {
+	return attempt >= b.MaxAttempts
+}
@@ -0,0 +1,119 @@
+package retry
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net"
+	"syscall"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// Class groups MySQL errors that call for the same handling
+type Class string
+
+const (
+	Deadlock        Class = "deadlock"
+	LockWaitTimeout Class = "lock_wait_timeout"
+	Connection      Class = "connection"
+	ReadOnly        Class = "read_only"
+	DuplicateKey    Class = "duplicate_key"
+	DataTooLong     Class = "data_too_long"
+	Other           Class = "other"
+)
+
+// Classes lists every error class, in the order they are documented
+var Classes = []Class{Deadlock, LockWaitTimeout, Connection, ReadOnly, DuplicateKey, DataTooLong, Other}
+
+// Policy is what a writer does with a failed statement
+type Policy string
+
+const (
+	Retry      Policy = "retry"       // retry with jittered exponential backoff
+	Skip       Policy = "skip"        // log and move on to the next record
+	DeadLetter Policy = "dead_letter" // hand the record to the dead-letter sink
+	Halt       Policy = "halt"        // stop the ingestor
+)
+
+// Policies lists every supported policy
+var Policies = []Policy{Retry, Skip, DeadLetter, Halt}
+
+// DefaultPolicies is applied for classes the config does not mention
+var DefaultPolicies = map[Class]Policy{
+	Deadlock:        Retry,
+	LockWaitTimeout: Retry,
+	Connection:      Retry,
+	ReadOnly:        Retry,
+	DuplicateKey:    Skip,
+	DataTooLong:     DeadLetter,
+	Other:           Skip,
+}
+
+// MySQL server error numbers, see https://dev.mysql.com/doc/mysql-errors/8.0/en/server-error-reference.html
+const (
+	erDupEntry           = 1062
+	erServerShutdown     = 1053
+	erLockWaitTimeout    = 1205
+	erLockDeadlock       = 1213
+	erOptionPreventsStmt = 1290 // --read-only / --super-read-only
+	erNoSuchTable        = 1146
+	erDataTooLong        = 1406
+	erReadOnlyMode       = 1836
+	erClientInteraction  = 4031 // disconnected by the server because of inactivity
+	erConnectionKilled   = 1927
+)
+
+// Classify maps an error returned by database/sql to its class
+func Classify(err error) Class {
+	if err == nil {
+		return ""
+	}
+
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		switch mysqlErr.Number {
+		case erLockDeadlock:
+			return Deadlock
+		case erLockWaitTimeout:
+			return LockWaitTimeout
+		case erOptionPreventsStmt, erReadOnlyMode:
+			return ReadOnly
+		case erDupEntry:
+			return DuplicateKey
+		case erDataTooLong:
+			return DataTooLong
+		case erServerShutdown, erConnectionKilled, erClientInteraction:
+			return Connection
+		}
+		return Other
+	}
+
+	var netErr net.Error
+	if errors.Is(err, driver.ErrBadConn) ||
+		errors.Is(err, mysql.ErrInvalidConn) ||
+		errors.Is(err, sql.ErrConnDone) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.As(err, &netErr) {
+		return Connection
+	}
+	return Other
+}
+
+// Code returns the MySQL error number of err, or 0 when it did not come from the server
+func Code(err error) uint16 {
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		return mysqlErr.Number
+	}
+	return 0
+}
+
+// NoSuchTable reports whether err is MySQL saying a table does not exist
+func NoSuchTable(err error) bool {
+	return Code(err) == erNoSuchTable
+}
@@ -0,0 +1,49 @@
+package retry
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		err   error
+		class Class
+	}{
+		{&mysql.MySQLError{Number: 1213}, Deadlock},
+		{&mysql.MySQLError{Number: 1205}, LockWaitTimeout},
+		{&mysql.MySQLError{Number: 1290}, ReadOnly},
+		{&mysql.MySQLError{Number: 1062}, DuplicateKey},
+		{&mysql.MySQLError{Number: 1406}, DataTooLong},
+		{&mysql.MySQLError{Number: 1146}, Other},
+		{fmt.Errorf("exec: %w", &mysql.MySQLError{Number: 1213}), Deadlock},
+		{driver.ErrBadConn, Connection},
+		{mysql.ErrInvalidConn, Connection},
+		{errors.New("sql: converting argument $1 type"), Other},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.class, Classify(tt.err), "Classify(%v)", tt.err)
+	}
+	assert.Equal(t, Class(""), Classify(nil))
+	assert.Equal(t, uint16(1062), Code(&mysql.MySQLError{Number: 1062}))
+	assert.Equal(t, uint16(0), Code(driver.ErrBadConn))
+}
+
+func TestBackoff(t *testing.T) {
+	b := Backoff{Initial: 100 * time.Millisecond, Max: time.Second, Multiplier: 2, MaxAttempts: 3}
+
+	for attempt, ceiling := range map[int]time.Duration{1: 100 * time.Millisecond, 3: 400 * time.Millisecond, 10: time.Second} {
+		delay := b.Delay(attempt)
+		assert.GreaterOrEqual(t, delay, ceiling/2, "attempt %d", attempt)
+		assert.LessOrEqual(t, delay, ceiling, "attempt %d", attempt)
+	}
+
+	assert.False(t, b.Exhausted(2))
+	assert.True(t, b.Exhausted(3))
+}
@@ -0,0 +1,101 @@
+package routing
+
+import (
+	"fmt"
+	"hash/fnv"
+	"slices"
+	"strings"
+
+	"mysql_public_data_ingestor/config"
+)
+
+// Router decides which targets receive which tables and records. A nil *Router sends everything everywhere.
+type Router struct {
+	policy  string
+	targets []string
+	key     func(record interface{}) []interface{} // record values, only used by hash_key
+	keyIdx  int
+}
+
+// New builds a Router for the named targets. fieldNames and values come from the API plugin and are used
+// to find the hash_key field of a record.
+func New(cfg config.RoutingConfig, targets []string, fieldNames []string, values func(record interface{}) []interface{}) (*Router, error) {
+	r := &Router{policy: cfg.Policy, targets: targets, key: values}
+	if r.policy == config.RouteHashKey {
+		r.keyIdx = slices.Index(fieldNames, cfg.HashKey)
+		if r.keyIdx < 0 {
+			return nil, fmt.Errorf("routing: hash_key field %s is not provided by the plugin", cfg.HashKey)
+		}
+	}
+	return r, nil
+}
+
+// QueueName is the name of the queue feeding dbName.tableName on target. A single target keeps the plain
+// db.table name so spool directories and metrics do not change when targets are not used.
+func (r *Router) QueueName(target, dbName, tableName string) string {
+	if r == nil || len(r.targets) < 2 {
+		return fmt.Sprintf("%s.%s", dbName, tableName)
+	}
+	return fmt.Sprintf("%s/%s.%s", target, dbName, tableName)
+}
+
+// TargetOf returns the target part of a name built by QueueName
+func TargetOf(queueName string) string {
+	target, _, found := strings.Cut(queueName, "/")
+	if !found {
+		return ""
+	}
+	return target
+}
+
+// TableOf returns the db.table part of a name built by QueueName
+func TableOf(queueName string) string {
+	_, table, found := strings.Cut(queueName, "/")
+	if !found {
+		return queueName
+	}
+	return table
+}
+
+// Owns reports whether target writes dbName.tableName. Only shard_tables gives a table a single owner.
+func (r *Router) Owns(target, dbName, tableName string) bool {
+	if r == nil || r.policy != config.RouteShardTables {
+		return true
+	}
+	return r.targets[index(dbName+"."+tableName, len(r.targets))] == target
+}
+
+// Split divides batch between the targets under hash_key. For the other policies it returns nil, meaning
+// every queue receives the whole batch.
+func (r *Router) Split(batch []interface{}) map[string][]interface{} {
+	if r == nil || r.policy != config.RouteHashKey || len(r.targets) < 2 {
+		return nil
+	}
+	parts := make(map[string][]interface{}, len(r.targets))
+	for _, record := range batch {
+		target := r.targets[index(r.keyOf(record), len(r.targets))]
+		parts[target] = append(parts[target], record)
+	}
+	return parts
+}
+
+// keyOf returns the hash_key value of record as a string. Records the plugin cannot read all hash to the
+// empty key, the table worker reports them when it fails to write them.
+func (r *Router) keyOf(record interface{}) (key string) {
+	defer func() {
+		if recover() != nil {
+			key = ""
+		}
+	}()
+	values := r.key(record)
+	if r.keyIdx >= len(values) {
+		return ""
+	}
+	return fmt.Sprint(values[r.keyIdx])
+}
+
+func index(key string, n int) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(n))
+}
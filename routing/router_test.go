@@ -0,0 +1,72 @@
+package routing
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"mysql_public_data_ingestor/config"
+)
+
+func TestQueueName(t *testing.T) {
+	var single *Router
+	assert.Equal(t, "auto_1.flights", single.QueueName("default", "auto_1", "flights"))
+	assert.Equal(t, "", TargetOf("auto_1.flights"))
+	assert.Equal(t, "auto_1.flights", TableOf("auto_1.flights"))
+
+	r, err := New(config.RoutingConfig{Policy: config.RouteReplicate}, []string{"a", "b"}, nil, nil)
+	assert.NoError(t, err)
+	name := r.QueueName("b", "auto_1", "flights")
+	assert.Equal(t, "b/auto_1.flights", name)
+	assert.Equal(t, "b", TargetOf(name))
+	assert.Equal(t, "auto_1.flights", TableOf(name))
+	assert.True(t, r.Owns("a", "auto_1", "flights"))
+	assert.True(t, r.Owns("b", "auto_1", "flights"))
+	assert.Nil(t, r.Split([]interface{}{"x"}), "replicate sends whole batches")
+}
+
+func TestShardTables(t *testing.T) {
+	targets := []string{"a", "b", "c"}
+	r, err := New(config.RoutingConfig{Policy: config.RouteShardTables}, targets, nil, nil)
+	assert.NoError(t, err)
+
+	for _, table := range []string{"flights_1", "flights_2", "flights_3", "flights_4"} {
+		owners := 0
+		for _, target := range targets {
+			if r.Owns(target, "auto_extra", table) {
+				owners++
+			}
+		}
+		assert.Equal(t, 1, owners, "%s should be written on exactly one target", table)
+	}
+}
+
+func TestHashKey(t *testing.T) {
+	values := func(record interface{}) []interface{} {
+		return record.([]interface{})
+	}
+	_, err := New(config.RoutingConfig{Policy: config.RouteHashKey, HashKey: "missing"}, []string{"a", "b"}, []string{"icao24"}, values)
+	assert.Error(t, err)
+
+	r, err := New(config.RoutingConfig{Policy: config.RouteHashKey, HashKey: "icao24"}, []string{"a", "b"}, []string{"time", "icao24"}, values)
+	assert.NoError(t, err)
+
+	var batch []interface{}
+	for _, key := range []string{"abc", "def", "ghi", "abc", "jkl", "abc"} {
+		batch = append(batch, []interface{}{1, key})
+	}
+	parts := r.Split(batch)
+
+	total := 0
+	seen := make(map[string]string)
+	for target, records := range parts {
+		total += len(records)
+		for _, record := range records {
+			key := record.([]interface{})[1].(string)
+			if previous, ok := seen[key]; ok {
+				assert.Equal(t, previous, target, "Records with the same key should go to the same target")
+			}
+			seen[key] = target
+		}
+	}
+	assert.Equal(t, len(batch), total)
+}
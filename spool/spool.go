@@ -0,0 +1,398 @@
+package spool
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"mysql_public_data_ingestor/config"
+	"mysql_public_data_ingestor/metrics"
+)
+
+// A spool is a directory of append-only segment files. Every entry is framed as
+//
+//	[4 byte length][4 byte CRC32 of payload][JSON encoded batch]
+//
+// and entries are read back strictly in the order they were appended. The read
+// position is kept in a cursor file so a restart resumes where replay stopped.
+// Numbers are decoded as json.Number, so integers above 2^53 come back intact.
+
+const (
+	headerSize          = 8
+	maxEntryBytes       = 64 << 20 // a longer length in a header can only come from corruption
+	segmentSuffix       = ".seg"
+	cursorFile          = "cursor"
+	defaultSegmentBytes = 16 << 20
+	defaultMaxBytes     = 1 << 30
+)
+
+// ErrFull is returned by Append when the spool has reached its size cap
+var ErrFull = errors.New("spool is full")
+
+// ErrTooLarge is returned by Append for a batch that does not fit in one entry
+var ErrTooLarge = errors.New("batch is too large for the spool")
+
+// ErrCorrupt is returned when an entry fails its checksum; the rest of that segment is skipped
+var ErrCorrupt = errors.New("spool entry failed checksum")
+
+// errTorn is an entry cut short, as a crash in the middle of an append leaves it
+var errTorn = errors.New("truncated entry")
+
+var (
+	pendingBatches  = metrics.Map("spool_pending_batches")
+	pendingBytes    = metrics.Map("spool_pending_bytes")
+	rejectedBatches = metrics.Map("spool_rejected_batches")
+	corruptSegments = metrics.Map("spool_corrupt_segments")
+)
+
+// Spool is a persistent FIFO of batches for a single table
+type Spool struct {
+	name         string
+	dir          string
+	maxBytes     int64
+	segmentBytes int64
+
+	mu       sync.Mutex
+	segments []uint64 // sequence numbers of segment files on disk, oldest first
+	lastSeq  uint64
+	writer   *os.File
+	writeOff int64
+	readOff  int64 // offset into segments[0]
+	pending  int
+	bytes    int64
+	next     []interface{}
+	nextSize int64
+	hasNext  bool
+	ends     map[uint64]int64 // where the readable entries of a damaged segment end, replay skips the rest
+}
+
+// Open opens or creates the spool in dir, recovering any entries left by a previous run
+func Open(name, dir string, cfg config.SpoolConfig) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create spool directory %s: %w", dir, err)
+	}
+	s := &Spool{
+		name:         name,
+		dir:          dir,
+		maxBytes:     cfg.MaxBytes,
+		segmentBytes: cfg.SegmentBytes,
+	}
+	if s.maxBytes <= 0 {
+		s.maxBytes = defaultMaxBytes
+	}
+	if s.segmentBytes <= 0 {
+		s.segmentBytes = defaultSegmentBytes
+	}
+	if err := s.recover(); err != nil {
+		return nil, err
+	}
+
+	pendingBatches.Set(name, expvar.Func(func() any { return s.Len() }))
+	pendingBytes.Set(name, expvar.Func(func() any { return s.Bytes() }))
+	return s, nil
+}
+
+// Len returns the number of batches waiting to be replayed
+func (s *Spool) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.pending
+}
+
+// Bytes returns the on-disk size of the batches waiting to be replayed
+func (s *Spool) Bytes() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.bytes
+}
+
+// Append durably adds a batch to the end of the spool
+func (s *Spool) Append(batch []interface{}) error {
+	payload, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	if len(payload) > maxEntryBytes {
+		rejectedBatches.Add(s.name, 1)
+		return fmt.Errorf("%w: %d bytes, at most %d", ErrTooLarge, len(payload), maxEntryBytes)
+	}
+	entry := make([]byte, headerSize+len(payload))
+	binary.BigEndian.PutUint32(entry[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(entry[4:8], crc32.ChecksumIEEE(payload))
+	copy(entry[headerSize:], payload)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.bytes+int64(len(entry)) > s.maxBytes {
+		rejectedBatches.Add(s.name, 1)
+		return ErrFull
+	}
+	if s.writer == nil || s.writeOff+int64(len(entry)) > s.segmentBytes {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	if _, err := s.writer.Write(entry); err != nil {
+		return err
+	}
+	if err := s.writer.Sync(); err != nil {
+		return err
+	}
+	s.writeOff += int64(len(entry))
+	s.pending++
+	s.bytes += int64(len(entry))
+	return nil
+}
+
+// Peek returns the oldest batch without removing it. Call Ack once it has been written.
+func (s *Spool) Peek() ([]interface{}, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.hasNext {
+		return s.next, true, nil
+	}
+	for s.pending > 0 {
+		if end, ok := s.ends[s.segments[0]]; ok && s.readOff >= end {
+			// The rest of the segment was found damaged when counting, skip to the next one
+			delete(s.ends, s.segments[0])
+			if err := s.dropHead(); err != nil {
+				return nil, false, err
+			}
+			continue
+		}
+		batch, size, err := s.readEntry(s.segments[0], s.readOff)
+		if err == io.EOF {
+			// Reached the end of a sealed segment, move on to the next one
+			if err := s.dropHead(); err != nil {
+				return nil, false, err
+			}
+			continue
+		}
+		if err != nil {
+			corruptSegments.Add(s.name, 1)
+			path := s.segmentPath(s.segments[0])
+			if len(s.segments) == 1 && s.writer != nil {
+				// Seal the active segment so the damaged one can be removed
+				if rotateErr := s.rotate(); rotateErr != nil {
+					return nil, false, rotateErr
+				}
+			}
+			if dropErr := s.dropHead(); dropErr != nil {
+				return nil, false, dropErr
+			}
+			s.recount()
+			return nil, false, fmt.Errorf("%w in %s: %v", ErrCorrupt, path, err)
+		}
+		s.next, s.nextSize, s.hasNext = batch, size, true
+		return batch, true, nil
+	}
+	return nil, false, nil
+}
+
+// Ack removes the batch returned by the last Peek
+func (s *Spool) Ack() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.hasNext {
+		return nil
+	}
+	s.readOff += s.nextSize
+	s.pending--
+	s.bytes -= s.nextSize
+	s.next, s.nextSize, s.hasNext = nil, 0, false
+	return s.saveCursor()
+}
+
+// Close releases the active segment; pending batches stay on disk for the next Open
+func (s *Spool) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.writer == nil {
+		return nil
+	}
+	err := s.writer.Close()
+	s.writer = nil
+	return err
+}
+
+func (s *Spool) segmentPath(seq uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", seq, segmentSuffix))
+}
+
+func (s *Spool) segmentsHead() uint64 {
+	if len(s.segments) == 0 {
+		return 0
+	}
+	return s.segments[0]
+}
+
+// rotate seals the active segment and starts a new one
+func (s *Spool) rotate() error {
+	if s.writer != nil {
+		if err := s.writer.Close(); err != nil {
+			return err
+		}
+	}
+	s.lastSeq++
+	seq := s.lastSeq
+	file, err := os.OpenFile(s.segmentPath(seq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to create spool segment: %w", err)
+	}
+	s.segments = append(s.segments, seq)
+	s.writer = file
+	s.writeOff = 0
+	return nil
+}
+
+// dropHead deletes the oldest segment once it has been fully replayed or found corrupt
+func (s *Spool) dropHead() error {
+	if len(s.segments) == 0 {
+		return nil
+	}
+	head := s.segments[0]
+	if len(s.segments) == 1 && s.writer != nil {
+		// Never delete the segment being written to, just wait for more data
+		if s.readOff >= s.writeOff {
+			s.pending = 0
+			s.bytes = 0
+		}
+		return nil
+	}
+	if err := os.Remove(s.segmentPath(head)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	s.segments = s.segments[1:]
+	s.readOff = 0
+	return s.saveCursor()
+}
+
+func (s *Spool) readEntry(seq uint64, offset int64) ([]interface{}, int64, error) {
+	file, err := os.Open(s.segmentPath(seq))
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+
+	header := make([]byte, headerSize)
+	if n, err := file.ReadAt(header, offset); err != nil {
+		if err == io.EOF && n == 0 {
+			return nil, 0, io.EOF
+		}
+		if err == io.EOF {
+			return nil, 0, fmt.Errorf("%w at offset %d", errTorn, offset)
+		}
+		return nil, 0, err
+	}
+	length := binary.BigEndian.Uint32(header[0:4])
+	if length > maxEntryBytes {
+		return nil, 0, fmt.Errorf("entry length %d at offset %d is over the %d byte limit", length, offset, maxEntryBytes)
+	}
+	payload := make([]byte, length)
+	if _, err := file.ReadAt(payload, offset+headerSize); err != nil {
+		return nil, 0, fmt.Errorf("%w at offset %d", errTorn, offset)
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, 0, fmt.Errorf("checksum mismatch at offset %d", offset)
+	}
+	var batch []interface{}
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+	if err := decoder.Decode(&batch); err != nil {
+		return nil, 0, err
+	}
+	return batch, int64(headerSize) + int64(length), nil
+}
+
+func (s *Spool) saveCursor() error {
+	cursor := fmt.Sprintf("%d %d", s.segmentsHead(), s.readOff)
+	return os.WriteFile(filepath.Join(s.dir, cursorFile), []byte(cursor), 0o644)
+}
+
+// recover rebuilds the in-memory state from the segment files and cursor on disk
+func (s *Spool) recover() error {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, segmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		s.segments = append(s.segments, seq)
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i] < s.segments[j] })
+
+	if data, err := os.ReadFile(filepath.Join(s.dir, cursorFile)); err == nil {
+		var seq uint64
+		var offset int64
+		if _, err := fmt.Sscanf(string(data), "%d %d", &seq, &offset); err == nil {
+			// Segments before the cursor were fully replayed but not yet removed
+			for len(s.segments) > 0 && s.segments[0] < seq {
+				_ = os.Remove(s.segmentPath(s.segments[0]))
+				s.segments = s.segments[1:]
+			}
+			if len(s.segments) > 0 && s.segments[0] == seq {
+				s.readOff = offset
+			}
+			s.lastSeq = seq
+		}
+	}
+	if len(s.segments) > 0 && s.segments[len(s.segments)-1] > s.lastSeq {
+		s.lastSeq = s.segments[len(s.segments)-1]
+	}
+
+	s.recount()
+	return nil
+}
+
+// recount scans the remaining entries to restore pending counts, truncating a torn tail. A damaged segment
+// is counted up to the damage and replay skips the rest of it; the segments after it are still counted.
+func (s *Spool) recount() {
+	s.pending, s.bytes = 0, 0
+	s.ends = make(map[uint64]int64)
+	for i, seq := range s.segments {
+		offset := int64(0)
+		if i == 0 {
+			offset = s.readOff
+		}
+		for {
+			_, size, err := s.readEntry(seq, offset)
+			if err == io.EOF {
+				break
+			}
+			if errors.Is(err, errTorn) && i == len(s.segments)-1 && s.writer == nil {
+				// A crash mid-append leaves a partial entry at the very end
+				_ = os.Truncate(s.segmentPath(seq), offset)
+				break
+			}
+			if err != nil {
+				corruptSegments.Add(s.name, 1)
+				s.ends[seq] = offset
+				break
+			}
+			offset += size
+			s.pending++
+			s.bytes += size
+		}
+	}
+}
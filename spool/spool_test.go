@@ -0,0 +1,168 @@
+package spool
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"mysql_public_data_ingestor/config"
+)
+
+func TestAppendPeekAck(t *testing.T) {
+	s, err := Open("test.order", t.TempDir(), config.SpoolConfig{SegmentBytes: 64})
+	if err != nil {
+		t.Fatalf("Error opening spool: %v", err)
+	}
+	defer s.Close()
+
+	for i := 1; i <= 5; i++ {
+		assert.NoError(t, s.Append([]interface{}{i, "padding to force segment rotation"}))
+	}
+	assert.Equal(t, 5, s.Len())
+
+	for i := 1; i <= 5; i++ {
+		batch, ok, err := s.Peek()
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, json.Number(strconv.Itoa(i)), batch[0])
+		assert.NoError(t, s.Ack())
+	}
+
+	_, ok, err := s.Peek()
+	assert.NoError(t, err)
+	assert.False(t, ok, "Spool should be empty after acking every batch")
+	assert.Equal(t, int64(0), s.Bytes())
+}
+
+func TestRecoverAfterReopen(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open("test.recover", dir, config.SpoolConfig{})
+	if err != nil {
+		t.Fatalf("Error opening spool: %v", err)
+	}
+	for i := 1; i <= 3; i++ {
+		assert.NoError(t, s.Append([]interface{}{i}))
+	}
+	_, _, _ = s.Peek()
+	assert.NoError(t, s.Ack())
+	assert.NoError(t, s.Close())
+
+	s, err = Open("test.recover", dir, config.SpoolConfig{})
+	if err != nil {
+		t.Fatalf("Error reopening spool: %v", err)
+	}
+	defer s.Close()
+
+	assert.Equal(t, 2, s.Len(), "Acked batches should not be replayed after a restart")
+	batch, ok, err := s.Peek()
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, []interface{}{json.Number("2")}, batch)
+}
+
+func TestSizeCap(t *testing.T) {
+	s, err := Open("test.cap", t.TempDir(), config.SpoolConfig{MaxBytes: 20})
+	if err != nil {
+		t.Fatalf("Error opening spool: %v", err)
+	}
+	defer s.Close()
+
+	assert.NoError(t, s.Append([]interface{}{1}))
+	assert.ErrorIs(t, s.Append([]interface{}{"too large for the remaining space"}), ErrFull)
+	assert.Equal(t, 1, s.Len())
+}
+
+func TestCorruptSegmentIsSkipped(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open("test.corrupt", dir, config.SpoolConfig{})
+	if err != nil {
+		t.Fatalf("Error opening spool: %v", err)
+	}
+	assert.NoError(t, s.Append([]interface{}{"first"}))
+	assert.NoError(t, s.Close())
+
+	// Flip a payload byte in the sealed segment
+	path := filepath.Join(dir, "00000000000000000001.seg")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Error reading segment: %v", err)
+	}
+	data[len(data)-2] ^= 0xff
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatalf("Error writing segment: %v", err)
+	}
+
+	s, err = Open("test.corrupt", dir, config.SpoolConfig{})
+	if err != nil {
+		t.Fatalf("Error reopening spool: %v", err)
+	}
+	defer s.Close()
+	assert.NoError(t, s.Append([]interface{}{"second"}))
+
+	batch, ok, err := s.Peek()
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, []interface{}{"second"}, batch, "Corrupt entries should not be counted or replayed")
+}
+
+// TestNumbersKeepPrecision tests integers above 2^53 come back exactly as they were appended
+func TestNumbersKeepPrecision(t *testing.T) {
+	s, err := Open("test.numbers", t.TempDir(), config.SpoolConfig{})
+	if err != nil {
+		t.Fatalf("Error opening spool: %v", err)
+	}
+	defer s.Close()
+
+	assert.NoError(t, s.Append([]interface{}{uint64(1<<53 + 1), 12.5}))
+	batch, ok, err := s.Peek()
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, []interface{}{json.Number("9007199254740993"), json.Number("12.5")}, batch)
+}
+
+// TestDamagedSegmentsAreSkipped tests an entry claiming an impossible length is treated as corruption instead
+// of being allocated, and that the segments after a damaged one are still counted and replayed
+func TestDamagedSegmentsAreSkipped(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open("test.damaged", dir, config.SpoolConfig{SegmentBytes: 16})
+	if err != nil {
+		t.Fatalf("Error opening spool: %v", err)
+	}
+	for i := 1; i <= 3; i++ {
+		assert.NoError(t, s.Append([]interface{}{i}))
+	}
+	assert.NoError(t, s.Close())
+
+	// Give the first segment a header claiming 4 GiB
+	path := filepath.Join(dir, "00000000000000000001.seg")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Error reading segment: %v", err)
+	}
+	binary.BigEndian.PutUint32(data[0:4], 0xffffffff)
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatalf("Error writing segment: %v", err)
+	}
+
+	s, err = Open("test.damaged", dir, config.SpoolConfig{SegmentBytes: 16})
+	if err != nil {
+		t.Fatalf("Error reopening spool: %v", err)
+	}
+	defer s.Close()
+	assert.Equal(t, 2, s.Len(), "Segments after the damaged one should still be counted")
+
+	for _, want := range []string{"2", "3"} {
+		batch, ok, err := s.Peek()
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, []interface{}{json.Number(want)}, batch)
+		assert.NoError(t, s.Ack())
+	}
+	_, ok, err := s.Peek()
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"mysql_public_data_ingestor/config"
+	"mysql_public_data_ingestor/ident"
+)
+
+// upsertAlias names the inserted row in an upsert written with a row alias
+const upsertAlias = "new"
+
+// writeQuery builds the statement a worker writes rows rows of columns with. LOAD DATA has no per row
+// statement, see loadQuery. rowAlias makes an upsert refer to the inserted row by an alias instead of
+// VALUES(), which servers that support the alias warn about on every statement.
+func writeQuery(statement, dbName, tableName string, columns []string, rows int, rowAlias bool) string {
+	verb := "INSERT INTO"
+	switch statement {
+	case config.StatementInsertIgnore:
+		verb = "INSERT IGNORE INTO"
+	case config.StatementReplace:
+		verb = "REPLACE INTO"
+	case config.StatementLoadData:
+		return ""
+	}
+	row := "(" + strings.Repeat("?, ", len(columns)-1) + "?)"
+	query := fmt.Sprintf("%s %s (%s) VALUES %s",
+		verb,
+		ident.Table(dbName, tableName),
+		ident.List(columns),
+		strings.Repeat(row+", ", rows-1)+row,
+	)
+	if statement == config.StatementUpsert {
+		updates := make([]string, len(columns))
+		for i, column := range columns {
+			if rowAlias {
+				updates[i] = fmt.Sprintf("%s = %s.%s", ident.Quote(column), ident.Quote(upsertAlias), ident.Quote(column))
+			} else {
+				updates[i] = fmt.Sprintf("%s = VALUES(%s)", ident.Quote(column), ident.Quote(column))
+			}
+		}
+		if rowAlias {
+			query += " AS " + ident.Quote(upsertAlias)
+		}
+		query += " ON DUPLICATE KEY UPDATE " + strings.Join(updates, ", ")
+	}
+	return query
+}
+
+// statementSizes returns the number of rows of each statement a worker writes batches with, largest first:
+// rowsPerStatement and the powers of two below it. Whatever is left of a batch once a full statement no
+// longer fits is written with the smaller ones, so a worker prepares a handful of statements at most.
+func statementSizes(rowsPerStatement int) []int {
+	sizes := []int{max(rowsPerStatement, 1)}
+	for size := 1 << (bits.Len(uint(sizes[0])) - 1); size >= 1; size /= 2 {
+		if size < sizes[0] {
+			sizes = append(sizes, size)
+		}
+	}
+	return sizes
+}
+
+// erNeedReprepare is returned when a table changed under a prepared statement in a way the server could not
+// re-prepare it for
+const erNeedReprepare = 1615
+
+// loadQuery loads the rows the reader handler named handler serves, as written by encodeRow
+func loadQuery(handler, dbName, tableName string, columns []string) string {
+	return fmt.Sprintf("LOAD DATA LOCAL INFILE 'Reader::%s' INTO TABLE %s "+
+		`FIELDS TERMINATED BY '\t' ESCAPED BY '\\' LINES TERMINATED BY '\n' (%s)`,
+		handler, ident.Table(dbName, tableName), ident.List(columns))
+}
+
+// loadHandlers numbers the reader handlers so concurrent workers never share a name
+var loadHandlers atomic.Uint64
+
+// loadBatch writes the batch with a single LOAD DATA LOCAL INFILE, streamed from memory through a driver
+// reader handler. Records that cannot be converted are dead-lettered on their own; an error on the load
+// applies to the whole batch. Like any LOCAL load, duplicates and bad values become warnings.
+func (w *tableWriter) loadBatch(batch []interface{}) ([]interface{}, error) {
+	var data bytes.Buffer
+	var loaded []interface{}
+	var checksum uint64
+	for _, record := range batch {
+		values, err := w.values(record)
+		if err == nil {
+			err = encodeRow(&data, values)
+		}
+		if err != nil {
+			w.control.setError(err)
+			w.sendToDeadLetter(record, err)
+			continue
+		}
+		loaded = append(loaded, record)
+		checksum ^= w.rowChecksum(values)
+	}
+	if len(loaded) == 0 {
+		return nil, nil
+	}
+
+	write := func() error {
+		rows, err := w.load(data.Bytes())
+		if err != nil {
+			return err
+		}
+		w.written += rows
+		w.checksum ^= checksum
+		return nil
+	}
+	deadLetter := func(err error) {
+		for _, record := range loaded {
+			w.sendToDeadLetter(record, err)
+		}
+	}
+	err := w.attempt(write, deadLetter)
+	if errors.Is(err, errUnavailable) {
+		return loaded, nil
+	}
+	return nil, err
+}
+
+// load runs LOAD DATA over data and returns the number of rows it loaded
+func (w *tableWriter) load(data []byte) (int64, error) {
+	conn, err := w.connection()
+	if err != nil {
+		return 0, err
+	}
+	handler := fmt.Sprintf("ingestor_load_%d", loadHandlers.Add(1)) // no table names, they could end the quoted file name
+	mysql.RegisterReaderHandler(handler, func() io.Reader { return bytes.NewReader(data) })
+	defer mysql.DeregisterReaderHandler(handler)
+
+	result, err := conn.ExecContext(context.Background(), loadQuery(handler, w.dbName, w.tableName, w.columns))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// tsvEscaper escapes the characters LOAD DATA treats specially with ESCAPED BY '\\'
+var tsvEscaper = strings.NewReplacer(`\`, `\\`, "\t", `\t`, "\n", `\n`, "\r", `\r`, "\x00", `\0`)
+
+// encodeRow appends values as one tab separated line, NULL as \N
+func encodeRow(buf *bytes.Buffer, values []interface{}) error {
+	for i, value := range values {
+		if i > 0 {
+			buf.WriteByte('\t')
+		}
+		field, err := encodeField(value)
+		if err != nil {
+			return fmt.Errorf("failed to encode column %d for LOAD DATA: %w", i+1, err)
+		}
+		buf.WriteString(field)
+	}
+	buf.WriteByte('\n')
+	return nil
+}
+
+func encodeField(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return `\N`, nil
+	case string:
+		return tsvEscaper.Replace(v), nil
+	case []byte:
+		return tsvEscaper.Replace(string(v)), nil
+	case bool:
+		if v {
+			return "1", nil
+		}
+		return "0", nil
+	case float32:
+		return strconv.FormatFloat(float64(v), 'g', -1, 32), nil
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64), nil
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, json.Number:
+		return fmt.Sprint(v), nil
+	case time.Time:
+		return v.Format("2006-01-02 15:04:05.999999"), nil
+	default:
+		// Nested values such as JSON columns
+		encoded, err := json.Marshal(v)
+		if err != nil {
+			return "", err
+		}
+		return tsvEscaper.Replace(string(encoded)), nil
+	}
+}
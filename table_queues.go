@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"mysql_public_data_ingestor/api_plugins"
+	"mysql_public_data_ingestor/config"
+	"mysql_public_data_ingestor/database"
+	"mysql_public_data_ingestor/queue"
+	"mysql_public_data_ingestor/spool"
+	"mysql_public_data_ingestor/syslogwrapper"
+)
+
+// TableQueues is the live set of table queues, each drained by its own TableWorker. Config reloads add and
+// remove tables while the fetcher distributes batches to them.
+type TableQueues struct {
+	mu       sync.RWMutex
+	queues   map[string]*queue.Queue
+	controls map[string]*TableControl
+	wg       sync.WaitGroup
+}
+
+func NewTableQueues() *TableQueues {
+	return &TableQueues{queues: make(map[string]*queue.Queue), controls: make(map[string]*TableControl)}
+}
+
+// Snapshot returns the current queues by name. The map is a copy and safe to range over while tables change.
+func (t *TableQueues) Snapshot() map[string]*queue.Queue {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	queues := make(map[string]*queue.Queue, len(t.queues))
+	for name, q := range t.queues {
+		queues[name] = q
+	}
+	return queues
+}
+
+// Names returns the names of the current queues in order
+func (t *TableQueues) Names() []string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	names := make([]string, 0, len(t.queues))
+	for name := range t.queues {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Control returns the pause and error state of a table's worker
+func (t *TableQueues) Control(name string) (*TableControl, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	control, ok := t.controls[name]
+	return control, ok
+}
+
+// SetPaused pauses or resumes the worker of a table
+func (t *TableQueues) SetPaused(name string, paused bool) error {
+	control, ok := t.Control(name)
+	if !ok {
+		return fmt.Errorf("unknown table %s", name)
+	}
+	control.Set(paused)
+	return nil
+}
+
+// Start creates the queue named name for a table of target and the worker writing it. share is the fraction
+// of each batch the table writes.
+func (t *TableQueues) Start(cfg config.MainConfig, target Target, name string, table database.Table, share float64, sysLog syslogwrapper.SyslogWrapperInterface, apiPlugin api_plugins.APIPlugin, workerOpts WorkerOptions) error {
+	q, err := queue.New(name, cfg.Queue)
+	if err != nil {
+		return err
+	}
+	opts := workerOpts
+	opts.DeadLetter = target.DeadLetter
+	opts.Audit = target.Audit
+	opts.Control = &TableControl{}
+	opts.Control.SetShare(share)
+	opts.Statement = table.Statement
+	opts.RowsPerStatement = cfg.Databases.RowsPerStatement
+	opts.Prepare = target.Prepare
+	opts.RowAlias = target.RowAlias
+	opts.Closed = q.Done()
+	if cfg.Spool.Dir != "" {
+		opts.Spool, err = spool.Open(name, filepath.Join(cfg.Spool.Dir, name), cfg.Spool)
+		if err != nil {
+			return err
+		}
+	}
+
+	t.mu.Lock()
+	t.queues[name] = q
+	t.controls[name] = opts.Control
+	t.mu.Unlock()
+	t.wg.Add(1)
+	go TableWorker(table.Database, table.Name, q.C(), &t.wg, sysLog, target.DBManager, apiPlugin, opts)
+	return nil
+}
+
+// Stop removes a table. Its worker writes the batches already queued and exits.
+func (t *TableQueues) Stop(name string) {
+	t.mu.Lock()
+	q, ok := t.queues[name]
+	control := t.controls[name]
+	delete(t.queues, name)
+	delete(t.controls, name)
+	t.mu.Unlock()
+	if ok {
+		control.Set(false) // A paused worker could not drain its queue
+		q.Close()
+	}
+}
+
+// Close closes every queue so the workers drain them and exit
+func (t *TableQueues) Close() {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for name, q := range t.queues {
+		t.controls[name].Set(false)
+		q.Close()
+	}
+}
+
+// Wait blocks until every worker, including those of removed tables, has exited
+func (t *TableQueues) Wait() {
+	t.wg.Wait()
+}
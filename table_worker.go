@@ -0,0 +1,589 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"mysql_public_data_ingestor/api_plugins"
+	"mysql_public_data_ingestor/audit"
+	"mysql_public_data_ingestor/config"
+	"mysql_public_data_ingestor/database"
+	"mysql_public_data_ingestor/deadletter"
+	"mysql_public_data_ingestor/distribution"
+	"mysql_public_data_ingestor/metrics"
+	"mysql_public_data_ingestor/retry"
+	"mysql_public_data_ingestor/spool"
+	"mysql_public_data_ingestor/syslogwrapper"
+	"mysql_public_data_ingestor/workload"
+)
+
+const defaultReplayInterval = 5 * time.Second
+
+var (
+	writeErrors        = metrics.Map("write_errors")
+	writeRetries       = metrics.Counter("write_retries")
+	preparedStatements = metrics.Counter("statements_prepared")
+)
+
+// errHalted is returned by a tableWriter once a halt policy has stopped it
+var errHalted = errors.New("table worker halted")
+
+// errSplit is returned when a multi-row statement failed on a record and its records are to be written one by one
+var errSplit = errors.New("multi-row statement failed on a record")
+
+// WorkerOptions carries the optional collaborators of a TableWorker. The zero value writes batches directly
+// with the default error policies and no retries.
+type WorkerOptions struct {
+	Profile        *workload.Profile
+	Spool          *spool.Spool // buffers batches on disk while MySQL is unreachable
+	ReplayInterval time.Duration
+	Backoff        retry.Backoff
+	Policies       map[retry.Class]retry.Policy
+	Halt           func(err error) // called when a halt policy stops the worker
+	DeadLetter     deadletter.Sink
+	Audit          audit.Sink    // records what each batch committed, tags rows with their batch id
+	Control        *TableControl // pauses the worker and keeps its last error for the admin API
+	Distributed    bool          // records arrive already picked by table, the table share is not sampled again
+	Statement      string        // how rows are written, one of config.Statements, INSERT when empty
+	// RowsPerStatement is the number of records written by one statement, 0 and 1 write each on its own
+	RowsPerStatement int
+	Prepare          bool // statements are prepared once per connection instead of sent as text
+	RowAlias         bool // the server takes a row alias in INSERT, upserts use it instead of VALUES()
+	// Closed is closed when the queue feeding the worker closes, so a paused worker still drains and exits
+	Closed <-chan struct{}
+}
+
+// NewWorkerOptions fills the options that come straight from config
+func NewWorkerOptions(cfg config.MainConfig) WorkerOptions {
+	policies := make(map[retry.Class]retry.Policy, len(cfg.WriteErrors.Policies))
+	for class, policy := range cfg.WriteErrors.Policies {
+		policies[retry.Class(class)] = retry.Policy(policy)
+	}
+	return WorkerOptions{
+		ReplayInterval: cfg.Spool.ReplayInterval,
+		Backoff: retry.Backoff{
+			Initial:     cfg.WriteErrors.Backoff.Initial,
+			Max:         cfg.WriteErrors.Backoff.Max,
+			Multiplier:  cfg.WriteErrors.Backoff.Multiplier,
+			MaxAttempts: cfg.WriteErrors.Backoff.MaxAttempts,
+		},
+		Policies:    policies,
+		Distributed: distribution.New(cfg.Distribution) != nil,
+	}
+}
+
+func TableWorker(dbName, tableName string, batchChan <-chan []interface{}, wg *sync.WaitGroup, sysLog syslogwrapper.SyslogWrapperInterface, dbManager database.DBManagerInterface, apiPlugin api_plugins.APIPlugin, opts WorkerOptions) {
+	defer wg.Done()
+
+	w := newTableWriter(dbName, tableName, sysLog, dbManager, apiPlugin, opts)
+	defer w.release()
+
+	// Spooled batches are retried on a timer so replay does not depend on new data arriving
+	var replayTick <-chan time.Time
+	if opts.Spool != nil {
+		interval := opts.ReplayInterval
+		if interval <= 0 {
+			interval = defaultReplayInterval
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		replayTick = ticker.C
+	}
+
+	err := w.run(batchChan, replayTick, opts.Profile)
+	if errors.Is(err, errHalted) {
+		if opts.Halt != nil {
+			opts.Halt(fmt.Errorf("%s.%s: %w", dbName, tableName, err))
+		}
+		for range batchChan {
+			// Keep draining so the fetcher is not blocked while the ingestor shuts down
+		}
+	}
+}
+
+func newTableWriter(dbName, tableName string, sysLog syslogwrapper.SyslogWrapperInterface, dbManager database.DBManagerInterface, apiPlugin api_plugins.APIPlugin, opts WorkerOptions) *tableWriter {
+	fieldNames := apiPlugin.GetFieldNames()
+	columns := fieldNames
+	var hashOrder []int
+	if opts.Audit != nil {
+		columns = append(slices.Clone(fieldNames), database.BatchColumn)
+		for _, column := range audit.Columns(fieldNames) {
+			hashOrder = append(hashOrder, slices.Index(fieldNames, column))
+		}
+	}
+	sizes := statementSizes(opts.RowsPerStatement)
+	queries := make(map[int]string, len(sizes))
+	for _, rows := range sizes {
+		queries[rows] = writeQuery(opts.Statement, dbName, tableName, columns, rows, opts.RowAlias)
+	}
+	w := &tableWriter{
+		dbName:      dbName,
+		tableName:   tableName,
+		statement:   opts.Statement,
+		queries:     queries,
+		sizes:       sizes,
+		prepare:     opts.Prepare,
+		columns:     columns,
+		fieldNames:  fieldNames,
+		sysLog:      sysLog,
+		dbManager:   dbManager,
+		apiPlugin:   apiPlugin,
+		spool:       opts.Spool,
+		backoff:     opts.Backoff,
+		policies:    opts.Policies,
+		deadLetter:  opts.DeadLetter,
+		audit:       opts.Audit,
+		control:     opts.Control,
+		distributed: opts.Distributed,
+		closed:      opts.Closed,
+		hashOrder:   hashOrder,
+	}
+	if w.policies == nil {
+		w.policies = retry.DefaultPolicies
+	}
+	return w
+}
+
+// run consumes batches until the channel is closed or a halt policy fires
+func (w *tableWriter) run(batchChan <-chan []interface{}, replayTick <-chan time.Time, profile *workload.Profile) error {
+	if err := w.replay(); err != nil {
+		return err
+	}
+	for {
+		if resumed := w.control.resumed(); resumed != nil {
+			// Paused, batches wait in the queue under its overflow policy
+			w.release()
+			select {
+			case <-resumed:
+			case <-w.closed:
+			}
+		}
+		select {
+		case batch, ok := <-batchChan:
+			if !ok {
+				return w.replay()
+			}
+			batch = workload.SampleBatch(profile.Phase(), batch)
+			if !w.distributed {
+				batch = workload.Sample(w.control.Share(), batch)
+			}
+			if len(batch) == 0 {
+				continue
+			}
+			if w.spool != nil && w.spool.Len() > 0 {
+				// Earlier batches are still waiting, queue behind them to keep order
+				w.spoolBatch(batch)
+				if err := w.replay(); err != nil {
+					return err
+				}
+				continue
+			}
+			rest, err := w.writeBatch(batch)
+			if err != nil {
+				return err
+			}
+			if len(rest) > 0 {
+				w.spoolBatch(rest)
+			}
+		case <-replayTick:
+			if err := w.replay(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// tableWriter holds the per-table state of a TableWorker
+type tableWriter struct {
+	dbName      string
+	tableName   string
+	statement   string
+	queries     map[int]string // write statement by number of rows
+	sizes       []int          // rows per statement, largest first
+	prepare     bool
+	columns     []string // written columns, the plugin fields and the batch column when auditing
+	sysLog      syslogwrapper.SyslogWrapperInterface
+	dbManager   database.DBManagerInterface
+	apiPlugin   api_plugins.APIPlugin
+	spool       *spool.Spool
+	backoff     retry.Backoff
+	policies    map[retry.Class]retry.Policy
+	deadLetter  deadletter.Sink
+	audit       audit.Sink
+	control     *TableControl
+	distributed bool
+	closed      <-chan struct{}
+	fieldNames  []string
+
+	conn         *sql.Conn
+	stmts        map[int]*sql.Stmt // statements prepared on conn by number of rows
+	replayOffset int               // records of the spool head already written by a partial replay
+	batchID      uint64            // id of the batch being written when auditing
+	written      int64             // records of the current batch committed so far
+	checksum     uint64            // audit checksum of the records committed so far
+	hashOrder    []int             // index of each field value in audit.Columns order
+}
+
+// connection returns the worker's connection, acquiring one from the pool when needed
+func (w *tableWriter) connection() (*sql.Conn, error) {
+	if w.conn != nil {
+		return w.conn, nil
+	}
+	conn, err := w.dbManager.Conn(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	w.conn = conn
+	return conn, nil
+}
+
+// release hands the connection back to the pool; the next write acquires a fresh one
+func (w *tableWriter) release() {
+	if w.conn == nil {
+		return
+	}
+	w.closeStatements()
+	if err := w.conn.Close(); err != nil {
+		w.sysLog.Warning(fmt.Sprintf("Failed to release DBPool connection: %v", err))
+	}
+	w.conn = nil
+}
+
+// writeBatch inserts the records in statements of w.sizes rows, each in its own transaction. It returns the
+// records that could not be written because MySQL was unreachable, or errHalted when a halt policy fired.
+func (w *tableWriter) writeBatch(batch []interface{}) ([]interface{}, error) {
+	if w.audit != nil {
+		w.batchID = audit.NextBatchID()
+		w.written = 0
+		w.checksum = 0
+		defer w.recordBatch()
+	}
+	if w.statement == config.StatementLoadData {
+		return w.loadBatch(batch)
+	}
+	single := 0 // records before this index are written one by one after their multi-row statement failed
+	for i := 0; i < len(batch); {
+		rows := 1
+		if i >= single {
+			rows = w.rowsFor(len(batch) - i)
+		}
+		var err error
+		if rows == 1 {
+			err = w.writeRecord(batch[i])
+		} else {
+			err = w.writeRows(batch[i : i+rows])
+		}
+		if errors.Is(err, errSplit) {
+			single = i + rows
+			continue
+		}
+		if errors.Is(err, errUnavailable) {
+			return batch[i:], nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		i += rows
+	}
+	return nil, nil
+}
+
+// rowsFor returns the largest statement size that fits in the remaining records
+func (w *tableWriter) rowsFor(remaining int) int {
+	for _, rows := range w.sizes {
+		if rows <= remaining {
+			return rows
+		}
+	}
+	return 1
+}
+
+// errUnavailable means MySQL could not be reached within the retry budget
+var errUnavailable = errors.New("mysql unavailable")
+
+// writeRecord inserts one record, applying the configured policy for the class of any error
+func (w *tableWriter) writeRecord(record interface{}) error {
+	values, err := w.values(record)
+	if err != nil {
+		w.control.setError(err)
+		w.sendToDeadLetter(record, err)
+		return nil
+	}
+	checksum := w.rowChecksum(values)
+	write := func() error {
+		if err := w.insert(1, values); err != nil {
+			return err
+		}
+		w.written++
+		w.checksum ^= checksum
+		return nil
+	}
+	return w.attempt(write, func(err error) { w.sendToDeadLetter(record, err) })
+}
+
+// writeRows writes records with one multi-row statement. An error that comes from a single record, such as a
+// duplicate key or a value too long, fails the whole statement; writeRows then returns errSplit and the
+// records are written again one by one so only the failing record meets its policy.
+func (w *tableWriter) writeRows(records []interface{}) error {
+	args := make([]interface{}, 0, len(records)*len(w.columns))
+	var checksum uint64
+	for _, record := range records {
+		values, err := w.values(record)
+		if err != nil {
+			return errSplit
+		}
+		args = append(args, values...)
+		checksum ^= w.rowChecksum(values)
+	}
+	split := false
+	write := func() error {
+		err := w.insert(len(records), args)
+		if err == nil {
+			w.written += int64(len(records))
+			w.checksum ^= checksum
+			return nil
+		}
+		switch retry.Classify(err) {
+		case retry.DuplicateKey, retry.DataTooLong, retry.Other:
+			split = true
+			return nil
+		}
+		return err
+	}
+	err := w.attempt(write, func(error) { split = true })
+	if err == nil && split {
+		return errSplit
+	}
+	return err
+}
+
+// attempt runs write until it succeeds or the configured policy for the class of its error gives up.
+// deadLetter stores what write was writing when the policy dead-letters it.
+func (w *tableWriter) attempt(write func() error, deadLetter func(err error)) error {
+	for attempt := 1; ; attempt++ {
+		err := write()
+		if err == nil {
+			return nil
+		}
+
+		w.control.setError(err)
+		class := retry.Classify(err)
+		writeErrors.Add(string(class), 1)
+		if class == retry.Connection || class == retry.ReadOnly {
+			// The next attempt starts from a fresh pool connection, on a new primary if there was a failover
+			w.release()
+			w.dbManager.CheckPrimary()
+		}
+
+		switch w.policies[class] {
+		case retry.Retry:
+			if !w.backoff.Exhausted(attempt) {
+				writeRetries.Add(1)
+				time.Sleep(w.backoff.Delay(attempt))
+				continue
+			}
+			if class == retry.Connection || class == retry.ReadOnly {
+				return errUnavailable // Out of retries, leave the rest of the batch to the spool
+			}
+			w.sysLog.Warning(fmt.Sprintf("Giving up on record for %s.%s after %d attempts (%s): %v", w.dbName, w.tableName, attempt, class, err))
+			return nil
+		case retry.DeadLetter:
+			deadLetter(err)
+			return nil
+		case retry.Halt:
+			w.sysLog.Error(fmt.Sprintf("Halting writes to %s.%s on %s error: %v", w.dbName, w.tableName, class, err))
+			return errHalted
+		default:
+			w.sysLog.Warning(fmt.Sprintf("Failed to insert record into %s.%s: %v", w.dbName, w.tableName, err))
+			return nil
+		}
+	}
+}
+
+// values converts a record to column values, turning a plugin panic on malformed input into an error.
+// When auditing the batch id is the last value.
+func (w *tableWriter) values(record interface{}) (values []interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("failed to convert record: %v", r)
+		}
+	}()
+	values = w.apiPlugin.GetValues(record)
+	if w.audit != nil {
+		values = append(values, w.batchID)
+	}
+	return values, nil
+}
+
+// rowChecksum returns the audit checksum of the values of a record, computed before they are written
+func (w *tableWriter) rowChecksum(values []interface{}) uint64 {
+	if w.audit == nil {
+		return 0
+	}
+	ordered := make([]interface{}, len(w.hashOrder))
+	for i, j := range w.hashOrder {
+		ordered[i] = values[j]
+	}
+	return audit.RowChecksum(ordered)
+}
+
+// sendToDeadLetter stores a record that cannot be written. Without a sink the record is kept in the log.
+func (w *tableWriter) sendToDeadLetter(record interface{}, cause error) {
+	if w.deadLetter == nil {
+		w.sysLog.Error(fmt.Sprintf("Dead-lettered record for %s.%s: %v: %v", w.dbName, w.tableName, cause, record))
+		return
+	}
+	entry, err := deadletter.NewEntry(w.dbName, w.tableName, record, retry.Code(cause), cause)
+	if err == nil {
+		err = w.deadLetter.Write(entry)
+	}
+	if err != nil {
+		w.sysLog.Error(fmt.Sprintf("Failed to dead-letter record for %s.%s (%v): %v: %v", w.dbName, w.tableName, cause, err, record))
+	}
+}
+
+// insert runs the write statement for rows rows in its own transaction
+func (w *tableWriter) insert(rows int, values []interface{}) error {
+	if w.prepare {
+		return w.execPrepared(rows, values)
+	}
+	db, err := w.connection()
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.BeginTx(context.Background(), &sql.TxOptions{})
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(w.queries[rows], values...)
+	if err != nil {
+		rollbackErr := tx.Rollback()
+		if rollbackErr != nil && retry.Classify(err) != retry.Connection {
+			w.sysLog.Warning(fmt.Sprintf("Failed to rollback transaction: %v", rollbackErr))
+		} // Rollback the current transaction on error
+		return err
+	}
+	// Commit each record change
+	return tx.Commit()
+}
+
+// execPrepared runs the statement for rows rows prepared on the worker's connection. It runs outside a
+// transaction, in autocommit a single statement is its own transaction, and a statement prepared on a
+// connection would be prepared again for every transaction begun on it.
+func (w *tableWriter) execPrepared(rows int, values []interface{}) error {
+	stmt, err := w.prepared(rows)
+	if err != nil {
+		return err
+	}
+	_, err = stmt.ExecContext(context.Background(), values...)
+	if retry.Code(err) == erNeedReprepare {
+		// The table changed under the statement, prepare it against the new definition
+		w.closeStatements()
+		if stmt, err = w.prepared(rows); err == nil {
+			_, err = stmt.ExecContext(context.Background(), values...)
+		}
+	}
+	return err
+}
+
+// prepared returns the statement for rows rows, preparing it on the worker's connection on first use
+func (w *tableWriter) prepared(rows int) (*sql.Stmt, error) {
+	if stmt, ok := w.stmts[rows]; ok {
+		return stmt, nil
+	}
+	conn, err := w.connection()
+	if err != nil {
+		return nil, err
+	}
+	stmt, err := conn.PrepareContext(context.Background(), w.queries[rows])
+	if err != nil {
+		return nil, err
+	}
+	preparedStatements.Add(1)
+	if w.stmts == nil {
+		w.stmts = make(map[int]*sql.Stmt, len(w.sizes))
+	}
+	w.stmts[rows] = stmt
+	return stmt, nil
+}
+
+// closeStatements drops the prepared statements, the next write prepares them again
+func (w *tableWriter) closeStatements() {
+	for rows, stmt := range w.stmts {
+		// The server frees them with the connection anyway, a failure to close one is of no consequence
+		_ = stmt.Close()
+		delete(w.stmts, rows)
+	}
+}
+
+// recordBatch stores the number of records the current batch committed together with the checksum of the values
+// they were written with, which is what the verify command later compares against
+func (w *tableWriter) recordBatch() {
+	if w.written == 0 {
+		return
+	}
+	entry := audit.Entry{
+		Database: w.dbName,
+		Table:    w.tableName,
+		BatchID:  w.batchID,
+		Rows:     w.written,
+		Checksum: w.checksum,
+		Time:     time.Now().UTC(),
+	}
+	if err := w.audit.Record(entry); err != nil {
+		w.sysLog.Warning(fmt.Sprintf("Failed to record audit entry for batch %d of %s.%s: %v", w.batchID, w.dbName, w.tableName, err))
+	}
+}
+
+// spoolBatch keeps records that could not be written, or drops them when no spool is configured
+func (w *tableWriter) spoolBatch(batch []interface{}) {
+	if w.spool == nil {
+		w.sysLog.Warning(fmt.Sprintf("Dropped %d records for %s.%s, no spool configured", len(batch), w.dbName, w.tableName))
+		return
+	}
+	if err := w.spool.Append(batch); err != nil {
+		w.sysLog.Warning(fmt.Sprintf("Dropped %d records for %s.%s, failed to spool: %v", len(batch), w.dbName, w.tableName, err))
+	}
+}
+
+// replay writes spooled batches oldest first until the spool is empty or MySQL fails again
+func (w *tableWriter) replay() error {
+	if w.spool == nil {
+		return nil
+	}
+	for {
+		batch, ok, err := w.spool.Peek()
+		if errors.Is(err, spool.ErrCorrupt) {
+			w.sysLog.Error(fmt.Sprintf("Skipped corrupt spool segment for %s.%s: %v", w.dbName, w.tableName, err))
+			continue
+		}
+		if err != nil {
+			w.sysLog.Warning(fmt.Sprintf("Failed to read spool for %s.%s: %v", w.dbName, w.tableName, err))
+			return nil
+		}
+		if !ok {
+			return nil
+		}
+
+		rest, err := w.writeBatch(batch[w.replayOffset:])
+		if err != nil {
+			return err
+		}
+		if len(rest) > 0 {
+			w.replayOffset = len(batch) - len(rest)
+			return nil
+		}
+		w.replayOffset = 0
+		if err := w.spool.Ack(); err != nil {
+			w.sysLog.Warning(fmt.Sprintf("Failed to advance spool for %s.%s: %v", w.dbName, w.tableName, err))
+			return nil
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"mysql_public_data_ingestor/api_plugins"
+	"mysql_public_data_ingestor/audit"
+	"mysql_public_data_ingestor/config"
+	"mysql_public_data_ingestor/database"
+	"mysql_public_data_ingestor/deadletter"
+	"mysql_public_data_ingestor/partitions"
+	"mysql_public_data_ingestor/reads"
+	"mysql_public_data_ingestor/replication"
+	"mysql_public_data_ingestor/retention"
+	"mysql_public_data_ingestor/routing"
+	"mysql_public_data_ingestor/syslogwrapper"
+)
+
+// Target is one MySQL destination with its own databases, connection pool, dead-letter and audit sinks
+type Target struct {
+	Name       string
+	DBManager  *database.DBManager
+	DeadLetter deadletter.Sink
+	Audit      audit.Sink
+	Prepare    bool // workers prepare their statements, false when the driver interpolates arguments
+	RowAlias   bool // the server takes a row alias in INSERT, see database.SupportsRowAlias
+}
+
+// InitializeTargets connects to every configured target and creates the database layout on each of them
+func InitializeTargets(cfg config.MainConfig, sysLog syslogwrapper.SyslogWrapperInterface, apiPlugin api_plugins.APIPlugin) ([]Target, error) {
+	targets := make([]Target, 0, len(cfg.Targets))
+	for _, targetCfg := range cfg.Targets {
+		dbManager, err := InitializeDatabases(cfg, targetCfg.MySQL, sysLog, apiPlugin)
+		if err != nil {
+			closeTargets(targets)
+			return nil, fmt.Errorf("target %s: %w", targetCfg.Name, err)
+		}
+		dbManager.Name = targetCfg.Name
+		target, err := newTarget(cfg, targetCfg, dbManager)
+		if err != nil {
+			dbManager.Close()
+			closeTargets(targets)
+			return nil, err
+		}
+		targets = append(targets, target)
+	}
+	return targets, nil
+}
+
+// OpenTargets connects to every configured target and opens its sinks without creating any database or
+// table, for commands that work on what an ingestor already created
+func OpenTargets(cfg config.MainConfig, apiPlugin api_plugins.APIPlugin) ([]Target, error) {
+	managers, err := connectTargets(cfg)
+	if err != nil {
+		return nil, err
+	}
+	targets := make([]Target, 0, len(managers))
+	for i, dbManager := range managers {
+		dbManager.SetLayout(cfg, apiPlugin.TablePrefix())
+		target, err := newTarget(cfg, cfg.Targets[i], dbManager)
+		if err != nil {
+			closeTargets(targets)
+			closeManagers(managers[i:])
+			return nil, err
+		}
+		targets = append(targets, target)
+	}
+	return targets, nil
+}
+
+// newTarget opens the dead-letter and audit sinks of a connected target
+func newTarget(cfg config.MainConfig, targetCfg config.TargetConfig, dbManager *database.DBManager) (Target, error) {
+	dlCfg := cfg.DeadLetter
+	if dlCfg.Sink == deadletter.FileSinkType {
+		dlCfg.File = targetFile(cfg, dlCfg.File, targetCfg.Name)
+	}
+	deadLetterSink, err := deadletter.New(dlCfg, dbManager.Pool, dbManager.DatabaseNames)
+	if err != nil {
+		return Target{}, fmt.Errorf("target %s: %w", targetCfg.Name, err)
+	}
+
+	auditCfg := cfg.Audit
+	if auditCfg.Sink == audit.FileSinkType {
+		auditCfg.File = targetFile(cfg, auditCfg.File, targetCfg.Name)
+	}
+	auditSink, err := audit.New(auditCfg, dbManager.Pool, dbManager.DatabaseNames)
+	if err != nil {
+		return Target{}, fmt.Errorf("target %s: %w", targetCfg.Name, err)
+	}
+
+	return Target{
+		Name:       targetCfg.Name,
+		DBManager:  dbManager,
+		DeadLetter: deadLetterSink,
+		Audit:      auditSink,
+		Prepare:    !targetCfg.MySQL.InterpolateParams,
+		RowAlias:   dbManager.RowAlias(),
+	}, nil
+}
+
+// targetFile gives each target its own copy of a file sink so replays and verification go back to the
+// right server. With a single target the configured path is used as is.
+func targetFile(cfg config.MainConfig, path, target string) string {
+	if len(cfg.Targets) < 2 || path == "" {
+		return path
+	}
+	ext := filepath.Ext(path)
+	return fmt.Sprintf("%s.%s%s", strings.TrimSuffix(path, ext), target, ext)
+}
+
+func targetNames(targets []Target) []string {
+	names := make([]string, len(targets))
+	for i, target := range targets {
+		names[i] = target.Name
+	}
+	return names
+}
+
+// StartTargetMaintenance keeps the pools of every target healthy and pointed at a writable primary
+func StartTargetMaintenance(cfg config.MainConfig, targets []Target, sysLog syslogwrapper.SyslogWrapperInterface) {
+	for i, target := range targets {
+		target.DBManager.StartMaintenance(sysLog, failoverCheckInterval(cfg.Targets[i].MySQL))
+	}
+}
+
+func failoverCheckInterval(mysqlConfig config.MySQLConfig) time.Duration {
+	if mysqlConfig.FailoverCheckInterval > 0 {
+		return mysqlConfig.FailoverCheckInterval
+	}
+	return 5 * time.Second
+}
+
+// StartReaders runs the read workload against the tables each target writes
+func StartReaders(cfg config.MainConfig, targets []Target, router *routing.Router, sysLog syslogwrapper.SyslogWrapperInterface, stop <-chan struct{}) (*sync.WaitGroup, error) {
+	var wg sync.WaitGroup
+	for _, target := range targets {
+		var tables []string
+		for _, dbName := range target.DBManager.DatabaseNames() {
+			for _, tableName := range target.DBManager.TableNames(dbName) {
+				if router.Owns(target.Name, dbName, tableName) {
+					tables = append(tables, fmt.Sprintf("%s.%s", dbName, tableName))
+				}
+			}
+		}
+		readers, err := reads.New(cfg.ReadWorkload, target.Name, target.DBManager.Pool, tables, sysLog)
+		if err != nil {
+			return nil, fmt.Errorf("target %s: %w", target.Name, err)
+		}
+		readers.Run(stop, &wg)
+	}
+	return &wg, nil
+}
+
+// StartReplicationCheck starts the replica lag and checksum checks against the configured primary target
+func StartReplicationCheck(cfg config.MainConfig, targets []Target, apiPlugin api_plugins.APIPlugin, sysLog syslogwrapper.SyslogWrapperInterface, stop <-chan struct{}, wg *sync.WaitGroup) error {
+	for _, target := range targets {
+		if target.Name != cfg.ReplicationCheck.Target {
+			continue
+		}
+		checker, err := replication.New(cfg.ReplicationCheck, target.DBManager, apiPlugin, sysLog)
+		if err != nil {
+			return err
+		}
+		return checker.Run(stop, wg)
+	}
+	return nil
+}
+
+// StartRetention keeps the generated tables of every target within retention.max_age. Partitioned tables
+// are rotated by the partition maintainer, which drops expired partitions instead of deleting rows.
+func StartRetention(cfg config.MainConfig, targets []Target, apiPlugin api_plugins.APIPlugin, sysLog syslogwrapper.SyslogWrapperInterface, stop <-chan struct{}, wg *sync.WaitGroup) error {
+	for _, target := range targets {
+		maintainer, err := partitions.New(cfg, target.DBManager, apiPlugin, sysLog)
+		if err != nil {
+			return err
+		}
+		if maintainer != nil {
+			maintainer.Run(stop, wg)
+			continue
+		}
+		purger, err := retention.New(cfg.Retention, cfg.Databases.Prefix, target.DBManager, apiPlugin, sysLog)
+		if err != nil {
+			return err
+		}
+		purger.Run(stop, wg)
+	}
+	return nil
+}
+
+func closeTargets(targets []Target) {
+	for _, target := range targets {
+		if target.DeadLetter != nil {
+			target.DeadLetter.Close()
+		}
+		if target.Audit != nil {
+			target.Audit.Close()
+		}
+		target.DBManager.Close()
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"mysql_public_data_ingestor/api_plugins"
+	"mysql_public_data_ingestor/audit"
+	"mysql_public_data_ingestor/config"
+	"mysql_public_data_ingestor/syslogwrapper"
+)
+
+// expiryMargin is how much older than their batch rows can be. Retention purges by the rows' own time, so
+// batches committed up to this long after the retention cutoff may already have lost rows.
+const expiryMargin = time.Hour
+
+// VerifyAudit recomputes every audited batch of target from its tables and reports lost or mutated rows.
+// With retention enabled batches old enough to have been purged are skipped.
+func VerifyAudit(cfg config.MainConfig, target Target, sysLog syslogwrapper.SyslogWrapperInterface, apiPlugin api_plugins.APIPlugin) (audit.Result, error) {
+	if target.Audit == nil {
+		return audit.Result{}, errors.New("no audit sink configured")
+	}
+	var expiredBefore time.Time
+	if cfg.Retention.MaxAge > 0 {
+		expiredBefore = time.Now().Add(-cfg.Retention.MaxAge).Add(expiryMargin)
+	}
+	return audit.Verify(target.Audit, target.DBManager.Pool, apiPlugin.GetFieldNames(), expiredBefore, sysLog)
+}
@@ -0,0 +1,156 @@
+package workload
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"mysql_public_data_ingestor/config"
+	"mysql_public_data_ingestor/metrics"
+	"mysql_public_data_ingestor/syslogwrapper"
+)
+
+var (
+	phaseIndex       = metrics.Counter("workload_phase")
+	phaseName        = metrics.Label("workload_phase_name")
+	phaseTransitions = metrics.Counter("workload_phase_transitions")
+)
+
+// defaultPhase is used when no profile is configured: full rate, full writes, all tables
+var defaultPhase = config.WorkloadPhase{Name: "default"}
+
+// Profile walks through the configured phases as wall clock time passes.
+// A nil *Profile is valid and always reports the default phase.
+type Profile struct {
+	phases []config.WorkloadPhase
+	loop   bool
+	total  time.Duration
+	sysLog syslogwrapper.SyslogWrapperInterface
+	now    func() time.Time
+
+	mu      sync.Mutex
+	start   time.Time
+	current int
+}
+
+// NewProfile builds a Profile from config. It returns nil when no phases are configured.
+func NewProfile(cfg config.WorkloadProfile, sysLog syslogwrapper.SyslogWrapperInterface) *Profile {
+	if len(cfg.Phases) == 0 {
+		return nil
+	}
+	p := &Profile{
+		phases:  cfg.Phases,
+		loop:    cfg.Loop,
+		sysLog:  sysLog,
+		now:     time.Now,
+		current: -1,
+	}
+	for _, phase := range cfg.Phases {
+		p.total += phase.Duration
+	}
+	return p
+}
+
+// Start resets the profile clock to the first phase
+func (p *Profile) Start() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	p.start = p.now()
+	p.current = -1
+	p.mu.Unlock()
+	p.Phase()
+}
+
+// Phase returns the phase active right now, logging and recording any transition
+func (p *Profile) Phase() config.WorkloadPhase {
+	if p == nil {
+		return defaultPhase
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.start.IsZero() {
+		p.start = p.now()
+	}
+	elapsed := p.now().Sub(p.start)
+	if p.loop {
+		elapsed %= p.total
+	}
+
+	idx := len(p.phases) - 1 // Without loop the last phase holds once the schedule is over
+	for i, phase := range p.phases {
+		if elapsed < phase.Duration {
+			idx = i
+			break
+		}
+		elapsed -= phase.Duration
+	}
+
+	if idx != p.current {
+		phase := p.phases[idx]
+		p.sysLog.Info(fmt.Sprintf("Workload profile entering phase %s (%d/%d): rate x%.2f, write mix %.2f, active tables %d",
+			phase.Name, idx+1, len(p.phases), phase.Rate(), phase.Mix(), phase.ActiveTables))
+		phaseIndex.Set(int64(idx))
+		phaseName.Set(phase.Name)
+		phaseTransitions.Add(1)
+		p.current = idx
+	}
+	return p.phases[idx]
+}
+
+// ActiveTables returns the subset of table queues the phase writes to.
+// Tables are chosen in name order so the same tables stay hot across phases.
+func ActiveTables[T any](phase config.WorkloadPhase, tables map[string]T) map[string]T {
+	if phase.ActiveTables <= 0 || phase.ActiveTables >= len(tables) {
+		return tables
+	}
+	names := make([]string, 0, len(tables))
+	for name := range tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	active := make(map[string]T, phase.ActiveTables)
+	for _, name := range names[:phase.ActiveTables] {
+		active[name] = tables[name]
+	}
+	return active
+}
+
+// Idle reports whether the phase fetches nothing, its rate multiplier being 0
+func Idle(phase config.WorkloadPhase) bool {
+	return phase.Rate() <= 0
+}
+
+// Interval scales the plugin polling interval by the phase rate multiplier. Idle phases keep the interval,
+// callers skip fetching for them.
+func Interval(phase config.WorkloadPhase, interval time.Duration) time.Duration {
+	if Idle(phase) {
+		return interval
+	}
+	return time.Duration(float64(interval) / phase.Rate())
+}
+
+// SampleBatch keeps each record with probability equal to the phase write mix
+func SampleBatch(phase config.WorkloadPhase, batch []interface{}) []interface{} {
+	return Sample(phase.Mix(), batch)
+}
+
+// Sample keeps each record with probability fraction, a fraction of 1 or more keeps the whole batch and 0
+// none of it
+func Sample(fraction float64, batch []interface{}) []interface{} {
+	if fraction >= 1 {
+		return batch
+	}
+	sampled := make([]interface{}, 0, int(float64(len(batch))*fraction)+1)
+	for _, record := range batch {
+		if rand.Float64() < fraction {
+			sampled = append(sampled, record)
+		}
+	}
+	return sampled
+}
@@ -0,0 +1,122 @@
+package workload
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"mysql_public_data_ingestor/config"
+)
+
+// MockSyslogWrapper is a mock implementation of syslogwrapper.SyslogWrapper
+type MockSyslogWrapper struct {
+	mock.Mock
+}
+
+func (m *MockSyslogWrapper) Close() {
+	m.Called()
+}
+
+func (m *MockSyslogWrapper) Warning(message string) {
+	m.Called(message)
+}
+
+func (m *MockSyslogWrapper) Error(message string) {
+	m.Called(message)
+}
+
+func (m *MockSyslogWrapper) Info(message string) {
+	m.Called(message)
+}
+
+func (m *MockSyslogWrapper) Debug(message string) {
+	m.Called(message)
+}
+
+func value(f float64) *float64 {
+	return &f
+}
+
+func testProfile(loop bool) config.WorkloadProfile {
+	return config.WorkloadProfile{
+		Loop: loop,
+		Phases: []config.WorkloadPhase{
+			{Name: "night", Duration: time.Hour, RateMultiplier: value(0.25), WriteMix: value(0.5), ActiveTables: 1},
+			{Name: "peak", Duration: 2 * time.Hour, RateMultiplier: value(4), WriteMix: value(1)},
+		},
+	}
+}
+
+func TestProfilePhaseTransitions(t *testing.T) {
+	mockSyslog := new(MockSyslogWrapper)
+	mockSyslog.On("Info", mock.Anything).Return()
+
+	clock := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	profile := NewProfile(testProfile(false), mockSyslog)
+	profile.now = func() time.Time { return clock }
+	profile.Start()
+
+	assert.Equal(t, "night", profile.Phase().Name)
+	assert.Equal(t, "night", phaseName.Value())
+
+	clock = clock.Add(90 * time.Minute)
+	assert.Equal(t, "peak", profile.Phase().Name)
+	assert.Equal(t, int64(1), phaseIndex.Value())
+
+	// Without loop the last phase holds after the schedule ends
+	clock = clock.Add(10 * time.Hour)
+	assert.Equal(t, "peak", profile.Phase().Name)
+
+	mockSyslog.AssertNumberOfCalls(t, "Info", 2)
+}
+
+func TestProfileLoop(t *testing.T) {
+	mockSyslog := new(MockSyslogWrapper)
+	mockSyslog.On("Info", mock.Anything).Return()
+
+	clock := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	profile := NewProfile(testProfile(true), mockSyslog)
+	profile.now = func() time.Time { return clock }
+	profile.Start()
+
+	clock = clock.Add(3*time.Hour + 30*time.Minute)
+	assert.Equal(t, "night", profile.Phase().Name)
+}
+
+func TestNilProfile(t *testing.T) {
+	var profile *Profile
+	profile.Start()
+	phase := profile.Phase()
+	assert.Equal(t, 1.0, phase.Rate())
+	assert.Equal(t, 1.0, phase.Mix())
+	assert.False(t, Idle(phase))
+	assert.Nil(t, NewProfile(config.WorkloadProfile{}, nil))
+}
+
+func TestActiveTables(t *testing.T) {
+	tableChannels := map[string]chan []interface{}{
+		"db1.t": make(chan []interface{}),
+		"db2.t": make(chan []interface{}),
+		"db3.t": make(chan []interface{}),
+	}
+
+	active := ActiveTables(config.WorkloadPhase{ActiveTables: 2}, tableChannels)
+	assert.Len(t, active, 2)
+	assert.Contains(t, active, "db1.t")
+	assert.Contains(t, active, "db2.t")
+
+	assert.Len(t, ActiveTables(config.WorkloadPhase{}, tableChannels), 3)
+}
+
+func TestIntervalAndSample(t *testing.T) {
+	assert.Equal(t, 15*time.Second, Interval(config.WorkloadPhase{RateMultiplier: value(4)}, time.Minute))
+	assert.Equal(t, 4*time.Minute, Interval(config.WorkloadPhase{RateMultiplier: value(0.25)}, time.Minute))
+	assert.True(t, Idle(config.WorkloadPhase{RateMultiplier: value(0)}), "A rate of 0 should stop fetching")
+
+	batch := []interface{}{1, 2, 3, 4}
+	assert.Equal(t, batch, SampleBatch(config.WorkloadPhase{}, batch))
+	assert.Equal(t, batch, SampleBatch(config.WorkloadPhase{WriteMix: value(1)}, batch))
+	assert.LessOrEqual(t, len(SampleBatch(config.WorkloadPhase{WriteMix: value(0.5)}, batch)), len(batch))
+	assert.Empty(t, SampleBatch(config.WorkloadPhase{WriteMix: value(0)}, batch), "A write mix of 0 should write nothing")
+}